@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+// serveAdmin serves the scraper's own endpoints, such as /metrics, the
+// health checks, the status of s's targets and the API managing them, and
+// the progress of the block scrapers, on
+// addr until ctx is done. Once there are keys, every endpoint but the health
+// checks, the dashboard's files and /openapi.json takes one.
+func serveAdmin(ctx context.Context, addr string, s *scheduler, managed *managedTargets, keys *apiKeys, chains []*blockScraper, profiling bool) error {
+	mux := http.NewServeMux()
+	read := func(h http.Handler) http.Handler { return keys.protect(scopeRead, scopeRead, h) }
+	operate := func(h http.Handler) http.Handler { return keys.protect(scopeRead, scopeOperate, h) }
+	if h := s.metrics.handler(); h != nil {
+		mux.Handle("/metrics", read(h))
+	}
+	// /healthz is for liveness probes: it fails once the scheduler has
+	// stalled. /readyz also fails while the last reload was rejected.
+	mux.Handle("/healthz", serveHealth(s.health, func(r healthReport) bool { return r.live }))
+	mux.Handle("/readyz", serveHealth(s.health, func(r healthReport) bool { return r.ready }))
+	mux.Handle("/status", read(serveStatus(s.history, s.pauses)))
+	mux.Handle("/stream", read(serveStream(s.feed)))
+	if s.store != nil {
+		mux.Handle("/results", read(serveResults(s.store.store)))
+		mux.Handle("/results/summary", read(serveSummary(s.store.store)))
+		mux.Handle("/aggregates", read(serveAggregates(s.store.store)))
+	}
+	mux.Handle("/silences", operate(serveSilences(s.alerts)))
+	mux.Handle("DELETE /silences/{id}", operate(liftSilence(s.alerts)))
+	mux.Handle("/pauses", operate(servePauses(s)))
+	mux.Handle("DELETE /pauses", operate(liftPause(s)))
+	if len(chains) > 0 {
+		mux.Handle("/chains", read(serveChains(chains)))
+		mux.Handle("GET /chains/{chain}/manifest", read(serveManifest(chains)))
+	}
+	serveTargets(mux, managed, keys)
+	mux.Handle("POST /targets/{id}/run", keys.require(scopeOperate, runTarget(s)))
+	serveKeys(mux, keys)
+	serveDashboard(mux)
+	mux.Handle("GET /openapi.json", serveOpenAPI())
+	if profiling {
+		// Profiles show much of what the scraper holds, keys included.
+		admin := func(h http.HandlerFunc) http.Handler { return keys.protect(scopeAdmin, scopeAdmin, h) }
+		mux.Handle("/debug/pprof/", admin(pprof.Index))
+		mux.Handle("/debug/pprof/cmdline", admin(pprof.Cmdline))
+		mux.Handle("/debug/pprof/profile", admin(pprof.Profile))
+		mux.Handle("/debug/pprof/symbol", admin(pprof.Symbol))
+		mux.Handle("/debug/pprof/trace", admin(pprof.Trace))
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	// No WriteTimeout: CPU profiles and traces take as long as asked for.
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Admin server failed", "error", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		srv.Shutdown(shutdown)
+	}()
+	return nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// Resolutions results are downsampled to.
+const (
+	hourly = time.Hour
+	daily  = 24 * time.Hour
+)
+
+// aggregate sums up the results of a target over an hour or a day, for
+// reporting on periods whose results have been pruned.
+// Archives have it as JSON, with durations in nanoseconds.
+type aggregate struct {
+	Target     string        `json:"target"`
+	Resolution time.Duration `json:"resolution"`
+	Start      time.Time     `json:"start"`
+	Checks     int           `json:"checks"`
+	Failures   int           `json:"failures"`
+	// The latency percentiles are those of the checks that got a response,
+	// 0 if none did.
+	LatencyP50 time.Duration `json:"latency_p50"`
+	LatencyP95 time.Duration `json:"latency_p95"`
+	LatencyP99 time.Duration `json:"latency_p99"`
+}
+
+// aggregateQuery selects aggregates of a resolution like resultQuery selects
+// results.
+type aggregateQuery struct {
+	resultQuery
+	resolution time.Duration
+}
+
+// aggregateResults sums up results, grouped by target, into aggregates at
+// resolution, in UTC.
+func aggregateResults(results []storedResult, resolution time.Duration) []aggregate {
+	var out []aggregate
+	for i := 0; i < len(results); {
+		j := i
+		for j < len(results) && results[j].Target == results[i].Target {
+			j++
+		}
+		// A target's results needn't be sorted by start.
+		index := make(map[time.Time]int)
+		var latencies [][]time.Duration
+		first := len(out)
+		for _, r := range results[i:j] {
+			start := r.Start.UTC().Truncate(resolution)
+			n, ok := index[start]
+			if !ok {
+				n = len(latencies)
+				index[start] = n
+				out = append(out, aggregate{Target: r.Target, Resolution: resolution, Start: start})
+				latencies = append(latencies, nil)
+			}
+			a := &out[first+n]
+			a.Checks++
+			if !r.OK {
+				a.Failures++
+			}
+			if r.Latency > 0 {
+				latencies[n] = append(latencies[n], r.Latency)
+			}
+		}
+		for n, l := range latencies {
+			slices.Sort(l)
+			a := &out[first+n]
+			a.LatencyP50 = percentile(l, 0.50)
+			a.LatencyP95 = percentile(l, 0.95)
+			a.LatencyP99 = percentile(l, 0.99)
+		}
+		i = j
+	}
+	return out
+}
+
+// percentile returns the pth percentile of sorted by the nearest-rank
+// method, 0 if it is empty.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p * float64(len(sorted))))
+	return sorted[max(rank, 1)-1]
+}
+
+// aggregateJSON is how /aggregates shows an aggregate.
+type aggregateJSON struct {
+	Target     string    `json:"target"`
+	Resolution string    `json:"resolution"`
+	Start      time.Time `json:"start"`
+	Checks     int       `json:"checks"`
+	Failures   int       `json:"failures"`
+	// Availability is the share of checks that passed.
+	Availability float64 `json:"availability"`
+	LatencyP50   string  `json:"latency_p50,omitempty"`
+	LatencyP95   string  `json:"latency_p95,omitempty"`
+	LatencyP99   string  `json:"latency_p99,omitempty"`
+}
+
+func newAggregateJSON(a aggregate) aggregateJSON {
+	out := aggregateJSON{
+		Target:       a.Target,
+		Resolution:   "day",
+		Start:        a.Start,
+		Checks:       a.Checks,
+		Failures:     a.Failures,
+		Availability: float64(a.Checks-a.Failures) / float64(a.Checks),
+	}
+	if a.Resolution == hourly {
+		out.Resolution = "hour"
+	}
+	if a.LatencyP50 > 0 {
+		out.LatencyP50 = a.LatencyP50.String()
+		out.LatencyP95 = a.LatencyP95.String()
+		out.LatencyP99 = a.LatencyP99.String()
+	}
+	return out
+}
+
+// serveAggregates answers with the aggregates of downsampled results as
+// JSON, newest first. The resolution query parameter picks hour or day, the
+// default, and the others select aggregates like those of /results select
+// results, by when their period started.
+func serveAggregates(st store) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		params := req.URL.Query()
+		rq, err := parseResultQuery(params)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		q := aggregateQuery{resultQuery: rq}
+		switch params.Get("resolution") {
+		case "hour":
+			q.resolution = hourly
+		case "day", "":
+			q.resolution = daily
+		default:
+			http.Error(w, "resolution must be hour or day", http.StatusBadRequest)
+			return
+		}
+
+		aggregates, err := st.aggregates(req.Context(), q)
+		if err != nil {
+			slog.Error("Querying aggregates failed", "error", err)
+			http.Error(w, "querying aggregates failed", http.StatusInternalServerError)
+			return
+		}
+		out := make([]aggregateJSON, len(aggregates))
+		for i, a := range aggregates {
+			out[i] = newAggregateJSON(a)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	}
+}
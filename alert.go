@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+)
+
+// notifier delivers alerts somewhere people will see them.
+type notifier interface {
+	// name identifies the notifier in logs.
+	name() string
+	notify(ctx context.Context, e *alertEvent) error
+}
+
+// notifierNames are the names of the notifiers, as escalate_to takes them.
+var notifierNames = []string{"webhook", "slack", "email", "telegram", "pagerduty", "discord", "exec"}
+
+// targetChecker is implemented by notifiers that rely on per-target
+// settings, so that missing ones are reported when the config is loaded
+// rather than when an alert is due.
+type targetChecker interface {
+	checkTarget(t *target) error
+}
+
+// notifierOptions configure the notifiers every target alerts through.
+type notifierOptions struct {
+	webhooks       []string
+	webhookSecret  string
+	webhookRetries int
+	slack          slackOptions
+	smtp           smtpOptions
+	telegramToken  string
+	execTimeout    time.Duration
+}
+
+func newNotifiers(o notifierOptions) ([]notifier, error) {
+	if o.webhookRetries < 0 {
+		return nil, errors.New("-webhook_retries must not be negative")
+	}
+	secret, err := secretValue(o.webhookSecret)
+	if err != nil {
+		return nil, fmt.Errorf("-webhook_secret: %w", err)
+	}
+
+	var notifiers []notifier
+	for _, u := range o.webhooks {
+		if _, err := url.ParseRequestURI(u); err != nil {
+			return nil, fmt.Errorf("-webhook_url: %w", err)
+		}
+		notifiers = append(notifiers, newWebhookNotifier(u, secret, o.webhookRetries))
+	}
+	slack, err := newSlackNotifier(o.slack, o.webhookRetries)
+	if err != nil {
+		return nil, err
+	}
+	if slack != nil {
+		notifiers = append(notifiers, slack)
+	}
+	email, err := newEmailNotifier(o.smtp, o.webhookRetries)
+	if err != nil {
+		return nil, err
+	}
+	if email != nil {
+		notifiers = append(notifiers, email)
+	}
+	telegram, err := newTelegramNotifier(o.telegramToken, o.webhookRetries)
+	if err != nil {
+		return nil, err
+	}
+	if telegram != nil {
+		notifiers = append(notifiers, telegram)
+	}
+	if o.execTimeout < 0 {
+		return nil, errors.New("-alert_exec_timeout must not be negative")
+	}
+	notifiers = append(notifiers,
+		newPagerDutyNotifier(o.webhookRetries),
+		newDiscordNotifier(o.webhookRetries),
+		&execNotifier{timeout: o.execTimeout},
+	)
+	return notifiers, nil
+}
+
+// alertEvent tells notifiers that a target went down or came back up.
+type alertEvent struct {
+	Target string            `json:"target"`
+	Labels map[string]string `json:"labels,omitempty"`
+	// State is the target's state, down or up.
+	State  string `json:"state"`
+	Reason string `json:"reason,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// At is when the check that changed the state started, Since when
+	// the state before it began, if known.
+	At    time.Time  `json:"at"`
+	Since *time.Time `json:"since,omitempty"`
+	// Repeat counts the reminders sent while the target stays down, and
+	// Escalated marks the event telling the escalation notifiers. Both
+	// have Since be when the target went down.
+	Repeat    int  `json:"repeat,omitempty"`
+	Escalated bool `json:"escalated,omitempty"`
+	// Outage sums up the outage a target came back up from, from its
+	// first failed check, which may be before Since when alert_after is
+	// above 1.
+	Outage *outage `json:"outage,omitempty"`
+	// Results are the target's most recent results, newest first.
+	Results []record `json:"results"`
+
+	// target is there for notifiers' per-target settings.
+	target *target
+}
+
+// alerter watches results for targets changing state and hands the change
+// to the target's notifiers. Its state is keyed by URL so that a reload
+// doesn't announce every target anew.
+type alerter struct {
+	work    context.Context
+	history *history
+	// results is how many recent results an event carries.
+	results int
+
+	silences silences
+
+	mu     sync.Mutex
+	states map[string]*alertState
+	// pending counts notifications still being delivered, so that
+	// shutdown can wait for them.
+	pending sync.WaitGroup
+}
+
+type alertState struct {
+	down bool
+	// since is when the state began, zero while the target hasn't passed
+	// a check yet.
+	since time.Time
+	// streak counts the checks in a row that went against the state.
+	streak int
+	// alerted is when the last alert about an outage went out, repeats
+	// how many reminders followed it and escalated whether the escalation
+	// notifiers have been told.
+	alerted   time.Time
+	repeats   int
+	escalated bool
+	// outage collects the failed checks since the first of the current
+	// run of failures, nil while the target is up and passing.
+	outage *outage
+}
+
+// outage sums up the failed checks of an outage.
+type outage struct {
+	Start    time.Time `json:"start"`
+	Duration string    `json:"duration"`
+	Failures int       `json:"failed_checks"`
+	// Reasons are the distinct failure reasons seen, in order of first
+	// appearance.
+	Reasons []string `json:"reasons"`
+}
+
+func (o *outage) add(r *result) {
+	o.Failures++
+	for _, reason := range resultReasons(r) {
+		if !slices.Contains(o.Reasons, reason) {
+			o.Reasons = append(o.Reasons, reason)
+		}
+	}
+}
+
+func newAlerter(work context.Context, h *history, results int) *alerter {
+	return &alerter{work: work, history: h, results: results, states: make(map[string]*alertState)}
+}
+
+// observe notifies r's target's notifiers when r changes its state: a
+// target goes down after alertAfter failed checks in a row and comes back up
+// after resolveAfter passed ones. Targets start out up, so a target failing
+// from the start counts as going down. While a target stays down, observe
+// also sends reminders every alertRepeat and escalates after escalateAfter.
+// It must be called after r has been added to the history.
+func (a *alerter) observe(r *result) {
+	t := r.target
+	a.mu.Lock()
+	s, ok := a.states[t.url]
+	if !ok {
+		s = &alertState{}
+		a.states[t.url] = s
+	}
+	// While silenced, results don't count towards a change of state, so
+	// once the silence ends a target that is still down alerts afresh.
+	if a.silenced(t, r.start) {
+		s.streak = 0
+		a.mu.Unlock()
+		return
+	}
+	if !r.ok() {
+		if s.outage == nil {
+			s.outage = &outage{Start: r.start}
+		}
+		s.outage.add(r)
+	} else if !s.down {
+		s.outage = nil
+	}
+	if s.down == !r.ok() {
+		s.streak = 0
+		if s.since.IsZero() {
+			s.since = r.start
+		}
+	} else {
+		s.streak++
+	}
+	threshold := t.alertAfter
+	if s.down {
+		threshold = t.resolveAfter
+	}
+
+	e := &alertEvent{Target: t.url, Labels: t.labels, State: "down", At: r.start, target: t}
+	if !s.since.IsZero() {
+		since := s.since
+		e.Since = &since
+	}
+	var to []notifier
+	switch {
+	case s.streak > 0 && s.streak >= threshold:
+		if s.down {
+			// Recoveries go to everyone who heard of the outage.
+			e.State = "up"
+			e.Outage = s.outage
+			e.Outage.Duration = r.start.Sub(e.Outage.Start).Round(time.Second).String()
+			to = t.alertNotifiers(s.escalated)
+			*s = alertState{since: r.start}
+		} else {
+			to = t.alertNotifiers(false)
+			*s = alertState{down: true, since: r.start, alerted: r.start, outage: s.outage}
+		}
+	case s.down && !s.escalated && t.escalates() && r.start.Sub(s.since) >= t.escalateAfter:
+		s.escalated = true
+		e.Escalated = true
+		to = t.escalationNotifiers()
+	case s.down && t.alertRepeat > 0 && r.start.Sub(s.alerted) >= t.alertRepeat:
+		s.alerted = r.start
+		s.repeats++
+		e.Repeat = s.repeats
+		to = t.alertNotifiers(s.escalated)
+	default:
+		a.mu.Unlock()
+		return
+	}
+	a.mu.Unlock()
+
+	e.Results = a.history.recent(t.url, a.results)
+	if e.State == "down" && len(e.Results) > 0 {
+		e.Reason, e.Error = e.Results[0].Reason, e.Results[0].Error
+	}
+	switch {
+	case e.State == "up":
+		slog.Info("Target up", "target", e.Target, e.target.logLabels())
+	case e.Escalated:
+		slog.Info("Target still down, escalating", "target", e.Target, e.target.logLabels(), "reason", e.Reason)
+	case e.Repeat > 0:
+		slog.Info("Target still down", "target", e.Target, e.target.logLabels(), "reason", e.Reason, "repeat", e.Repeat)
+	default:
+		slog.Info("Target down", "target", e.Target, e.target.logLabels(), "reason", e.Reason)
+	}
+	for _, n := range to {
+		a.send(n, e)
+	}
+}
+
+// escalates reports whether some notifiers only hear about outages that
+// last escalateAfter.
+func (t *target) escalates() bool {
+	return t.escalateAfter > 0 && len(t.escalateTo) > 0
+}
+
+// alertNotifiers returns the notifiers told about the target's outages,
+// including once escalated the escalation notifiers.
+func (t *target) alertNotifiers(escalated bool) []notifier {
+	if escalated || !t.escalates() {
+		return t.notifiers
+	}
+	var out []notifier
+	for _, n := range t.notifiers {
+		if !slices.Contains(t.escalateTo, n.name()) {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+func (t *target) escalationNotifiers() []notifier {
+	var out []notifier
+	for _, n := range t.notifiers {
+		if slices.Contains(t.escalateTo, n.name()) {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// send delivers e through n in the background, so that slow notifiers don't
+// hold up checks.
+func (a *alerter) send(n notifier, e *alertEvent) {
+	a.pending.Add(1)
+	go func() {
+		defer a.pending.Done()
+		if err := n.notify(a.work, e); err != nil {
+			slog.Error("Notification failed", "notifier", n.name(), "target", e.Target, e.target.logLabels(), "state", e.State, "error", err)
+		}
+	}()
+}
+
+// retain forgets the state of targets no longer configured.
+func (a *alerter) retain(targets []*target) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	next := make(map[string]*alertState, len(targets))
+	for _, t := range targets {
+		if s, ok := a.states[t.url]; ok {
+			next[t.url] = s
+		} else {
+			next[t.url] = &alertState{}
+		}
+	}
+	a.states = next
+}
+
+// configured reports whether url is one of the targets.
+func (a *alerter) configured(url string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	_, ok := a.states[url]
+	return ok
+}
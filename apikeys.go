@@ -0,0 +1,373 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scope is what an API key may do. Each scope includes those before it.
+type scope int
+
+const (
+	// scopeRead reads the status, results, silences, pauses and targets.
+	scopeRead scope = iota + 1
+	// scopeOperate also silences alerts, pauses and resumes targets and
+	// checks them on demand.
+	scopeOperate
+	// scopeAdmin also adds, changes and deletes targets and API keys.
+	scopeAdmin
+)
+
+var scopeNames = []string{scopeRead: "read", scopeOperate: "operate", scopeAdmin: "admin"}
+
+func (s scope) String() string {
+	if s < scopeRead || s > scopeAdmin {
+		return fmt.Sprintf("scope(%d)", int(s))
+	}
+	return scopeNames[s]
+}
+
+func parseScope(name string) (scope, error) {
+	if i := slices.Index(scopeNames, name); i > 0 {
+		return scope(i), nil
+	}
+	return 0, fmt.Errorf("unknown scope %q, want read, operate or admin", name)
+}
+
+func (s scope) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *scope) UnmarshalText(b []byte) error {
+	var err error
+	*s, err = parseScope(string(b))
+	return err
+}
+
+// apiKey is a key to the admin API, as /keys lists it. Only its hash is
+// kept.
+type apiKey struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	// Source is config for -admin_token and -admin_key, api for keys
+	// created through /keys.
+	Source  string     `json:"source"`
+	Scope   scope      `json:"scope"`
+	Created *time.Time `json:"created,omitempty"`
+	hash    [sha256.Size]byte
+}
+
+func newAPIKey(secret string, sc scope) apiKey {
+	hash := sha256.Sum256([]byte(secret))
+	return apiKey{ID: hex.EncodeToString(hash[:6]), Source: "config", Scope: sc, hash: hash}
+}
+
+// parseAdminKey parses an -admin_key entry, scope:key, resolving the key
+// with secretValue.
+func parseAdminKey(entry string) (apiKey, error) {
+	name, value, ok := strings.Cut(entry, ":")
+	if !ok {
+		return apiKey{}, errors.New("want scope:key")
+	}
+	sc, err := parseScope(name)
+	if err != nil {
+		return apiKey{}, err
+	}
+	secret, err := secretValue(value)
+	if err != nil {
+		return apiKey{}, err
+	}
+	if secret == "" {
+		return apiKey{}, errors.New("empty key")
+	}
+	return newAPIKey(secret, sc), nil
+}
+
+// keyList collects -admin_key entries from repeated flags and
+// comma-separated values.
+type keyList []string
+
+func (l *keyList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *keyList) Set(value string) error {
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			*l = append(*l, entry)
+		}
+	}
+	return nil
+}
+
+// savedKey is how a key created through /keys is saved.
+type savedKey struct {
+	apiKey
+	Hash string `json:"hash"`
+}
+
+// keyRequest is what POST /keys takes.
+type keyRequest struct {
+	Name  string `json:"name,omitempty"`
+	Scope scope  `json:"scope"`
+}
+
+// createdKey is what POST /keys returns: the only time the key itself is
+// shown.
+type createdKey struct {
+	apiKey
+	Key string `json:"key"`
+}
+
+// Errors of the API keys.
+var (
+	errNoKeys    = errors.New("the admin API has no keys; set -admin_token or -admin_key")
+	errBadKey    = errors.New("unauthorized")
+	errNoKey     = errors.New("no such key")
+	errConfigKey = errors.New("key is configured, not created through the API")
+)
+
+// scopeError is returned for keys without the scope a request needs.
+type scopeError struct{ need scope }
+
+func (e scopeError) Error() string { return fmt.Sprintf("this needs a key with the %s scope", e.need) }
+
+// apiKeys are the keys the admin and gRPC APIs take: the -admin_token,
+// which has the admin scope and bootstraps the others, the -admin_key
+// ones and those created through /keys. If path is set the created ones
+// are saved to it and loaded from it on startup.
+type apiKeys struct {
+	path string
+
+	mu sync.Mutex
+	// configured are from the config last loaded.
+	configured []apiKey
+	created    []apiKey
+}
+
+// newAPIKeys loads the keys saved at path, if any.
+func newAPIKeys(path string) (*apiKeys, error) {
+	k := &apiKeys{path: path}
+	if path == "" {
+		return k, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var saved []savedKey
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, sk := range saved {
+		hash, err := hex.DecodeString(sk.Hash)
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("%s: key %s: bad hash", path, sk.ID)
+		}
+		copy(sk.hash[:], hash)
+		k.created = append(k.created, sk.apiKey)
+	}
+	return k, nil
+}
+
+// configure takes the keys of c.
+func (k *apiKeys) configure(c *config) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.configured = k.configured[:0:0]
+	if c.adminToken != "" {
+		key := newAPIKey(c.adminToken, scopeAdmin)
+		key.Name = "admin token"
+		k.configured = append(k.configured, key)
+	}
+	k.configured = append(k.configured, c.adminKeys...)
+}
+
+// authorize checks that token is a key with scope need, returning
+// errNoKeys if there are no keys at all.
+func (k *apiKeys) authorize(token string, need scope) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if len(k.configured) == 0 && len(k.created) == 0 {
+		return errNoKeys
+	}
+	hash := sha256.Sum256([]byte(token))
+	var found *apiKey
+	// Every key is compared, so that the time taken doesn't tell which
+	// one matched.
+	for _, keys := range [][]apiKey{k.configured, k.created} {
+		for i := range keys {
+			if subtle.ConstantTimeCompare(hash[:], keys[i].hash[:]) == 1 {
+				found = &keys[i]
+			}
+		}
+	}
+	switch {
+	case found == nil || token == "":
+		return errBadKey
+	case found.Scope < need:
+		return scopeError{need}
+	}
+	return nil
+}
+
+// list returns every key, the configured ones first.
+func (k *apiKeys) list() []apiKey {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return slices.Concat(k.configured, k.created)
+}
+
+// create creates a key, saving it along with the others.
+func (k *apiKeys) create(name string, sc scope) (createdKey, error) {
+	b := make([]byte, 32)
+	rand.Read(b)
+	secret := hex.EncodeToString(b)
+	key := newAPIKey(secret, sc)
+	key.Name, key.Source = name, "api"
+	key.Created = timePtr(time.Now().UTC().Truncate(time.Second))
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err := k.save(append(slices.Clip(k.created), key)); err != nil {
+		return createdKey{}, err
+	}
+	k.created = append(k.created, key)
+	slog.Info("Created API key", "id", key.ID, "name", key.Name, "scope", key.Scope)
+	return createdKey{key, secret}, nil
+}
+
+// revoke deletes a key created through the API.
+func (k *apiKeys) revoke(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	i := slices.IndexFunc(k.created, func(key apiKey) bool { return key.ID == id })
+	if i < 0 {
+		if slices.ContainsFunc(k.configured, func(key apiKey) bool { return key.ID == id }) {
+			return errConfigKey
+		}
+		return errNoKey
+	}
+	keys := slices.Delete(slices.Clone(k.created), i, i+1)
+	if err := k.save(keys); err != nil {
+		return err
+	}
+	k.created = keys
+	slog.Info("Revoked API key", "id", id)
+	return nil
+}
+
+// save writes keys to the file, if any. The caller holds k.mu.
+func (k *apiKeys) save(keys []apiKey) error {
+	if k.path == "" {
+		return nil
+	}
+	saved := make([]savedKey, len(keys))
+	for i, key := range keys {
+		saved[i] = savedKey{key, hex.EncodeToString(key.hash[:])}
+	}
+	b, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	return replaceFile(k.path, append(b, '\n'))
+}
+
+// bearerToken returns the bearer token of req, if any.
+func bearerToken(req *http.Request) string {
+	token, _ := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return token
+}
+
+// protect lets requests through to h that bear a key with the scope
+// reads, for GET and HEAD requests, or writes, for others. Until there
+// are keys, every request is let through.
+func (k *apiKeys) protect(reads, writes scope, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		need := writes
+		if req.Method == http.MethodGet || req.Method == http.MethodHead {
+			need = reads
+		}
+		if err := k.authorize(bearerToken(req), need); err != nil && !errors.Is(err, errNoKeys) {
+			authError(w, err)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// require lets requests through to h that bear a key with scope need, and
+// refuses every request while there are no keys.
+func (k *apiKeys) require(need scope, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := k.authorize(bearerToken(req), need); err != nil {
+			authError(w, err)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+func authError(w http.ResponseWriter, err error) {
+	status := http.StatusForbidden
+	if errors.Is(err, errBadKey) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="scraper"`)
+		status = http.StatusUnauthorized
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// serveKeys serves the API managing keys on mux, for admin keys.
+func serveKeys(mux *http.ServeMux, k *apiKeys) {
+	mux.Handle("GET /keys", k.require(scopeAdmin, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, http.StatusOK, k.list())
+	})))
+	mux.Handle("POST /keys", k.require(scopeAdmin, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body keyRequest
+		err := json.NewDecoder(req.Body).Decode(&body)
+		if err == nil && body.Scope == 0 {
+			err = errors.New("give the scope: read, operate or admin")
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		key, err := k.create(body.Name, body.Scope)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusCreated, key)
+	})))
+	mux.Handle("DELETE /keys/{id}", k.require(scopeAdmin, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch err := k.revoke(req.PathValue("id")); {
+		case errors.Is(err, errNoKey):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, errConfigKey):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// address is an Ethereum address.
+type address [20]byte
+
+// parseAddress parses a 0x-prefixed hex address, in either case.
+func parseAddress(s string) (address, error) {
+	var a address
+	digits, ok := strings.CutPrefix(s, "0x")
+	if !ok || len(digits) != 2*len(a) {
+		return a, fmt.Errorf("bad address %q", s)
+	}
+	if _, err := hex.Decode(a[:], []byte(digits)); err != nil {
+		return a, fmt.Errorf("bad address %q", s)
+	}
+	return a, nil
+}
+
+func (a address) String() string {
+	return "0x" + hex.EncodeToString(a[:])
+}
+
+// Transaction indexes of appearances outside any transaction, as the
+// Unchained Index has them.
+const (
+	// txBlockReward is that of the miner of a block.
+	txBlockReward = 99999
+	// txUncleReward is that of the miner of an uncle of a block.
+	txUncleReward = 99998
+	// txWithdrawal is that of the recipient of a withdrawal from the
+	// beacon chain, since Shanghai.
+	txWithdrawal = 99997
+)
+
+// appearance is an address appearing in a block, in the transaction at
+// txIndex or in one of the special places above.
+type appearance struct {
+	address address
+	block   uint64
+	txIndex uint32
+}
+
+// newScrapedBlock starts b on its way through the pipeline with the
+// appearances the block itself has: its miner, the senders and recipients
+// of its transactions and the recipients of its withdrawals.
+func newScrapedBlock(b *ethBlock) *scrapedBlock {
+	sb := &scrapedBlock{block: b, appearances: make(map[appearance]struct{})}
+	sb.appear(b.Miner, txBlockReward)
+	for _, tx := range b.Transactions {
+		sb.appear(tx.From, uint32(tx.Index))
+		sb.appear(tx.To, uint32(tx.Index))
+	}
+	for _, w := range b.Withdrawals {
+		sb.appear(w.Address, txWithdrawal)
+	}
+	return sb
+}
+
+// appear records that the address s appears in the transaction at tx.
+// Anything that isn't an address, such as the empty recipient of a
+// contract creation, is ignored.
+func (b *scrapedBlock) appear(s string, tx uint32) {
+	a, err := parseAddress(s)
+	if err != nil {
+		return
+	}
+	b.appearances[appearance{address: a, block: uint64(b.block.Number), txIndex: tx}] = struct{}{}
+}
+
+// appearTopic records the address a log topic holds, if it looks like it
+// holds one.
+func (b *scrapedBlock) appearTopic(topic string, tx uint32) {
+	if a, ok := topicAddress(topic); ok {
+		b.appearances[appearance{address: a, block: uint64(b.block.Number), txIndex: tx}] = struct{}{}
+	}
+}
+
+// topicAddress returns the address an indexed log topic holds, as a word
+// whose top 12 bytes are zero. So that amounts and IDs, which are zero
+// there too, don't pass for addresses, words below 2^96 are taken for
+// numbers.
+func topicAddress(topic string) (address, bool) {
+	var a address
+	digits, ok := strings.CutPrefix(topic, "0x")
+	if !ok || len(digits) != 64 {
+		return a, false
+	}
+	var word [32]byte
+	if _, err := hex.Decode(word[:], []byte(digits)); err != nil {
+		return a, false
+	}
+	if !allZero(word[:12]) || allZero(word[12:20]) {
+		return a, false
+	}
+	copy(a[:], word[12:])
+	return a, true
+}
+
+func allZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// headerShorthands maps options that predate the generic header assertion
+// to the header they expect an exact value for.
+var headerShorthands = map[string]string{
+	"server":       "Server",
+	"content_type": "Content-Type",
+}
+
+// headerAssertion expects a response header to be present, absent, equal to
+// a value or match a regular expression.
+type headerAssertion struct {
+	name      string
+	value     string
+	re        *regexp.Regexp
+	forbidden bool
+	exact     bool
+}
+
+// newHeaderAssertion parses one of
+//
+//	Name: value    the header must be exactly value
+//	Name ~ regex   the header must match regex
+//	Name           the header must be present
+//	!Name          the header must be absent
+func newHeaderAssertion(spec string) (assertion, error) {
+	spec = strings.TrimSpace(spec)
+	var a headerAssertion
+	switch i := strings.IndexAny(spec, ":~"); {
+	case strings.HasPrefix(spec, "!"):
+		a.name = strings.TrimSpace(spec[1:])
+		a.forbidden = true
+	case i < 0:
+		a.name = spec
+	case spec[i] == ':':
+		a.name = strings.TrimSpace(spec[:i])
+		a.value = strings.TrimSpace(spec[i+1:])
+		a.exact = true
+	default:
+		re, err := regexp.Compile(strings.TrimSpace(spec[i+1:]))
+		if err != nil {
+			return nil, err
+		}
+		a.name = strings.TrimSpace(spec[:i])
+		a.re = re
+	}
+	if a.name == "" || strings.ContainsAny(a.name, " \t") {
+		return nil, fmt.Errorf("bad header name in %q", spec)
+	}
+	a.name = http.CanonicalHeaderKey(a.name)
+	return a, nil
+}
+
+func (a headerAssertion) check(r *response) error {
+	values, present := r.Header[a.name]
+	got := strings.Join(values, ", ")
+
+	switch {
+	case a.forbidden && present:
+		return fmt.Errorf("%s header present, got: %s", a.name, got)
+	case a.forbidden:
+		return nil
+	case !present:
+		return errors.New(a.name + " header missing")
+	case a.exact && got != a.value:
+		return fmt.Errorf("%s header mismatch, got: %s", a.name, got)
+	case a.re != nil && !a.re.MatchString(got):
+		return fmt.Errorf("%s header does not match %s, got: %s", a.name, a.re, got)
+	}
+	return nil
+}
+
+// echoHeaderAssertion expects the response to carry a request header back
+// with the value it was sent with, as echo services and some proxies do.
+type echoHeaderAssertion string
+
+func (a echoHeaderAssertion) check(r *response) error {
+	name := string(a)
+	sent := r.Request.Header.Get(name)
+	if sent == "" {
+		return fmt.Errorf("%s header not sent, nothing to echo", name)
+	}
+	got, present := r.Header[name]
+	if !present {
+		return errors.New(name + " header not echoed")
+	}
+	if v := strings.Join(got, ", "); v != sent {
+		return fmt.Errorf("%s header echo mismatch, got: %s, sent: %s", name, v, sent)
+	}
+	return nil
+}
+
+// finalURLAssertion expects the last URL requested, after following any
+// redirects, to be the given one.
+type finalURLAssertion string
+
+func (a finalURLAssertion) check(r *response) error {
+	chain := redirectChain(r.Response)
+	if got := chain[len(chain)-1]; got != string(a) {
+		return fmt.Errorf("Final URL mismatch, got: %s (via %s)", got, strings.Join(chain, " -> "))
+	}
+	return nil
+}
+
+// bodyAssertion expects the body to contain a substring or match a regular
+// expression, or with negate set, not to.
+type bodyAssertion struct {
+	substring string
+	re        *regexp.Regexp
+	negate    bool
+}
+
+func newBodyAssertion(key, value string) (assertion, error) {
+	a := bodyAssertion{negate: key == "body_not_contains" || key == "body_not_matches"}
+	if key == "body_matches" || key == "body_not_matches" {
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, err
+		}
+		a.re = re
+	} else {
+		a.substring = value
+	}
+	return a, nil
+}
+
+func (a bodyAssertion) check(r *response) error {
+	var found bool
+	var what string
+	if a.re != nil {
+		found = a.re.Match(r.body)
+		what = "match " + a.re.String()
+	} else {
+		found = bytes.Contains(r.body, []byte(a.substring))
+		what = fmt.Sprintf("contain %q", a.substring)
+	}
+
+	switch {
+	case a.negate && found:
+		return fmt.Errorf("Body does %s", what)
+	case !a.negate && !found && r.truncated:
+		return fmt.Errorf("Body does not %s in the first %d bytes", what, len(r.body))
+	case !a.negate && !found:
+		return fmt.Errorf("Body does not %s", what)
+	}
+	return nil
+}
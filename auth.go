@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// secretValue resolves a credential so that it needn't appear on the command
+// line: "env:NAME" reads an environment variable, "@path" and "file://path" a
+// file, with trailing newlines removed, and "vault://path#key" a secret in
+// Vault, see vaultSecret. Anything else is taken literally. Secrets are
+// resolved whenever the config is loaded, so reloading picks up changes.
+func secretValue(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, "vault://"):
+		return vaultSecret(value[len("vault://"):])
+	case strings.HasPrefix(value, "file://"):
+		return secretValue("@" + value[len("file://"):])
+	case strings.HasPrefix(value, "env:"):
+		name := value[len("env:"):]
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return v, nil
+	case strings.HasPrefix(value, "@"):
+		b, err := os.ReadFile(value[1:])
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+	return value, nil
+}
+
+// setAuth applies one of the authentication options to t's request headers.
+func (t *target) setAuth(key, value string) error {
+	secret, err := secretValue(value)
+	if err != nil {
+		return err
+	}
+
+	h := t.requestHeader.Clone()
+	if h == nil {
+		h = make(http.Header)
+	}
+	switch key {
+	case "basic_auth":
+		if !strings.Contains(secret, ":") {
+			return fmt.Errorf("want user:password")
+		}
+		h.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(secret)))
+	case "bearer_token":
+		h.Set("Authorization", "Bearer "+secret)
+	case "api_key":
+		// Kept apart, as api_key_header may still change.
+		t.apiKey = secret
+		return nil
+	}
+	t.requestHeader = h
+	return nil
+}
+
+// header returns the headers to send with t's requests.
+func (t *target) header() http.Header {
+	if t.apiKey == "" {
+		return t.requestHeader
+	}
+	h := t.requestHeader.Clone()
+	if h == nil {
+		h = make(http.Header)
+	}
+	h.Set(t.apiKeyHeader, t.apiKey)
+	return h
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// blobStage archives the blobs of the blob transactions of each block,
+// since Cancun, fetching their sidecars from a beacon node before it
+// prunes them. The sidecars of a block are kept as the beacon API returns
+// them, in blobs/<block>.json under the chain's directory, once their
+// commitments are found to match the versioned hashes of the block's
+// transactions.
+type blobStage struct {
+	chain  string
+	dir    string
+	api    string
+	client *http.Client
+
+	mu sync.Mutex
+	// genesis and slotSeconds place blocks in the beacon chain's slots,
+	// fetched from the beacon node once it first answers.
+	genesis, slotSeconds uint64
+	counts               blobStatus
+}
+
+// blobStatus is the progress of the blob archive, as /chains shows it.
+type blobStatus struct {
+	// Archived counts the blocks whose blobs were archived since startup,
+	// and Missing those the beacon node no longer had the blobs of.
+	Archived uint64 `json:"archived"`
+	Missing  uint64 `json:"missing"`
+}
+
+func newBlobStage(dir string, o chainOptions, client *http.Client) (*blobStage, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &blobStage{chain: o.name, dir: dir, api: strings.TrimRight(o.beaconAPI, "/"), client: client}, nil
+}
+
+// errBeaconNotFound is the beacon node not having what was asked for.
+var errBeaconNotFound = errors.New("not found")
+
+// get fetches path from the beacon API and decodes its data into v.
+func (x *blobStage) get(ctx context.Context, path string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, x.api+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := x.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("beacon API: %w", err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return fmt.Errorf("beacon API %s: %w", path, errBeaconNotFound)
+	case resp.StatusCode != http.StatusOK:
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("beacon API %s: %s: %s", path, resp.Status, strings.TrimSpace(string(b)))
+	}
+	var doc struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return fmt.Errorf("beacon API %s: %w", path, err)
+	}
+	return json.Unmarshal(doc.Data, v)
+}
+
+// slot returns the slot of the beacon chain the block with timestamp ts
+// was proposed in.
+func (x *blobStage) slot(ctx context.Context, ts uint64) (uint64, error) {
+	x.mu.Lock()
+	genesis, seconds := x.genesis, x.slotSeconds
+	x.mu.Unlock()
+	if seconds == 0 {
+		var g struct {
+			GenesisTime string `json:"genesis_time"`
+		}
+		if err := x.get(ctx, "/eth/v1/beacon/genesis", &g); err != nil {
+			return 0, err
+		}
+		var spec struct {
+			SecondsPerSlot string `json:"SECONDS_PER_SLOT"`
+		}
+		if err := x.get(ctx, "/eth/v1/config/spec", &spec); err != nil {
+			return 0, err
+		}
+		var err error
+		if genesis, err = strconv.ParseUint(g.GenesisTime, 10, 64); err != nil {
+			return 0, fmt.Errorf("beacon API: bad genesis_time %q", g.GenesisTime)
+		}
+		if seconds, err = strconv.ParseUint(spec.SecondsPerSlot, 10, 64); err != nil || seconds == 0 {
+			return 0, fmt.Errorf("beacon API: bad SECONDS_PER_SLOT %q", spec.SecondsPerSlot)
+		}
+		x.mu.Lock()
+		x.genesis, x.slotSeconds = genesis, seconds
+		x.mu.Unlock()
+	}
+	if ts < genesis {
+		return 0, fmt.Errorf("block of %d is before the beacon chain's genesis at %d", ts, genesis)
+	}
+	return (ts - genesis) / seconds, nil
+}
+
+// blobSidecar is the sidecar of a blob, as far as checking it goes.
+type blobSidecar struct {
+	Index         string `json:"index"`
+	KZGCommitment string `json:"kzg_commitment"`
+}
+
+// versionedHash is the versioned hash a transaction refers to the blob
+// with the KZG commitment to by.
+func versionedHash(commitment string) (string, error) {
+	b, err := hex.DecodeString(strings.TrimPrefix(commitment, "0x"))
+	if err != nil || len(b) != 48 {
+		return "", fmt.Errorf("bad KZG commitment %q", commitment)
+	}
+	h := sha256.Sum256(b)
+	h[0] = 0x01
+	return "0x" + hex.EncodeToString(h[:]), nil
+}
+
+func (x *blobStage) fetch(ctx context.Context, blocks []*scrapedBlock) error {
+	for _, b := range blocks {
+		var hashes []string
+		for _, tx := range b.block.Transactions {
+			hashes = append(hashes, tx.BlobVersionedHashes...)
+		}
+		if len(hashes) == 0 {
+			continue
+		}
+		if err := x.archive(ctx, b.block, hashes); err != nil {
+			return fmt.Errorf("block %d: %w", b.block.Number, err)
+		}
+	}
+	return nil
+}
+
+// archive fetches the sidecars of the blobs of block, which its
+// transactions have the versioned hashes of, and keeps them.
+func (x *blobStage) archive(ctx context.Context, block *ethBlock, hashes []string) error {
+	slot, err := x.slot(ctx, uint64(block.Timestamp))
+	if err != nil {
+		return err
+	}
+	var raw json.RawMessage
+	err = x.get(ctx, "/eth/v1/beacon/blob_sidecars/"+strconv.FormatUint(slot, 10), &raw)
+	if errors.Is(err, errBeaconNotFound) {
+		slog.Warn("Beacon node lacks the blobs of a block, not archiving them", "chain", x.chain, "block", uint64(block.Number), "slot", slot)
+		x.mu.Lock()
+		x.counts.Missing++
+		x.mu.Unlock()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var sidecars []blobSidecar
+	if err := json.Unmarshal(raw, &sidecars); err != nil {
+		return fmt.Errorf("blob sidecars of slot %d: %w", slot, err)
+	}
+	if len(sidecars) != len(hashes) {
+		return fmt.Errorf("slot %d has %d blob sidecars for the %d blobs of the block", slot, len(sidecars), len(hashes))
+	}
+	for i, sc := range sidecars {
+		vh, err := versionedHash(sc.KZGCommitment)
+		if err != nil {
+			return fmt.Errorf("blob sidecar %s of slot %d: %w", sc.Index, slot, err)
+		}
+		if !strings.EqualFold(vh, hashes[i]) {
+			return fmt.Errorf("blob sidecar %s of slot %d is of blob %s, not %s", sc.Index, slot, vh, hashes[i])
+		}
+	}
+	var out bytes.Buffer
+	if err := json.Compact(&out, raw); err != nil {
+		return err
+	}
+	out.WriteByte('\n')
+	if err := replaceFileMode(x.path(uint64(block.Number)), out.Bytes(), 0o644); err != nil {
+		return err
+	}
+	x.mu.Lock()
+	x.counts.Archived++
+	x.mu.Unlock()
+	return nil
+}
+
+func (x *blobStage) path(block uint64) string {
+	return filepath.Join(x.dir, fmt.Sprintf("%09d.json", block))
+}
+
+func (x *blobStage) process(ctx context.Context, b *scrapedBlock) error {
+	return nil
+}
+
+func (x *blobStage) flush() error {
+	return nil
+}
+
+// unwind removes the blobs of the blocks from on.
+func (x *blobStage) unwind(from uint64) error {
+	entries, err := os.ReadDir(x.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok {
+			continue
+		}
+		if n, err := strconv.ParseUint(name, 10, 64); err == nil && n >= from {
+			if err := os.Remove(filepath.Join(x.dir, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (x *blobStage) status() *blobStatus {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	st := x.counts
+	return &st
+}
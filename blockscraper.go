@@ -0,0 +1,622 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// roundBlocks is the most blocks a round of the block scraper fetches
+// before flushing the stages and saving its progress.
+const roundBlocks = 100
+
+// chainOptions configures the block scraper.
+type chainOptions struct {
+	name string
+	// rpcURLs are the providers of the chain, the first preferred.
+	rpcURLs []string
+	// rpcMaxLag is how many blocks a provider may fall behind the others
+	// before the scraper leaves it.
+	rpcMaxLag uint64
+	// rpcBatch is the most calls sent to a provider in one request.
+	rpcBatch int
+	// wsURL is a WebSocket endpoint to subscribe to newHeads at, empty to
+	// poll for blocks.
+	wsURL string
+	// firstBlock is where the scraper starts when it has no progress
+	// saved.
+	firstBlock uint64
+	// dir is where the scraper keeps what it makes of the chain, in a
+	// directory named after it; empty for nowhere.
+	dir         string
+	poll        time.Duration
+	concurrency int
+	// traces and receipts have the appearances in the traces and the
+	// receipts of each block added.
+	traces, receipts bool
+	// appsPerChunk is how many appearances an index chunk has at least,
+	// and unripeDepth how far behind the head a block has to be for its
+	// appearances to go into one.
+	appsPerChunk int
+	unripeDepth  uint64
+	bloom        bloomOptions
+	// reorgDepth is how many of the latest blocks processed the scraper
+	// remembers the hashes of.
+	reorgDepth uint64
+	ipfs       ipfsOptions
+	// beaconAPI is a beacon node to archive the blobs of each block from,
+	// empty not to.
+	beaconAPI string
+	// genesis is a file with the genesis allocations to add to block 0,
+	// empty for none.
+	genesis string
+	// bootstrap is the manifest of a published index to download the
+	// chunks of before scraping, empty not to.
+	bootstrap string
+}
+
+func (o chainOptions) check() error {
+	if o.name == "" || strings.ContainsAny(o.name, `/\`) {
+		return fmt.Errorf("-chain: bad name %q", o.name)
+	}
+	if len(o.rpcURLs) == 0 {
+		return errors.New("no -chain_rpc_url")
+	}
+	if o.wsURL != "" && !strings.HasPrefix(o.wsURL, "ws://") && !strings.HasPrefix(o.wsURL, "wss://") {
+		return errors.New("-chain_ws_url must be a ws:// or wss:// URL")
+	}
+	if o.poll <= 0 {
+		return errors.New("-chain_poll must be positive")
+	}
+	if o.concurrency < 1 {
+		return errors.New("-chain_concurrency must be at least 1")
+	}
+	if o.rpcBatch < 1 {
+		return errors.New("-chain_rpc_batch must be at least 1")
+	}
+	if o.appsPerChunk < 1 {
+		return errors.New("-chain_apps_per_chunk must be at least 1")
+	}
+	if err := o.bloom.check(); err != nil {
+		return err
+	}
+	if o.reorgDepth < 1 {
+		return errors.New("-chain_reorg_depth must be at least 1")
+	}
+	if o.ipfs.retry <= 0 {
+		return errors.New("-chain_pin_retry must be positive")
+	}
+	if o.beaconAPI != "" && o.dir == "" {
+		return errors.New("-chain_beacon_api archives blobs, which takes -chain_dir")
+	}
+	if (o.ipfs.api != "" || o.ipfs.pinataJWT != "") && o.dir == "" {
+		return errors.New("-chain_ipfs_api and -chain_pinata_jwt pin the index, which takes -chain_dir")
+	}
+	if o.bootstrap != "" {
+		if o.dir == "" {
+			return errors.New("-chain_bootstrap downloads an index, which takes -chain_dir")
+		}
+		if !strings.HasPrefix(o.bootstrap, "http://") && !strings.HasPrefix(o.bootstrap, "https://") && !strings.HasPrefix(o.bootstrap, "ipfs://") {
+			return errors.New("-chain_bootstrap must be an http://, https:// or ipfs:// URL")
+		}
+	}
+	return nil
+}
+
+// scrapedBlock is a block on its way through the pipeline.
+type scrapedBlock struct {
+	block *ethBlock
+	// appearances are those the stages have found so far.
+	appearances map[appearance]struct{}
+}
+
+// blockStage is a step of the pipeline blocks are handed to, in order. A
+// round of blocks is processed and then flushed; the scraper only saves its
+// progress past blocks once the stages have flushed them, so a stage may
+// be handed the blocks after the last flush again after a failure or a
+// restart.
+type blockStage interface {
+	process(ctx context.Context, b *scrapedBlock) error
+	flush() error
+}
+
+// blockFetcher is a stage that needs more of a block from the node than
+// eth_getBlockByNumber has. fetch gets it for a batch of consecutive
+// blocks, before they are processed; several batches are fetched at once,
+// in no particular order.
+type blockFetcher interface {
+	fetch(ctx context.Context, blocks []*scrapedBlock) error
+}
+
+// chainStatus is the progress of a chain's scraper, as /chains shows it.
+type chainStatus struct {
+	Chain string `json:"chain"`
+	// RPC is the provider in use, one of Providers.
+	RPC       string      `json:"rpc"`
+	Providers []rpcStatus `json:"providers"`
+	// Subscribed is whether the newHeads subscription of -chain_ws_url is
+	// up, unset without one.
+	Subscribed *bool `json:"subscribed,omitempty"`
+	// NextBlock is the first block not yet processed.
+	NextBlock uint64 `json:"next_block"`
+	Head      uint64 `json:"head"`
+	// Behind is how many blocks the scraper has yet to process to reach
+	// the head.
+	Behind uint64 `json:"behind"`
+	// Blocks, Transactions and Appearances count what was processed since
+	// startup.
+	Blocks       uint64 `json:"blocks"`
+	Transactions uint64 `json:"transactions"`
+	Appearances  uint64 `json:"appearances"`
+	// Reorgs counts the reorgs rolled back from since startup, and
+	// Orphaned the blocks they orphaned.
+	Reorgs   uint64 `json:"reorgs"`
+	Orphaned uint64 `json:"orphaned"`
+	// LastBlock is the timestamp of the last block processed.
+	LastBlock *time.Time `json:"last_block,omitempty"`
+	// BlobTransactions, Blobs and BlobGasUsed count the blob transactions
+	// processed since startup, the blobs they carried and the blob gas of
+	// their blocks, and ExcessBlobGas is that of the last block processed,
+	// which sets the blob base fee; unset before Cancun.
+	BlobTransactions uint64       `json:"blob_transactions"`
+	Blobs            uint64       `json:"blobs"`
+	BlobGasUsed      uint64       `json:"blob_gas_used"`
+	ExcessBlobGas    *uint64      `json:"excess_blob_gas,omitempty"`
+	Index            *indexStatus `json:"index,omitempty"`
+	BlobArchive      *blobStatus  `json:"blob_archive,omitempty"`
+	Error            string       `json:"error,omitempty"`
+	ErrorAt          *time.Time   `json:"error_at,omitempty"`
+}
+
+// blockScraper walks a chain from its first block to the head over the
+// node's JSON-RPC API, handing each block to the stages, and follows the
+// head once it has caught up.
+type blockScraper struct {
+	o      chainOptions
+	rpc    *rpcClient
+	stages []blockStage
+	// index is the stage building the index, nil without -chain_dir.
+	index *indexStage
+	// blobs is the stage archiving blobs, nil without -chain_beacon_api.
+	blobs *blobStage
+	// heads follows the head over -chain_ws_url, nil without one.
+	heads   *headWatcher
+	metrics metrics
+	done    chan struct{}
+
+	mu sync.Mutex
+	// saved is the next block as last saved, next the one after those
+	// processed.
+	saved, next uint64
+	status      chainStatus
+	// recent are the latest blocks processed, oldest first, and adapted
+	// the provider the stages last adapted to; only run touches them.
+	recent  []recentBlock
+	adapted *rpcEndpoint
+}
+
+func newBlockScraper(o chainOptions, client *http.Client, m metrics) (*blockScraper, error) {
+	s := &blockScraper{
+		o:       o,
+		rpc:     newRPCClient(o, client, m),
+		metrics: m,
+		done:    make(chan struct{}),
+		status:  chainStatus{Chain: o.name},
+	}
+	s.stages = append(s.stages, &uncleStage{rpc: s.rpc})
+	if o.genesis != "" {
+		allocs, err := loadAllocations(o.genesis)
+		if err != nil {
+			return nil, err
+		}
+		s.stages = append(s.stages, &genesisStage{allocs: allocs})
+	}
+	if o.wsURL != "" {
+		s.heads = newHeadWatcher(o)
+	}
+	if o.traces {
+		s.stages = append(s.stages, &traceStage{chain: o.name, rpc: s.rpc})
+	}
+	if o.receipts {
+		s.stages = append(s.stages, &receiptStage{chain: o.name, rpc: s.rpc})
+	}
+	p, err := s.loadProgress()
+	if err != nil {
+		return nil, err
+	}
+	next := p.NextBlock
+	s.recent = p.Recent
+	if dir := s.chainDir(); dir != "" && o.beaconAPI != "" {
+		if s.blobs, err = newBlobStage(filepath.Join(dir, "blobs"), o, client); err != nil {
+			return nil, err
+		}
+		s.stages = append(s.stages, s.blobs)
+	}
+	if dir := s.chainDir(); dir != "" {
+		if s.index, err = newIndexStage(dir, o, client); err != nil {
+			return nil, err
+		}
+		s.stages = append(s.stages, s.index)
+		switch resume := s.index.resume(); {
+		case resume < next:
+			slog.Warn("Index lacks blocks the scraper is past, scraping them again", "chain", o.name, "from", resume, "progress", next)
+			next = resume
+		case resume > next && o.bootstrap != "":
+			// The chunks bootstrapped are past the blocks scraped.
+			slog.Info("Resuming after the bootstrapped index", "chain", o.name, "from", resume, "progress", next)
+			next = resume
+		}
+	}
+	s.stages = append(s.stages, &blockCounter{s: s})
+	if o.genesis != "" && next > 0 {
+		slog.Warn("Scraper is past block 0, so the genesis allocations aren't added", "chain", o.name, "genesis", o.genesis, "from", next)
+	}
+	s.forget(next)
+	s.saved, s.next = next, next
+	s.status.NextBlock = next
+	return s, nil
+}
+
+// chainDir is the directory the scraper keeps what it makes of the chain
+// in, empty for none.
+func (s *blockScraper) chainDir() string {
+	if s.o.dir == "" {
+		return ""
+	}
+	return filepath.Join(s.o.dir, s.o.name)
+}
+
+// progress is what the scraper saves of its progress.
+type progress struct {
+	NextBlock uint64        `json:"next_block"`
+	Recent    []recentBlock `json:"recent,omitempty"`
+}
+
+func (s *blockScraper) progressPath() string {
+	return filepath.Join(s.chainDir(), "progress.json")
+}
+
+// loadProgress returns the progress as last saved, or the first block if
+// nothing was.
+func (s *blockScraper) loadProgress() (progress, error) {
+	p := progress{NextBlock: s.o.firstBlock}
+	if s.chainDir() == "" {
+		return p, nil
+	}
+	b, err := os.ReadFile(s.progressPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return p, nil
+	}
+	if err != nil {
+		return p, err
+	}
+	if err := json.Unmarshal(b, &p); err != nil {
+		return p, fmt.Errorf("%s: %w", s.progressPath(), err)
+	}
+	return p, nil
+}
+
+func (s *blockScraper) saveProgress(next uint64) error {
+	if s.chainDir() == "" {
+		return nil
+	}
+	if err := os.MkdirAll(s.chainDir(), 0o755); err != nil {
+		return err
+	}
+	b, err := json.Marshal(progress{NextBlock: next, Recent: s.recent})
+	if err != nil {
+		return err
+	}
+	return replaceFileMode(s.progressPath(), append(b, '\n'), 0o644)
+}
+
+// run scrapes blocks until ctx is done.
+func (s *blockScraper) run(ctx context.Context) {
+	defer close(s.done)
+	var background sync.WaitGroup
+	defer background.Wait()
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		s.rpc.probe(ctx, s.o.poll)
+	}()
+	if s.index != nil {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			s.index.runPinning(ctx)
+		}()
+	}
+	if s.heads != nil {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			s.heads.run(ctx)
+		}()
+	}
+	rpc, _ := s.rpc.status()
+	slog.Info("Scraping blocks", "chain", s.o.name, "rpc", rpc, "providers", len(s.o.rpcURLs), "from", s.next)
+	following := false
+	for {
+		caughtUp, err := s.round(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		s.failed(err)
+		wait := time.Duration(0)
+		if err != nil {
+			slog.Warn("Scraping blocks failed", "chain", s.o.name, "error", err)
+			wait = s.o.poll
+		} else if caughtUp {
+			if !following {
+				slog.Info("Caught up with the head", "chain", s.o.name, "head", s.report().Head)
+				following = true
+			}
+			wait = s.o.poll
+		}
+		// Once caught up, a subscription to newHeads says when there's a
+		// block to scrape, or that it dropped and polling takes over.
+		timer, heads := time.After(wait), (<-chan struct{})(nil)
+		if err == nil && caughtUp && s.heads.following() {
+			timer, heads = nil, s.heads.wake
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer:
+		case <-heads:
+		}
+	}
+}
+
+// wait waits for run to return.
+func (s *blockScraper) wait() {
+	<-s.done
+}
+
+// round processes the blocks up to the head, at most roundBlocks of them,
+// reporting whether there were none left to.
+func (s *blockScraper) round(ctx context.Context) (bool, error) {
+	head, err := s.rpc.blockNumber(ctx)
+	if err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	next := s.next
+	s.status.Head = head
+	s.mu.Unlock()
+	if s.index != nil {
+		s.index.sawHead(head)
+	}
+	s.metrics.chainProgress(s.o.name, next, head)
+	if err := s.adapt(ctx); err != nil {
+		return false, err
+	}
+	if next > head {
+		return true, nil
+	}
+	to := min(head, next+roundBlocks-1)
+	err = s.fetch(ctx, next, to, func(b *scrapedBlock) error {
+		if err := s.follows(b.block); err != nil {
+			return err
+		}
+		for _, st := range s.stages {
+			if err := st.process(ctx, b); err != nil {
+				return fmt.Errorf("block %d: %w", b.block.Number, err)
+			}
+		}
+		s.remember(b.block)
+		s.mu.Lock()
+		s.next = uint64(b.block.Number) + 1
+		s.mu.Unlock()
+		return nil
+	})
+	var reorg *reorgError
+	if errors.As(err, &reorg) {
+		return false, s.rollback(ctx, reorg.block)
+	}
+	// What was processed is flushed and saved even if the round was cut
+	// short.
+	if ferr := s.flush(); ferr != nil {
+		return false, errors.Join(err, ferr)
+	}
+	return false, err
+}
+
+// flush flushes the stages and saves the progress past what they were
+// handed; if either fails, the blocks since the last save are processed
+// again.
+func (s *blockScraper) flush() error {
+	s.mu.Lock()
+	next, saved := s.next, s.saved
+	s.mu.Unlock()
+	if next == saved {
+		return nil
+	}
+	var err error
+	for _, st := range s.stages {
+		if err = st.flush(); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = s.saveProgress(next)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.next = saved
+		s.forget(saved)
+		return err
+	}
+	s.saved = next
+	s.status.NextBlock = next
+	return nil
+}
+
+// fetch fetches blocks from through to, with what the stages need of them,
+// in batches of -chain_rpc_batch, up to -chain_concurrency batches at
+// once, and calls fn with each in order until it fails or a block can't be
+// fetched.
+func (s *blockScraper) fetch(ctx context.Context, from, to uint64, fn func(*scrapedBlock) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type fetched struct {
+		blocks []*scrapedBlock
+		err    error
+	}
+	size := uint64(s.o.rpcBatch)
+	results := make([]chan fetched, (to-from)/size+1)
+	for i := range results {
+		results[i] = make(chan fetched, 1)
+	}
+	go func() {
+		sem := make(chan struct{}, s.o.concurrency)
+		for i := range results {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			go func() {
+				defer func() { <-sem }()
+				first := from + uint64(i)*size
+				blocks, err := s.fetchBlocks(ctx, first, min(to, first+size-1))
+				results[i] <- fetched{blocks, err}
+			}()
+		}
+	}()
+	for _, ch := range results {
+		var f fetched
+		select {
+		case f = <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if f.err != nil {
+			return f.err
+		}
+		for _, b := range f.blocks {
+			if err := fn(b); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fetchBlocks fetches the blocks from through to and what the stages need
+// of them.
+func (s *blockScraper) fetchBlocks(ctx context.Context, from, to uint64) ([]*scrapedBlock, error) {
+	blocks, err := s.rpc.blocks(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+	scraped := make([]*scrapedBlock, len(blocks))
+	for i, b := range blocks {
+		scraped[i] = newScrapedBlock(b)
+	}
+	for _, st := range s.stages {
+		if f, ok := st.(blockFetcher); ok {
+			if err := f.fetch(ctx, scraped); err != nil {
+				return nil, fmt.Errorf("blocks %d-%d: %w", from, to, err)
+			}
+		}
+	}
+	return scraped, nil
+}
+
+// failed records the error the last round failed with, clearing it for
+// nil.
+func (s *blockScraper) failed(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		s.status.Error, s.status.ErrorAt = "", nil
+		return
+	}
+	s.status.Error = err.Error()
+	s.status.ErrorAt = timePtr(time.Now().UTC().Truncate(time.Second))
+}
+
+func (s *blockScraper) report() chainStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.status
+	st.RPC, st.Providers = s.rpc.status()
+	if s.heads != nil {
+		subscribed := s.heads.following()
+		st.Subscribed = &subscribed
+	}
+	if s.index != nil {
+		st.Index = s.index.status()
+	}
+	if s.blobs != nil {
+		st.BlobArchive = s.blobs.status()
+	}
+	if st.Head >= st.NextBlock {
+		st.Behind = st.Head - st.NextBlock + 1
+	}
+	return st
+}
+
+// blockCounter is the stage counting what was processed, for /chains and
+// the metrics.
+type blockCounter struct {
+	s *blockScraper
+}
+
+func (c *blockCounter) process(ctx context.Context, b *scrapedBlock) error {
+	s := c.s
+	slog.Debug("Processed block", "chain", s.o.name, "block", uint64(b.block.Number), "transactions", len(b.block.Transactions), "appearances", len(b.appearances))
+	s.metrics.chainBlock(s.o.name, len(b.block.Transactions), len(b.appearances))
+	var blobTxs, blobs int
+	for _, tx := range b.block.Transactions {
+		if len(tx.BlobVersionedHashes) > 0 {
+			blobTxs++
+			blobs += len(tx.BlobVersionedHashes)
+		}
+	}
+	gasUsed, excessGas := b.block.BlobGasUsed, b.block.ExcessBlobGas
+	if gasUsed != nil && excessGas != nil {
+		s.metrics.chainBlobs(s.o.name, blobTxs, blobs, uint64(*gasUsed), uint64(*excessGas))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.Blocks++
+	s.status.Transactions += uint64(len(b.block.Transactions))
+	s.status.Appearances += uint64(len(b.appearances))
+	s.status.LastBlock = timePtr(time.Unix(int64(b.block.Timestamp), 0).UTC())
+	s.status.BlobTransactions += uint64(blobTxs)
+	s.status.Blobs += uint64(blobs)
+	if gasUsed != nil && excessGas != nil {
+		s.status.BlobGasUsed += uint64(*gasUsed)
+		excess := uint64(*excessGas)
+		s.status.ExcessBlobGas = &excess
+	}
+	return nil
+}
+
+func (c *blockCounter) flush() error {
+	return nil
+}
+
+// serveChains answers with the progress of each chain's scraper as JSON.
+func serveChains(scrapers []*blockScraper) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		out := make([]chainStatus, len(scrapers))
+		for i, s := range scrapers {
+			out[i] = s.report()
+		}
+		writeJSON(w, http.StatusOK, out)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// A bloom file goes with each chunk, so that queries can skip the chunks
+// that don't have an address without reading them. It starts with the
+// magic number, as a uint16, and the hash of the index's version, followed
+// by the number of blooms and the blooms, each the number of addresses in
+// it and its bits. A bloom takes up to bloomMaxAddrs addresses before the
+// next one is started, and sets a bit for each of the first hashes 4-byte
+// words of an address, taken as a big-endian number modulo the number of
+// bits.
+const (
+	bloomMagic    = 0xdead
+	bloomMaxAddrs = 50000
+	// bloomMaxHashes is the number of words in an address.
+	bloomMaxHashes = 5
+)
+
+// bloomOptions configures the blooms.
+type bloomOptions struct {
+	// bits is the width of each bloom, a multiple of 8.
+	bits   uint32
+	hashes int
+}
+
+func (o bloomOptions) check() error {
+	if o.bits == 0 || o.bits%8 != 0 {
+		return errors.New("-chain_bloom_bits must be a positive multiple of 8")
+	}
+	if o.hashes < 1 || o.hashes > bloomMaxHashes {
+		return errors.New("-chain_bloom_hashes must be between 1 and 5")
+	}
+	return nil
+}
+
+// bloomBits returns the bits a sets.
+func (o bloomOptions) bloomBits(a address) []uint32 {
+	bits := make([]uint32, o.hashes)
+	for i := range bits {
+		bits[i] = binary.BigEndian.Uint32(a[4*i:]) % o.bits
+	}
+	return bits
+}
+
+// encodeBlooms encodes the blooms of addrs, sorted and without duplicates.
+func encodeBlooms(addrs []address, o bloomOptions) []byte {
+	type bloom struct {
+		inserted uint32
+		bits     []byte
+	}
+	var blooms []*bloom
+	for i, a := range addrs {
+		if i%bloomMaxAddrs == 0 {
+			blooms = append(blooms, &bloom{bits: make([]byte, o.bits/8)})
+		}
+		bl := blooms[len(blooms)-1]
+		for _, bit := range o.bloomBits(a) {
+			bl.bits[bit/8] |= 1 << (bit % 8)
+		}
+		bl.inserted++
+	}
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, uint16(bloomMagic))
+	b.Write(indexVersionHash[:])
+	binary.Write(&b, binary.LittleEndian, uint32(len(blooms)))
+	for _, bl := range blooms {
+		binary.Write(&b, binary.LittleEndian, bl.inserted)
+		b.Write(bl.bits)
+	}
+	return b.Bytes()
+}
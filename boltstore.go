@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Top-level buckets of a bolt store. Each holds a bucket per target.
+var (
+	boltResults    = []byte("results")
+	boltAggregates = []byte("aggregates")
+)
+
+// boltStore is a store in an embedded bbolt file, for small hosts where
+// reading status matters more than writing it. A target's results are
+// keyed by start and a sequence number, so they sort by start; its
+// aggregates by resolution and start.
+type boltStore struct {
+	db *bolt.DB
+}
+
+// boltResult is a result as a bolt store keeps it, under its target.
+type boltResult struct {
+	Duration time.Duration `json:"d"`
+	Latency  time.Duration `json:"l,omitempty"`
+	Status   int           `json:"s,omitempty"`
+	OK       bool          `json:"ok,omitempty"`
+	Reason   string        `json:"r,omitempty"`
+	Error    string        `json:"e,omitempty"`
+}
+
+// boltAggregate is an aggregate as a bolt store keeps it.
+type boltAggregate struct {
+	Checks     int           `json:"c"`
+	Failures   int           `json:"f"`
+	LatencyP50 time.Duration `json:"p50"`
+	LatencyP95 time.Duration `json:"p95"`
+	LatencyP99 time.Duration `json:"p99"`
+}
+
+// openBolt opens the bolt file at path, creating it if need be. Only one
+// process may have it open.
+func openBolt(path string) (*boltStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("-store: bolt needs a path")
+	}
+	db, err := bolt.Open(path, 0o644, &bolt.Options{Timeout: 5 * time.Second})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("-store %s: in use by another process", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("-store %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltResults, boltAggregates} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("-store %s: %w", path, err)
+	}
+	return &boltStore{db: db}, nil
+}
+
+// boltKey returns two big-endian numbers as a key, which sorts like them.
+func boltKey(a, b uint64) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, a)
+	binary.BigEndian.PutUint64(key[8:], b)
+	return key
+}
+
+// boltTime returns the time a key of a target's results starts with.
+func boltTime(key []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(key)))
+}
+
+func boltStart(t time.Time) []byte {
+	return boltKey(uint64(t.UnixNano()), 0)
+}
+
+func (s *boltStore) save(ctx context.Context, results []storedResult) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(boltResults)
+		for _, r := range results {
+			b, err := root.CreateBucketIfNotExists([]byte(r.Target))
+			if err != nil {
+				return err
+			}
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			v, err := json.Marshal(boltResult{r.Duration, r.Latency, r.Status, r.OK, r.Reason, r.Error})
+			if err != nil {
+				return err
+			}
+			if err := b.Put(boltKey(uint64(r.Start.UnixNano()), seq), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) query(ctx context.Context, q resultQuery) ([]storedResult, error) {
+	var out []storedResult
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return eachTarget(tx.Bucket(boltResults), q.target, func(target string, b *bolt.Bucket) error {
+			// Walk back from the upper bound, so that only the newest
+			// limit results of the target are read.
+			c := b.Cursor()
+			var k, v []byte
+			upper, inclusive := q.upper()
+			if inclusive {
+				upper = upper.Add(1)
+			}
+			if upper.IsZero() {
+				k, v = c.Last()
+			} else if k, v = c.Seek(boltStart(upper)); k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+			n := 0
+			for ; k != nil && n < q.limit; k, v = c.Prev() {
+				start := boltTime(k)
+				if !q.since.IsZero() && start.Before(q.since) {
+					break
+				}
+				r, err := boltStored(target, start, v)
+				if err != nil {
+					return err
+				}
+				if q.selects(r) {
+					out = append(out, r)
+					n++
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortStableFunc(out, func(a, b storedResult) int {
+		if c := b.Start.Compare(a.Start); c != 0 {
+			return c
+		}
+		return strings.Compare(b.Target, a.Target)
+	})
+	if len(out) > q.limit {
+		out = out[:q.limit]
+	}
+	return out, nil
+}
+
+func (s *boltStore) each(ctx context.Context, q resultQuery, fn func(storedResult) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return eachTarget(tx.Bucket(boltResults), q.target, func(target string, b *bolt.Bucket) error {
+			c := b.Cursor()
+			k, v := c.First()
+			if !q.since.IsZero() {
+				k, v = c.Seek(boltStart(q.since))
+			}
+			upper, inclusive := q.upper()
+			for ; k != nil; k, v = c.Next() {
+				start := boltTime(k)
+				if !upper.IsZero() && (start.After(upper) || !inclusive && start.Equal(upper)) {
+					break
+				}
+				r, err := boltStored(target, start, v)
+				if err != nil {
+					return err
+				}
+				if !q.selects(r) {
+					continue
+				}
+				if err := fn(r); err != nil {
+					return err
+				}
+			}
+			return ctx.Err()
+		})
+	})
+}
+
+// boltStored decodes a result of target stored under a key starting with
+// start.
+func boltStored(target string, start time.Time, v []byte) (storedResult, error) {
+	var r boltResult
+	if err := json.Unmarshal(v, &r); err != nil {
+		return storedResult{}, fmt.Errorf("%s: %w", target, err)
+	}
+	return storedResult{target, start, r.Duration, r.Latency, r.Status, r.OK, r.Reason, r.Error}, nil
+}
+
+// eachTarget calls fn with the bucket of every target in root, or only that
+// of target if it isn't empty.
+func eachTarget(root *bolt.Bucket, target string, fn func(target string, b *bolt.Bucket) error) error {
+	if target != "" {
+		if b := root.Bucket([]byte(target)); b != nil {
+			return fn(target, b)
+		}
+		return nil
+	}
+	return root.ForEachBucket(func(name []byte) error {
+		return fn(string(name), root.Bucket(name))
+	})
+}
+
+// targets returns the names of the target buckets in the root bucket name.
+func (s *boltStore) targets(name []byte) ([]string, error) {
+	var out []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(name).ForEachBucket(func(name []byte) error {
+			out = append(out, string(name))
+			return nil
+		})
+	})
+	return out, err
+}
+
+func (s *boltStore) prune(ctx context.Context, before time.Time, keep int) (int64, error) {
+	targets, err := s.targets(boltResults)
+	if err != nil {
+		return 0, err
+	}
+	// A transaction per target keeps saving from waiting long.
+	var total int64
+	for _, target := range targets {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(boltResults).Bucket([]byte(target))
+			if b == nil {
+				return nil
+			}
+			// Keys are collected first: deleting under a cursor can
+			// have it skip the next key.
+			var doomed [][]byte
+			excess := b.Stats().KeyN - keep
+			c := b.Cursor()
+			for k, _ := c.First(); k != nil; k, _ = c.Next() {
+				old := !before.IsZero() && boltTime(k).Before(before)
+				if !old && (keep == 0 || len(doomed) >= excess) {
+					break
+				}
+				doomed = append(doomed, k)
+			}
+			for _, k := range doomed {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+			total += int64(len(doomed))
+			return nil
+		})
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (s *boltStore) downsample(ctx context.Context, before, hourlyBefore time.Time) (int64, error) {
+	targets, err := s.targets(boltResults)
+	if err != nil {
+		return 0, err
+	}
+	cutoff := boltStart(before.UTC().Truncate(daily))
+	var total int64
+	for _, target := range targets {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(boltResults).Bucket([]byte(target))
+			if b == nil {
+				return nil
+			}
+			var doomed [][]byte
+			var results []storedResult
+			c := b.Cursor()
+			for k, v := c.First(); k != nil && bytes.Compare(k, cutoff) < 0; k, v = c.Next() {
+				var r boltResult
+				if err := json.Unmarshal(v, &r); err != nil {
+					return fmt.Errorf("%s: %w", target, err)
+				}
+				doomed = append(doomed, k)
+				results = append(results, storedResult{Target: target, Start: boltTime(k), Latency: r.Latency, OK: r.OK})
+			}
+			if len(results) == 0 {
+				return nil
+			}
+			aggregates, err := tx.Bucket(boltAggregates).CreateBucketIfNotExists([]byte(target))
+			if err != nil {
+				return err
+			}
+			for _, a := range append(aggregateResults(results, hourly), aggregateResults(results, daily)...) {
+				if err := addAggregate(aggregates, a); err != nil {
+					return err
+				}
+			}
+			for _, k := range doomed {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+			total += int64(len(doomed))
+			return nil
+		})
+		if err != nil {
+			return total, err
+		}
+	}
+	if hourlyBefore.IsZero() {
+		return total, nil
+	}
+
+	end := boltKey(uint64(hourly), uint64(hourlyBefore.UnixNano()))
+	return total, s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltAggregates).ForEachBucket(func(name []byte) error {
+			b := tx.Bucket(boltAggregates).Bucket(name)
+			var doomed [][]byte
+			c := b.Cursor()
+			for k, _ := c.Seek(boltKey(uint64(hourly), 0)); k != nil && bytes.Compare(k, end) < 0; k, _ = c.Next() {
+				doomed = append(doomed, k)
+			}
+			for _, k := range doomed {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
+
+// addAggregate stores a in b. A period already rolled up, from results that
+// came in late, gets the new checks added to it but keeps its percentiles.
+func addAggregate(b *bolt.Bucket, a aggregate) error {
+	key := boltKey(uint64(a.Resolution), uint64(a.Start.UnixNano()))
+	v := boltAggregate{a.Checks, a.Failures, a.LatencyP50, a.LatencyP95, a.LatencyP99}
+	if old := b.Get(key); old != nil {
+		var prev boltAggregate
+		if err := json.Unmarshal(old, &prev); err != nil {
+			return err
+		}
+		prev.Checks += v.Checks
+		prev.Failures += v.Failures
+		v = prev
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, data)
+}
+
+func (s *boltStore) aggregates(ctx context.Context, q aggregateQuery) ([]aggregate, error) {
+	res := uint64(q.resolution)
+	from, to := boltKey(res, 0), boltKey(res+1, 0)
+	if !q.since.IsZero() {
+		from = boltKey(res, uint64(q.since.UnixNano()))
+	}
+	if !q.until.IsZero() {
+		to = boltKey(res, uint64(q.until.UnixNano()))
+	}
+
+	var out []aggregate
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return eachTarget(tx.Bucket(boltAggregates), q.target, func(target string, b *bolt.Bucket) error {
+			c := b.Cursor()
+			k, v := c.Seek(to)
+			if k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+			for n := 0; k != nil && n < q.limit && bytes.Compare(k, from) >= 0; k, v = c.Prev() {
+				if bytes.Compare(k, to) >= 0 {
+					continue
+				}
+				var a boltAggregate
+				if err := json.Unmarshal(v, &a); err != nil {
+					return fmt.Errorf("%s: %w", target, err)
+				}
+				out = append(out, aggregate{
+					Target:     target,
+					Resolution: q.resolution,
+					Start:      time.Unix(0, int64(binary.BigEndian.Uint64(k[8:]))).UTC(),
+					Checks:     a.Checks,
+					Failures:   a.Failures,
+					LatencyP50: a.LatencyP50,
+					LatencyP95: a.LatencyP95,
+					LatencyP99: a.LatencyP99,
+				})
+				n++
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortStableFunc(out, func(a, b aggregate) int { return b.Start.Compare(a.Start) })
+	if len(out) > q.limit {
+		out = out[:q.limit]
+	}
+	return out, nil
+}
+
+func (s *boltStore) saveAggregates(ctx context.Context, aggregates []aggregate) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, a := range aggregates {
+			b, err := tx.Bucket(boltAggregates).CreateBucketIfNotExists([]byte(a.Target))
+			if err != nil {
+				return err
+			}
+			if err := addAggregate(b, a); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// scan goes through the results target by target, oldest first.
+func (s *boltStore) scan(ctx context.Context, fn func(storedResult) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return eachTarget(tx.Bucket(boltResults), "", func(target string, b *bolt.Bucket) error {
+			return b.ForEach(func(k, v []byte) error {
+				r, err := boltStored(target, boltTime(k), v)
+				if err != nil {
+					return err
+				}
+				return fn(r)
+			})
+		})
+	})
+}
+
+func (s *boltStore) scanAggregates(ctx context.Context, fn func(aggregate) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return eachTarget(tx.Bucket(boltAggregates), "", func(target string, b *bolt.Bucket) error {
+			return b.ForEach(func(k, v []byte) error {
+				var a boltAggregate
+				if err := json.Unmarshal(v, &a); err != nil {
+					return fmt.Errorf("%s: %w", target, err)
+				}
+				return fn(aggregate{
+					Target:     target,
+					Resolution: time.Duration(binary.BigEndian.Uint64(k)),
+					Start:      time.Unix(0, int64(binary.BigEndian.Uint64(k[8:]))).UTC(),
+					Checks:     a.Checks,
+					Failures:   a.Failures,
+					LatencyP50: a.LatencyP50,
+					LatencyP95: a.LatencyP95,
+					LatencyP99: a.LatencyP99,
+				})
+			})
+		})
+	})
+}
+
+func (s *boltStore) close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// bootstrapIndex downloads the chunks of a published index, and their
+// blooms, from the manifest at o.bootstrap, an http(s):// URL or an
+// ipfs:// CID fetched through o.ipfs.gateway, so that the scraper resumes
+// after them instead of indexing the chain from its first block. Only the
+// chunks that carry on from the end of the index under the chain's
+// directory are taken, in order, each checked against the size and CID,
+// and SHA-256 if it has one, that the manifest has of it before it goes
+// into finalized/; the files of a chunk with CIDs are fetched from the
+// gateway, and the others next to the manifest, from its finalized/ and
+// blooms/. The manifest of an ipfs:// CID, which must be a CIDv0, is
+// checked against it too, so that the gateway needn't be trusted. The
+// chunks taken are added to manifest.json with their CIDs, so they aren't
+// pinned again.
+// Failing to bootstrap an index that has chunks of its own only warns, and
+// the scraper carries on from them.
+func bootstrapIndex(ctx context.Context, o chainOptions, client *http.Client) error {
+	dir := filepath.Join(o.dir, o.name)
+	for _, sub := range []string{"finalized", "blooms"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return err
+		}
+	}
+	chunks, err := readChunks(dir)
+	if err != nil {
+		return err
+	}
+	next := o.firstBlock
+	if n := len(chunks); n > 0 {
+		next = chunks[n-1].Last + 1
+	}
+	b := &bootstrapper{chain: o.name, source: o.bootstrap, gateway: strings.TrimSuffix(o.ipfs.gateway, "/"), client: client}
+	x := &indexStage{chain: o.name, dir: dir}
+	err = b.take(ctx, x, next)
+	if err != nil && len(chunks) > 0 {
+		slog.Warn("Bootstrapping the index failed, scraping on from its own chunks", "chain", o.name, "next", next, "error", err)
+		return nil
+	}
+	return err
+}
+
+// take downloads the published chunks from the block next on into the
+// index x.
+func (b *bootstrapper) take(ctx context.Context, x *indexStage, next uint64) error {
+	published, err := b.manifest(ctx)
+	if err != nil {
+		return err
+	}
+	local, err := readManifest(x.manifestPath())
+	if err != nil {
+		return err
+	}
+	slices.SortFunc(published.Chunks, func(a, b manifestChunk) int { return strings.Compare(a.Range, b.Range) })
+	var taken []manifestChunk
+	for _, c := range published.Chunks {
+		r, err := parseBlockRange(c.Range)
+		if err != nil {
+			return fmt.Errorf("manifest %s: %w", redactURL(b.source), err)
+		}
+		if r.First != next {
+			continue
+		}
+		if err := b.fetchChunk(ctx, x, r, c); err != nil {
+			err = fmt.Errorf("chunk %s: %w", r, err)
+			if len(taken) > 0 {
+				// Keep those already taken, so a retry starts after them.
+				return errors.Join(err, x.addBootstrapped(local, taken))
+			}
+			return err
+		}
+		slog.Info("Downloaded index chunk", "chain", b.chain, "blocks", r.String(), "size", c.IndexSize)
+		next = r.Last + 1
+		taken = append(taken, c)
+	}
+	if len(taken) == 0 {
+		slog.Info("Published index has no chunks after the index's", "chain", b.chain, "manifest", redactURL(b.source), "next", next)
+		return nil
+	}
+	slog.Info("Bootstrapped the index", "chain", b.chain, "manifest", redactURL(b.source), "chunks", len(taken), "next", next)
+	return x.addBootstrapped(local, taken)
+}
+
+// bootstrapper fetches a published index.
+type bootstrapper struct {
+	chain   string
+	source  string
+	gateway string
+	client  *http.Client
+}
+
+// manifestURL returns where the manifest is fetched from.
+func (b *bootstrapper) manifestURL() (string, error) {
+	if cid, ok := strings.CutPrefix(b.source, "ipfs://"); ok {
+		if !isCIDv0(cid) {
+			return "", fmt.Errorf("CID %s isn't a CIDv0, which is all that the manifest can be checked by", cid)
+		}
+		if b.gateway == "" {
+			return "", errors.New("an ipfs:// manifest takes -chain_ipfs_gateway")
+		}
+		return b.gateway + "/ipfs/" + cid, nil
+	}
+	return b.source, nil
+}
+
+// manifest fetches the published manifest and checks that it is of the
+// chain and of the version of the index this scraper writes.
+func (b *bootstrapper) manifest(ctx context.Context) (indexManifest, error) {
+	var m indexManifest
+	u, err := b.manifestURL()
+	if err != nil {
+		return m, err
+	}
+	data, err := b.get(ctx, u, 64<<20)
+	if err != nil {
+		return m, fmt.Errorf("manifest: %w", err)
+	}
+	if cid, ok := strings.CutPrefix(b.source, "ipfs://"); ok {
+		if got := fileCID(data); got != cid {
+			return m, fmt.Errorf("manifest %s: got CID %s", b.source, got)
+		}
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("manifest %s: %w", redactURL(b.source), err)
+	}
+	switch {
+	case m.Version != indexVersion:
+		return m, fmt.Errorf("manifest %s is of index version %q, not %q", redactURL(b.source), m.Version, indexVersion)
+	case m.Chain != b.chain:
+		return m, fmt.Errorf("manifest %s is of chain %q, not %q", redactURL(b.source), m.Chain, b.chain)
+	}
+	return m, nil
+}
+
+// fileURL returns where the file of the chunk with the CID cid is
+// fetched from, rel being its path next to the manifest.
+func (b *bootstrapper) fileURL(cid, rel string) (string, error) {
+	if cid != "" && b.gateway != "" {
+		return b.gateway + "/ipfs/" + cid, nil
+	}
+	if strings.HasPrefix(b.source, "ipfs://") {
+		return "", errors.New("no CID in the manifest to fetch it by")
+	}
+	base, err := url.Parse(b.source)
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(rel)
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(ref).String(), nil
+}
+
+// fetchChunk downloads the chunk r and its bloom, as c lists them, and
+// writes them, the bloom first so that there's never a chunk without one.
+func (b *bootstrapper) fetchChunk(ctx context.Context, x *indexStage, r blockRange, c manifestChunk) error {
+	bloom, err := b.fetchFile(ctx, c.BloomHash, "blooms/"+r.String()+".bloom", c.BloomSize, c.BloomSHA256)
+	if err != nil {
+		return fmt.Errorf("bloom: %w", err)
+	}
+	chunk, err := b.fetchFile(ctx, c.IndexHash, "finalized/"+r.String()+".bin", c.IndexSize, c.IndexSHA256)
+	if err != nil {
+		return err
+	}
+	if _, _, err := chunkHeader(chunk); err != nil {
+		return err
+	}
+	if err := replaceFileMode(x.bloomPath(r), bloom, 0o644); err != nil {
+		return err
+	}
+	return replaceFileMode(x.chunkPath(r), chunk, 0o644)
+}
+
+// fetchFile downloads a file of size bytes and checks that it has the
+// CID and, if given, the SHA-256 digest. A CID other than a CIDv0, which
+// is what ipfs add and Pinata give by default, can't be checked, so
+// without a digest the file isn't taken.
+func (b *bootstrapper) fetchFile(ctx context.Context, cid, rel string, size int64, digest string) ([]byte, error) {
+	switch {
+	case size <= 0:
+		return nil, errors.New("no size in the manifest")
+	case cid == "" && digest == "":
+		return nil, errors.New("no CID or SHA-256 in the manifest to check it against")
+	case cid != "" && !isCIDv0(cid) && digest == "":
+		return nil, fmt.Errorf("CID %s isn't a CIDv0, which is all that can be checked, and no SHA-256 in the manifest", cid)
+	}
+	u, err := b.fileURL(cid, rel)
+	if err != nil {
+		return nil, err
+	}
+	data, err := b.get(ctx, u, size+1)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != size {
+		return nil, fmt.Errorf("%s: got %d bytes, not %d", redactURL(u), len(data), size)
+	}
+	if isCIDv0(cid) {
+		if got := fileCID(data); got != cid {
+			return nil, fmt.Errorf("%s: got CID %s, not %s", redactURL(u), got, cid)
+		}
+	}
+	if digest != "" {
+		sum := sha256.Sum256(data)
+		if got := hex.EncodeToString(sum[:]); !strings.EqualFold(got, digest) {
+			return nil, fmt.Errorf("%s: SHA-256 %s, not %s", redactURL(u), got, digest)
+		}
+	}
+	return data, nil
+}
+
+// get fetches u, reading at most limit bytes of it.
+func (b *bootstrapper) get(ctx context.Context, u string, limit int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("%s: %s: %s", redactURL(u), resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, limit))
+}
+
+// addBootstrapped adds the chunks taken to the manifest local, replacing
+// any entries of the same blocks, and saves it.
+func (x *indexStage) addBootstrapped(local indexManifest, taken []manifestChunk) error {
+	x.manifest = local
+	x.manifest.Version, x.manifest.Chain = indexVersion, x.chain
+	x.manifest.Chunks = slices.DeleteFunc(x.manifest.Chunks, func(l manifestChunk) bool {
+		return slices.ContainsFunc(taken, func(c manifestChunk) bool { return c.Range == l.Range })
+	})
+	x.manifest.Chunks = append(x.manifest.Chunks, taken...)
+	slices.SortFunc(x.manifest.Chunks, func(a, b manifestChunk) int { return strings.Compare(a.Range, b.Range) })
+	return x.saveManifest()
+}
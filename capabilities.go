@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// nodeCaps is what a provider has of what the stages may need of it.
+type nodeCaps struct {
+	// Block is the block it was probed at, the next to scrape or the head
+	// if that's further.
+	Block         uint64 `json:"block"`
+	TraceBlock    bool   `json:"trace_block"`
+	DebugTrace    bool   `json:"debug_trace"`
+	BlockReceipts bool   `json:"block_receipts"`
+	// Archive is whether it has the state of Block, which tracing it
+	// takes and which a pruned node lacks for all but the latest blocks.
+	Archive bool `json:"archive"`
+}
+
+// nodeAdapter is a stage that depends on what the provider in use has.
+// adapt is handed that at startup and whenever the scraper moves to
+// another provider, and returns an error if the stage can't work with it.
+type nodeAdapter interface {
+	adapt(caps nodeCaps) error
+}
+
+// incapableError is a provider lacking something a stage can't do
+// without.
+type incapableError struct {
+	url string
+	err error
+}
+
+func (e *incapableError) Error() string { return fmt.Sprintf("%s: %v", redactURL(e.url), e.err) }
+func (e *incapableError) Unwrap() error { return e.err }
+
+// stateMissing reports whether err is a node lacking the state a call
+// needs, having pruned it.
+func stateMissing(err error) bool {
+	var re *rpcError
+	if !errors.As(err, &re) {
+		return false
+	}
+	msg := strings.ToLower(re.Message)
+	return strings.Contains(msg, "missing trie node") || strings.Contains(msg, "historical state") || strings.Contains(msg, "pruned") ||
+		strings.Contains(msg, "state not available") || strings.Contains(msg, "state is not available")
+}
+
+// probeCaps finds out what e has at block, or at its head if block is
+// past it. A method counts as there unless the node says it isn't, so a
+// call failing for another reason doesn't take it away.
+func (c *rpcClient) probeCaps(ctx context.Context, e *rpcEndpoint, block uint64) (nodeCaps, error) {
+	post := func(method string, result any, params ...any) error {
+		body, err := json.Marshal(rpcRequest{JSONRPC: "2.0", ID: c.ids.Add(1), Method: method, Params: params})
+		if err != nil {
+			return err
+		}
+		return c.post(ctx, e, method, body, result)
+	}
+	var head quantity
+	if err := post("eth_blockNumber", &head); err != nil {
+		return nodeCaps{}, err
+	}
+	caps := nodeCaps{Block: min(block, uint64(head))}
+	n := quantity(caps.Block).String()
+	probes := []struct {
+		has     *bool
+		missing func(error) bool
+		method  string
+		params  []any
+	}{
+		{&caps.Archive, stateMissing, "eth_getBalance", []any{"0x0000000000000000000000000000000000000000", n}},
+		{&caps.TraceBlock, methodMissing, "trace_block", []any{n}},
+		{&caps.DebugTrace, methodMissing, "debug_traceBlockByNumber", []any{n, callTracer}},
+		{&caps.BlockReceipts, methodMissing, "eth_getBlockReceipts", []any{n}},
+	}
+	for _, p := range probes {
+		var result json.RawMessage
+		err := post(p.method, &result, p.params...)
+		if providerFault(err) {
+			return caps, err
+		}
+		*p.has = !p.missing(err)
+	}
+	c.mu.Lock()
+	e.caps = &caps
+	c.mu.Unlock()
+	return caps, nil
+}
+
+// adapt has the stages adapt to the provider in use if they haven't yet,
+// probing it at the next block. The scraper fails over from a provider
+// lacking something a stage can't do without, and adapt returns an
+// *incapableError if there's none to go to.
+func (s *blockScraper) adapt(ctx context.Context) error {
+	for {
+		e := s.rpc.pick()
+		if e == s.adapted {
+			return nil
+		}
+		s.mu.Lock()
+		next := s.next
+		s.mu.Unlock()
+		caps, err := s.rpc.probeCaps(ctx, e, next)
+		if err != nil {
+			return fmt.Errorf("probing %s: %w", redactURL(e.url), err)
+		}
+		for _, st := range s.stages {
+			if a, ok := st.(nodeAdapter); ok && err == nil {
+				err = a.adapt(caps)
+			}
+		}
+		if err == nil {
+			slog.Info("Probed the RPC provider", "chain", s.o.name, "rpc", redactURL(e.url), "block", caps.Block,
+				"archive", caps.Archive, "trace_block", caps.TraceBlock, "debug_trace", caps.DebugTrace, "block_receipts", caps.BlockReceipts)
+			s.adapted = e
+			return nil
+		}
+		incapable := &incapableError{url: e.url, err: err}
+		if s.rpc.failed(e, incapable) == e {
+			return incapable
+		}
+	}
+}
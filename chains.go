@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// chainSpec is a chain as a chains file declares it. The options it leaves
+// out are those of the -chain_ flags.
+type chainSpec struct {
+	Name         string         `yaml:"name"`
+	RPCURL       stringList     `yaml:"rpc_url"`
+	FirstBlock   *uint64        `yaml:"first_block"`
+	Dir          *string        `yaml:"dir"`
+	Poll         *time.Duration `yaml:"poll"`
+	Concurrency  *int           `yaml:"concurrency"`
+	Traces       *bool          `yaml:"traces"`
+	Receipts     *bool          `yaml:"receipts"`
+	AppsPerChunk *int           `yaml:"apps_per_chunk"`
+	UnripeDepth  *uint64        `yaml:"unripe_depth"`
+	BloomBits    *uint32        `yaml:"bloom_bits"`
+	BloomHashes  *int           `yaml:"bloom_hashes"`
+	ReorgDepth   *uint64        `yaml:"reorg_depth"`
+	RPCMaxLag    *uint64        `yaml:"rpc_max_lag"`
+	RPCBatch     *int           `yaml:"rpc_batch"`
+	WSURL        *string        `yaml:"ws_url"`
+	IPFSAPI      *string        `yaml:"ipfs_api"`
+	PinataURL    *string        `yaml:"pinata_url"`
+	PinataJWT    *string        `yaml:"pinata_jwt"`
+	PinRetry     *time.Duration `yaml:"pin_retry"`
+	BeaconAPI    *string        `yaml:"beacon_api"`
+	Genesis      *string        `yaml:"genesis"`
+	Bootstrap    *string        `yaml:"bootstrap"`
+	IPFSGateway  *string        `yaml:"ipfs_gateway"`
+}
+
+// loadChainsFile reads a YAML file listing chains to scrape, e.g.
+//
+//	chains:
+//	  - name: mainnet
+//	    rpc_url:
+//	      - env:MAINNET_RPC_URL
+//	      - https://eth.llamarpc.com
+//	  - name: sepolia
+//	    rpc_url: http://127.0.0.1:8546
+//	    first_block: 3000000
+//	    reorg_depth: 128
+//	  - name: polygon
+//	    rpc_url: "@/run/secrets/polygon_rpc_url"
+//	    poll: 2s
+//	    traces: false
+//
+// Each chain needs a name and an RPC URL, or a list of them to fail over
+// between, which, like ws_url, beacon_api and pinata_jwt, may be given as
+// env:NAME or @file. The other keys are the -chain_ flags without the
+// prefix, and those left out are taken from defaults.
+func loadChainsFile(path string, defaults chainOptions) ([]chainOptions, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Chains []chainSpec `yaml:"chains"`
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(doc.Chains) == 0 {
+		return nil, fmt.Errorf("%s: no chains", path)
+	}
+	chains := make([]chainOptions, 0, len(doc.Chains))
+	for _, spec := range doc.Chains {
+		o, err := spec.options(defaults)
+		if err == nil {
+			err = o.check()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: chain %s: %w", path, spec.Name, err)
+		}
+		if slices.ContainsFunc(chains, func(c chainOptions) bool { return c.name == o.name }) {
+			return nil, fmt.Errorf("%s: chain %s listed twice", path, o.name)
+		}
+		chains = append(chains, o)
+	}
+	return chains, nil
+}
+
+// options returns the options of the chain, those it lacks from defaults.
+func (spec chainSpec) options(defaults chainOptions) (chainOptions, error) {
+	o := defaults
+	o.name = spec.Name
+	var err error
+	if o.rpcURLs, err = secretURLs(spec.RPCURL); err != nil {
+		return o, fmt.Errorf("rpc_url: %w", err)
+	}
+	if len(o.rpcURLs) == 0 {
+		return o, errors.New("no rpc_url")
+	}
+	override(&o.firstBlock, spec.FirstBlock)
+	override(&o.dir, spec.Dir)
+	override(&o.poll, spec.Poll)
+	override(&o.concurrency, spec.Concurrency)
+	override(&o.traces, spec.Traces)
+	override(&o.receipts, spec.Receipts)
+	override(&o.appsPerChunk, spec.AppsPerChunk)
+	override(&o.unripeDepth, spec.UnripeDepth)
+	override(&o.bloom.bits, spec.BloomBits)
+	override(&o.bloom.hashes, spec.BloomHashes)
+	override(&o.reorgDepth, spec.ReorgDepth)
+	override(&o.rpcMaxLag, spec.RPCMaxLag)
+	override(&o.rpcBatch, spec.RPCBatch)
+	override(&o.ipfs.api, spec.IPFSAPI)
+	override(&o.ipfs.pinataURL, spec.PinataURL)
+	override(&o.ipfs.retry, spec.PinRetry)
+	override(&o.genesis, spec.Genesis)
+	override(&o.bootstrap, spec.Bootstrap)
+	override(&o.ipfs.gateway, spec.IPFSGateway)
+	if spec.WSURL != nil {
+		if o.wsURL, err = secretValue(*spec.WSURL); err != nil {
+			return o, fmt.Errorf("ws_url: %w", err)
+		}
+	}
+	if spec.BeaconAPI != nil {
+		if o.beaconAPI, err = secretValue(*spec.BeaconAPI); err != nil {
+			return o, fmt.Errorf("beacon_api: %w", err)
+		}
+	}
+	if spec.PinataJWT != nil {
+		if o.ipfs.pinataJWT, err = secretValue(*spec.PinataJWT); err != nil {
+			return o, fmt.Errorf("pinata_jwt: %w", err)
+		}
+	}
+	return o, nil
+}
+
+// stringList is a string, or a list of them.
+type stringList []string
+
+func (l *stringList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*l = stringList{value.Value}
+		return nil
+	}
+	return value.Decode((*[]string)(l))
+}
+
+// secretURLs returns the URLs of entries, given as for secretValue, each of
+// which may have several, comma-separated.
+func secretURLs(entries []string) ([]string, error) {
+	var urls []string
+	for _, entry := range entries {
+		v, err := secretValue(entry)
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, splitURLs(v)...)
+	}
+	return urls, nil
+}
+
+// override sets *dst to *v if v is given.
+func override[T any](dst *T, v *T) {
+	if v != nil {
+		*dst = *v
+	}
+}
+
+// selectChains returns the chains named in the comma-separated list names.
+func selectChains(chains []chainOptions, names string) ([]chainOptions, error) {
+	var selected []chainOptions
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		i := slices.IndexFunc(chains, func(c chainOptions) bool { return c.name == name })
+		if i < 0 {
+			return nil, fmt.Errorf("no chain %q in -chains_file", name)
+		}
+		if !slices.ContainsFunc(selected, func(c chainOptions) bool { return c.name == name }) {
+			selected = append(selected, chains[i])
+		}
+	}
+	return selected, nil
+}
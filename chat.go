@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// chatStyle is how a chat service marks up alert messages.
+type chatStyle struct {
+	down, up string
+	// bold surrounds text to be shown in bold.
+	bold string
+	// escape makes text safe to include in a message.
+	escape func(string) string
+}
+
+// message formats e for people: what happened, the failure that caused it
+// and the latency of the most recent checks.
+func (s chatStyle) message(e *alertEvent) string {
+	var b strings.Builder
+	target := s.bold + s.escape(e.Target) + s.bold
+	if e.State == "down" {
+		fmt.Fprintf(&b, "%s %s is down", s.down, target)
+		if (e.Repeat > 0 || e.Escalated) && e.Since != nil {
+			fmt.Fprintf(&b, " for %s now", e.At.Sub(*e.Since).Round(time.Second))
+		}
+		if e.Error != "" {
+			fmt.Fprintf(&b, "\n> %s: %s", e.Reason, s.escape(e.Error))
+		}
+	} else {
+		fmt.Fprintf(&b, "%s %s is up again", s.up, target)
+		if o := e.Outage; o != nil {
+			fmt.Fprintf(&b, " after %s down\n> %d failed checks: %s", o.Duration, o.Failures, strings.Join(o.Reasons, ", "))
+		}
+	}
+
+	var latencies []string
+	for _, r := range e.Results {
+		d, err := time.ParseDuration(r.Latency)
+		if err != nil {
+			latencies = append(latencies, "-")
+		} else {
+			latencies = append(latencies, d.Round(100*time.Microsecond).String())
+		}
+	}
+	if len(latencies) > 0 {
+		fmt.Fprintf(&b, "\nRecent latency, newest first: %s", strings.Join(latencies, ", "))
+	}
+	return b.String()
+}
+
+// postJSON POSTs v as JSON to url, retrying like webhooks.
+func postJSON(ctx context.Context, client *http.Client, retries int, url string, v any, accept func(*http.Response) error) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return postWithRetries(ctx, client, retries, accept, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
+}
+
+// telegramAPI is the Telegram Bot API, followed by the bot token.
+var telegramAPI = "https://api.telegram.org/bot"
+
+// telegramStyle formats alerts as plain text, which Telegram shows as is.
+var telegramStyle = chatStyle{
+	down:   "\U0001F534",
+	up:     "\U0001F7E2",
+	escape: func(s string) string { return s },
+}
+
+// telegramNotifier sends alerts as a Telegram bot to each target's chat.
+type telegramNotifier struct {
+	client  *http.Client
+	token   string
+	retries int
+}
+
+// newTelegramNotifier returns nil when Telegram isn't configured.
+func newTelegramNotifier(token string, retries int) (*telegramNotifier, error) {
+	token, err := secretValue(token)
+	if err != nil {
+		return nil, fmt.Errorf("-telegram_token: %w", err)
+	}
+	if token == "" {
+		return nil, nil
+	}
+	return &telegramNotifier{client: &http.Client{Timeout: 10 * time.Second}, token: token, retries: retries}, nil
+}
+
+func (n *telegramNotifier) name() string {
+	return "telegram"
+}
+
+func (n *telegramNotifier) checkTarget(t *target) error {
+	if t.telegramChat == "" {
+		return errors.New("-telegram_token needs a telegram_chat")
+	}
+	return nil
+}
+
+func (n *telegramNotifier) notify(ctx context.Context, e *alertEvent) error {
+	msg := struct {
+		ChatID string `json:"chat_id"`
+		Text   string `json:"text"`
+	}{e.target.telegramChat, telegramStyle.message(e)}
+	return postJSON(ctx, n.client, n.retries, telegramAPI+n.token+"/sendMessage", msg, acceptTelegramAPI)
+}
+
+// acceptTelegramAPI accepts Bot API responses that report success.
+func acceptTelegramAPI(resp *http.Response) error {
+	var reply struct {
+		OK          bool   `json:"ok"`
+		Description string `json:"description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return fmt.Errorf("got status %s", resp.Status)
+	}
+	if !reply.OK {
+		return fmt.Errorf("telegram: %s", reply.Description)
+	}
+	return nil
+}
+
+// discordStyle formats alerts in Discord's markdown.
+var discordStyle = chatStyle{
+	down:   ":red_circle:",
+	up:     ":green_circle:",
+	bold:   "**",
+	escape: strings.NewReplacer(`\`, `\\`, "*", `\*`, "_", `\_`, "~", `\~`, "`", "\\`", "|", `\|`, ">", `\>`).Replace,
+}
+
+// discordNotifier posts alerts to each target's Discord webhook. Targets
+// without one are skipped, which is why every target has this notifier.
+type discordNotifier struct {
+	client  *http.Client
+	retries int
+}
+
+func newDiscordNotifier(retries int) *discordNotifier {
+	return &discordNotifier{client: &http.Client{Timeout: 10 * time.Second}, retries: retries}
+}
+
+func (n *discordNotifier) name() string {
+	return "discord"
+}
+
+func (n *discordNotifier) notify(ctx context.Context, e *alertEvent) error {
+	if e.target.discordWebhook == "" {
+		return nil
+	}
+	msg := struct {
+		Content string `json:"content"`
+	}{discordStyle.message(e)}
+	return postJSON(ctx, n.client, n.retries, e.target.discordWebhook, msg, acceptStatus)
+}
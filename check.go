@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// result is the outcome of a single check.
+type result struct {
+	target *target
+	start  time.Time
+	// duration covers the whole check including retries, latency only the
+	// final attempt, up to its body having been read.
+	duration time.Duration
+	latency  time.Duration
+	status   int
+	// checksum is the hex SHA-256 of the whole body, when the target asks
+	// for one.
+	checksum string
+	// err is set when no usable response was received at all.
+	err error
+	// failures lists every expectation the response didn't meet.
+	failures []failure
+}
+
+// failure is an unmet expectation. reason names the kind of expectation,
+// from a small fixed set, so that failures can be counted by it.
+type failure struct {
+	reason  string
+	message string
+}
+
+func (r *result) ok() bool {
+	return r.err == nil && len(r.failures) == 0
+}
+
+// response is what assertions get to see of a reply. body holds at most
+// target.bodyLimit bytes.
+type response struct {
+	*http.Response
+	body      []byte
+	truncated bool
+	// size is the number of body bytes read, which is one more than kept
+	// when truncated.
+	size int64
+	// sent is when the request that produced this response went out.
+	sent time.Time
+
+	// The body decoded as JSON, filled in on first use.
+	jsonDone  bool
+	jsonValue interface{}
+	jsonErr   error
+}
+
+// assertion is a single expectation about a response beyond its status
+// code.
+type assertion interface {
+	check(r *response) error
+}
+
+// probes maps URL schemes to the function that checks targets of that kind.
+// A probe fills in r and reports failed expectations with r.fail.
+var probes = map[string]func(ctx context.Context, t *target, r *result){
+	"http":  probeHTTP,
+	"https": probeHTTP,
+	"dns":   probeDNS,
+	"tcp":   probeTCP,
+	"icmp":  probeICMP,
+	"grpc":  probeGRPC,
+	"grpcs": probeGRPC,
+	"ws":    probeWebSocket,
+	"wss":   probeWebSocket,
+}
+
+// check performs a single check of t and logs any failure or mismatch
+// between what was observed and the expected values.
+func check(ctx context.Context, t *target) *result {
+	r := &result{target: t, start: time.Now()}
+	ctx, span := startCheckSpan(ctx, t)
+	probes[t.scheme](ctx, t, r)
+	r.duration = time.Since(r.start)
+	endCheckSpan(span, r)
+	slog.Info("Checked", "target", t.url, t.logLabels(), "check", t.scheme, "duration", r.duration, "status", r.status, "ok", r.ok())
+	return r
+}
+
+// checkLatency fails r if it took longer than t allows.
+func checkLatency(t *target, r *result) {
+	if t.maxLatency > 0 && r.latency > t.maxLatency {
+		r.fail("latency", "Latency %s exceeds %s", r.latency.Round(time.Millisecond), t.maxLatency)
+	}
+}
+
+// bodySize returns the size of resp's body as far as min_size and max_size
+// need it. A body that was cut off at body_limit is read on, without being
+// kept, until the bounds are decided.
+func bodySize(t *target, resp *response) (int64, error) {
+	size := resp.size
+	if resp.truncated && (t.minSize > 0 || t.maxSize > 0) {
+		if want := max(t.minSize, t.maxSize) + 1 - size; want > 0 {
+			n, err := io.Copy(io.Discard, io.LimitReader(resp.Body, want))
+			size += n
+			if err != nil {
+				return size, err
+			}
+		}
+	}
+	return size, nil
+}
+
+// checkSize enforces min_size and max_size on a body of size bytes, or fails
+// r with err if measuring it did.
+func checkSize(t *target, r *result, size int64, err error) {
+	if t.minSize == 0 && t.maxSize == 0 {
+		return
+	}
+	if err != nil {
+		r.fail("body", "Reading body failed: %s", err)
+		return
+	}
+	if t.maxSize > 0 && size > t.maxSize {
+		r.fail("size", "Body larger than %d bytes", t.maxSize)
+	}
+	if t.minSize > 0 && size < t.minSize {
+		r.fail("size", "Body size %d is below %d bytes", size, t.minSize)
+	}
+}
+
+func probeHTTP(ctx context.Context, t *target, r *result) {
+	ctx, release := t.connections(ctx)
+	defer release()
+
+	resp, err := fetch(ctx, t)
+	if err != nil {
+		r.err = err
+		slog.Warn("Request failed", "target", t.url, t.logLabels(), "error", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	r.status = resp.StatusCode
+	var digest func() (string, error)
+	if t.checksum != "" {
+		digest = hashBody(resp)
+	}
+	if t.readBody {
+		if err := resp.readBody(t.bodyLimit); err != nil {
+			r.err = err
+			slog.Warn("Reading body failed", "target", t.url, t.logLabels(), "error", err)
+			return
+		}
+	}
+	// The rest of the body is read before the latency is taken, so that
+	// the whole of it counts, as max_latency has it.
+	size, sizeErr := bodySize(t, resp)
+	var digestErr error
+	if digest != nil {
+		r.checksum, digestErr = digest()
+	}
+	r.latency = time.Since(resp.sent)
+	endRequestSpan(resp)
+
+	_, span := tracer.Start(ctx, "assertions")
+	defer span.End()
+
+	if !t.status[resp.StatusCode] {
+		r.fail("status", "Status code mismatch, got: %d", resp.StatusCode)
+	}
+	if t.conn.http2 && resp.ProtoMajor != 2 {
+		r.fail("protocol", "Protocol mismatch, got: %s", resp.Proto)
+	}
+
+	checkLatency(t, r)
+	checkSize(t, r, size, sizeErr)
+	if digestErr != nil {
+		r.fail("body", "Reading body failed: %s", digestErr)
+	}
+	checkChecksum(t, r)
+
+	for _, a := range t.assertions {
+		if err := a.check(resp); err != nil {
+			r.fail("assertion", "%s", err)
+		}
+	}
+}
+
+// fail records and logs a failed expectation.
+func (r *result) fail(reason, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	r.failures = append(r.failures, failure{reason, msg})
+	slog.Warn("Check failed", "target", r.target.url, r.target.logLabels(), "reason", reason, "error", msg)
+}
+
+// readBody reads up to limit bytes of the body. Anything beyond that is
+// left unread and marks the response as truncated.
+func (r *response) readBody(limit int64) error {
+	b, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return err
+	}
+	r.size = int64(len(b))
+	if int64(len(b)) > limit {
+		b = b[:limit]
+		r.truncated = true
+	}
+	r.body = b
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+)
+
+// checksumStable is the sha256 option value that expects the body to stay
+// the same from one check to the next rather than to have a given digest.
+const checksumStable = "stable"
+
+func parseChecksum(value string) (string, error) {
+	value = strings.ToLower(value)
+	if value == "" || value == checksumStable {
+		return value, nil
+	}
+	if b, err := hex.DecodeString(value); err != nil || len(b) != sha256.Size {
+		return "", errors.New("want a hex SHA-256 digest or stable")
+	}
+	return value, nil
+}
+
+// hashBody arranges for everything read from resp's body to be hashed. Call
+// the returned function once done with the body to read the remainder and
+// get the digest.
+func hashBody(resp *response) func() (string, error) {
+	h := sha256.New()
+	resp.Body = hashedBody{io.TeeReader(resp.Body, h), resp.Body}
+	return func() (string, error) {
+		if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+}
+
+type hashedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// checkChecksum compares the digest of the body with the sha256 option when
+// that names a digest. Stable bodies are compared by a checksumTracker.
+func checkChecksum(t *target, r *result) {
+	if t.checksum == "" || t.checksum == checksumStable || r.checksum == "" {
+		return
+	}
+	if r.checksum != t.checksum {
+		r.fail("checksum", "Body SHA-256 mismatch, got: %s", r.checksum)
+	}
+}
+
+// checksumTracker remembers the last body digest of each target whose body
+// is expected to be stable. It is keyed by URL so that a reload doesn't
+// hide a change.
+type checksumTracker struct {
+	mu   sync.Mutex
+	last map[string]string
+}
+
+func newChecksumTracker() *checksumTracker {
+	return &checksumTracker{last: make(map[string]string)}
+}
+
+// observe fails r when its body differs from the one seen by the previous
+// check. The new digest becomes the one later checks are compared with.
+func (c *checksumTracker) observe(r *result) {
+	if r.target.checksum != checksumStable || r.checksum == "" {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	last, ok := c.last[r.target.url]
+	c.last[r.target.url] = r.checksum
+	if ok && last != r.checksum {
+		r.fail("checksum", "Body SHA-256 changed from %s to %s", last, r.checksum)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math/big"
+	"strings"
+)
+
+// The CIDv0 of a file is that of the root of the DAG ipfs add builds of it
+// with its defaults, as Kubo and Pinata do: chunks of 256 KiB, each a leaf
+// of dag-pb and UnixFS, under a balanced tree of nodes of up to 174 links
+// each, the multihash of the root's SHA-256 in base58.
+const (
+	cidChunkSize = 256 << 10
+	cidMaxLinks  = 174
+)
+
+// isCIDv0 reports whether cid is a CIDv0, which fileCID can check.
+func isCIDv0(cid string) bool {
+	return len(cid) == 46 && strings.HasPrefix(cid, "Qm")
+}
+
+// fileCID returns the CIDv0 of the file b.
+func fileCID(b []byte) string {
+	var leaves []dagNode
+	for off := 0; off < len(b) || off == 0; off += cidChunkSize {
+		chunk := b[off:min(off+cidChunkSize, len(b))]
+		leaves = append(leaves, newDagNode(nil, unixfsFile(chunk, uint64(len(chunk)), nil), uint64(len(chunk))))
+	}
+	root := leaves[0]
+	if len(leaves) > 1 {
+		depth, span := 1, cidMaxLinks
+		for span < len(leaves) {
+			depth, span = depth+1, span*cidMaxLinks
+		}
+		root = dagTree(leaves, depth)
+	}
+	return base58(root.hash[:])
+}
+
+// dagNode is a node of the DAG of a file, as the links to it have it.
+type dagNode struct {
+	// hash is the multihash of the node; tsize the size of it and of
+	// those under it, and fileSize that of the data they hold.
+	hash     [34]byte
+	tsize    uint64
+	fileSize uint64
+}
+
+// dagTree returns the node of depth over leaves, with up to cidMaxLinks
+// nodes of depth-1 under it, each as full as it goes before the next.
+func dagTree(leaves []dagNode, depth int) dagNode {
+	span := 1
+	for range depth - 1 {
+		span *= cidMaxLinks
+	}
+	var children []dagNode
+	for i := 0; i < len(leaves); i += span {
+		group := leaves[i:min(i+span, len(leaves))]
+		if depth == 1 {
+			children = append(children, group[0])
+		} else {
+			children = append(children, dagTree(group, depth-1))
+		}
+	}
+	var fileSize uint64
+	sizes := make([]uint64, len(children))
+	for i, c := range children {
+		fileSize += c.fileSize
+		sizes[i] = c.fileSize
+	}
+	return newDagNode(children, unixfsFile(nil, fileSize, sizes), fileSize)
+}
+
+// newDagNode encodes a dag-pb node of the links and data, the links first
+// as the canonical encoding has them.
+func newDagNode(links []dagNode, data []byte, fileSize uint64) dagNode {
+	var b []byte
+	tsize := uint64(0)
+	for _, l := range links {
+		var link []byte
+		link = protoBytes(link, 1, l.hash[:])
+		link = protoBytes(link, 2, nil) // the name, empty but always there
+		link = protoVarint(link, 3, l.tsize)
+		b = protoBytes(b, 2, link)
+		tsize += l.tsize
+	}
+	b = protoBytes(b, 1, data)
+	n := dagNode{tsize: tsize + uint64(len(b)), fileSize: fileSize}
+	n.hash[0], n.hash[1] = 0x12, 0x20 // sha2-256, 32 bytes
+	sum := sha256.Sum256(b)
+	copy(n.hash[2:], sum[:])
+	return n
+}
+
+// unixfsFile encodes the UnixFS data of a file node: data for a leaf,
+// left out if there's none, and the sizes of the children for the others.
+func unixfsFile(data []byte, fileSize uint64, blockSizes []uint64) []byte {
+	b := protoVarint(nil, 1, 2) // File
+	if len(data) > 0 {
+		b = protoBytes(b, 2, data)
+	}
+	b = protoVarint(b, 3, fileSize)
+	for _, s := range blockSizes {
+		b = protoVarint(b, 4, s)
+	}
+	return b
+}
+
+func protoVarint(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3)
+	return binary.AppendUvarint(b, v)
+}
+
+func protoBytes(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// base58 encodes b as Bitcoin's base58 does, as CIDv0s are.
+func base58(b []byte) string {
+	n := new(big.Int).SetBytes(b)
+	radix, mod := big.NewInt(58), new(big.Int)
+	var out []byte
+	for n.Sign() > 0 {
+		n.DivMod(n, radix, mod)
+		out = append(out, base58Alphabet[mod.Int64()])
+	}
+	for _, c := range b {
+		if c != 0 {
+			break
+		}
+		out = append(out, base58Alphabet[0])
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return string(out)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// clientOptions tunes the http.Client shared by all targets.
+type clientOptions struct {
+	connectTimeout        time.Duration
+	keepAlive             time.Duration
+	tlsHandshakeTimeout   time.Duration
+	responseHeaderTimeout time.Duration
+	idleConnTimeout       time.Duration
+	maxIdleConns          int
+	maxIdleConnsPerHost   int
+	insecureSkipVerify    bool
+	tlsMinVersion         uint16
+}
+
+func newClient(o clientOptions) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   o.connectTimeout,
+		KeepAlive: o.keepAlive,
+	}
+	transport := &http.Transport{
+		Proxy:                 proxyFromContext,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   o.tlsHandshakeTimeout,
+		ResponseHeaderTimeout: o.responseHeaderTimeout,
+		IdleConnTimeout:       o.idleConnTimeout,
+		MaxIdleConns:          o.maxIdleConns,
+		MaxIdleConnsPerHost:   o.maxIdleConnsPerHost,
+		ExpectContinueTimeout: time.Second,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: o.insecureSkipVerify,
+			MinVersion:         o.tlsMinVersion,
+		},
+	}
+	// Cloning configures HTTP/2 on the original, which adds h2 to the ALPN
+	// protocols offered; the HTTP/1.1 variant must not offer it.
+	http1 := transport.Clone()
+	http1.ForceAttemptHTTP2 = false
+	http1.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	http1.TLSClientConfig.NextProtos = []string{"http/1.1"}
+	return &http.Client{
+		Transport: &transports{
+			auto:   transport,
+			http1:  http1,
+			custom: make(map[customTransport]*http.Transport),
+		},
+		CheckRedirect: checkRedirect,
+	}
+}
+
+// transports are the variants of the shared transport targets choose from.
+// auto speaks HTTP/2 to TLS servers that offer it, http1 never does. Targets
+// with TLS files of their own get a transport, and so a connection pool, per
+// set of files. The client is shared, so the choice travels in the request
+// context.
+type transports struct {
+	auto  *http.Transport
+	http1 *http.Transport
+
+	mu     sync.Mutex
+	custom map[customTransport]*http.Transport
+}
+
+type customTransport struct {
+	files tlsFiles
+	http1 bool
+}
+
+// pick returns the transport for requests made with the given TLS files.
+func (m *transports) pick(files tlsFiles, http1 bool) *http.Transport {
+	base := m.auto
+	if http1 {
+		base = m.http1
+	}
+	if files == (tlsFiles{}) {
+		return base
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := customTransport{files, http1}
+	tr, ok := m.custom[key]
+	if !ok {
+		tr = base.Clone()
+		newTLSCredentials(files).apply(tr.TLSClientConfig)
+		m.custom[key] = tr
+	}
+	return tr
+}
+
+type transportKey struct{}
+
+func (m *transports) RoundTrip(req *http.Request) (*http.Response, error) {
+	if tr, ok := req.Context().Value(transportKey{}).(*http.Transport); ok {
+		return tr.RoundTrip(req)
+	}
+	return m.auto.RoundTrip(req)
+}
+
+func (m *transports) CloseIdleConnections() {
+	m.auto.CloseIdleConnections()
+	m.http1.CloseIdleConnections()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, tr := range m.custom {
+		tr.CloseIdleConnections()
+	}
+}
+
+// connPolicy is how a target's HTTP requests use connections.
+type connPolicy struct {
+	// http1 keeps to HTTP/1.1, http2 fails checks answered over anything
+	// but HTTP/2.
+	http1 bool
+	http2 bool
+	// keepAlive leaves connections open for later requests.
+	keepAlive bool
+	// fresh gives every check connections of its own instead of ones
+	// pooled by earlier checks.
+	fresh bool
+}
+
+// connections puts the transport for one check of t into ctx. The returned
+// function must be called once the check is done with its response.
+func (t *target) connections(ctx context.Context) (context.Context, func()) {
+	m, ok := t.client.Transport.(*transports)
+	if !ok {
+		return ctx, func() {}
+	}
+	tr := m.pick(t.tls, t.conn.http1)
+	if !t.conn.fresh {
+		return context.WithValue(ctx, transportKey{}, tr), func() {}
+	}
+	// Connections that become idle after CloseIdleConnections are closed
+	// too, so none of the clone's outlive the check.
+	tr = tr.Clone()
+	return context.WithValue(ctx, transportKey{}, tr), tr.CloseIdleConnections
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func parseTLSVersion(value string) (uint16, error) {
+	v, ok := tlsVersions[value]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q, want one of 1.0, 1.1, 1.2, 1.3", value)
+	}
+	return v, nil
+}
+
+// cancelBody releases a request's timeout context once its response body
+// has been closed, so the timeout covers reading the body as well.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// redirectPolicy is how a single request treats redirects. The client is
+// shared, so the policy travels in the request context.
+type redirectPolicy struct {
+	follow bool
+	max    int
+}
+
+type redirectPolicyKey struct{}
+
+// checkRedirect applies the redirectPolicy found in req's context. Requests
+// without one follow up to ten redirects like http.DefaultClient.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	p, ok := req.Context().Value(redirectPolicyKey{}).(redirectPolicy)
+	if !ok {
+		p = redirectPolicy{follow: true, max: 10}
+	}
+	if !p.follow {
+		return http.ErrUseLastResponse
+	}
+	if len(via) > p.max {
+		return fmt.Errorf("stopped after %d redirects", p.max)
+	}
+	return nil
+}
+
+// redirectChain lists the URLs requested on the way to resp, in order,
+// ending with the one resp came from.
+func redirectChain(resp *http.Response) []string {
+	var chain []string
+	for req := resp.Request; req != nil; {
+		chain = append([]string{req.URL.String()}, chain...)
+		if req.Response == nil {
+			break
+		}
+		req = req.Response.Request
+	}
+	return chain
+}
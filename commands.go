@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/namsral/flag"
+)
+
+// version is the scraper's version, set when building releases with
+// -ldflags "-X main.version=v1.2.3".
+var version = "dev"
+
+// command is something the scraper can be asked to do, named by its first
+// argument. summary is listed by help, and doc heads the command's usage.
+// run gets the arguments from the command's name on and returns the exit
+// status.
+type command struct {
+	name, args   string
+	summary, doc string
+	run          func(ctx context.Context, args []string, out io.Writer) (int, error)
+}
+
+// commands are listed in help in this order. They're set up in init, as
+// help refers to them.
+var commands []command
+
+func init() {
+	commands = []command{
+		{
+			"run", "[flags]", "Check the targets until stopped",
+			"Checks the targets on their schedules until stopped. This is the default\nwhen the first argument is a flag.",
+			runCommand,
+		},
+		{
+			"check", "[flags] URL...", "Check URLs once and print the results",
+			"Checks the URLs given once, with the options the flags give every target,\nprints the results and exits, non-zero if any failed. -url and targets\nfiles are ignored.",
+			checkCommand,
+		},
+		{
+			"validate", "[flags]", "Report problems with the config",
+			"Loads the config as run would, reports any problem, and exits, non-zero\nif there was one, without running checks.",
+			validateCommand,
+		},
+		{
+			"export", "[flags] ARCHIVE", "Dump the stored data to an archive",
+			"Writes every result and aggregate in -store, and the -state_file if the\nscraper is stopped, to a new zip archive, to import elsewhere.",
+			exportCommand,
+		},
+		{
+			"import", "[flags] ARCHIVE", "Load an archive into the store",
+			"Adds the results and aggregates in an archive written by export to\n-store, and with -state_file restores the state, for the scraper to pick\nup when it next starts. Importing an archive twice doubles its results.",
+			importCommand,
+		},
+		{
+			"ctl", "[flags] ACTION [URL...]", "Control the running scraper",
+			"Talks to the scraper running with -control_socket on this host. Actions:\n\n  status          Print the status of every target\n  pause URL...    Stop checking the targets until resumed, or with -for\n                  for that long; -all pauses every target\n  resume URL...   Check paused targets again, or with -all every target\n  run-now URL...  Check the targets right away and print the results\n  reload          Reload the config and report whether that worked",
+			ctlCommand,
+		},
+		{"version", "", "Print the version", "Prints the version and build details.", versionCommand},
+		{"help", "[command]", "Describe the commands", "Describes the commands, or the flags of one.", helpCommand},
+	}
+}
+
+// programName is what the scraper was run as, for usage messages.
+func programName() string {
+	return filepath.Base(os.Args[0])
+}
+
+// parseCommand returns the command args ask for and the arguments that go to
+// it. Arguments starting with a flag are for run, so the scraper can still
+// be started without naming a command.
+func parseCommand(args []string) (*command, []string) {
+	name, rest := "run", args[1:]
+	if len(rest) > 0 && rest[0] != "" && rest[0][0] != '-' {
+		name, rest = rest[0], rest[1:]
+	}
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i], append([]string{name}, rest...)
+		}
+	}
+	return nil, nil
+}
+
+// commandUsage has flags print the usage of the command called name.
+func commandUsage(flags *flag.FlagSet, name string) {
+	flags.Usage = func() {
+		for _, cmd := range commands {
+			if cmd.name == name {
+				fmt.Fprintf(os.Stderr, "Usage: %s\n\n%s\n", strings.TrimSpace(programName()+" "+cmd.name+" "+cmd.args), cmd.doc)
+			}
+		}
+		n := 0
+		flags.VisitAll(func(*flag.Flag) { n++ })
+		if n > 0 {
+			fmt.Fprintf(os.Stderr, "\nFlags:\n")
+			flags.PrintDefaults()
+		}
+	}
+}
+
+// usage describes every command.
+func usage(out io.Writer) {
+	fmt.Fprintf(out, "Usage: %s <command> [flags]\n\nCommands:\n", programName())
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %s\t%s\n", cmd.name, cmd.summary)
+	}
+	w.Flush()
+	fmt.Fprintf(out, "\nRun %q for the flags of a command.\n", programName()+" help <command>")
+}
+
+func runCommand(ctx context.Context, args []string, out io.Writer) (int, error) {
+	c := &config{}
+	err := run(ctx, c, args, out)
+	switch {
+	case errors.Is(err, errChecksFailed):
+		return 1, nil
+	case err != nil:
+		return 1, err
+	case c.checkConfig || c.once:
+		return 0, nil
+	}
+	return c.exitCode, nil
+}
+
+func validateCommand(ctx context.Context, args []string, out io.Writer) (int, error) {
+	c := &config{}
+	if err := c.init(args); err != nil {
+		return 1, err
+	}
+	fmt.Fprintf(out, "Config OK, %d targets\n", len(c.targets))
+	return 0, nil
+}
+
+func checkCommand(ctx context.Context, args []string, out io.Writer) (int, error) {
+	c := &config{}
+	if err := c.init(args); err != nil {
+		return 1, err
+	}
+	logger, err := newLogger(c.logFormat, os.Stderr)
+	if err != nil {
+		return 1, err
+	}
+	logLevel.Set(c.logLevel)
+	slog.SetDefault(logger)
+
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if !printResults(out, checkAll(ctx, c.targets, c.workers)) {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// checkAll checks every target once, up to workers at a time, and returns
+// the results in the order of targets.
+func checkAll(ctx context.Context, targets []*target, workers int) []*result {
+	results := make([]*result, len(targets))
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			results[i] = check(ctx, t)
+			<-sem
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// printResults writes a line for each of results to out and reports whether
+// they all passed.
+func printResults(out io.Writer, results []*result) bool {
+	ok := true
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STATE\tTARGET\tSTATUS\tDURATION\tERROR")
+	for _, r := range results {
+		rec := newRecord(r)
+		state := "up"
+		if !rec.OK {
+			state, ok = "down", false
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", state, r.target.url, statusText(rec.Status), r.duration.Round(100*time.Microsecond), rec.Error)
+	}
+	w.Flush()
+	return ok
+}
+
+func versionCommand(ctx context.Context, args []string, out io.Writer) (int, error) {
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	commandUsage(flags, args[0])
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2, err
+	}
+
+	v := version
+	info, ok := debug.ReadBuildInfo()
+	if ok && v == "dev" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		v = info.Main.Version
+	}
+	fmt.Fprintf(out, "%s %s\n", programName(), v)
+	if !ok {
+		return 0, nil
+	}
+	fmt.Fprintf(out, "go: %s\n", info.GoVersion)
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision", "vcs.time", "vcs.modified", "GOOS", "GOARCH":
+			fmt.Fprintf(out, "%s: %s\n", s.Key, s.Value)
+		}
+	}
+	return 0, nil
+}
+
+func helpCommand(ctx context.Context, args []string, out io.Writer) (int, error) {
+	if len(args) < 2 {
+		usage(out)
+		return 0, nil
+	}
+	cmd, _ := parseCommand([]string{programName(), args[1]})
+	if cmd == nil || args[1][0] == '-' {
+		return 2, fmt.Errorf("unknown command %q", args[1])
+	}
+	if cmd.name == "help" {
+		usage(out)
+		return 0, nil
+	}
+	// Every command prints its usage when asked for it with -h.
+	cmd.run(ctx, []string{cmd.name, "-h"}, io.Discard)
+	return 0, nil
+}
@@ -0,0 +1,653 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/namsral/flag"
+)
+
+const (
+	defaultTick            = 60 * time.Second
+	defaultShutdownTimeout = 10 * time.Second
+	defaultWorkers         = 16
+	// envPrefix starts the environment variable of every option: -tick
+	// is read from SCRAPER_TICK.
+	envPrefix = "SCRAPER"
+)
+
+type config struct {
+	adminAddr string
+	adminKeys []apiKey
+	// adminKeysFile is where keys created through the admin API are kept.
+	adminKeysFile string
+	adminToken    string
+	alertResults  int
+	// archive is the path export and import take.
+	archive     string
+	chains      []chainOptions
+	checkConfig bool
+	client      *http.Client
+	configFile  string
+	// controlSocket is where ctl finds the scraper.
+	controlSocket string
+	defaults      target
+	exitCode      int
+	export        exportOptions
+	grpcAddr      string
+	historySize   int
+	influx        influxOptions
+	uptimeReport  time.Duration
+	limiter       *limiter
+	logFile       string
+	logFormat     string
+	logLevel      slog.Level
+	logRotation   logRotation
+	// managedTargetsFile is where targets added through the admin API are
+	// kept.
+	managedTargetsFile string
+	metrics            metricsOptions
+	once               bool
+	pprof              bool
+	shutdownTimeout    time.Duration
+	stallTimeout       time.Duration
+	stateFile          string
+	store              storeOptions
+	targetsFile        string
+	targetsRefresh     time.Duration
+	targetsURL         string
+	targets            []*target
+	tracing            tracingOptions
+	watchConfig        bool
+	workers            int
+}
+
+// init parses args, the environment and the config file named by -config
+// into c. It is called again on every reload, so a parse failure leaves c
+// untouched rather than exiting the process. args[0] is the command; for
+// check, the URLs to check are given as arguments and replace the targets
+// otherwise configured.
+func (c *config) init(args []string) error {
+	flags := flag.NewFlagSetWithEnvPrefix(args[0], envPrefix, flag.ContinueOnError)
+	commandUsage(flags, args[0])
+
+	var urls, webhooks urlList
+	flags.Var(&urls, "url", "Request URL; repeat or comma-separate to monitor several, per-target options go in the fragment")
+	flags.Var(&webhooks, "webhook_url", "URL to POST a JSON event to when a target goes down or comes back up; repeat or comma-separate for several")
+	var chainRPCs urlList
+	flags.Var(&chainRPCs, "chain_rpc_url", "JSON-RPC URL of an Ethereum node to scrape blocks from; repeat or comma-separate for several providers, the first preferred, to fail over between; env:NAME and @file read it from elsewhere; fixed at startup, like the other -chain_ flags")
+	var adminKeys keyList
+	flags.Var(&adminKeys, "admin_key", "API key for -admin_addr and -grpc_addr as scope:key, the scope being read, operate or admin; repeat or comma-separate for several, env:NAME and @file read the key from elsewhere")
+
+	var (
+		configFile      = flags.String(flag.DefaultConfigFlagname, "", "Path to config file")
+		checkConfig     = flags.Bool("check_config", false, "Same as the validate command")
+		targetsFile     = flags.String("targets_file", "", "Path to a YAML file listing targets with their options, in addition to -url; re-read on reload")
+		targetsURL      = flags.String("targets_url", "", "http://, https:// or s3:// URL of a YAML document listing targets like -targets_file; fetched on reload")
+		targetsRefresh  = flags.Duration("targets_refresh", time.Minute, "How often -targets_url is checked for changes, 0 for only on reload; fixed at startup")
+		watch           = flags.Bool("watch_config", false, "Reload automatically when the config file changes")
+		tick            = flags.Duration("tick", defaultTick, "Ticking interval")
+		exitCode        = flags.Int("exit_code", 0, "Process exit code after a clean shutdown")
+		storeURL        = flags.String("store", "", "Where to keep every check result, as sqlite:path, bolt:path or a postgres:// URL; fixed at startup")
+		storeFlush      = flags.Duration("store_flush", time.Second, "How often results are written to -store; fixed at startup")
+		storeJournal    = flags.String("store_journal", "", "File results are journaled to until they are written to -store, so that a crash doesn't lose them")
+		storeMaxAge     = flags.String("store_max_age", "0", "Delete stored results older than this, e.g. 90d, 0 to keep them; fixed at startup, like the other -store_ flags")
+		storeMaxResults = flags.Int("store_max_results", 0, "Number of stored results kept per target, 0 for all")
+		storeDownsample = flags.Bool("store_downsample", false, "Roll results past -store_max_age up into hourly and daily aggregates before deleting them")
+		storeHourlyAge  = flags.String("store_hourly_max_age", "0", "Delete hourly aggregates older than this, e.g. 400d, 0 to keep them; daily ones are kept")
+		storePrune      = flags.Duration("store_prune_every", time.Hour, "How often results past -store_max_age or -store_max_results are deleted")
+		influxURL       = flags.String("influx_url", "", "udp:// address or http(s):// write URL of an InfluxDB to write every check result to in line protocol; fixed at startup, like the other -influx_ flags")
+		influxToken     = flags.String("influx_token", "", "Token to authenticate to -influx_url with; env:NAME and @file read it from elsewhere")
+		influxFlush     = flags.Duration("influx_flush", 10*time.Second, "How often results are written to an http(s):// -influx_url")
+		exportFile      = flags.String("export_file", "", "CSV (.csv) or NDJSON (.ndjson, .jsonl) file every check result is appended to; fixed at startup, like the -export_ rotation flags")
+		exportMaxSize   = flags.Int("export_max_size", 100, "Size in megabytes at which -export_file is rotated, 0 for never")
+		exportRotate    = flags.Duration("export_rotate_every", 0, "Rotate -export_file at this interval too, e.g. 1h, 0 to rotate by size only")
+		exportMaxAge    = flags.String("export_max_age", "0", "Delete rotated export files older than this, e.g. 14d, 0 to keep them")
+		exportBackups   = flags.Int("export_max_backups", 0, "Number of rotated export files kept, 0 for all")
+		exportCompress  = flags.Bool("export_compress", false, "Gzip rotated export files")
+		stateFile       = flags.String("state_file", "", "File the state of targets and alerts is saved to on shutdown and restored from on startup; fixed at startup")
+		once            = flags.Bool("once", false, "Check every target once, print the results and exit, non-zero if any failed")
+		workers         = flags.Int("workers", defaultWorkers, "Maximum number of checks running at once; fixed at startup")
+		adminAddr       = flags.String("admin_addr", "", "Address to serve the dashboard, /metrics, /healthz, /readyz, /status, /stream, /silences, /pauses, /results, /results/summary, /aggregates, /chains, /targets, /keys and /openapi.json on, e.g. localhost:9100; fixed at startup")
+		adminToken      = flags.String("admin_token", "", "Bootstrap API key with the admin scope, for /targets and /keys on -admin_addr, which are off without any keys; env:NAME and @file read it from elsewhere")
+		adminKeysFile   = flags.String("admin_keys_file", "", "File the API keys created through /keys are saved to and loaded from; fixed at startup")
+		controlSocket   = flags.String("control_socket", "", "Unix socket to serve the control API ctl uses on, e.g. /run/scraper/control.sock; fixed at startup")
+		grpcAddr        = flags.String("grpc_addr", "", "Address to serve the gRPC management API of scraperpb on, which takes the API keys like /targets, e.g. localhost:9101; fixed at startup")
+		managedTargets  = flags.String("managed_targets_file", "", "File the targets added through the /targets API are saved to and loaded from; fixed at startup")
+		pprof           = flags.Bool("pprof", false, "Serve Go's profiling endpoints under /debug/pprof/ on -admin_addr; fixed at startup")
+		historySize     = flags.Int("history_size", 100, "Number of recent results kept per target for /status; fixed at startup")
+		alertResults    = flags.Int("alert_results", 5, "Number of recent results sent along with each alert; fixed at startup")
+		webhookSecret   = flags.String("webhook_secret", "", "Key to sign webhook bodies with in the X-Scraper-Signature header; env:NAME and @file read it from elsewhere")
+		slackWebhook    = flags.String("slack_webhook_url", "", "Slack incoming webhook URL to post alerts to; env:NAME and @file read it from elsewhere")
+		slackToken      = flags.String("slack_token", "", "Slack bot token to post alerts with chat.postMessage instead; env:NAME and @file read it from elsewhere")
+		smtpAddr        = flags.String("smtp_addr", "", "host:port of the SMTP server to send email alerts through")
+		smtpUsername    = flags.String("smtp_username", "", "User name to authenticate to -smtp_addr with, empty for none")
+		smtpPassword    = flags.String("smtp_password", "", "Password for -smtp_username; env:NAME and @file read it from elsewhere")
+		smtpFrom        = flags.String("smtp_from", "scraper@localhost", "Sender address of email alerts")
+		smtpSecurity    = flags.String("smtp_security", "starttls", "How to secure the SMTP connection: starttls, tls or none")
+		emailDigest     = flags.Duration("email_digest", time.Minute, "How long to collect alerts for the same recipients into one email, 0 to send each right away")
+		telegramToken   = flags.String("telegram_token", "", "Telegram bot token to send alerts with; env:NAME and @file read it from elsewhere")
+		execTimeout     = flags.Duration("alert_exec_timeout", 30*time.Second, "How long an -alert_exec hook may run before it is killed, 0 for no limit")
+		webhookRetries  = flags.Int("webhook_retries", 3, "Times a failed notification is retried")
+		uptimeReport    = flags.Duration("uptime_report_every", 0, "How often to log every target's availability, e.g. 24h, 0 to never; fixed at startup")
+		stallTimeout    = flags.Duration("stall_timeout", 5*time.Minute, "How long a due check may wait for a free worker before /healthz reports the scheduler stalled")
+		logFormat       = flags.String("log_format", "text", "Log format, text or json; fixed at startup")
+		logLevel        = flags.String("log_level", "info", "Least severe level logged: debug, info, warn or error")
+		verbose         = flags.Bool("verbose", false, "Log at debug level, including every request and response")
+		quiet           = flags.Bool("quiet", false, "Log warnings and errors only")
+		logFile         = flags.String("log_file", "", "File to log to instead of standard output; fixed at startup, like the -log_ rotation flags")
+		logMaxSize      = flags.Int("log_max_size", 100, "Size in megabytes at which -log_file is rotated")
+		logRotateEvery  = flags.Duration("log_rotate_every", 0, "Rotate -log_file at this interval too, e.g. 24h, 0 to rotate by size only")
+		logMaxAge       = flags.String("log_max_age", "0", "Delete rotated log files older than this, e.g. 14d, 0 to keep them")
+		logMaxBackups   = flags.Int("log_max_backups", 0, "Number of rotated log files kept, 0 for all")
+		logCompress     = flags.Bool("log_compress", true, "Gzip rotated log files")
+		metricsBackend  = flags.String("metrics_backend", "prometheus", "Where metrics go: prometheus, served at /metrics on -admin_addr, or statsd; fixed at startup, like the -statsd_ flags")
+		statsdAddr      = flags.String("statsd_addr", "127.0.0.1:8125", "host:port of the StatsD server")
+		statsdPrefix    = flags.String("statsd_prefix", "scraper.", "Prefix of StatsD metric names")
+		dogstatsd       = flags.Bool("statsd_dogstatsd", false, "Send the target and reason as DogStatsD tags instead of in the metric name")
+		otlpEndpoint    = flags.String("otlp_endpoint", "", "host:port of an OTLP/gRPC collector to export a trace of every check to; fixed at startup")
+		otlpInsecure    = flags.Bool("otlp_insecure", false, "Talk to -otlp_endpoint without TLS")
+		sampleRatio     = flags.Float64("trace_sample_ratio", 1, "Share of checks traced, between 0 and 1")
+		rateLimit       = flags.Float64("rate_limit", 0, "Maximum requests per second across all targets, 0 for no limit")
+		rateBurst       = flags.Int("rate_burst", 1, "Number of requests allowed in a burst above -rate_limit")
+		hostRateLimit   = flags.Float64("host_rate_limit", 0, "Maximum requests per second to any one host, 0 for no limit")
+		hostRateBurst   = flags.Int("host_rate_burst", 1, "Number of requests allowed in a burst above -host_rate_limit")
+		connectTimeout  = flags.Duration("connect_timeout", 10*time.Second, "Maximum time to establish a TCP connection")
+		tlsTimeout      = flags.Duration("tls_handshake_timeout", 10*time.Second, "Maximum time for the TLS handshake")
+		headerTimeout   = flags.Duration("response_header_timeout", 0, "Maximum time to wait for response headers after sending the request, 0 for none")
+		keepAlive       = flags.Duration("keep_alive", 30*time.Second, "Interval between TCP keep-alive probes, negative to disable")
+		idleConnTimeout = flags.Duration("idle_conn_timeout", 90*time.Second, "How long idle connections are kept for reuse")
+		maxIdleConns    = flags.Int("max_idle_conns", 100, "Maximum idle connections kept across all hosts, 0 for no limit")
+		maxIdlePerHost  = flags.Int("max_idle_conns_per_host", 4, "Maximum idle connections kept per host")
+		tlsInsecure     = flags.Bool("tls_insecure_skip_verify", false, "Accept any server certificate")
+		tlsMinVersion   = flags.String("tls_min_version", "1.2", "Minimum TLS version to negotiate")
+		shutdownTimeout = flags.Duration("shutdown_timeout", defaultShutdownTimeout, "Time allowed for in-flight checks to finish on shutdown")
+		chainName       = flags.String("chain", "mainnet", "Name of the chain -chain_rpc_url serves, used in /chains, metrics and -chain_dir; with -chains_file, the comma-separated chains of it to scrape, all of them if not set")
+		chainsFile      = flags.String("chains_file", "", "Path to a YAML file listing chains to scrape, each with its RPC URL and the options it sets of the -chain_ flags, which give the rest; fixed at startup")
+		rpcBatch        = flags.Int("chain_rpc_batch", 10, "Most JSON-RPC calls sent to a provider in one request, 1 not to batch them; halved for a provider that rejects a batch")
+		chainWS         = flags.String("chain_ws_url", "", "WebSocket URL of the node, such as ws://127.0.0.1:8546, to subscribe to newHeads at and scrape each block as it arrives instead of polling, which it falls back to while the subscription is down; env:NAME and @file read it from elsewhere")
+		rpcMaxLag       = flags.Uint64("chain_rpc_max_lag", 5, "Blocks an RPC provider may fall behind the furthest of -chain_rpc_url before the scraper fails over from it")
+		chainGenesis    = flags.String("chain_genesis", "", "Genesis file with an alloc, or CSV file of addresses and balances, of the accounts the genesis allocates to, added as appearances in block 0; empty for none")
+		chainBootstrap  = flags.String("chain_bootstrap", "", "URL of the manifest of a published index, http(s):// or ipfs://CID, to download the chunks and blooms of that follow on from -chain_dir's index before scraping, and resume after them; empty not to")
+		chainFirst      = flags.Uint64("chain_first_block", 0, "Block to start scraping at when -chain_dir has no progress saved")
+		chainDir        = flags.String("chain_dir", "", "Directory to keep the block scraper's progress and the Unchained Index of each chain in, empty to start over on every restart without an index")
+		chainPoll       = flags.Duration("chain_poll", 12*time.Second, "How often the node is asked for new blocks once the scraper has caught up, and how long it waits after a failure")
+		chainWorkers    = flags.Int("chain_concurrency", 4, "Blocks fetched at once while the scraper catches up")
+		chainTraces     = flags.Bool("chain_traces", true, "Find the addresses in the traces of each block, which takes a node with trace_block or debug_traceBlockByNumber")
+		chainReceipts   = flags.Bool("chain_receipts", true, "Find the addresses in the receipts and logs of each block")
+		appsPerChunk    = flags.Int("chain_apps_per_chunk", 2000000, "Appearances staged before they are written to an index chunk under -chain_dir, along with the rest of their last block's")
+		unripeDepth     = flags.Uint64("chain_unripe_depth", 28, "Blocks behind the head a block has to be for its appearances to be staged for an index chunk; until then they're kept apart as unripe")
+		bloomBits       = flags.Uint("chain_bloom_bits", 1<<20, "Width in bits of the blooms of each index chunk, a multiple of 8")
+		bloomHashes     = flags.Int("chain_bloom_hashes", 5, "Bits each address sets in a bloom, up to 5")
+		reorgDepth      = flags.Uint64("chain_reorg_depth", 64, "Blocks the scraper remembers the hashes of to roll back from a reorg; deeper reorgs stop it")
+		ipfsAPI         = flags.String("chain_ipfs_api", "", "RPC API URL of an IPFS node, such as http://127.0.0.1:5001, to add and pin each index chunk and its bloom with, empty not to")
+		pinataURL       = flags.String("chain_pinata_url", "https://api.pinata.cloud", "Pinata API URL")
+		pinataJWT       = flags.String("chain_pinata_jwt", "", "Pinata API JWT to pin each index chunk and its bloom with, empty not to; env:NAME and @file read it from elsewhere")
+		beaconAPI       = flags.String("chain_beacon_api", "", "Beacon node API URL, such as http://127.0.0.1:5052, to archive the blobs of each block from under -chain_dir, empty not to; env:NAME and @file read it from elsewhere")
+		pinRetry        = flags.Duration("chain_pin_retry", time.Minute, "How long a failed pin waits before it is tried again, doubling after each failure up to an hour")
+		ipfsGateway     = flags.String("chain_ipfs_gateway", "https://ipfs.io", "IPFS gateway URL -chain_bootstrap fetches ipfs:// manifests and the chunks with CIDs from, empty to fetch the chunks next to the manifest")
+	)
+
+	// Each of these sets the default of the per-target option of the same
+	// name and is parsed by target.set.
+	options := map[string]*string{
+		"status":                flags.String("status", "200", "Expected response status codes: comma-separated codes, ranges such as 301-302 and classes such as 2xx"),
+		"header":                flags.String("header", "", "Expected response header: \"Name: value\", \"Name ~ regex\", \"Name\" (present) or \"!Name\" (absent)"),
+		"method":                flags.String("method", "GET", "Request method"),
+		"request_body":          flags.String("request_body", "", "Request body, or @path to read it from a file"),
+		"request_content_type":  flags.String("request_content_type", "", "Content-Type of the request body"),
+		"tls_cert":              flags.String("tls_cert", "", "PEM client certificate presented to servers that ask for one; needs -tls_key"),
+		"tls_key":               flags.String("tls_key", "", "PEM private key for -tls_cert"),
+		"tls_ca":                flags.String("tls_ca", "", "PEM bundle of CA certificates servers are verified against instead of the system roots"),
+		"http_version":          flags.String("http_version", "auto", "HTTP version: auto to use HTTP/2 when a TLS server offers it, 1.1 never to, 2 to fail checks answered over HTTP/1"),
+		"http_keep_alive":       flags.String("http_keep_alive", "true", "Keep connections open for later requests; false asks servers to close them after each response"),
+		"fresh_connection":      flags.String("fresh_connection", "false", "Open new connections for every check instead of reusing ones from earlier checks"),
+		"follow_redirects":      flags.String("follow_redirects", "true", "Follow redirects; when false the redirect response itself is checked"),
+		"max_redirects":         flags.String("max_redirects", "10", "Maximum number of redirects followed before the check fails"),
+		"final_url":             flags.String("final_url", "", "URL every check must end up at after following redirects"),
+		"location":              flags.String("location", "", "Expected Location header, for use with -follow_redirects=false"),
+		"dns_type":              flags.String("dns_type", "A", "Record type looked up by dns:// targets"),
+		"dns_answer":            flags.String("dns_answer", "", "Answer dns:// targets must return; repeat in the fragment for a set"),
+		"dns_server":            flags.String("dns_server", "", "host:port of the DNS server dns:// targets query instead of the system resolver"),
+		"ping_count":            flags.String("ping_count", "3", "Echo requests sent per check by icmp:// targets"),
+		"ping_interval":         flags.String("ping_interval", "200ms", "Delay between echo requests of icmp:// targets"),
+		"ping_timeout":          flags.String("ping_timeout", "1s", "How long each echo request of icmp:// targets waits for its reply"),
+		"grpc_service":          flags.String("grpc_service", "", "Service name grpc:// targets ask the health service about, empty for the whole server"),
+		"grpc_status":           flags.String("grpc_status", "SERVING", "Serving status grpc:// targets must report"),
+		"ws_message":            flags.String("ws_message", "", "Message ws:// targets send after connecting, or @path to read it from a file"),
+		"ws_expect":             flags.String("ws_expect", "1", "Number of messages ws:// targets must receive within -ws_deadline"),
+		"ws_deadline":           flags.String("ws_deadline", "10s", "Time after connecting within which ws:// targets must receive their messages"),
+		"max_packet_loss":       flags.String("max_packet_loss", "0", "Share of echo requests icmp:// targets may lose, as a ratio or percentage"),
+		"cert_min_validity":     flags.String("cert_min_validity", "0", "Fail when the server certificate expires within this long, e.g. 14d"),
+		"cert_verify":           flags.String("cert_verify", "false", "Verify the server certificate chain even with -tls_insecure_skip_verify, reporting problems as failures"),
+		"cert_hostname":         flags.String("cert_hostname", "", "Host name the server certificate must cover"),
+		"basic_auth":            flags.String("basic_auth", "", "user:password sent as basic authentication"),
+		"bearer_token":          flags.String("bearer_token", "", "Token sent as bearer authentication"),
+		"api_key":               flags.String("api_key", "", "API key sent in the -api_key_header request header"),
+		"api_key_header":        flags.String("api_key_header", "X-API-Key", "Request header -api_key is sent in"),
+		"proxy":                 flags.String("proxy", "", "http://, https:// or socks5:// proxy for requests, direct for none; defaults to HTTP_PROXY and friends"),
+		"no_proxy":              flags.String("no_proxy", "", "Comma-separated hosts, domains and CIDRs reached without -proxy, like NO_PROXY"),
+		"request_header":        flags.String("request_header", "", "Header sent with every request, as \"Name: value\""),
+		"server":                flags.String("server", "", "Server HTTP header value"),
+		"content_type":          flags.String("content_type", "", "Content-Type HTTP header value"),
+		"user_agent":            flags.String("user_agent", "", "User-Agent sent with requests, instead of Go's default"),
+		"echo_header":           flags.String("echo_header", "", "Request header the response must carry back with the value sent, e.g. User-Agent"),
+		"jitter":                flags.String("jitter", "0", "Random spread applied to each interval, as a ratio or percentage of it"),
+		"schedule":              flags.String("schedule", "", "Cron expression to run checks on instead of -tick"),
+		"attempts":              flags.String("attempts", "3", "Maximum number of attempts per check"),
+		"retry_backoff":         flags.String("retry_backoff", "1s", "Delay before the first retry, doubled for each one after"),
+		"retry_max_backoff":     flags.String("retry_max_backoff", "30s", "Upper bound on the delay between retries"),
+		"timeout":               flags.String("timeout", "30s", "Maximum time for a single attempt including reading the body, 0 for none"),
+		"body_contains":         flags.String("body_contains", "", "Substring every response body must contain"),
+		"body_not_contains":     flags.String("body_not_contains", "", "Substring no response body may contain"),
+		"body_matches":          flags.String("body_matches", "", "Regular expression every response body must match"),
+		"body_not_matches":      flags.String("body_not_matches", "", "Regular expression no response body may match"),
+		"json":                  flags.String("json", "", "Assertion on a JSON response body, e.g. \"result.syncing == false\""),
+		"body_limit":            flags.String("body_limit", "1048576", "Maximum number of body bytes read for assertions"),
+		"max_latency":           flags.String("max_latency", "0s", "Fail checks whose final attempt takes longer than this, 0 for no limit"),
+		"sha256":                flags.String("sha256", "", "Expected hex SHA-256 of the whole response body, or stable to fail when it changes between checks"),
+		"min_size":              flags.String("min_size", "0", "Fail checks whose response body is shorter than this many bytes, 0 for no limit"),
+		"max_size":              flags.String("max_size", "0", "Fail checks whose response body is longer than this many bytes, 0 for no limit"),
+		"slo_latency":           flags.String("slo_latency", "0s", "Latency checks must stay under to count towards the SLO, 0 to disable SLO evaluation"),
+		"slo_objective":         flags.String("slo_objective", "99%", "Share of checks within the rolling window that must meet -slo_latency"),
+		"slo_window":            flags.String("slo_window", "24h", "Length of the rolling SLO window"),
+		"retry_status":          flags.String("retry_status", "408,429,500,502,503,504", "Response status codes worth retrying"),
+		"slack_channel":         flags.String("slack_channel", "", "Slack channel alerts are posted to; needed with -slack_token"),
+		"telegram_chat":         flags.String("telegram_chat", "", "Telegram chat ID or @channel alerts are sent to; needed with -telegram_token"),
+		"discord_webhook_url":   flags.String("discord_webhook_url", "", "Discord webhook URL alerts are posted to, empty for none; env:NAME and @file read it from elsewhere"),
+		"pagerduty_routing_key": flags.String("pagerduty_routing_key", "", "Integration key of the PagerDuty service incidents are raised in; env:NAME and @file read it from elsewhere"),
+		"alert_after":           flags.String("alert_after", "1", "Number of checks in a row that must fail before a target is alerted as down"),
+		"resolve_after":         flags.String("resolve_after", "1", "Number of checks in a row that must pass before a down target is alerted as up again"),
+		"alert_repeat":          flags.String("alert_repeat", "0", "How often to repeat alerts while a target stays down, 0 for never"),
+		"escalate_after":        flags.String("escalate_after", "0", "How long a target must be down before the -escalate_to notifiers are alerted too, 0 never to escalate"),
+		"escalate_to":           flags.String("escalate_to", "", "Comma-separated notifiers only alerted once -escalate_after has passed, e.g. pagerduty"),
+		"alert_exec":            flags.String("alert_exec", "", "Shell command run when a target goes down or comes back up, with the details in SCRAPER_ environment variables"),
+		"maintenance":           flags.String("maintenance", "", "Semicolon-separated windows without alerts, start/end in RFC 3339 or \"<cron> for <duration>\"; the fragment adds to them"),
+		"paused":                flags.String("paused", "false", "Don't check the target, e.g. while it is being worked on"),
+		"label":                 flags.String("label", "", "Comma-separated name=value labels for log entries, metrics and alerts; the fragment adds to them"),
+		"email_to":              flags.String("email_to", "", "Comma-separated addresses email alerts are sent to; needed with -smtp_addr"),
+	}
+
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	checking := args[0] == "check"
+	var archive string
+	switch {
+	case checking:
+		urls = flags.Args()
+		if len(urls) == 0 {
+			return errors.New("no URLs to check")
+		}
+		*targetsFile, *targetsURL = "", ""
+	case args[0] == "export" || args[0] == "import":
+		if flags.NArg() != 1 {
+			return errors.New("want the path of the archive")
+		}
+		if *storeURL == "" {
+			return fmt.Errorf("%s needs -store", args[0])
+		}
+		archive = flags.Arg(0)
+	case flags.NArg() > 0:
+		return fmt.Errorf("unexpected argument %q", flags.Arg(0))
+	}
+	var specs []targetSpec
+	if *targetsFile != "" {
+		var err error
+		if specs, err = loadTargetsFile(*targetsFile); err != nil {
+			return err
+		}
+	}
+	if *targetsURL != "" {
+		more, err := loadRemoteTargets(*targetsURL)
+		if err != nil {
+			return err
+		}
+		specs = append(specs, more...)
+	}
+	keys := make([]apiKey, len(adminKeys))
+	canAdd := *adminToken != ""
+	for i, entry := range adminKeys {
+		var err error
+		if keys[i], err = parseAdminKey(entry); err != nil {
+			return fmt.Errorf("-admin_key: %w", err)
+		}
+		canAdd = canAdd || keys[i].Scope == scopeAdmin
+	}
+	if len(urls) == 0 && len(specs) == 0 && archive == "" && !canAdd && len(chainRPCs) == 0 && *chainsFile == "" {
+		return errors.New("at least one -url, -targets_file or -targets_url entry is required, or -admin_token or an admin -admin_key to add targets through the API, or -chain_rpc_url or -chains_file to scrape blocks")
+	}
+	if *exportMaxSize < 0 {
+		return errors.New("-export_max_size must not be negative")
+	}
+	if *influxFlush <= 0 {
+		return errors.New("-influx_flush must be positive")
+	}
+	if *storeFlush <= 0 {
+		return errors.New("-store_flush must be positive")
+	}
+	if *storeMaxResults < 0 {
+		return errors.New("-store_max_results must not be negative")
+	}
+	if *storeDownsample && *storeMaxAge == "0" {
+		return errors.New("-store_downsample needs -store_max_age")
+	}
+	if *storePrune <= 0 {
+		return errors.New("-store_prune_every must be positive")
+	}
+	if *targetsRefresh < 0 {
+		return errors.New("-targets_refresh must not be negative")
+	}
+	if *tick <= 0 {
+		return errors.New("-tick must be positive")
+	}
+	if *workers < 1 {
+		return errors.New("-workers must be at least 1")
+	}
+	if *historySize < 1 {
+		return errors.New("-history_size must be at least 1")
+	}
+	if *alertResults < 0 {
+		return errors.New("-alert_results must not be negative")
+	}
+	if *uptimeReport < 0 {
+		return errors.New("-uptime_report_every must not be negative")
+	}
+	if *bloomBits > math.MaxUint32 {
+		return errors.New("-chain_bloom_bits must fit in 32 bits")
+	}
+	if *rateBurst < 1 || *hostRateBurst < 1 {
+		return errors.New("-rate_burst and -host_rate_burst must be at least 1")
+	}
+	minVersion, err := parseTLSVersion(*tlsMinVersion)
+	if err != nil {
+		return fmt.Errorf("-tls_min_version: %w", err)
+	}
+
+	level, err := parseLogLevel(*logLevel, *verbose, *quiet)
+	if err != nil {
+		return err
+	}
+	maxAge, err := parseDays(*logMaxAge)
+	if err != nil {
+		return fmt.Errorf("-log_max_age: %w", err)
+	}
+	exportAge, err := parseDays(*exportMaxAge)
+	if err != nil {
+		return fmt.Errorf("-export_max_age: %w", err)
+	}
+	adminSecret, err := secretValue(*adminToken)
+	if err != nil {
+		return fmt.Errorf("-admin_token: %w", err)
+	}
+	rpcURLs, err := secretURLs(chainRPCs)
+	if err != nil {
+		return fmt.Errorf("-chain_rpc_url: %w", err)
+	}
+	wsURL, err := secretValue(*chainWS)
+	if err != nil {
+		return fmt.Errorf("-chain_ws_url: %w", err)
+	}
+	beacon, err := secretValue(*beaconAPI)
+	if err != nil {
+		return fmt.Errorf("-chain_beacon_api: %w", err)
+	}
+	jwt, err := secretValue(*pinataJWT)
+	if err != nil {
+		return fmt.Errorf("-chain_pinata_jwt: %w", err)
+	}
+	// The -chain_ flags describe the chain to scrape, or give the chains
+	// of -chains_file the options they leave out.
+	chain := chainOptions{
+		name:         *chainName,
+		rpcURLs:      rpcURLs,
+		rpcMaxLag:    *rpcMaxLag,
+		rpcBatch:     *rpcBatch,
+		wsURL:        wsURL,
+		firstBlock:   *chainFirst,
+		dir:          *chainDir,
+		poll:         *chainPoll,
+		concurrency:  *chainWorkers,
+		traces:       *chainTraces,
+		receipts:     *chainReceipts,
+		appsPerChunk: *appsPerChunk,
+		unripeDepth:  *unripeDepth,
+		bloom:        bloomOptions{bits: uint32(*bloomBits), hashes: *bloomHashes},
+		reorgDepth:   *reorgDepth,
+		ipfs:         ipfsOptions{api: *ipfsAPI, pinataURL: *pinataURL, pinataJWT: jwt, retry: *pinRetry, gateway: *ipfsGateway},
+		beaconAPI:    beacon,
+		genesis:      *chainGenesis,
+		bootstrap:    *chainBootstrap,
+	}
+	var chains []chainOptions
+	if *chainsFile != "" {
+		if len(rpcURLs) > 0 {
+			return errors.New("-chain_rpc_url and -chains_file don't go together; give each chain its rpc_url in the file")
+		}
+		if wsURL != "" || beacon != "" || *chainGenesis != "" || *chainBootstrap != "" {
+			return errors.New("-chain_ws_url, -chain_beacon_api, -chain_genesis and -chain_bootstrap don't go together with -chains_file; give each chain its own in the file")
+		}
+		if chains, err = loadChainsFile(*chainsFile, chain); err != nil {
+			return err
+		}
+		selecting := false
+		flags.Visit(func(f *flag.Flag) { selecting = selecting || f.Name == "chain" })
+		if selecting {
+			if chains, err = selectChains(chains, *chainName); err != nil {
+				return fmt.Errorf("-chain: %w", err)
+			}
+		}
+	} else if len(rpcURLs) > 0 {
+		if err := chain.check(); err != nil {
+			return err
+		}
+		chains = append(chains, chain)
+	}
+	influxSecret, err := secretValue(*influxToken)
+	if err != nil {
+		return fmt.Errorf("-influx_token: %w", err)
+	}
+	storeAge, err := parseDays(*storeMaxAge)
+	if err != nil {
+		return fmt.Errorf("-store_max_age: %w", err)
+	}
+	hourlyAge, err := parseDays(*storeHourlyAge)
+	if err != nil {
+		return fmt.Errorf("-store_hourly_max_age: %w", err)
+	}
+	notifiers, err := newNotifiers(notifierOptions{
+		webhooks:       webhooks,
+		webhookSecret:  *webhookSecret,
+		webhookRetries: *webhookRetries,
+		slack: slackOptions{
+			webhook: *slackWebhook,
+			token:   *slackToken,
+		},
+		smtp: smtpOptions{
+			addr:     *smtpAddr,
+			username: *smtpUsername,
+			password: *smtpPassword,
+			from:     *smtpFrom,
+			security: *smtpSecurity,
+			digest:   *emailDigest,
+		},
+		telegramToken: *telegramToken,
+		execTimeout:   *execTimeout,
+	})
+	if err != nil {
+		return err
+	}
+
+	next := config{
+		client: newClient(clientOptions{
+			connectTimeout:        *connectTimeout,
+			keepAlive:             *keepAlive,
+			tlsHandshakeTimeout:   *tlsTimeout,
+			responseHeaderTimeout: *headerTimeout,
+			idleConnTimeout:       *idleConnTimeout,
+			maxIdleConns:          *maxIdleConns,
+			maxIdleConnsPerHost:   *maxIdlePerHost,
+			insecureSkipVerify:    *tlsInsecure,
+			tlsMinVersion:         minVersion,
+		}),
+		adminAddr:     *adminAddr,
+		adminKeys:     keys,
+		adminKeysFile: *adminKeysFile,
+		adminToken:    adminSecret,
+		configFile:    *configFile,
+		controlSocket: *controlSocket,
+		alertResults:  *alertResults,
+		archive:       archive,
+		chains:        chains,
+		checkConfig:   *checkConfig,
+		defaults: target{
+			notifiers: notifiers,
+			tick:      *tick,
+		},
+		exitCode: *exitCode,
+		export: exportOptions{
+			path: *exportFile,
+			rotation: logRotation{
+				maxSize:    *exportMaxSize,
+				every:      *exportRotate,
+				maxAge:     exportAge,
+				maxBackups: *exportBackups,
+				compress:   *exportCompress,
+			},
+		},
+		grpcAddr:    *grpcAddr,
+		historySize: *historySize,
+		influx: influxOptions{
+			url:   *influxURL,
+			token: influxSecret,
+			flush: *influxFlush,
+		},
+		limiter:   c.limiter.reuse(*rateLimit, *rateBurst, *hostRateLimit, *hostRateBurst),
+		logFile:   *logFile,
+		logFormat: *logFormat,
+		logLevel:  level,
+		logRotation: logRotation{
+			maxSize:    *logMaxSize,
+			every:      *logRotateEvery,
+			maxAge:     maxAge,
+			maxBackups: *logMaxBackups,
+			compress:   *logCompress,
+		},
+		managedTargetsFile: *managedTargets,
+		metrics: metricsOptions{
+			backend: *metricsBackend,
+			statsd: statsdOptions{
+				addr:      *statsdAddr,
+				prefix:    *statsdPrefix,
+				dogstatsd: *dogstatsd,
+			},
+		},
+		once:            *once,
+		pprof:           *pprof,
+		shutdownTimeout: *shutdownTimeout,
+		stallTimeout:    *stallTimeout,
+		stateFile:       *stateFile,
+		store: storeOptions{
+			url:     *storeURL,
+			flush:   *storeFlush,
+			journal: *storeJournal,
+			retention: retention{
+				maxAge:       storeAge,
+				maxResults:   *storeMaxResults,
+				every:        *storePrune,
+				downsample:   *storeDownsample,
+				hourlyMaxAge: hourlyAge,
+			},
+		},
+		targetsFile:    *targetsFile,
+		targetsRefresh: *targetsRefresh,
+		targetsURL:     *targetsURL,
+		tracing: tracingOptions{
+			endpoint:    *otlpEndpoint,
+			insecure:    *otlpInsecure,
+			sampleRatio: *sampleRatio,
+		},
+		uptimeReport: *uptimeReport,
+		watchConfig:  *watch,
+		workers:      *workers,
+	}
+	next.defaults.client = next.client
+	next.defaults.limiter = next.limiter
+	if err := setOptions(&next.defaults, options); err != nil {
+		return err
+	}
+	for _, u := range urls {
+		t, err := newTarget(u, next.defaults)
+		if err != nil {
+			return err
+		}
+		next.targets = append(next.targets, t)
+	}
+	for _, spec := range specs {
+		t, err := spec.newTarget(next.defaults)
+		if err != nil {
+			return err
+		}
+		next.targets = append(next.targets, t)
+	}
+	*c = next
+
+	return nil
+}
+
+// setOptions applies option flags to t in name order, so that errors are
+// reported deterministically.
+func setOptions(t *target, options map[string]*string) error {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := t.set(name, *options[name]); err != nil {
+			return fmt.Errorf("-%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// urlList collects URLs from repeated flags and comma-separated values.
+type urlList []string
+
+func (l *urlList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *urlList) Set(value string) error {
+	*l = append(*l, splitURLs(value)...)
+	return nil
+}
+
+// splitURLs splits a comma-separated list of URLs. A comma only separates
+// entries when what follows it starts a new URL (has a scheme), so commas
+// inside a URL's path or query survive.
+func splitURLs(value string) []string {
+	var urls []string
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if len(urls) > 0 && !strings.Contains(part, "://") {
+			urls[len(urls)-1] += "," + part
+			continue
+		}
+		urls = append(urls, part)
+	}
+	return urls
+}
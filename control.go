@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/namsral/flag"
+)
+
+// serveControl serves the API ctl talks to on a Unix socket at path until
+// ctx is done. The socket is only accessible to its owner, which is all the
+// authentication there is. reloads takes the channel a reload's outcome is
+// to be sent on.
+func serveControl(ctx context.Context, path string, s *scheduler, reloads chan<- chan error) error {
+	// A socket left behind by a scraper that didn't shut down is in the
+	// way; one still answering belongs to another scraper.
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s: another scraper is listening on it", path)
+	}
+	os.Remove(path)
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		ln.Close()
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /status", serveStatus(s.history, s.pauses))
+	mux.HandleFunc("POST /pause", func(w http.ResponseWriter, req *http.Request) {
+		end, err := pauseEnd(req.URL.Query().Get("duration"), time.Time{})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		urls, ok := pauseURLs(w, req, s)
+		if !ok {
+			return
+		}
+		for _, u := range urls {
+			s.pauseTargets(u, end, "control socket")
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /resume", func(w http.ResponseWriter, req *http.Request) {
+		urls, ok := pauseURLs(w, req, s)
+		if !ok {
+			return
+		}
+		for _, u := range urls {
+			s.resumeTargets(u, "control socket")
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /run", func(w http.ResponseWriter, req *http.Request) {
+		targets, ok := requestTargets(w, req, s)
+		if !ok {
+			return
+		}
+		out := make([]storedResultJSON, len(targets))
+		for i, t := range targets {
+			r, err := s.runNow(req.Context(), t)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			sr := newStoredResult(r)
+			out[i] = storedResultJSON{sr.Target, sr.record()}
+		}
+		writeJSON(w, http.StatusOK, out)
+	})
+	mux.HandleFunc("POST /reload", func(w http.ResponseWriter, req *http.Request) {
+		done := make(chan error, 1)
+		select {
+		case reloads <- done:
+		case <-req.Context().Done():
+			return
+		}
+		if err := <-done; err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Control server failed", "error", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		srv.Shutdown(shutdown)
+	}()
+	return nil
+}
+
+// pauseURLs returns the URLs of the targets to pause or resume: those named
+// by req's target query parameters, or the empty URL, for every target,
+// with all.
+func pauseURLs(w http.ResponseWriter, req *http.Request, s *scheduler) ([]string, bool) {
+	if req.URL.Query().Has("all") {
+		return []string{""}, true
+	}
+	targets, ok := requestTargets(w, req, s)
+	urls := make([]string, len(targets))
+	for i, t := range targets {
+		urls[i] = t.url
+	}
+	return urls, ok
+}
+
+// requestTargets returns the targets named by req's target query
+// parameters, or answers it and returns false if one isn't configured.
+func requestTargets(w http.ResponseWriter, req *http.Request, s *scheduler) ([]*target, bool) {
+	urls := req.URL.Query()["target"]
+	if len(urls) == 0 {
+		http.Error(w, "no targets given", http.StatusBadRequest)
+		return nil, false
+	}
+	targets := make([]*target, len(urls))
+	for i, u := range urls {
+		if targets[i] = s.target(u); targets[i] == nil {
+			http.Error(w, "no target "+u, http.StatusNotFound)
+			return nil, false
+		}
+	}
+	return targets, true
+}
+
+// ctlActions are what ctl can ask the scraper to do, and whether they take
+// targets.
+var ctlActions = map[string]bool{
+	"status":  false,
+	"pause":   true,
+	"resume":  true,
+	"run-now": true,
+	"reload":  false,
+}
+
+func ctlCommand(ctx context.Context, args []string, out io.Writer) (int, error) {
+	flags := flag.NewFlagSetWithEnvPrefix(args[0], envPrefix, flag.ContinueOnError)
+	commandUsage(flags, args[0])
+	socket := flags.String("control_socket", "", "Unix socket the scraper serves its control API on, as given to it with -control_socket")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2, err
+	}
+	if flags.NArg() == 0 {
+		return 2, errors.New("want an action: status, pause, resume, run-now or reload")
+	}
+	action, urls := flags.Arg(0), flags.Args()[1:]
+	takesTargets, ok := ctlActions[action]
+	var pauseFor string
+	var all bool
+	if action == "pause" || action == "resume" {
+		sub := flag.NewFlagSet(action, flag.ContinueOnError)
+		sub.BoolVar(&all, "all", false, "Pause or resume every target")
+		if action == "pause" {
+			sub.StringVar(&pauseFor, "for", "", "How long to pause for, e.g. 2h; until resumed if not given")
+		}
+		if err := sub.Parse(urls); err != nil {
+			return 2, err
+		}
+		urls = sub.Args()
+	}
+	switch {
+	case !ok:
+		return 2, fmt.Errorf("unknown action %q", action)
+	case all && len(urls) > 0:
+		return 2, errors.New("give either -all or URLs")
+	case takesTargets && len(urls) == 0 && !all:
+		return 2, fmt.Errorf("%s wants the URLs of the targets", action)
+	case !takesTargets && len(urls) > 0:
+		return 2, fmt.Errorf("unexpected argument %q", urls[0])
+	case *socket == "":
+		return 2, errors.New("-control_socket is required")
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", *socket)
+		},
+	}}
+	params := url.Values{"target": urls}
+	if all {
+		params.Set("all", "true")
+	}
+	if pauseFor != "" {
+		params.Set("duration", pauseFor)
+	}
+	query := params.Encode()
+	switch action {
+	case "status":
+		var st []targetStatus
+		if err := ctlCall(ctx, client, http.MethodGet, "/status", &st); err != nil {
+			return 1, err
+		}
+		printStatus(out, st)
+	case "pause", "resume":
+		if err := ctlCall(ctx, client, http.MethodPost, "/"+action+"?"+query, nil); err != nil {
+			return 1, err
+		}
+		past := map[string]string{"pause": "Paused", "resume": "Resumed"}[action]
+		if all {
+			urls = []string{"every target"}
+		}
+		for _, u := range urls {
+			if pauseFor != "" {
+				fmt.Fprintf(out, "%s %s for %s\n", past, u, pauseFor)
+			} else {
+				fmt.Fprintf(out, "%s %s\n", past, u)
+			}
+		}
+	case "run-now":
+		var results []storedResultJSON
+		if err := ctlCall(ctx, client, http.MethodPost, "/run?"+query, &results); err != nil {
+			return 1, err
+		}
+		ok := true
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "STATE\tTARGET\tSTATUS\tDURATION\tERROR")
+		for _, r := range results {
+			state := "up"
+			if !r.OK {
+				state, ok = "down", false
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", state, r.Target, statusText(r.Status), r.Duration, r.Error)
+		}
+		w.Flush()
+		if !ok {
+			return 1, nil
+		}
+	case "reload":
+		if err := ctlCall(ctx, client, http.MethodPost, "/reload", nil); err != nil {
+			return 1, fmt.Errorf("reload failed: %w", err)
+		}
+		fmt.Fprintln(out, "Reloaded")
+	}
+	return 0, nil
+}
+
+// ctlCall calls the control API and decodes its answer into v, if not nil.
+func ctlCall(ctx context.Context, client *http.Client, method, path string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, method, "http://scraper"+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return errors.New(strings.TrimSpace(string(b)))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// printStatus writes a line for each target of st to out.
+func printStatus(out io.Writer, st []targetStatus) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STATE\tTARGET\tFAILURES\tLAST CHECK\tSTATUS\tERROR")
+	for _, s := range st {
+		state, last, status, msg := s.State, "-", "-", ""
+		if s.Paused {
+			state += " (paused)"
+		}
+		if s.LastCheck != nil {
+			last = time.Since(s.LastCheck.Start).Round(time.Second).String() + " ago"
+			status, msg = statusText(s.LastCheck.Status), s.LastCheck.Error
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n", state, s.Target, s.ConsecutiveFailures, last, status, msg)
+	}
+	w.Flush()
+}
+
+// statusText is how a status code is shown in tables: "-" for none.
+func statusText(status int) string {
+	if status == 0 {
+		return "-"
+	}
+	return fmt.Sprint(status)
+}
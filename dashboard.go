@@ -0,0 +1,24 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// dashboardFiles are the dashboard's static files. The dashboard fetches
+// /status itself, so it needs nothing from the server but these.
+//
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// serveDashboard serves the dashboard under /dashboard/ on mux, and
+// redirects / to it.
+func serveDashboard(mux *http.ServeMux) {
+	files, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		panic(err)
+	}
+	mux.Handle("GET /dashboard/", http.StripPrefix("/dashboard/", http.FileServerFS(files)))
+	mux.Handle("GET /{$}", http.RedirectHandler("/dashboard/", http.StatusFound))
+}
@@ -0,0 +1,112 @@
+// The dashboard polls /status and redraws the table. It has no
+// dependencies, so that it works offline and from the binary alone.
+"use strict";
+
+const refreshEvery = 10000;
+const recentResults = 50;
+
+// key is the API key to read /status with, given as #key=... so that it
+// isn't sent to the server in the dashboard's own URL.
+const key = new URLSearchParams(location.hash.slice(1)).get("key");
+
+// units converts Go duration units to milliseconds.
+const units = { ns: 1e-6, "µs": 1e-3, "us": 1e-3, ms: 1, s: 1e3, m: 6e4, h: 3.6e6 };
+
+// durationMs parses a Go duration string such as "1m2.5s" into milliseconds.
+function durationMs(s) {
+  let ms = 0;
+  for (const [, n, unit] of (s || "").matchAll(/([\d.]+)(ns|µs|us|ms|s|m|h)/g)) {
+    ms += parseFloat(n) * units[unit];
+  }
+  return ms;
+}
+
+function element(tag, attrs, ...children) {
+  const el = document.createElement(tag);
+  for (const [k, v] of Object.entries(attrs || {})) {
+    el.setAttribute(k, v);
+  }
+  el.append(...children);
+  return el;
+}
+
+function availability(a, window) {
+  const v = a && a[window];
+  return v === undefined ? "–" : v.toFixed(v === 100 ? 0 : 2) + "%";
+}
+
+// sparkline draws the results oldest first, as bars as tall as their
+// latency, failures in red at full height.
+function sparkline(results) {
+  const ns = "http://www.w3.org/2000/svg";
+  const width = 150, height = 24, bar = width / recentResults;
+  const svg = document.createElementNS(ns, "svg");
+  svg.setAttribute("class", "spark");
+  svg.setAttribute("width", width);
+  svg.setAttribute("height", height);
+  const rs = (results || []).slice().reverse();
+  const max = Math.max(1, ...rs.map(r => durationMs(r.latency || r.duration)));
+  rs.forEach((r, i) => {
+    const h = r.ok ? Math.max(2, height * durationMs(r.latency || r.duration) / max) : height;
+    const rect = document.createElementNS(ns, "rect");
+    rect.setAttribute("x", i * bar);
+    rect.setAttribute("y", height - h);
+    rect.setAttribute("width", Math.max(1, bar - 1));
+    rect.setAttribute("height", h);
+    rect.setAttribute("class", r.ok ? "ok" : "failed");
+    const title = document.createElementNS(ns, "title");
+    title.textContent = new Date(r.start).toLocaleString() + ": " +
+      (r.ok ? "ok" : r.reason || "failed") + ", " + (r.latency || r.duration);
+    rect.append(title);
+    svg.append(rect);
+  });
+  return svg;
+}
+
+function row(t) {
+  const labels = Object.entries(t.labels || {}).map(([k, v]) => k + "=" + v).join(" ");
+  const state = t.paused ? "paused" : t.state;
+  const failure = element("td", { class: "failure" });
+  if (t.last_failure) {
+    failure.append(
+      element("span", { class: "reason" }, t.last_failure.reason || "failed"), " ",
+      t.last_failure.error || "", " ",
+      element("time", { datetime: t.last_failure.start, title: t.last_failure.start },
+        new Date(t.last_failure.start).toLocaleString()));
+  }
+  return element("tr", {},
+    element("td", { class: "url" }, t.target, element("span", { class: "labels" }, labels)),
+    element("td", {}, element("span", { class: "state " + state }, state)),
+    element("td", {}, availability(t.availability, "24h")),
+    element("td", {}, availability(t.availability, "7d")),
+    element("td", {}, availability(t.availability, "30d")),
+    element("td", {}, sparkline(t.results)),
+    failure);
+}
+
+async function refresh() {
+  const error = document.getElementById("error");
+  try {
+    const resp = await fetch("../status?results=" + recentResults, {
+      headers: key ? { Authorization: "Bearer " + key } : {},
+    });
+    if (!resp.ok) {
+      throw new Error(resp.status + " " + resp.statusText);
+    }
+    const targets = await resp.json();
+    // Down targets first, then by URL.
+    targets.sort((a, b) => (a.state !== "down") - (b.state !== "down") || a.target.localeCompare(b.target));
+    document.getElementById("targets").replaceChildren(...targets.map(row));
+    const down = targets.filter(t => t.state === "down").length;
+    document.getElementById("summary").textContent =
+      targets.length + " targets, " + (down ? down + " down" : "all up");
+    document.getElementById("updated").textContent = "Updated " + new Date().toLocaleTimeString();
+    error.hidden = true;
+  } catch (e) {
+    error.textContent = "Fetching the status failed: " + e.message;
+    error.hidden = false;
+  }
+}
+
+refresh();
+setInterval(refresh, refreshEvery);
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// sensitiveHeaders are logged as "redacted" rather than verbatim.
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// traceRequest logs req at debug level and returns it with a trace of its
+// connection attached. The returned function logs the outcome along with
+// how long DNS, connecting, the TLS handshake and the first byte took.
+// When debug logging is off req is returned as it is.
+func traceRequest(t *target, req *http.Request) (*http.Request, func(*http.Response, error)) {
+	ctx := req.Context()
+	if !slog.Default().Enabled(ctx, slog.LevelDebug) {
+		return req, func(*http.Response, error) {}
+	}
+	slog.DebugContext(ctx, "Request", "target", t.url, t.logLabels(), "method", req.Method, "url", req.URL.String(),
+		"header", t.redact(req.Header))
+
+	var (
+		mu                            sync.Mutex
+		start                         = time.Now()
+		dnsStart, connStart, tlsStart time.Time
+		dns, connect, handshake, ttfb time.Duration
+		reused                        bool
+	)
+	since := func(from time.Time) time.Duration {
+		if from.IsZero() {
+			return 0
+		}
+		return time.Since(from)
+	}
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { mu.Lock(); dnsStart = time.Now(); mu.Unlock() },
+		DNSDone:  func(httptrace.DNSDoneInfo) { mu.Lock(); dns = since(dnsStart); mu.Unlock() },
+		ConnectStart: func(string, string) {
+			mu.Lock()
+			connStart = time.Now()
+			mu.Unlock()
+		},
+		ConnectDone: func(string, string, error) { mu.Lock(); connect = since(connStart); mu.Unlock() },
+		TLSHandshakeStart: func() {
+			mu.Lock()
+			tlsStart = time.Now()
+			mu.Unlock()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			mu.Lock()
+			handshake = since(tlsStart)
+			mu.Unlock()
+		},
+		GotConn:              func(info httptrace.GotConnInfo) { mu.Lock(); reused = info.Reused; mu.Unlock() },
+		GotFirstResponseByte: func() { mu.Lock(); ttfb = since(start); mu.Unlock() },
+	}
+	req = req.WithContext(httptrace.WithClientTrace(ctx, trace))
+
+	return req, func(resp *http.Response, err error) {
+		mu.Lock()
+		timing := slog.Group("timing", "dns", dns, "connect", connect, "tls", handshake,
+			"first_byte", ttfb, "reused", reused)
+		mu.Unlock()
+		if err != nil {
+			slog.DebugContext(ctx, "Request failed", "target", t.url, t.logLabels(), "error", err, timing)
+			return
+		}
+		slog.DebugContext(ctx, "Response", "target", t.url, t.logLabels(), "status", resp.StatusCode, "proto", resp.Proto,
+			"header", t.redact(resp.Header), timing)
+	}
+}
+
+// redact returns a copy of h with credentials blanked out, for logging.
+func (t *target) redact(h http.Header) http.Header {
+	h = h.Clone()
+	for _, name := range append(sensitiveHeaders, t.apiKeyHeader) {
+		if _, ok := h[http.CanonicalHeaderKey(name)]; ok {
+			h.Set(name, "redacted")
+		}
+	}
+	return h
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// dnsOptions configures dns:// targets, whose host is the name looked up.
+type dnsOptions struct {
+	recordType string
+	// answers, when set, is the exact set of records expected.
+	answers []string
+	// server is the host:port queried instead of the system resolver.
+	server string
+}
+
+// dnsLookups maps the supported record types to a lookup returning their
+// answers.
+var dnsLookups = map[string]func(ctx context.Context, r *net.Resolver, name string) ([]string, error){
+	"A": func(ctx context.Context, r *net.Resolver, name string) ([]string, error) {
+		return lookupIP(ctx, r, "ip4", name)
+	},
+	"AAAA": func(ctx context.Context, r *net.Resolver, name string) ([]string, error) {
+		return lookupIP(ctx, r, "ip6", name)
+	},
+	"CNAME": lookupCNAME,
+	"MX":    lookupMX,
+	"NS":    lookupNS,
+	"TXT": func(ctx context.Context, r *net.Resolver, name string) ([]string, error) {
+		return r.LookupTXT(ctx, name)
+	},
+}
+
+func lookupIP(ctx context.Context, r *net.Resolver, network, name string) ([]string, error) {
+	ips, err := r.LookupIP(ctx, network, name)
+	if err != nil {
+		return nil, err
+	}
+	answers := make([]string, len(ips))
+	for i, ip := range ips {
+		answers[i] = ip.String()
+	}
+	return answers, nil
+}
+
+func lookupCNAME(ctx context.Context, r *net.Resolver, name string) ([]string, error) {
+	cname, err := r.LookupCNAME(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return []string{cname}, nil
+}
+
+func lookupMX(ctx context.Context, r *net.Resolver, name string) ([]string, error) {
+	mxs, err := r.LookupMX(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	answers := make([]string, len(mxs))
+	for i, mx := range mxs {
+		answers[i] = mx.Host
+	}
+	return answers, nil
+}
+
+func lookupNS(ctx context.Context, r *net.Resolver, name string) ([]string, error) {
+	nss, err := r.LookupNS(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	answers := make([]string, len(nss))
+	for i, ns := range nss {
+		answers[i] = ns.Host
+	}
+	return answers, nil
+}
+
+// normalizeAnswer makes host names comparable regardless of case and
+// trailing dot.
+func normalizeAnswer(s string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), ".")
+}
+
+func (o dnsOptions) resolver() *net.Resolver {
+	if o.server == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, o.server)
+		},
+	}
+}
+
+func probeDNS(ctx context.Context, t *target, r *result) {
+	name := t.hostname()
+	if t.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.timeout)
+		defer cancel()
+	}
+	if err := t.limiter.wait(ctx, name); err != nil {
+		r.err = err
+		return
+	}
+
+	start := time.Now()
+	answers, err := dnsLookups[t.dns.recordType](ctx, t.dns.resolver(), name)
+	r.latency = time.Since(start)
+	if err != nil {
+		r.err = err
+		slog.Warn("Lookup failed", "target", t.url, t.logLabels(), "error", err)
+		return
+	}
+
+	checkLatency(t, r)
+
+	if t.dns.answers == nil {
+		return
+	}
+	got := make([]string, len(answers))
+	for i, a := range answers {
+		got[i] = normalizeAnswer(a)
+	}
+	want := append([]string(nil), t.dns.answers...)
+	sort.Strings(got)
+	sort.Strings(want)
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		r.fail("dns_answer", "DNS %s answers mismatch, got: %s, want: %s", t.dns.recordType, strings.Join(got, " "), strings.Join(want, " "))
+	}
+}
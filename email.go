@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// smtpOptions configure sending alerts by email.
+type smtpOptions struct {
+	addr     string
+	username string
+	// password is resolved with secretValue.
+	password string
+	from     string
+	// security is starttls, tls for implicit TLS as on port 465, or none.
+	security string
+	// digest, when positive, is how long alerts are collected for before
+	// being sent together.
+	digest time.Duration
+}
+
+// emailNotifier mails alerts to each target's recipients. Alerts for the same
+// recipients that come within the digest interval of the first are sent as a
+// single message.
+type emailNotifier struct {
+	o       smtpOptions
+	host    string
+	auth    smtp.Auth
+	retries int
+
+	mu      sync.Mutex
+	batches map[string]*emailBatch
+}
+
+// emailBatch collects the alerts for one set of recipients. sent is closed,
+// with err set, once they have been mailed.
+type emailBatch struct {
+	to     []string
+	events []*alertEvent
+	sent   chan struct{}
+	err    error
+}
+
+// newEmailNotifier returns nil when email isn't configured.
+func newEmailNotifier(o smtpOptions, retries int) (*emailNotifier, error) {
+	if o.addr == "" {
+		return nil, nil
+	}
+	host, _, err := net.SplitHostPort(o.addr)
+	if err != nil {
+		return nil, fmt.Errorf("-smtp_addr: %w", err)
+	}
+	switch o.security {
+	case "starttls", "tls", "none":
+	default:
+		return nil, errors.New("-smtp_security: want starttls, tls or none")
+	}
+	if _, err := mail.ParseAddress(o.from); err != nil {
+		return nil, fmt.Errorf("-smtp_from: %w", err)
+	}
+	if o.digest < 0 {
+		return nil, errors.New("-email_digest must not be negative")
+	}
+	password, err := secretValue(o.password)
+	if err != nil {
+		return nil, fmt.Errorf("-smtp_password: %w", err)
+	}
+
+	n := &emailNotifier{o: o, host: host, retries: retries, batches: make(map[string]*emailBatch)}
+	if o.username != "" {
+		n.auth = smtp.PlainAuth("", o.username, password, host)
+	}
+	return n, nil
+}
+
+// parseRecipients parses a comma-separated list of email addresses.
+func parseRecipients(value string) ([]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+	list, err := mail.ParseAddressList(value)
+	if err != nil {
+		return nil, err
+	}
+	to := make([]string, len(list))
+	for i, a := range list {
+		to[i] = a.Address
+	}
+	return to, nil
+}
+
+func (n *emailNotifier) name() string {
+	return "email"
+}
+
+func (n *emailNotifier) checkTarget(t *target) error {
+	if len(t.emailTo) == 0 {
+		return errors.New("-smtp_addr needs an email_to")
+	}
+	return nil
+}
+
+// notify adds e to the batch for its target's recipients and returns once
+// the batch has been sent. The first alert of a batch waits out the digest
+// interval, or until ctx is done, and then sends it.
+func (n *emailNotifier) notify(ctx context.Context, e *alertEvent) error {
+	to := append([]string(nil), e.target.emailTo...)
+	sort.Strings(to)
+	key := strings.Join(to, ",")
+
+	n.mu.Lock()
+	b, joined := n.batches[key]
+	if !joined {
+		b = &emailBatch{to: to, sent: make(chan struct{})}
+		n.batches[key] = b
+	}
+	b.events = append(b.events, e)
+	n.mu.Unlock()
+
+	if joined {
+		<-b.sent
+		return b.err
+	}
+
+	if n.o.digest > 0 {
+		timer := time.NewTimer(n.o.digest)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+	}
+	n.mu.Lock()
+	delete(n.batches, key)
+	n.mu.Unlock()
+
+	b.err = n.sendWithRetries(ctx, b.to, b.events)
+	close(b.sent)
+	return b.err
+}
+
+func (n *emailNotifier) sendWithRetries(ctx context.Context, to []string, events []*alertEvent) error {
+	msg := emailMessage(n.o.from, to, events)
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		err := n.send(to, msg)
+		if err == nil || attempt >= n.retries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// send delivers msg over a new SMTP connection.
+func (n *emailNotifier) send(to []string, msg []byte) error {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	tlsConfig := &tls.Config{ServerName: n.host}
+
+	var conn net.Conn
+	var err error
+	if n.o.security == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", n.o.addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", n.o.addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(time.Minute))
+
+	c, err := smtp.NewClient(conn, n.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if n.o.security == "starttls" {
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if n.auth != nil {
+		if err := c.Auth(n.auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(n.o.from); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// emailMessage formats events as a plain text message, oldest first.
+func emailMessage(from string, to []string, events []*alertEvent) []byte {
+	var subject string
+	if len(events) == 1 {
+		subject = fmt.Sprintf("%s is %s", events[0].Target, events[0].State)
+		if events[0].Repeat > 0 || events[0].Escalated {
+			subject = events[0].Target + " is still down"
+		}
+	} else {
+		down := 0
+		for _, e := range events {
+			if e.State == "down" {
+				down++
+			}
+		}
+		subject = fmt.Sprintf("%d alerts: %d down, %d up", len(events), down, len(events)-down)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", "[scraper] "+subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+
+	for i, e := range events {
+		if i > 0 {
+			b.WriteString("\r\n")
+		}
+		fmt.Fprintf(&b, "%s is %s as of %s\r\n", e.Target, e.State, e.At.Format(time.RFC3339))
+		if e.Since != nil {
+			previous := "up"
+			if e.State == "up" {
+				previous = "down"
+			}
+			fmt.Fprintf(&b, "It had been %s since %s.\r\n", previous, e.Since.Format(time.RFC3339))
+		}
+		if e.Error != "" {
+			fmt.Fprintf(&b, "Failure (%s): %s\r\n", e.Reason, e.Error)
+		}
+		if o := e.Outage; o != nil {
+			fmt.Fprintf(&b, "The outage lasted %s from %s, with %d failed checks: %s.\r\n",
+				o.Duration, o.Start.Format(time.RFC3339), o.Failures, strings.Join(o.Reasons, ", "))
+		}
+		if len(e.Results) > 0 {
+			b.WriteString("Recent results, newest first:\r\n")
+			for _, r := range e.Results {
+				fmt.Fprintf(&b, "  %s  %s  %s\r\n", r.Start.Format(time.RFC3339), emailOutcome(r), r.Latency)
+			}
+		}
+	}
+	return []byte(b.String())
+}
+
+func emailOutcome(r record) string {
+	if r.OK {
+		return "ok"
+	}
+	return "failed: " + r.Error
+}
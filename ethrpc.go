@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// rpcClient calls the JSON-RPC API of an Ethereum node over HTTP, through
+// one of the providers of a chain. It sticks to one for as long as it
+// serves, and fails over to the healthiest of the others when it fails, is
+// rate limited or falls behind; see rpcpool.go.
+type rpcClient struct {
+	chain     string
+	client    *http.Client
+	metrics   metrics
+	ids       atomic.Uint64
+	endpoints []*rpcEndpoint
+	// maxLag is how many blocks a provider may be behind the others.
+	maxLag uint64
+
+	mu      sync.Mutex
+	current int
+}
+
+func newRPCClient(o chainOptions, client *http.Client, m metrics) *rpcClient {
+	c := &rpcClient{chain: o.name, client: client, metrics: m, maxLag: o.rpcMaxLag}
+	for _, url := range o.rpcURLs {
+		c.endpoints = append(c.endpoints, &rpcEndpoint{url: url, score: 1, batch: o.rpcBatch})
+	}
+	return c
+}
+
+type rpcRequest struct {
+	JSONRPC string `json:"jsonrpc"`
+	ID      uint64 `json:"id"`
+	Method  string `json:"method"`
+	Params  []any  `json:"params"`
+}
+
+type rpcResponse struct {
+	ID     uint64          `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *rpcError       `json:"error"`
+}
+
+// rpcError is an error the node answered a call with.
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return fmt.Sprintf("%s (code %d)", e.Message, e.Code)
+}
+
+// call calls method with params and decodes the result into result. A null
+// result leaves it alone.
+func (c *rpcClient) call(ctx context.Context, method string, result any, params ...any) error {
+	_, err := c.do(ctx, method, result, params...)
+	return err
+}
+
+// do calls method like call, failing over to the other providers while the
+// one called is at fault, and returns the one that answered.
+func (c *rpcClient) do(ctx context.Context, method string, result any, params ...any) (*rpcEndpoint, error) {
+	if params == nil {
+		params = []any{}
+	}
+	body, err := json.Marshal(rpcRequest{JSONRPC: "2.0", ID: c.ids.Add(1), Method: method, Params: params})
+	if err != nil {
+		return nil, err
+	}
+	e := c.pick()
+	for tried := 1; ; tried++ {
+		err = c.post(ctx, e, method, body, result)
+		if ctx.Err() != nil || !providerFault(err) {
+			c.served(e)
+			return e, err
+		}
+		next := c.failed(e, err)
+		if next == e || tried >= len(c.endpoints) {
+			return e, err
+		}
+		e = next
+	}
+}
+
+// endpointError is a call that failed for want of an answer from the
+// provider: it couldn't be reached, answered with an HTTP error or with
+// something other than JSON-RPC.
+type endpointError struct {
+	err error
+}
+
+func (e *endpointError) Error() string { return e.err.Error() }
+func (e *endpointError) Unwrap() error { return e.err }
+
+// post calls method of the provider e with body.
+func (c *rpcClient) post(ctx context.Context, e *rpcEndpoint, method string, body []byte, result any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return &endpointError{fmt.Errorf("%s: %w", method, err)}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &endpointError{fmt.Errorf("%s: %s: %s", method, resp.Status, strings.TrimSpace(string(b)))}
+	}
+	var r rpcResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return &endpointError{fmt.Errorf("%s: %w", method, err)}
+	}
+	if r.Error != nil {
+		return fmt.Errorf("%s: %w", method, r.Error)
+	}
+	if len(r.Result) == 0 || string(r.Result) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(r.Result, result); err != nil {
+		return fmt.Errorf("%s: %w", method, err)
+	}
+	return nil
+}
+
+// quantity is a number as JSON-RPC has it, in hex with a 0x prefix.
+type quantity uint64
+
+func (q *quantity) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	digits, ok := strings.CutPrefix(s, "0x")
+	if !ok {
+		return fmt.Errorf("quantity %q lacks the 0x prefix", s)
+	}
+	n, err := strconv.ParseUint(digits, 16, 64)
+	if err != nil {
+		return fmt.Errorf("quantity %q: %w", s, err)
+	}
+	*q = quantity(n)
+	return nil
+}
+
+func (q quantity) MarshalJSON() ([]byte, error) {
+	return json.Marshal(q.String())
+}
+
+func (q quantity) String() string {
+	return "0x" + strconv.FormatUint(uint64(q), 16)
+}
+
+// ethBlock is a block as eth_getBlockByNumber returns it with full
+// transactions, as far as the scraper cares.
+type ethBlock struct {
+	Number       quantity         `json:"number"`
+	Hash         string           `json:"hash"`
+	ParentHash   string           `json:"parentHash"`
+	Timestamp    quantity         `json:"timestamp"`
+	Miner        string           `json:"miner"`
+	Transactions []ethTransaction `json:"transactions"`
+	// Uncles are the hashes of the uncles the block includes.
+	Uncles []string `json:"uncles"`
+	// Withdrawals are missing before Shanghai, and BlobGasUsed and
+	// ExcessBlobGas before Cancun.
+	Withdrawals   []ethWithdrawal `json:"withdrawals"`
+	BlobGasUsed   *quantity       `json:"blobGasUsed"`
+	ExcessBlobGas *quantity       `json:"excessBlobGas"`
+}
+
+// ethTransaction is a transaction of an ethBlock. To is empty for contract
+// creations.
+type ethTransaction struct {
+	Hash  string   `json:"hash"`
+	Index quantity `json:"transactionIndex"`
+	Type  quantity `json:"type"`
+	From  string   `json:"from"`
+	To    string   `json:"to"`
+	// BlobVersionedHashes are those of the blobs a blob transaction, of
+	// type 3, carries.
+	BlobVersionedHashes []string `json:"blobVersionedHashes"`
+}
+
+// ethWithdrawal is a withdrawal from the beacon chain a block pays out,
+// as far as the scraper cares.
+type ethWithdrawal struct {
+	Address string `json:"address"`
+}
+
+// ethReceipt is the receipt of a transaction, as far as the scraper cares.
+// ContractAddress is empty but for contract creations.
+type ethReceipt struct {
+	TransactionIndex quantity `json:"transactionIndex"`
+	ContractAddress  string   `json:"contractAddress"`
+	Logs             []ethLog `json:"logs"`
+}
+
+// ethLog is a log a transaction emitted.
+type ethLog struct {
+	Address string   `json:"address"`
+	Topics  []string `json:"topics"`
+}
+
+// blockNumber asks the node for the number of its latest block.
+func (c *rpcClient) blockNumber(ctx context.Context) (uint64, error) {
+	var n quantity
+	e, err := c.do(ctx, "eth_blockNumber", &n)
+	if err != nil {
+		return 0, err
+	}
+	c.sawHead(e, uint64(n))
+	return uint64(n), nil
+}
+
+// blocks fetches the blocks from through to with their transactions.
+func (c *rpcClient) blocks(ctx context.Context, from, to uint64) ([]*ethBlock, error) {
+	blocks := make([]*ethBlock, to-from+1)
+	calls := make([]*rpcCall, len(blocks))
+	for i := range calls {
+		calls[i] = newRPCCall("eth_getBlockByNumber", &blocks[i], quantity(from+uint64(i)).String(), true)
+	}
+	if err := c.batch(ctx, calls); err != nil {
+		return nil, err
+	}
+	if err := callErr(calls); err != nil {
+		return nil, err
+	}
+	for i, b := range blocks {
+		n := from + uint64(i)
+		if b == nil {
+			return nil, fmt.Errorf("eth_getBlockByNumber: no block %d", n)
+		}
+		if uint64(b.Number) != n {
+			return nil, fmt.Errorf("asked for block %d, got %d", n, b.Number)
+		}
+	}
+	return blocks, nil
+}
+
+// blockHash returns the hash of block n, as the node has it now.
+func (c *rpcClient) blockHash(ctx context.Context, n uint64) (string, error) {
+	var b *struct {
+		Hash string `json:"hash"`
+	}
+	if err := c.call(ctx, "eth_getBlockByNumber", &b, quantity(n).String(), false); err != nil {
+		return "", err
+	}
+	if b == nil {
+		return "", fmt.Errorf("eth_getBlockByNumber: no block %d", n)
+	}
+	return b.Hash, nil
+}
+
+// methodMissing reports whether err is the node saying it doesn't have the
+// method called, or has it turned off.
+func methodMissing(err error) bool {
+	var re *rpcError
+	if !errors.As(err, &re) {
+		return false
+	}
+	if re.Code == -32601 {
+		return true
+	}
+	msg := strings.ToLower(re.Message)
+	return strings.Contains(msg, "method") &&
+		(strings.Contains(msg, "not found") || strings.Contains(msg, "does not exist") || strings.Contains(msg, "not available") || strings.Contains(msg, "not supported"))
+}
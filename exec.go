@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// execOutputLimit bounds how much of a failed hook's output is logged.
+const execOutputLimit = 4096
+
+// execNotifier runs each target's hook command through the shell when the
+// target goes down or comes back up, for remediation such as restarting a
+// node. Targets without a hook are skipped, which is why every target has
+// this notifier. Reminders don't run the hook again.
+type execNotifier struct {
+	timeout time.Duration
+}
+
+func (n *execNotifier) name() string {
+	return "exec"
+}
+
+func (n *execNotifier) notify(ctx context.Context, e *alertEvent) error {
+	if e.target.alertExec == "" || e.Repeat > 0 {
+		return nil
+	}
+	event, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	if n.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, n.timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", e.target.alertExec)
+	cmd.Env = append(os.Environ(), execEnv(e, event)...)
+	// Give the hook's children, which may hold on to its output, a moment
+	// after it has been killed.
+	cmd.WaitDelay = time.Second
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	start := time.Now()
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("timed out after %s", n.timeout)
+		}
+		output := out.String()
+		if len(output) > execOutputLimit {
+			output = output[:execOutputLimit] + "..."
+		}
+		return fmt.Errorf("%s: %w, output: %s", e.target.alertExec, err, strings.TrimSpace(output))
+	}
+	slog.Debug("Hook ran", "target", e.Target, e.target.logLabels(), "state", e.State, "duration", time.Since(start))
+	return nil
+}
+
+// execEnv describes e to hooks in SCRAPER_ variables. SCRAPER_EVENT holds
+// the whole event as webhooks get it. None of the names may be that of an
+// option's variable, or a hook running the scraper would be configured by
+// them.
+func execEnv(e *alertEvent, event []byte) []string {
+	env := []string{
+		"SCRAPER_TARGET=" + e.Target,
+		"SCRAPER_STATE=" + e.State,
+		"SCRAPER_REASON=" + e.Reason,
+		"SCRAPER_ERROR=" + e.Error,
+		"SCRAPER_AT=" + e.At.Format(time.RFC3339),
+		"SCRAPER_ESCALATED=" + strconv.FormatBool(e.Escalated),
+		"SCRAPER_EVENT=" + string(event),
+	}
+	if e.Since != nil {
+		env = append(env, "SCRAPER_SINCE="+e.Since.Format(time.RFC3339))
+	}
+	if o := e.Outage; o != nil {
+		env = append(env,
+			"SCRAPER_OUTAGE_DURATION="+o.Duration,
+			"SCRAPER_FAILED_CHECKS="+strconv.Itoa(o.Failures),
+			"SCRAPER_REASONS="+strings.Join(o.Reasons, ","),
+		)
+	}
+	if len(e.Labels) > 0 {
+		pairs := make([]string, 0, len(e.Labels))
+		for _, name := range labelNames(e.Labels) {
+			pairs = append(pairs, name+"="+e.Labels[name])
+		}
+		env = append(env, "SCRAPER_LABELS="+strings.Join(pairs, ","))
+	}
+	if len(e.Results) > 0 {
+		r := e.Results[0]
+		env = append(env, "SCRAPER_STATUS_CODE="+strconv.Itoa(r.Status), "SCRAPER_LATENCY="+r.Latency)
+	}
+	return env
+}
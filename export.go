@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// csvHeader is the first line of every CSV export file. The columns are
+// those of the store's results table.
+var csvHeader = []string{"target", "start", "duration", "latency", "status", "ok", "reason", "error"}
+
+// exportOptions says where -export_file results go and when the file is
+// rotated.
+type exportOptions struct {
+	path     string
+	rotation logRotation
+}
+
+// exporter appends every result to a CSV or NDJSON file, as its extension
+// says, for tools that pick up files rather than query a store. A nil
+// exporter exports nothing.
+type exporter struct {
+	format string
+	// maxSize is the size in bytes the file is rotated at.
+	maxSize int64
+
+	mu sync.Mutex
+	w  *lumberjack.Logger
+	// size is how much has been written to the current file.
+	size int64
+}
+
+// exportFormat returns the format of the export file at path.
+func exportFormat(path string) (string, error) {
+	switch ext := filepath.Ext(path); ext {
+	case ".csv":
+		return "csv", nil
+	case ".ndjson", ".jsonl":
+		return "ndjson", nil
+	}
+	return "", fmt.Errorf("-export_file %q: want a .csv, .ndjson or .jsonl file", path)
+}
+
+// newExporter opens the export file o names, appending to it if it
+// exists. Rotated files get a timestamp added to their name like rotated
+// log files, and each CSV file starts with a header.
+func newExporter(ctx context.Context, o exportOptions) (*exporter, error) {
+	format, err := exportFormat(o.path)
+	if err != nil {
+		return nil, err
+	}
+	e := &exporter{
+		format:  format,
+		maxSize: int64(o.rotation.maxSize) << 20,
+		w: &lumberjack.Logger{
+			Filename: o.path,
+			// The exporter rotates by size itself, to start each
+			// file with a header.
+			MaxSize:    1 << 20,
+			MaxAge:     int((o.rotation.maxAge + 24*time.Hour - 1) / (24 * time.Hour)),
+			MaxBackups: o.rotation.maxBackups,
+			LocalTime:  true,
+			Compress:   o.rotation.compress,
+		},
+	}
+	// lumberjack would create the file readable by its owner only; rotated
+	// files keep the mode of the first, so other users' tools can read
+	// them too.
+	f, err := os.OpenFile(o.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	e.size = info.Size()
+	if e.size == 0 {
+		if err := e.header(); err != nil {
+			return nil, err
+		}
+	}
+	if every := o.rotation.every; every > 0 {
+		go func() {
+			ticker := time.NewTicker(every)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					e.mu.Lock()
+					if err := e.rotate(); err != nil {
+						slog.Error("Rotating export file failed", "error", err)
+					}
+					e.mu.Unlock()
+				}
+			}
+		}()
+	}
+	return e, nil
+}
+
+// header starts a new file. e.mu must be held, if e is in use.
+func (e *exporter) header() error {
+	if e.format != "csv" {
+		return nil
+	}
+	var b bytes.Buffer
+	cw := csv.NewWriter(&b)
+	cw.Write(csvHeader)
+	cw.Flush()
+	return e.write(b.Bytes())
+}
+
+func (e *exporter) write(b []byte) error {
+	n, err := e.w.Write(b)
+	e.size += int64(n)
+	return err
+}
+
+// rotate moves the current file aside and starts a new one. e.mu must be
+// held.
+func (e *exporter) rotate() error {
+	if err := e.w.Rotate(); err != nil {
+		return err
+	}
+	e.size = 0
+	return e.header()
+}
+
+func (e *exporter) observe(r *result) {
+	if e == nil {
+		return
+	}
+	s := newStoredResult(r)
+	var b bytes.Buffer
+	switch e.format {
+	case "csv":
+		cw := csv.NewWriter(&b)
+		cw.Write([]string{
+			s.Target,
+			s.Start.Format(time.RFC3339Nano),
+			strconv.FormatInt(int64(s.Duration), 10),
+			strconv.FormatInt(int64(s.Latency), 10),
+			strconv.Itoa(s.Status),
+			strconv.FormatBool(s.OK),
+			s.Reason,
+			s.Error,
+		})
+		cw.Flush()
+	case "ndjson":
+		json.NewEncoder(&b).Encode(storedResultJSON{s.Target, s.record()})
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.maxSize > 0 && e.size > 0 && e.size+int64(b.Len()) > e.maxSize {
+		if err := e.rotate(); err != nil {
+			slog.Error("Rotating export file failed", "error", err)
+		}
+	}
+	if err := e.write(b.Bytes()); err != nil {
+		slog.Error("Exporting result failed", "target", r.target.url, r.target.logLabels(), "error", err)
+	}
+}
+
+// close closes the export file. No results may be observed after.
+func (e *exporter) close() {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.w.Close(); err != nil {
+		slog.Error("Closing export file failed", "error", err)
+	}
+}
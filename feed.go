@@ -0,0 +1,48 @@
+package main
+
+import "sync"
+
+// feedBuffer is how many results a subscriber may fall behind by before it
+// misses some.
+const feedBuffer = 256
+
+// feed hands every result to whoever subscribed to it, for the streaming
+// APIs. Subscribers that fall behind miss results rather than hold up the
+// workers.
+type feed struct {
+	mu   sync.Mutex
+	subs map[chan storedResult]struct{}
+}
+
+func newFeed() *feed {
+	return &feed{subs: make(map[chan storedResult]struct{})}
+}
+
+func (f *feed) observe(r *result) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.subs) == 0 {
+		return
+	}
+	sr := newStoredResult(r)
+	for ch := range f.subs {
+		select {
+		case ch <- sr:
+		default:
+		}
+	}
+}
+
+// subscribe returns a channel receiving results from now on, and a function
+// that unsubscribes it.
+func (f *feed) subscribe() (<-chan storedResult, func()) {
+	ch := make(chan storedResult, feedBuffer)
+	f.mu.Lock()
+	f.subs[ch] = struct{}{}
+	f.mu.Unlock()
+	return ch, func() {
+		f.mu.Lock()
+		delete(f.subs, ch)
+		f.mu.Unlock()
+	}
+}
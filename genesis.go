@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+// genesisStage adds the accounts the genesis allocates balances to as
+// appearances in block 0, which has no transactions to show them by. As
+// in the Unchained Index, the appearance of each has its place in the
+// allocation as its transaction index.
+type genesisStage struct {
+	allocs []address
+}
+
+// loadAllocations reads the accounts a genesis allocates to from path: a
+// genesis file, such as Geth's genesis.json, whose alloc has them, taken
+// in the order of their addresses, or a CSV file of addresses, each with
+// its balance after it, such as the allocs.csv files TrueBlocks publishes
+// of the prefunds of the chains it knows, taken in the order they're in.
+func loadAllocations(path string) ([]address, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var allocs []address
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		var genesis struct {
+			Alloc map[string]json.RawMessage `json:"alloc"`
+		}
+		if err := json.Unmarshal(b, &genesis); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		for s := range genesis.Alloc {
+			if !strings.HasPrefix(s, "0x") {
+				s = "0x" + s
+			}
+			a, err := parseAddress(strings.ToLower(s))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			allocs = append(allocs, a)
+		}
+		slices.SortFunc(allocs, func(a, b address) int { return bytes.Compare(a[:], b[:]) })
+	} else {
+		r := csv.NewReader(bytes.NewReader(b))
+		r.FieldsPerRecord = -1
+		r.TrimLeadingSpace = true
+		for line := 1; ; line++ {
+			rec, err := r.Read()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			a, err := parseAddress(strings.ToLower(rec[0]))
+			if err != nil {
+				if line == 1 {
+					continue // the header
+				}
+				return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+			}
+			allocs = append(allocs, a)
+		}
+	}
+	if len(allocs) == 0 {
+		return nil, fmt.Errorf("%s: no allocations", path)
+	}
+	if len(allocs) > txWithdrawal {
+		return nil, fmt.Errorf("%s: %d allocations, more than the Unchained Index has transaction indexes for", path, len(allocs))
+	}
+	return allocs, nil
+}
+
+func (g *genesisStage) process(ctx context.Context, b *scrapedBlock) error {
+	if b.block.Number != 0 {
+		return nil
+	}
+	for i, a := range g.allocs {
+		b.appearances[appearance{address: a, block: 0, txIndex: uint32(i)}] = struct{}{}
+	}
+	return nil
+}
+
+func (g *genesisStage) flush() error {
+	return nil
+}
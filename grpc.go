@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+)
+
+// grpcOptions configures grpc:// (plaintext) and grpcs:// (TLS) targets,
+// which call grpc.health.v1.Health/Check. Request headers are sent as call
+// metadata.
+type grpcOptions struct {
+	// service is the name passed to the health check; empty asks about
+	// the server as a whole.
+	service string
+	// status is the serving status expected back.
+	status healthpb.HealthCheckResponse_ServingStatus
+}
+
+func probeGRPC(ctx context.Context, t *target, r *result) {
+	if t.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.timeout)
+		defer cancel()
+	}
+	if err := t.limiter.wait(ctx, t.hostname()); err != nil {
+		r.err = err
+		return
+	}
+
+	creds := insecure.NewCredentials()
+	if t.scheme == "grpcs" {
+		creds = credentials.NewTLS(t.tlsConfig())
+	}
+	conn, err := grpc.NewClient(t.address(), grpc.WithTransportCredentials(creds))
+	if err != nil {
+		r.err = err
+		slog.Warn("Dial failed", "target", t.url, t.logLabels(), "error", err)
+		return
+	}
+	defer conn.Close()
+
+	for name, values := range t.header() {
+		for _, v := range values {
+			ctx = metadata.AppendToOutgoingContext(ctx, strings.ToLower(name), v)
+		}
+	}
+
+	start := time.Now()
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: t.grpc.service})
+	r.latency = time.Since(start)
+	if err != nil {
+		r.err = err
+		slog.Warn("Health check failed", "target", t.url, t.logLabels(), "error", err)
+		return
+	}
+
+	if resp.Status != t.grpc.status {
+		r.fail("serving_status", "Serving status mismatch, got: %s", resp.Status)
+	}
+	checkLatency(t, r)
+}
+
+// tlsConfig returns a copy of the TLS settings t's HTTP requests use, client
+// certificate included, for probes that make their own connections.
+func (t *target) tlsConfig() *tls.Config {
+	if m, ok := t.client.Transport.(*transports); ok {
+		cfg := m.pick(t.tls, false).TLSClientConfig.Clone()
+		// ALPN is up to the probe.
+		cfg.NextProtos = nil
+		return cfg
+	}
+	return &tls.Config{}
+}
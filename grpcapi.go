@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/TrueBlocks/trueblocks-scraper-go/scraperpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcAPI serves the management API of scraperpb, the gRPC counterpart of
+// /targets, along with a stream of results.
+type grpcAPI struct {
+	scraperpb.UnimplementedScraperServer
+	managed *managedTargets
+	keys    *apiKeys
+	feed    *feed
+}
+
+// grpcScopes are the scopes the methods of the API need, as for their
+// counterparts on -admin_addr. Methods not listed need the admin scope.
+var grpcScopes = map[string]scope{
+	scraperpb.Scraper_ListTargets_FullMethodName:   scopeRead,
+	scraperpb.Scraper_GetTarget_FullMethodName:     scopeRead,
+	scraperpb.Scraper_PauseTarget_FullMethodName:   scopeOperate,
+	scraperpb.Scraper_ResumeTarget_FullMethodName:  scopeOperate,
+	scraperpb.Scraper_StreamResults_FullMethodName: scopeRead,
+}
+
+// serveGRPC serves the gRPC management API on addr until ctx is done.
+func serveGRPC(ctx context.Context, addr string, managed *managedTargets, keys *apiKeys, f *feed) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	api := &grpcAPI{managed: managed, keys: keys, feed: f}
+	srv := grpc.NewServer(grpc.UnaryInterceptor(api.authorizeUnary), grpc.StreamInterceptor(api.authorizeStream))
+	scraperpb.RegisterScraperServer(srv, api)
+	go func() {
+		if err := srv.Serve(ln); err != nil {
+			slog.Error("gRPC server failed", "error", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		// Result streams only end when canceled, so they're cut off.
+		stop := time.AfterFunc(time.Second, srv.Stop)
+		srv.GracefulStop()
+		stop.Stop()
+	}()
+	return nil
+}
+
+// grpcToken returns the bearer token the call bears, if any.
+func grpcToken(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var token string
+	if v := md.Get("authorization"); len(v) > 0 {
+		token, _ = strings.CutPrefix(v[0], "Bearer ")
+	}
+	return token
+}
+
+func (a *grpcAPI) authorize(ctx context.Context, method string) error {
+	need, ok := grpcScopes[method]
+	if !ok {
+		need = scopeAdmin
+	}
+	switch err := a.keys.authorize(grpcToken(ctx), need); {
+	case errors.Is(err, errBadKey):
+		return status.Error(codes.Unauthenticated, err.Error())
+	case err != nil:
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	return nil
+}
+
+func (a *grpcAPI) authorizeUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if err := a.authorize(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (a *grpcAPI) authorizeStream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := a.authorize(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+func (a *grpcAPI) ListTargets(ctx context.Context, _ *scraperpb.ListTargetsRequest) (*scraperpb.ListTargetsResponse, error) {
+	var resp scraperpb.ListTargetsResponse
+	for _, tj := range a.managed.list() {
+		resp.Targets = append(resp.Targets, targetProto(a.reveal(ctx, tj)))
+	}
+	return &resp, nil
+}
+
+// reveal returns tj as the caller may see it: redacted, as the REST API
+// has it, for keys short of the admin scope.
+func (a *grpcAPI) reveal(ctx context.Context, tj targetJSON) targetJSON {
+	if a.keys.authorize(grpcToken(ctx), scopeAdmin) != nil {
+		return tj.redacted()
+	}
+	return tj
+}
+
+func (a *grpcAPI) GetTarget(ctx context.Context, req *scraperpb.GetTargetRequest) (*scraperpb.Target, error) {
+	tj, err := a.managed.get(req.Id)
+	return targetReply(a.reveal(ctx, tj), err)
+}
+
+func (a *grpcAPI) AddTarget(ctx context.Context, req *scraperpb.AddTargetRequest) (*scraperpb.Target, error) {
+	return targetReply(a.managed.add(managedTarget{URL: req.Url, Options: optionsOf(req.Options)}))
+}
+
+func (a *grpcAPI) UpdateTarget(ctx context.Context, req *scraperpb.UpdateTargetRequest) (*scraperpb.Target, error) {
+	return targetReply(a.managed.modify(req.Id, func(map[string]optionValues) map[string]optionValues {
+		return optionsOf(req.Options)
+	}))
+}
+
+func (a *grpcAPI) DeleteTarget(ctx context.Context, req *scraperpb.DeleteTargetRequest) (*scraperpb.DeleteTargetResponse, error) {
+	if err := a.managed.remove(req.Id); err != nil {
+		return nil, grpcError(err)
+	}
+	return &scraperpb.DeleteTargetResponse{}, nil
+}
+
+func (a *grpcAPI) PauseTarget(ctx context.Context, req *scraperpb.PauseTargetRequest) (*scraperpb.Target, error) {
+	tj, err := a.managed.setPaused(req.Id, true)
+	return targetReply(a.reveal(ctx, tj), err)
+}
+
+func (a *grpcAPI) ResumeTarget(ctx context.Context, req *scraperpb.ResumeTargetRequest) (*scraperpb.Target, error) {
+	tj, err := a.managed.setPaused(req.Id, false)
+	return targetReply(a.reveal(ctx, tj), err)
+}
+
+func (a *grpcAPI) StreamResults(req *scraperpb.StreamResultsRequest, stream scraperpb.Scraper_StreamResultsServer) error {
+	results, unsubscribe := a.feed.subscribe()
+	defer unsubscribe()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case r := <-results:
+			if len(req.Targets) > 0 && !slices.Contains(req.Targets, r.Target) {
+				continue
+			}
+			if err := stream.Send(resultProto(r)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func targetReply(tj targetJSON, err error) (*scraperpb.Target, error) {
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return targetProto(tj), nil
+}
+
+// grpcError is the gRPC status for an error of the targets API.
+func grpcError(err error) error {
+	var invalid invalidTargetError
+	code := codes.Internal
+	switch {
+	case errors.Is(err, errNoTarget):
+		code = codes.NotFound
+	case errors.Is(err, errTargetExists):
+		code = codes.AlreadyExists
+	case errors.Is(err, errConfigured):
+		code = codes.FailedPrecondition
+	case errors.As(err, &invalid):
+		code = codes.InvalidArgument
+	}
+	return status.Error(code, err.Error())
+}
+
+func targetProto(tj targetJSON) *scraperpb.Target {
+	t := &scraperpb.Target{Id: tj.ID, Url: tj.URL, Source: tj.Source, Paused: tj.Paused, Labels: tj.Labels}
+	if len(tj.Options) > 0 {
+		t.Options = make(map[string]*scraperpb.OptionValues, len(tj.Options))
+		for k, v := range tj.Options {
+			t.Options[k] = &scraperpb.OptionValues{Values: v}
+		}
+	}
+	return t
+}
+
+func optionsOf(options map[string]*scraperpb.OptionValues) map[string]optionValues {
+	out := make(map[string]optionValues, len(options))
+	for k, v := range options {
+		out[k] = v.GetValues()
+	}
+	return out
+}
+
+func resultProto(r storedResult) *scraperpb.Result {
+	return &scraperpb.Result{
+		Target:   redactURL(r.Target),
+		Start:    timestamppb.New(r.Start),
+		Duration: durationpb.New(r.Duration),
+		Latency:  durationpb.New(r.Latency),
+		Status:   int32(r.Status),
+		Ok:       r.OK,
+		Reason:   r.Reason,
+		Error:    r.Error,
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// health tracks what /healthz and /readyz report: whether the scheduler is
+// making progress and whether the configuration loaded.
+type health struct {
+	// stallTimeout is how long a due check may wait for a worker before
+	// the scheduler counts as stalled.
+	stallTimeout time.Duration
+
+	mu       sync.Mutex
+	running  bool
+	targets  int
+	lastTick time.Time
+	// waiting holds when each loop that is waiting for a worker started to.
+	waiting    map[*target]time.Time
+	loadedAt   time.Time
+	reloadErr  error
+	reloadedAt time.Time
+}
+
+func newHealth(stallTimeout time.Duration) *health {
+	return &health{stallTimeout: stallTimeout, waiting: make(map[*target]time.Time)}
+}
+
+// started records that the scheduler runs the given set of targets, freshly
+// loaded.
+func (h *health) started(targets []*target) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.running = true
+	h.targets = len(targets)
+	h.loadedAt = time.Now()
+}
+
+func (h *health) stopped() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.running = false
+}
+
+// due records that a check of t is due and waiting for a worker.
+func (h *health) due(t *target) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.waiting[t] = time.Now()
+}
+
+// picked records that a worker took on the check of t.
+func (h *health) picked(t *target) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.waiting, t)
+	h.lastTick = time.Now()
+}
+
+// abandoned records that the check of t was dropped before a worker took it
+// on, because its loop was stopped.
+func (h *health) abandoned(t *target) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.waiting, t)
+}
+
+// reloaded records the outcome of a reload.
+func (h *health) reloaded(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.reloadErr = err
+	h.reloadedAt = time.Now()
+}
+
+type healthReport struct {
+	Status        string     `json:"status"`
+	LastTick      *time.Time `json:"last_tick,omitempty"`
+	ChecksWaiting int        `json:"checks_waiting"`
+	LongestWait   string     `json:"longest_wait,omitempty"`
+	Targets       int        `json:"targets"`
+	ConfigLoaded  *time.Time `json:"config_loaded,omitempty"`
+	LastReload    *time.Time `json:"last_reload,omitempty"`
+	LastReloadErr string     `json:"last_reload_error,omitempty"`
+	live, ready   bool
+}
+
+func (h *health) report() healthReport {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	r := healthReport{Status: "ok", ChecksWaiting: len(h.waiting), Targets: h.targets}
+	var longest time.Duration
+	for _, since := range h.waiting {
+		if d := time.Since(since); d > longest {
+			longest = d
+		}
+	}
+	if longest > 0 {
+		r.LongestWait = longest.Round(time.Millisecond).String()
+	}
+	if !h.lastTick.IsZero() {
+		r.LastTick = &h.lastTick
+	}
+	if !h.loadedAt.IsZero() {
+		r.ConfigLoaded = &h.loadedAt
+	}
+	if !h.reloadedAt.IsZero() {
+		r.LastReload = &h.reloadedAt
+	}
+	if h.reloadErr != nil {
+		r.LastReloadErr = h.reloadErr.Error()
+	}
+
+	r.live = h.running && longest <= h.stallTimeout
+	r.ready = r.live && h.reloadErr == nil
+	switch {
+	case !h.running:
+		r.Status = "stopped"
+	case !r.live:
+		r.Status = "stalled"
+	case !r.ready:
+		r.Status = "reload failed"
+	}
+	return r
+}
+
+// serveHealth answers with the health report, and a 503 status unless ok
+// says the report is good.
+func serveHealth(h *health, ok func(healthReport) bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		r := h.report()
+		w.Header().Set("Content-Type", "application/json")
+		if !ok(r) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(r)
+	}
+}
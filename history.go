@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// record is what the history keeps of a result.
+type record struct {
+	Start    time.Time `json:"start"`
+	Duration string    `json:"duration"`
+	Latency  string    `json:"latency,omitempty"`
+	Status   int       `json:"status,omitempty"`
+	OK       bool      `json:"ok"`
+	// Reason lists the distinct failure reasons, comma-separated, or is
+	// "error" when no usable response was received.
+	Reason string `json:"reason,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func newRecord(r *result) record {
+	rec := record{Start: r.start, Duration: r.duration.String(), Status: r.status, OK: r.ok()}
+	if r.latency > 0 {
+		rec.Latency = r.latency.String()
+	}
+	rec.Reason = strings.Join(resultReasons(r), ",")
+	if r.err != nil {
+		rec.Error = r.err.Error()
+	} else if len(r.failures) > 0 {
+		msgs := make([]string, len(r.failures))
+		for i, f := range r.failures {
+			msgs[i] = f.message
+		}
+		rec.Error = strings.Join(msgs, "; ")
+	}
+	return rec
+}
+
+// resultReasons returns the distinct reasons r failed for, "error" when no
+// usable response was received.
+func resultReasons(r *result) []string {
+	if r.err != nil {
+		return []string{"error"}
+	}
+	var reasons []string
+	for _, f := range r.failures {
+		if !slices.Contains(reasons, f.reason) {
+			reasons = append(reasons, f.reason)
+		}
+	}
+	return reasons
+}
+
+// history keeps the most recent results of every target in a ring buffer,
+// along with a summary of its state. It is keyed by URL so that history
+// survives a reload.
+type history struct {
+	size int
+
+	mu      sync.Mutex
+	targets map[string]*targetHistory
+}
+
+type targetHistory struct {
+	ring []record
+	// next is where the next record goes once the ring is full.
+	next                int
+	consecutiveFailures int
+	lastSuccess         time.Time
+	lastFailure         *record
+	uptime              uptime
+	labels              map[string]string
+	paused              bool
+}
+
+func newHistory(size int) *history {
+	return &history{size: size, targets: make(map[string]*targetHistory)}
+}
+
+func (h *history) observe(r *result) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.add(r.target.url, newRecord(r))
+}
+
+// restore fills in the history of targets with their most recent results in
+// st, so that it survives restarts.
+func (h *history) restore(ctx context.Context, st store, targets []*target) error {
+	for _, t := range targets {
+		results, err := st.query(ctx, resultQuery{target: t.url, limit: h.size})
+		if err != nil {
+			return err
+		}
+		h.mu.Lock()
+		for i := len(results) - 1; i >= 0; i-- {
+			h.add(t.url, results[i].record())
+		}
+		h.mu.Unlock()
+	}
+	return nil
+}
+
+// add records rec as the latest result of the target at url. h.mu must be
+// held.
+func (h *history) add(url string, rec record) {
+	th, ok := h.targets[url]
+	if !ok {
+		th = &targetHistory{}
+		h.targets[url] = th
+	}
+	if len(th.ring) < h.size {
+		th.ring = append(th.ring, rec)
+	} else if h.size > 0 {
+		th.ring[th.next] = rec
+		th.next = (th.next + 1) % h.size
+	}
+	th.uptime.observe(rec.Start, rec.OK)
+	if rec.OK {
+		th.consecutiveFailures = 0
+		th.lastSuccess = rec.Start
+	} else {
+		th.consecutiveFailures++
+		th.lastFailure = &rec
+	}
+}
+
+// retain forgets targets no longer configured. Targets that are still
+// configured but haven't been checked yet get an empty entry, so that they
+// show up as unknown.
+func (h *history) retain(targets []*target) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	next := make(map[string]*targetHistory, len(targets))
+	for _, t := range targets {
+		th, ok := h.targets[t.url]
+		if !ok {
+			th = &targetHistory{}
+		}
+		th.labels = t.labels
+		th.paused = t.paused
+		next[t.url] = th
+	}
+	h.targets = next
+}
+
+// records returns up to n of the most recent records of th, newest first.
+func (th *targetHistory) records(n int) []record {
+	out := make([]record, 0, min(n, len(th.ring)))
+	for i := 0; i < len(th.ring) && i < n; i++ {
+		out = append(out, th.ring[(th.next-1-i+2*len(th.ring))%len(th.ring)])
+	}
+	return out
+}
+
+// recent returns up to n of url's most recent records, newest first.
+func (h *history) recent(url string, n int) []record {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	th, ok := h.targets[url]
+	if !ok {
+		return nil
+	}
+	return th.records(n)
+}
+
+type targetStatus struct {
+	Target              string            `json:"target"`
+	Labels              map[string]string `json:"labels,omitempty"`
+	State               string            `json:"state"`
+	Paused              bool              `json:"paused,omitempty"`
+	ConsecutiveFailures int               `json:"consecutive_failures"`
+	LastCheck           *record           `json:"last_check,omitempty"`
+	LastSuccess         *time.Time        `json:"last_success,omitempty"`
+	LastFailure         *record           `json:"last_failure,omitempty"`
+	// Availability is the percentage of checks that passed over the
+	// trailing 24h, 7d and 30d, for windows with any checks.
+	Availability map[string]float64 `json:"availability"`
+	Results      []record           `json:"results,omitempty"`
+}
+
+// status summarizes every target, with up to results of its most recent
+// results.
+func (h *history) status(results int) []targetStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	out := make([]targetStatus, 0, len(h.targets))
+	for url, th := range h.targets {
+		s := targetStatus{
+			Target:              url,
+			Labels:              th.labels,
+			Paused:              th.paused,
+			State:               "unknown",
+			ConsecutiveFailures: th.consecutiveFailures,
+			LastFailure:         th.lastFailure,
+			Availability:        th.uptime.availability(now),
+		}
+		if last := th.records(1); len(last) > 0 {
+			s.LastCheck = &last[0]
+			s.State = "up"
+			if !last[0].OK {
+				s.State = "down"
+			}
+		}
+		if !th.lastSuccess.IsZero() {
+			at := th.lastSuccess
+			s.LastSuccess = &at
+		}
+		s.Results = th.records(results)
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Target < out[j].Target })
+	return out
+}
+
+// serveStatus answers with the status of every target as JSON, passwords in
+// their URLs masked. A results query parameter adds that many of each
+// target's most recent results.
+func serveStatus(h *history, p *pauses) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		results := 0
+		if v := req.URL.Query().Get("results"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				http.Error(w, "results must be a non-negative number", http.StatusBadRequest)
+				return
+			}
+			results = n
+		}
+		st := h.status(results)
+		for i := range st {
+			st[i].Paused = st[i].Paused || p.paused(st[i].Target)
+			st[i].Target = redactURL(st[i].Target)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(st)
+	}
+}
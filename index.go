@@ -0,0 +1,608 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// The Unchained Index is made of chunks, each of the appearances in a range
+// of blocks. A chunk file starts with a header of the magic number, the
+// Keccak-256 of the format's version and the number of addresses and of
+// appearances. A table of the addresses follows, sorted, each with the
+// offset and number of its appearances in the table of appearances after
+// it, which has each address's in block and transaction order. Numbers are
+// little-endian uint32s.
+const (
+	indexMagic   = 0xdeadbeef
+	indexVersion = "trueblocks-core@v2.0.0-release"
+)
+
+var indexVersionHash = keccak256([]byte(indexVersion))
+
+func keccak256(b []byte) [32]byte {
+	var sum [32]byte
+	h := sha3.NewLegacyKeccak256()
+	h.Write(b)
+	h.Sum(sum[:0])
+	return sum
+}
+
+// blockRange is the range of blocks of a chunk, first and last included.
+type blockRange struct {
+	First uint64 `json:"first"`
+	Last  uint64 `json:"last"`
+}
+
+// String returns r as chunk files are named after it.
+func (r blockRange) String() string {
+	return fmt.Sprintf("%09d-%09d", r.First, r.Last)
+}
+
+func parseBlockRange(s string) (blockRange, error) {
+	first, last, ok := strings.Cut(s, "-")
+	var r blockRange
+	var err1, err2 error
+	r.First, err1 = strconv.ParseUint(first, 10, 64)
+	r.Last, err2 = strconv.ParseUint(last, 10, 64)
+	if !ok || err1 != nil || err2 != nil || r.Last < r.First {
+		return blockRange{}, fmt.Errorf("bad block range %q", s)
+	}
+	return r, nil
+}
+
+// compareBlockOrder orders appearances by block, and then as
+// compareAppearances does.
+func compareBlockOrder(a, b appearance) int {
+	if a.block != b.block {
+		return cmpUint(a.block, b.block)
+	}
+	return compareAppearances(a, b)
+}
+
+func compareAppearances(a, b appearance) int {
+	if c := bytes.Compare(a.address[:], b.address[:]); c != 0 {
+		return c
+	}
+	if a.block != b.block {
+		return cmpUint(a.block, b.block)
+	}
+	return cmpUint(a.txIndex, b.txIndex)
+}
+
+func cmpUint[T uint32 | uint64](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// encodeChunk encodes appearances, sorted, as a chunk.
+func encodeChunk(apps []appearance) []byte {
+	type record struct {
+		address       address
+		offset, count uint32
+	}
+	var records []record
+	for i, a := range apps {
+		if i == 0 || a.address != apps[i-1].address {
+			records = append(records, record{address: a.address, offset: uint32(i)})
+		}
+		records[len(records)-1].count++
+	}
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, uint32(indexMagic))
+	b.Write(indexVersionHash[:])
+	binary.Write(&b, binary.LittleEndian, [2]uint32{uint32(len(records)), uint32(len(apps))})
+	for _, r := range records {
+		b.Write(r.address[:])
+		binary.Write(&b, binary.LittleEndian, [2]uint32{r.offset, r.count})
+	}
+	for _, a := range apps {
+		binary.Write(&b, binary.LittleEndian, [2]uint32{uint32(a.block), a.txIndex})
+	}
+	return b.Bytes()
+}
+
+// chunkHeader checks the header of the chunk b, returning its numbers of
+// addresses and appearances.
+func chunkHeader(b []byte) (int, int, error) {
+	if len(b) < 44 || binary.LittleEndian.Uint32(b) != indexMagic {
+		return 0, 0, errors.New("not an index chunk")
+	}
+	if !bytes.Equal(b[4:36], indexVersionHash[:]) {
+		return 0, 0, errors.New("index chunk of another version")
+	}
+	n := int(binary.LittleEndian.Uint32(b[36:]))
+	apps := int(binary.LittleEndian.Uint32(b[40:]))
+	if len(b) != 44+28*n+8*apps {
+		return 0, 0, errors.New("index chunk of the wrong size")
+	}
+	return n, apps, nil
+}
+
+// chunkAddresses returns the addresses of the chunk b.
+func chunkAddresses(b []byte) ([]address, error) {
+	n, _, err := chunkHeader(b)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]address, n)
+	for i := range addrs {
+		copy(addrs[i][:], b[44+28*i:])
+	}
+	return addrs, nil
+}
+
+// chunkAppearances returns the appearances of the chunk b.
+func chunkAppearances(b []byte) ([]appearance, error) {
+	n, count, err := chunkHeader(b)
+	if err != nil {
+		return nil, err
+	}
+	table := 44 + 28*n
+	apps := make([]appearance, 0, count)
+	for i := range n {
+		rec := b[44+28*i:]
+		var a appearance
+		copy(a.address[:], rec)
+		offset := int(binary.LittleEndian.Uint32(rec[20:]))
+		end := offset + int(binary.LittleEndian.Uint32(rec[24:]))
+		if end > count {
+			return nil, errors.New("index chunk with appearances out of range")
+		}
+		for j := offset; j < end; j++ {
+			a.block = uint64(binary.LittleEndian.Uint32(b[table+8*j:]))
+			a.txIndex = binary.LittleEndian.Uint32(b[table+8*j+4:])
+			apps = append(apps, a)
+		}
+	}
+	return apps, nil
+}
+
+// indexStage builds the appearances of the blocks into an Unchained Index
+// under the chain's directory. The appearances of a block are unripe until
+// it is unripeDepth blocks behind the head, and then staged; once there
+// are at least appsPerChunk staged, they are written to a chunk in
+// finalized/ along with those of every block staged, so that chunks end at
+// block boundaries and never have blocks a shallow reorg could orphan. The
+// staged and unripe appearances are saved to a file in staging/ and one
+// in unripe/ on every flush, so that a restart picks them up. Each chunk
+// has its bloom in blooms/, and is listed in manifest.json.
+type indexStage struct {
+	chain        string
+	dir          string
+	appsPerChunk int
+	unripeDepth  uint64
+	bloom        bloomOptions
+	ipfs         ipfsOptions
+	pinners      []pinner
+	// pinNow wakes runPinning when a chunk is written.
+	pinNow chan struct{}
+
+	mu       sync.Mutex
+	chunks   []blockRange
+	manifest indexManifest
+	// next is the first block neither in a chunk, staged nor unripe, first
+	// the first block staged and ripe the first unripe block.
+	next, first, ripe uint64
+	staged            []appearance
+	// unripe are the appearances of the blocks from ripe on, in block
+	// order, and head the head of the chain as last seen.
+	unripe []appearance
+	head   uint64
+	// dirty is set while the staged appearances differ from those saved.
+	dirty bool
+}
+
+// newIndexStage loads the index under dir, as far as it goes, so that the
+// blocks before next are skipped.
+func newIndexStage(dir string, o chainOptions, client *http.Client) (*indexStage, error) {
+	x := &indexStage{
+		chain:        o.name,
+		dir:          dir,
+		appsPerChunk: o.appsPerChunk,
+		unripeDepth:  o.unripeDepth,
+		bloom:        o.bloom,
+		ipfs:         o.ipfs,
+		pinners:      newPinners(o.ipfs, client),
+		pinNow:       make(chan struct{}, 1),
+		next:         o.firstBlock,
+		first:        o.firstBlock,
+		ripe:         o.firstBlock,
+	}
+	for _, sub := range []string{"finalized", "blooms", "staging", "unripe"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	if x.chunks, err = readChunks(dir); err != nil {
+		return nil, err
+	}
+	for _, r := range x.chunks {
+		if err := x.ensureBloom(r); err != nil {
+			return nil, err
+		}
+	}
+	if err := x.loadManifest(); err != nil {
+		return nil, err
+	}
+	if n := len(x.chunks); n > 0 {
+		x.next = x.chunks[n-1].Last + 1
+		x.first, x.ripe = x.next, x.next
+	}
+	if err := x.loadStaging(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// readChunks returns the blocks of the chunks in finalized/ under dir,
+// oldest first.
+func readChunks(dir string) ([]blockRange, error) {
+	entries, err := os.ReadDir(filepath.Join(dir, "finalized"))
+	if err != nil {
+		return nil, err
+	}
+	var chunks []blockRange
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".bin")
+		if !ok {
+			continue
+		}
+		r, err := parseBlockRange(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filepath.Join(dir, "finalized", e.Name()), err)
+		}
+		chunks = append(chunks, r)
+	}
+	slices.SortFunc(chunks, func(a, b blockRange) int { return cmpUint(a.First, b.First) })
+	return chunks, nil
+}
+
+func (x *indexStage) chunkPath(r blockRange) string {
+	return filepath.Join(x.dir, "finalized", r.String()+".bin")
+}
+
+func (x *indexStage) bloomPath(r blockRange) string {
+	return filepath.Join(x.dir, "blooms", r.String()+".bloom")
+}
+
+// ensureBloom writes the bloom of the chunk r if it has none, as chunks
+// written before blooms were don't.
+func (x *indexStage) ensureBloom(r blockRange) error {
+	if _, err := os.Stat(x.bloomPath(r)); !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	b, err := os.ReadFile(x.chunkPath(r))
+	if err != nil {
+		return err
+	}
+	addrs, err := chunkAddresses(b)
+	if err != nil {
+		return fmt.Errorf("%s: %w", x.chunkPath(r), err)
+	}
+	slog.Info("Writing missing bloom", "chain", x.chain, "blocks", r.String())
+	return replaceFileMode(x.bloomPath(r), encodeBlooms(addrs, x.bloom), 0o644)
+}
+
+// stagingFiles returns the names of the files in sub, staging/ or
+// unripe/.
+func (x *indexStage) stagingFiles(sub string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(x.dir, sub))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".txt") {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+// loadStaging loads the staged appearances and then the unripe ones, each
+// in a file named after their blocks with a line for each appearance: the
+// address, block number and transaction index separated by tabs.
+func (x *indexStage) loadStaging() error {
+	for _, sub := range []string{"staging", "unripe"} {
+		if err := x.loadStagingFiles(sub); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (x *indexStage) loadStagingFiles(sub string) error {
+	names, err := x.stagingFiles(sub)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		path := filepath.Join(x.dir, sub, name)
+		r, err := parseBlockRange(strings.TrimSuffix(name, ".txt"))
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if r.Last < x.next {
+			// Left over from before its blocks went into a chunk.
+			os.Remove(path)
+			continue
+		}
+		if r.First != x.next {
+			// Left over from a rollback cut short; resume makes the
+			// scraper fetch the blocks again.
+			slog.Warn("Discarding staged appearances that don't follow the last index chunk", "chain", x.chain, "file", path, "next", x.next)
+			os.Remove(path)
+			continue
+		}
+		apps, err := readStaging(path)
+		if err != nil {
+			return err
+		}
+		if sub == "unripe" {
+			slices.SortFunc(apps, compareBlockOrder)
+			x.unripe, x.next = apps, r.Last+1
+			continue
+		}
+		x.staged, x.first, x.ripe, x.next = apps, r.First, r.Last+1, r.Last+1
+	}
+	return nil
+}
+
+func readStaging(path string) ([]appearance, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var apps []appearance
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		fields := strings.Split(sc.Text(), "\t")
+		var a appearance
+		var err error
+		if len(fields) != 3 {
+			err = errors.New("want address, block and transaction index")
+		}
+		if err == nil {
+			a.address, err = parseAddress(fields[0])
+		}
+		if err == nil {
+			a.block, err = strconv.ParseUint(fields[1], 10, 64)
+		}
+		if err == nil {
+			var tx uint64
+			tx, err = strconv.ParseUint(fields[2], 10, 32)
+			a.txIndex = uint32(tx)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		apps = append(apps, a)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return apps, nil
+}
+
+// resume returns the first block the index lacks.
+func (x *indexStage) resume() uint64 {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.next
+}
+
+func (x *indexStage) process(ctx context.Context, b *scrapedBlock) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	n := uint64(b.block.Number)
+	if n < x.next {
+		// Already in the index, from before a restart.
+		return nil
+	}
+	if n > x.next {
+		return fmt.Errorf("index: expected block %d, got %d", x.next, n)
+	}
+	for a := range b.appearances {
+		x.unripe = append(x.unripe, a)
+	}
+	x.next = n + 1
+	x.dirty = true
+	return x.ripen()
+}
+
+// sawHead records the head of the chain, which the blocks ripen behind.
+func (x *indexStage) sawHead(head uint64) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.head = head
+}
+
+// ripen stages the appearances of the unripe blocks now unripeDepth
+// behind the head, a block at a time, writing a chunk whenever enough are
+// staged. The caller holds x.mu.
+func (x *indexStage) ripen() error {
+	for x.ripe < x.next && x.ripe+x.unripeDepth <= x.head {
+		n := x.ripe
+		i := 0
+		for i < len(x.unripe) && x.unripe[i].block == n {
+			i++
+		}
+		x.staged = append(x.staged, x.unripe[:i]...)
+		x.unripe = x.unripe[i:]
+		x.ripe = n + 1
+		if len(x.staged) >= x.appsPerChunk {
+			if err := x.finalize(blockRange{First: x.first, Last: n}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// finalize writes the staged appearances to a chunk of the blocks r, and
+// its bloom before it, so that there's never a chunk without one. The
+// caller holds x.mu.
+func (x *indexStage) finalize(r blockRange) error {
+	slices.SortFunc(x.staged, compareAppearances)
+	var addrs []address
+	for i, a := range x.staged {
+		if i == 0 || a.address != x.staged[i-1].address {
+			addrs = append(addrs, a.address)
+		}
+	}
+	if err := replaceFileMode(x.bloomPath(r), encodeBlooms(addrs, x.bloom), 0o644); err != nil {
+		return err
+	}
+	if err := replaceFileMode(x.chunkPath(r), encodeChunk(x.staged), 0o644); err != nil {
+		return err
+	}
+	if err := x.addToManifest(r); err != nil {
+		return err
+	}
+	slog.Info("Wrote index chunk", "chain", x.chain, "blocks", r.String(), "appearances", len(x.staged))
+	x.chunks = append(x.chunks, r)
+	x.staged = x.staged[:0]
+	x.first = r.Last + 1
+	select {
+	case x.pinNow <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// flush saves the staged and the unripe appearances, replacing the files
+// of those saved before.
+func (x *indexStage) flush() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if !x.dirty {
+		return nil
+	}
+	slices.SortFunc(x.staged, compareAppearances)
+	if err := x.saveStaging("staging", x.first, x.ripe, x.staged); err != nil {
+		return err
+	}
+	if err := x.saveStaging("unripe", x.ripe, x.next, x.unripe); err != nil {
+		return err
+	}
+	x.dirty = false
+	return nil
+}
+
+// saveStaging saves apps, of the blocks from first up to next, to a file
+// in sub, removing the others there. The caller holds x.mu.
+func (x *indexStage) saveStaging(sub string, first, next uint64, apps []appearance) error {
+	old, err := x.stagingFiles(sub)
+	if err != nil {
+		return err
+	}
+	name := ""
+	if next > first {
+		name = blockRange{First: first, Last: next - 1}.String() + ".txt"
+		var b bytes.Buffer
+		for _, a := range apps {
+			fmt.Fprintf(&b, "%s\t%09d\t%05d\n", a.address, a.block, a.txIndex)
+		}
+		if err := replaceFileMode(filepath.Join(x.dir, sub, name), b.Bytes(), 0o644); err != nil {
+			return err
+		}
+	}
+	for _, o := range old {
+		if o != name {
+			os.Remove(filepath.Join(x.dir, sub, o))
+		}
+	}
+	return nil
+}
+
+// unwind drops the appearances of the blocks from on, taking apart the
+// chunks with any and staging the rest of theirs again. The staged
+// appearances are saved on the next flush.
+func (x *indexStage) unwind(from uint64) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if from >= x.next {
+		return nil
+	}
+	for n := len(x.chunks); n > 0 && x.chunks[n-1].Last >= from; n-- {
+		r := x.chunks[n-1]
+		b, err := os.ReadFile(x.chunkPath(r))
+		if err != nil {
+			return err
+		}
+		apps, err := chunkAppearances(b)
+		if err != nil {
+			return fmt.Errorf("%s: %w", x.chunkPath(r), err)
+		}
+		if err := x.dropFromManifest(r); err != nil {
+			return err
+		}
+		if err := os.Remove(x.chunkPath(r)); err != nil {
+			return err
+		}
+		os.Remove(x.bloomPath(r))
+		slog.Warn("Removed index chunk with orphaned blocks", "chain", x.chain, "blocks", r.String())
+		x.chunks = x.chunks[:n-1]
+		x.staged = append(x.staged, apps...)
+		x.first = r.First
+	}
+	orphaned := func(a appearance) bool { return a.block >= from }
+	x.staged = slices.DeleteFunc(x.staged, orphaned)
+	x.unripe = slices.DeleteFunc(x.unripe, orphaned)
+	x.first = min(x.first, from)
+	x.ripe = min(x.ripe, from)
+	x.next = from
+	x.dirty = true
+	return nil
+}
+
+// indexStatus is the state of the index, as /chains shows it.
+type indexStatus struct {
+	Chunks    int         `json:"chunks"`
+	LastChunk *blockRange `json:"last_chunk,omitempty"`
+	// Staged counts the appearances not yet in a chunk, of the blocks
+	// from StagedFrom on, and Unripe those of the blocks from UnripeFrom
+	// on, too close to the head to be staged.
+	Staged     int    `json:"staged"`
+	StagedFrom uint64 `json:"staged_from"`
+	Unripe     int    `json:"unripe"`
+	UnripeFrom uint64 `json:"unripe_from"`
+	// Unpinned counts the chunks not yet pinned, when they're pinned.
+	Unpinned *int `json:"unpinned,omitempty"`
+}
+
+func (x *indexStage) status() *indexStatus {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	st := &indexStatus{Chunks: len(x.chunks), Staged: len(x.staged), StagedFrom: x.first, Unripe: len(x.unripe), UnripeFrom: x.ripe}
+	if n := len(x.chunks); n > 0 {
+		st.LastChunk = &x.chunks[n-1]
+	}
+	if len(x.pinners) > 0 {
+		n := x.unpinned()
+		st.Unpinned = &n
+	}
+	return st
+}
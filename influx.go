@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// influxMeasurement is the measurement results are written as.
+const influxMeasurement = "scraper_check"
+
+// influxOptions says where results are written in InfluxDB line protocol.
+type influxOptions struct {
+	// url is a udp://host:port address, or the http:// or https:// URL of
+	// a write endpoint, with the database or bucket in its query.
+	url   string
+	token string
+	flush time.Duration
+}
+
+// influxWriter writes results in line protocol. Over UDP each goes out in a
+// packet of its own as it comes in, best effort like StatsD; over HTTP they
+// are written in batches, off the workers. A nil influxWriter writes
+// nothing.
+type influxWriter struct {
+	o      influxOptions
+	conn   net.Conn
+	client *http.Client
+	lines  chan string
+	done   chan struct{}
+}
+
+func newInfluxWriter(o influxOptions) (*influxWriter, error) {
+	u, err := url.Parse(o.url)
+	if err != nil {
+		return nil, fmt.Errorf("-influx_url: %w", err)
+	}
+	switch u.Scheme {
+	case "udp":
+		conn, err := net.Dial("udp", u.Host)
+		if err != nil {
+			return nil, fmt.Errorf("-influx_url: %w", err)
+		}
+		return &influxWriter{o: o, conn: conn}, nil
+	case "http", "https":
+		w := &influxWriter{
+			o:      o,
+			client: &http.Client{Timeout: 30 * time.Second},
+			lines:  make(chan string, storeBuffer),
+			done:   make(chan struct{}),
+		}
+		go w.loop()
+		return w, nil
+	}
+	return nil, fmt.Errorf("-influx_url %q: want a udp://, http:// or https:// URL", o.url)
+}
+
+// influxEscaper escapes measurements, tag keys and tag values.
+var influxEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+
+// influxString quotes a string field value.
+func influxString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+// influxLine formats r as a point of influxMeasurement, tagged with its
+// target, labels and, if it failed, reason.
+func influxLine(r *result) string {
+	s := newStoredResult(r)
+	tags := map[string]string{"target": s.Target}
+	for name, value := range r.target.labels {
+		tags[name] = value
+	}
+	if s.Reason != "" {
+		tags["reason"] = s.Reason
+	}
+
+	var b strings.Builder
+	b.WriteString(influxMeasurement)
+	// Influx prefers tags sorted by key.
+	for _, name := range labelNames(tags) {
+		if tags[name] == "" {
+			continue
+		}
+		b.WriteString("," + influxEscaper.Replace(name) + "=" + influxEscaper.Replace(tags[name]))
+	}
+	fmt.Fprintf(&b, " ok=%t,status=%di,duration_ms=%s", s.OK, s.Status, millis(s.Duration))
+	if s.Latency > 0 {
+		b.WriteString(",latency_ms=" + millis(s.Latency))
+	}
+	if s.Error != "" {
+		b.WriteString(",error=" + influxString(s.Error))
+	}
+	b.WriteString(" " + strconv.FormatInt(s.Start.UnixNano(), 10))
+	return b.String()
+}
+
+func (w *influxWriter) observe(r *result) {
+	if w == nil {
+		return
+	}
+	line := influxLine(r)
+	if w.conn != nil {
+		w.conn.Write([]byte(line))
+		return
+	}
+	select {
+	case w.lines <- line:
+	default:
+		slog.Warn("Influx falling behind, dropping result", "target", r.target.url, r.target.logLabels())
+	}
+}
+
+func (w *influxWriter) loop() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.o.flush)
+	defer ticker.Stop()
+
+	var batch bytes.Buffer
+	n := 0
+	flush := func() {
+		if n == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		body := batch.Bytes()
+		err := postWithRetries(ctx, w.client, 2, acceptStatus, func() (*http.Request, error) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.o.url, bytes.NewReader(body))
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+			if w.o.token != "" {
+				req.Header.Set("Authorization", "Token "+w.o.token)
+			}
+			return req, nil
+		})
+		if err != nil {
+			slog.Error("Writing results to Influx failed", "results", n, "error", err)
+		}
+		batch.Reset()
+		n = 0
+	}
+	for {
+		select {
+		case line, ok := <-w.lines:
+			if !ok {
+				flush()
+				return
+			}
+			batch.WriteString(line + "\n")
+			if n++; n >= storeBatch {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// close writes the results still waiting. No results may be observed after.
+func (w *influxWriter) close() {
+	if w == nil {
+		return
+	}
+	if w.conn != nil {
+		w.conn.Close()
+		return
+	}
+	close(w.lines)
+	<-w.done
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ipfsOptions configures where index chunks are pinned: an IPFS node's
+// API, Pinata, or both.
+type ipfsOptions struct {
+	api       string
+	pinataURL string
+	pinataJWT string
+	// retry is how long a failed pin waits before it is tried again,
+	// doubled after each failure up to an hour.
+	retry time.Duration
+	// gateway is the IPFS gateway a bootstrapped index is fetched from.
+	gateway string
+}
+
+// pinner adds files to IPFS and pins them, returning their CIDs.
+type pinner interface {
+	pin(ctx context.Context, name string, b []byte) (string, error)
+	String() string
+}
+
+func newPinners(o ipfsOptions, client *http.Client) []pinner {
+	var pinners []pinner
+	if o.api != "" {
+		pinners = append(pinners, &kuboPinner{api: strings.TrimSuffix(o.api, "/"), client: client})
+	}
+	if o.pinataJWT != "" {
+		pinners = append(pinners, &pinataPinner{url: strings.TrimSuffix(o.pinataURL, "/"), jwt: o.pinataJWT, client: client})
+	}
+	return pinners
+}
+
+// fileForm returns a multipart form with b as the file name, and fields.
+func fileForm(name string, b []byte, fields map[string]string) (*bytes.Buffer, string, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("file", name)
+	if err != nil {
+		return nil, "", err
+	}
+	fw.Write(b)
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	if err := mw.Close(); err != nil {
+		return nil, "", err
+	}
+	return &body, mw.FormDataContentType(), nil
+}
+
+// postForm posts a form and decodes the JSON response into v.
+func postForm(ctx context.Context, client *http.Client, url, jwt string, body io.Reader, contentType string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if jwt != "" {
+		req.Header.Set("Authorization", "Bearer "+jwt)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// kuboPinner adds files through the RPC API of an IPFS node such as Kubo.
+type kuboPinner struct {
+	api    string
+	client *http.Client
+}
+
+func (k *kuboPinner) String() string { return "IPFS API " + redactURL(k.api) }
+
+func (k *kuboPinner) pin(ctx context.Context, name string, b []byte) (string, error) {
+	body, contentType, err := fileForm(name, b, nil)
+	if err != nil {
+		return "", err
+	}
+	var added struct {
+		Hash string `json:"Hash"`
+	}
+	if err := postForm(ctx, k.client, k.api+"/api/v0/add?pin=true&cid-version=0", "", body, contentType, &added); err != nil {
+		return "", err
+	}
+	if added.Hash == "" {
+		return "", fmt.Errorf("no CID for %s", name)
+	}
+	return added.Hash, nil
+}
+
+// pinataPinner uploads files to Pinata, which pins them.
+type pinataPinner struct {
+	url    string
+	jwt    string
+	client *http.Client
+}
+
+func (p *pinataPinner) String() string { return "Pinata" }
+
+func (p *pinataPinner) pin(ctx context.Context, name string, b []byte) (string, error) {
+	meta, _ := json.Marshal(map[string]string{"name": name})
+	body, contentType, err := fileForm(name, b, map[string]string{
+		"pinataMetadata": string(meta),
+		"pinataOptions":  `{"cidVersion":0}`,
+	})
+	if err != nil {
+		return "", err
+	}
+	var pinned struct {
+		IpfsHash string `json:"IpfsHash"`
+	}
+	if err := postForm(ctx, p.client, p.url+"/pinning/pinFileToIPFS", p.jwt, body, contentType, &pinned); err != nil {
+		return "", err
+	}
+	if pinned.IpfsHash == "" {
+		return "", fmt.Errorf("no CID for %s", name)
+	}
+	return pinned.IpfsHash, nil
+}
+
+// pinFile pins the file at path with every pinner, returning its CID. The
+// pinners are expected to agree on it; if they don't, the first one's is
+// kept.
+func pinFile(ctx context.Context, pinners []pinner, path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	name := filepath.Base(path)
+	cid := ""
+	for _, p := range pinners {
+		got, err := p.pin(ctx, name, b)
+		if err != nil {
+			return "", fmt.Errorf("pinning %s with %s: %w", name, p, err)
+		}
+		if cid == "" {
+			cid = got
+		} else if got != cid {
+			slog.Warn("Pinners disagree on a CID", "file", name, "cid", cid, "other", got, "pinner", p.String())
+		}
+	}
+	return cid, nil
+}
+
+// runPinning pins each chunk and its bloom that the manifest lacks the CIDs
+// of, until ctx is done, recording the CIDs in the manifest. Failed pins
+// are retried, backing off, until they succeed.
+func (x *indexStage) runPinning(ctx context.Context) {
+	if len(x.pinners) == 0 {
+		return
+	}
+	delay := x.ipfs.retry
+	for {
+		err := x.pinPending(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		// After a failure, the chunks written meanwhile wait for the retry.
+		wake, retry := x.pinNow, (<-chan time.Time)(nil)
+		if err != nil {
+			slog.Warn("Pinning index chunk failed, retrying", "chain", x.chain, "in", delay, "error", err)
+			wake, retry = nil, time.After(delay)
+			delay = min(2*delay, time.Hour)
+		} else {
+			delay = x.ipfs.retry
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-wake:
+		case <-retry:
+		}
+	}
+}
+
+// pinPending pins the chunks not yet pinned, oldest first.
+func (x *indexStage) pinPending(ctx context.Context) error {
+	for {
+		r, ok := x.nextUnpinned()
+		if !ok {
+			return nil
+		}
+		bloomCID, err := pinFile(ctx, x.pinners, x.bloomPath(r))
+		if err != nil {
+			return err
+		}
+		indexCID, err := pinFile(ctx, x.pinners, x.chunkPath(r))
+		if err != nil {
+			return err
+		}
+		if err := x.pinned(r, bloomCID, indexCID); err != nil {
+			return err
+		}
+		slog.Info("Pinned index chunk", "chain", x.chain, "blocks", r.String(), "index", indexCID, "bloom", bloomCID)
+	}
+}
+
+// nextUnpinned returns the first chunk the manifest lacks a CID of.
+func (x *indexStage) nextUnpinned() (blockRange, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for _, c := range x.manifest.Chunks {
+		if c.BloomHash == "" || c.IndexHash == "" {
+			r, err := parseBlockRange(c.Range)
+			return r, err == nil
+		}
+	}
+	return blockRange{}, false
+}
+
+// pinned records the CIDs of the chunk r in the manifest.
+func (x *indexStage) pinned(r blockRange, bloomCID, indexCID string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for i := range x.manifest.Chunks {
+		if c := &x.manifest.Chunks[i]; c.Range == r.String() {
+			c.BloomHash, c.IndexHash = bloomCID, indexCID
+		}
+	}
+	return x.saveManifest()
+}
+
+// unpinned counts the chunks not yet pinned. The caller holds x.mu.
+func (x *indexStage) unpinned() int {
+	n := 0
+	for _, c := range x.manifest.Chunks {
+		if c.BloomHash == "" || c.IndexHash == "" {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// journal appends results to a file before they are queued for the store,
+// so that those a crash cuts off on their way are saved on the next start.
+// Each flush moves the file aside as a segment of its own, removed once its
+// results are saved; segments whose results could not be saved stay for
+// the next start too.
+type journal struct {
+	path string
+
+	mu sync.Mutex
+	f  *os.File
+	// n is how many results the file holds.
+	n int
+}
+
+// openJournal starts a journal at path, which replayJournal must have
+// emptied.
+func openJournal(path string) (*journal, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &journal{path: path, f: f}, nil
+}
+
+// journalSegments returns the files of the journal at path, oldest first.
+func journalSegments(path string) ([]string, error) {
+	segments, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	// The names end in nanoseconds, so they sort by time as long as they
+	// have as many digits.
+	if _, err := os.Stat(path); err == nil {
+		segments = append(segments, path)
+	}
+	return segments, nil
+}
+
+// replayJournal saves the results left in the journal at path to st, and
+// removes its files. It returns how many results it saved.
+func replayJournal(ctx context.Context, st store, path string) (int, error) {
+	segments, err := journalSegments(path)
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, segment := range segments {
+		f, err := os.Open(segment)
+		if err != nil {
+			return total, err
+		}
+		var results []storedResult
+		sc := bufio.NewScanner(f)
+		sc.Buffer(nil, 1<<20)
+		line := 0
+		for sc.Scan() {
+			line++
+			var r storedResult
+			if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+				// A crash can cut off the last line.
+				slog.Warn("Skipping bad journal entry", "path", segment, "line", line, "error", err)
+				continue
+			}
+			results = append(results, r)
+		}
+		f.Close()
+		if err := sc.Err(); err != nil {
+			return total, fmt.Errorf("%s: %w", segment, err)
+		}
+		for len(results) > 0 {
+			n := min(len(results), storeBatch)
+			if err := st.save(ctx, results[:n]); err != nil {
+				return total, err
+			}
+			results = results[n:]
+			total += n
+		}
+		if err := os.Remove(segment); err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// add appends r to the journal and then has queue queue it, so that
+// whatever rotate collects is in the segment it moves aside.
+func (j *journal) add(r storedResult, queue func()) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.f.Write(append(b, '\n')); err != nil {
+		slog.Error("Journaling result failed", "target", r.Target, "error", err)
+	} else {
+		j.n++
+	}
+	queue()
+}
+
+// rotate has collect gather the results queued so far, moves the file
+// holding them aside and returns its new name, empty if there were none.
+func (j *journal) rotate(collect func()) (string, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	collect()
+	if j.n == 0 {
+		return "", nil
+	}
+	if err := j.f.Close(); err != nil {
+		return "", err
+	}
+	segment := j.path + "." + strconv.FormatInt(time.Now().UnixNano(), 10)
+	if err := os.Rename(j.path, segment); err != nil {
+		return "", err
+	}
+	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return "", err
+	}
+	j.f, j.n = f, 0
+	return segment, nil
+}
+
+// close closes the journal, removing its file if everything in it was
+// saved.
+func (j *journal) close() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.f.Close()
+	if j.n == 0 {
+		os.Remove(j.path)
+	}
+}
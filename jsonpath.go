@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// jsonAssertion extracts a value from a JSON body with a JSONPath-like
+// expression and compares it against an expected value. Expressions take
+// the form "<path> <op> [<operand>]", for example:
+//
+//	result.syncing == false
+//	$.result > 0x10d4f0
+//	items[0].name exists
+//	error !exists
+//	result is string
+//	result.version matches ^v1\.
+//
+// Numbers given as hex strings ("0x1b4"), as Ethereum JSON-RPC returns
+// them, compare numerically against numeric operands.
+type jsonAssertion struct {
+	expr    string
+	path    []interface{} // string keys and int indexes
+	op      string
+	operand interface{}
+	re      *regexp.Regexp
+}
+
+var jsonOps = map[string]bool{
+	"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true,
+	"exists": false, "!exists": false, "is": true, "matches": true,
+}
+
+var jsonTypes = map[string]bool{
+	"string": true, "number": true, "bool": true, "null": true, "array": true, "object": true,
+}
+
+func newJSONAssertion(expr string) (assertion, error) {
+	parts := strings.SplitN(strings.TrimSpace(expr), " ", 3)
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("%q: want \"<path> <op> [<operand>]\"", expr)
+	}
+
+	a := &jsonAssertion{expr: expr, op: parts[1]}
+	needsOperand, ok := jsonOps[a.op]
+	if !ok {
+		return nil, fmt.Errorf("%q: unknown operator %q", expr, a.op)
+	}
+	if needsOperand != (len(parts) == 3) {
+		return nil, fmt.Errorf("%q: operator %s takes %s operand", expr, a.op, map[bool]string{true: "an", false: "no"}[needsOperand])
+	}
+
+	path, err := parseJSONPath(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("%q: %w", expr, err)
+	}
+	a.path = path
+
+	if !needsOperand {
+		return a, nil
+	}
+	operand := strings.TrimSpace(parts[2])
+	switch a.op {
+	case "is":
+		if !jsonTypes[operand] {
+			return nil, fmt.Errorf("%q: unknown type %q", expr, operand)
+		}
+		a.operand = operand
+	case "matches":
+		if a.re, err = regexp.Compile(operand); err != nil {
+			return nil, fmt.Errorf("%q: %w", expr, err)
+		}
+	default:
+		a.operand = parseJSONOperand(operand)
+		if a.op != "==" && a.op != "!=" {
+			if _, ok := toNumber(a.operand); !ok {
+				return nil, fmt.Errorf("%q: %s needs a numeric operand", expr, a.op)
+			}
+		}
+	}
+	return a, nil
+}
+
+// parseJSONPath splits a path such as "$.result.items[2]['odd key']" into
+// its keys and indexes. The leading "$" is optional.
+func parseJSONPath(path string) ([]interface{}, error) {
+	path = strings.TrimPrefix(path, "$")
+	var steps []interface{}
+	for len(path) > 0 {
+		switch path[0] {
+		case '.':
+			path = path[1:]
+		case '[':
+			end := strings.IndexByte(path, ']')
+			if end < 0 {
+				return nil, errors.New("unterminated [")
+			}
+			inner := path[1:end]
+			path = path[end+1:]
+			if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				steps = append(steps, inner[1:len(inner)-1])
+				continue
+			}
+			i, err := strconv.Atoi(inner)
+			if err != nil {
+				return nil, fmt.Errorf("bad index [%s]", inner)
+			}
+			steps = append(steps, i)
+		default:
+			end := strings.IndexAny(path, ".[")
+			if end < 0 {
+				end = len(path)
+			}
+			steps = append(steps, path[:end])
+			path = path[end:]
+		}
+	}
+	return steps, nil
+}
+
+// parseJSONOperand decodes operand as a JSON literal, falling back to
+// treating it as a bare string.
+func parseJSONOperand(operand string) interface{} {
+	dec := json.NewDecoder(strings.NewReader(operand))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err == nil && !dec.More() {
+		return v
+	}
+	return operand
+}
+
+func (a *jsonAssertion) check(r *response) error {
+	doc, err := r.json()
+	if err != nil {
+		return fmt.Errorf("JSON %s: body is not JSON: %s", a.expr, err)
+	}
+
+	got, found := lookupJSON(doc, a.path)
+	switch a.op {
+	case "exists":
+		if !found {
+			return fmt.Errorf("JSON %s: not found", a.expr)
+		}
+		return nil
+	case "!exists":
+		if found {
+			return fmt.Errorf("JSON %s: got %s", a.expr, compactJSON(got))
+		}
+		return nil
+	}
+	if !found {
+		return fmt.Errorf("JSON %s: not found", a.expr)
+	}
+
+	var pass bool
+	switch a.op {
+	case "is":
+		pass = jsonType(got) == a.operand
+	case "matches":
+		s, ok := got.(string)
+		if !ok {
+			s = compactJSON(got)
+		}
+		pass = a.re.MatchString(s)
+	case "==", "!=":
+		pass = jsonEqual(got, a.operand) == (a.op == "==")
+	default:
+		x, ok := toNumber(got)
+		if !ok {
+			return fmt.Errorf("JSON %s: %s is not a number", a.expr, compactJSON(got))
+		}
+		y, _ := toNumber(a.operand)
+		c := x.Cmp(y)
+		pass = a.op == "<" && c < 0 || a.op == "<=" && c <= 0 || a.op == ">" && c > 0 || a.op == ">=" && c >= 0
+	}
+
+	if !pass {
+		return fmt.Errorf("JSON %s: got %s", a.expr, compactJSON(got))
+	}
+	return nil
+}
+
+// json decodes the body once and caches the outcome for later assertions.
+func (r *response) json() (interface{}, error) {
+	if !r.jsonDone {
+		dec := json.NewDecoder(bytes.NewReader(r.body))
+		dec.UseNumber()
+		r.jsonErr = dec.Decode(&r.jsonValue)
+		if r.jsonErr != nil && r.truncated {
+			r.jsonErr = fmt.Errorf("%w (body truncated at %d bytes)", r.jsonErr, len(r.body))
+		}
+		r.jsonDone = true
+	}
+	return r.jsonValue, r.jsonErr
+}
+
+func lookupJSON(v interface{}, path []interface{}) (interface{}, bool) {
+	for _, step := range path {
+		switch s := step.(type) {
+		case string:
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if v, ok = m[s]; !ok {
+				return nil, false
+			}
+		case int:
+			l, ok := v.([]interface{})
+			if !ok {
+				return nil, false
+			}
+			if s < 0 {
+				s += len(l)
+			}
+			if s < 0 || s >= len(l) {
+				return nil, false
+			}
+			v = l[s]
+		}
+	}
+	return v, true
+}
+
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "bool"
+	case json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// jsonEqual compares numbers by value, so 0x10, 16 and 16.0 are all equal,
+// and everything else structurally.
+func jsonEqual(got, want interface{}) bool {
+	if y, ok := want.(json.Number); ok {
+		x, ok := toNumber(got)
+		if !ok {
+			return false
+		}
+		w, _ := toNumber(y)
+		return x.Cmp(w) == 0
+	}
+	return reflect.DeepEqual(got, want)
+}
+
+// toNumber converts JSON numbers, decimal strings and 0x-prefixed hex
+// strings to an arbitrary precision number.
+func toNumber(v interface{}) (*big.Float, bool) {
+	var s string
+	switch n := v.(type) {
+	case json.Number:
+		s = n.String()
+	case string:
+		s = n
+	default:
+		return nil, false
+	}
+
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		i, ok := new(big.Int).SetString(s[2:], 16)
+		if !ok {
+			return nil, false
+		}
+		return new(big.Float).SetInt(i), true
+	}
+	f, ok := new(big.Float).SetString(s)
+	return f, ok
+}
+
+func compactJSON(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// labelName matches label names, those Prometheus allows minus the ones
+// it reserves.
+var labelName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// setLabels adds the comma-separated name=value pairs in value to t's
+// labels. A pair without a value removes the label.
+func (t *target) setLabels(value string) error {
+	labels := make(map[string]string, len(t.labels))
+	for name, v := range t.labels {
+		labels[name] = v
+	}
+	for _, pair := range strings.Split(value, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, v, ok := strings.Cut(pair, "=")
+		name, v = strings.TrimSpace(name), strings.TrimSpace(v)
+		if !ok {
+			return fmt.Errorf("%q: want name=value", pair)
+		}
+		if !labelName.MatchString(name) || strings.HasPrefix(name, "__") || name == "target" {
+			return fmt.Errorf("bad label name %q", name)
+		}
+		if v == "" {
+			delete(labels, name)
+		} else {
+			labels[name] = v
+		}
+	}
+	t.labels = labels
+	return nil
+}
+
+// labelNames returns the names of labels in order.
+func labelNames(labels map[string]string) []string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// logLabels returns t's labels as a group for log entries. Handlers leave
+// out empty groups, so it can go in every entry about t.
+func (t *target) logLabels() slog.Attr {
+	return labelGroup(t.labels)
+}
+
+func labelGroup(labels map[string]string) slog.Attr {
+	attrs := make([]any, 0, len(labels))
+	for _, name := range labelNames(labels) {
+		attrs = append(attrs, slog.String(name, labels[name]))
+	}
+	return slog.Group("labels", attrs...)
+}
+
+// targetInfo exports scraper_target_info, 1 for every target with its labels,
+// for joining onto the other metrics by target. Targets needn't have the
+// same labels, so it is built when collected rather than kept in a vector,
+// and describes nothing to be registered unchecked.
+type targetInfo struct {
+	mu      sync.Mutex
+	targets []*target
+}
+
+func (c *targetInfo) set(targets []*target) {
+	c.mu.Lock()
+	c.targets = targets
+	c.mu.Unlock()
+}
+
+func (c *targetInfo) Describe(chan<- *prometheus.Desc) {}
+
+func (c *targetInfo) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	all := make(map[string]string)
+	for _, t := range c.targets {
+		for name := range t.labels {
+			all[name] = ""
+		}
+	}
+	names := labelNames(all)
+	desc := prometheus.NewDesc("scraper_target_info", "Labels of the targets being checked.",
+		append([]string{"target"}, names...), nil)
+	for _, t := range c.targets {
+		values := []string{t.url}
+		for _, name := range names {
+			values = append(values, t.labels[name])
+		}
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1, values...)
+	}
+}
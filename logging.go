@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// logLevel is the threshold of the default logger. It is set from the
+// config on start and on every reload.
+var logLevel slog.LevelVar
+
+// parseLogLevel works out the threshold from -log_level and the -verbose
+// and -quiet shorthands for debug and warn.
+func parseLogLevel(name string, verbose, quiet bool) (slog.Level, error) {
+	switch {
+	case verbose && quiet:
+		return 0, errors.New("-verbose and -quiet don't go together")
+	case verbose:
+		return slog.LevelDebug, nil
+	case quiet:
+		return slog.LevelWarn, nil
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return 0, fmt.Errorf("-log_level: %w", err)
+	}
+	return level, nil
+}
+
+// logRotation says when -log_file is rotated and how many old files are
+// kept.
+type logRotation struct {
+	// maxSize is the size in megabytes a file is rotated at.
+	maxSize int
+	// every rotates the file at this interval as well, 0 for size only.
+	every time.Duration
+	// maxAge and maxBackups bound the rotated files kept, 0 for no bound.
+	maxAge     time.Duration
+	maxBackups int
+	compress   bool
+}
+
+// openLogFile returns a writer appending to path and rotating it as o says.
+// Rotated files get a timestamp added to their name, and are gzipped when
+// o.compress is set.
+func openLogFile(ctx context.Context, path string, o logRotation) io.WriteCloser {
+	w := &lumberjack.Logger{
+		Filename:   path,
+		MaxSize:    o.maxSize,
+		MaxAge:     int((o.maxAge + 24*time.Hour - 1) / (24 * time.Hour)),
+		MaxBackups: o.maxBackups,
+		LocalTime:  true,
+		Compress:   o.compress,
+	}
+	if o.every > 0 {
+		go func() {
+			ticker := time.NewTicker(o.every)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					if err := w.Rotate(); err != nil {
+						slog.Error("Rotating log file failed", "error", err)
+					}
+				}
+			}
+		}()
+	}
+	return w
+}
+
+// newLogger returns a logger writing records to out in the given format,
+// text (key=value pairs) or json (one object per line).
+func newLogger(format string, out io.Writer) (*slog.Logger, error) {
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(out, &slog.HandlerOptions{Level: &logLevel})), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(out, &slog.HandlerOptions{Level: &logLevel})), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q, want text or json", format)
+}
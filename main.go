@@ -2,121 +2,323 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
-	"net/http"
+	"log/slog"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/namsral/flag"
 )
 
-const defaultTick = 60 * time.Second
+// drain waits for in-flight checks to return. Checks that are still running
+// after timeout have their context canceled and are waited for once more.
+func drain(wg *sync.WaitGroup, abort context.CancelFunc, timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
 
-type config struct {
-	contentType string
-	server      string
-	statusCode  int
-	tick        time.Duration
-	url         string
-	userAgent   string
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		slog.Warn("Shutdown timeout reached, aborting in-flight checks", "timeout", timeout)
+		abort()
+		<-done
+	}
 }
 
-func (c *config) init(args []string) error {
-	flags := flag.NewFlagSet(args[0], flag.ExitOnError)
-	flags.String(flag.DefaultConfigFlagname, "", "Path to config file")
+// reload re-reads the command line, environment and config file. On failure
+// the running configuration is kept and the error returned.
+func reload(c *config, args []string, m metrics) error {
+	old := c.client
+	if err := c.init(args); err != nil {
+		m.reloaded(false)
+		slog.Error("Reload failed, keeping current config", "error", err)
+		return err
+	}
+	m.reloaded(true)
+	logLevel.Set(c.logLevel)
+	old.CloseIdleConnections()
+	return nil
+}
 
-	var (
-		statusCode  = flags.Int("status", 200, "Response HTTP status code")
-		tick        = flags.Duration("tick", defaultTick, "Ticking interval")
-		server      = flags.String("server", "", "Server HTTP header value")
-		contentType = flags.String("content_type", "", "Content-Type HTTP header value")
-		userAgent   = flags.String("user_agent", "", "User-Agent HTTP header value")
-		url         = flags.String("url", "", "Request URL")
-	)
+// errChecksFailed is returned by run with -once when a check failed.
+var errChecksFailed = errors.New("checks failed")
 
-	if err := flags.Parse(args[1:]); err != nil {
+// run runs the scraper until ctx is done or it is signaled to stop, or with
+// -once until every target has been checked.
+func run(ctx context.Context, c *config, args []string, out io.Writer) error {
+	if err := c.init(args); err != nil {
 		return err
 	}
+	if c.checkConfig {
+		fmt.Fprintf(out, "Config OK, %d targets\n", len(c.targets))
+		return nil
+	}
+	// With -once, standard output is for the results.
+	logOut := out
+	if c.once {
+		logOut = os.Stderr
+	}
+	if c.logFile != "" {
+		f := openLogFile(ctx, c.logFile, c.logRotation)
+		defer f.Close()
+		logOut = f
+	}
+	logger, err := newLogger(c.logFormat, logOut)
+	if err != nil {
+		return err
+	}
+	logLevel.Set(c.logLevel)
+	slog.SetDefault(logger)
+	managed, err := newManagedTargets(c.managedTargetsFile)
+	if err != nil {
+		return err
+	}
+	targets := managed.with(c)
+	keys, err := newAPIKeys(c.adminKeysFile)
+	if err != nil {
+		return err
+	}
+	keys.configure(c)
 
-	c.statusCode = *statusCode
-	c.tick = *tick
-	c.server = *server
-	c.contentType = *contentType
-	c.userAgent = *userAgent
-	c.url = *url
+	if c.tracing.endpoint != "" {
+		shutdown, err := setupTracing(ctx, c.tracing)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			flush, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := shutdown(flush); err != nil {
+				slog.Error("Flushing traces failed", "error", err)
+			}
+		}()
+		slog.Info("Exporting traces", "endpoint", c.tracing.endpoint)
+	}
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	return nil
-}
+	if c.once {
+		if !printResults(out, checkAll(ctx, targets, c.workers)) {
+			return errChecksFailed
+		}
+		return nil
+	}
+	slog.Info("Starting", "targets", len(targets), "pid", os.Getpid())
 
-func cancel() {
-	log.Println("I am dying, please wait...")
-	time.Sleep(2 * time.Second)
-	log.Println("I am dead.")
-}
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	defer signal.Stop(hupChan)
 
-func run(ctx context.Context, c *config, out io.Writer) error {
-	c.init(os.Args)
-	log.SetOutput(out)
-	log.Println("Starting...", c.tick, os.Getpid())
+	// The config and targets files and whether they are watched are fixed
+	// at startup, as are the targets URL and how often it is polled;
+	// changing any takes a restart. Files the targets file includes are not
+	// watched.
+	reloadChan := make(chan struct{}, 1)
+	if c.watchConfig {
+		for _, path := range []string{c.configFile, c.targetsFile} {
+			if path == "" {
+				continue
+			}
+			if err := watchConfig(ctx, path, reloadChan); err != nil {
+				return err
+			}
+			slog.Info("Watching config file for changes", "path", path)
+		}
+	}
+	refreshChan := make(chan struct{}, 1)
+	if c.targetsURL != "" && c.targetsRefresh > 0 {
+		go pollTargets(ctx, c.targetsURL, c.targetsRefresh, refreshChan)
+		slog.Info("Polling targets for changes", "url", c.targetsURL, "every", c.targetsRefresh)
+	}
 
-	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	// Checks run on their own context so that a shutdown lets them finish
+	// instead of cutting them off mid-request.
+	work, abort := context.WithCancel(context.Background())
+	defer abort()
 
-	for {
-		select {
-		case s := <-signalChan:
-			switch s {
-			case syscall.SIGINT, syscall.SIGTERM:
-				log.Printf("Got SIGINT/SIGTERM, exiting.")
-				cancel()
-				os.Exit(1)
-			case syscall.SIGHUP:
-				log.Printf("Got SIGHUP, reloading.")
-				c.init(os.Args)
-			}
-		case <-ctx.Done():
-			return nil
-		case <-time.Tick(c.tick):
-			resp, err := http.Get(c.url)
+	m, err := newMetrics(c.metrics)
+	if err != nil {
+		return err
+	}
+	var writer *storeWriter
+	if c.store.url != "" {
+		st, err := openStore(c.store.url)
+		if err != nil {
+			return err
+		}
+		var j *journal
+		if c.store.journal != "" {
+			n, err := replayJournal(ctx, st, c.store.journal)
 			if err != nil {
+				st.close()
+				return fmt.Errorf("replaying journal: %w", err)
+			}
+			if n > 0 {
+				slog.Info("Replayed journal", "path", c.store.journal, "results", n)
+			}
+			if j, err = openJournal(c.store.journal); err != nil {
+				st.close()
 				return err
 			}
-			log.Print(os.Getpid(), ": ")
-			if resp.StatusCode != c.statusCode {
-				log.Printf("Status code mismatch, got: %d\n", resp.StatusCode)
+		}
+		writer = newStoreWriter(st, c.store.flush, j)
+		defer writer.close()
+		slog.Info("Storing results", "store", redactURL(c.store.url))
+		go pruneResults(ctx, st, c.store.retention)
+	}
+	var exp *exporter
+	if c.export.path != "" {
+		if exp, err = newExporter(ctx, c.export); err != nil {
+			return err
+		}
+		defer exp.close()
+		slog.Info("Exporting results", "path", c.export.path)
+	}
+	var influx *influxWriter
+	if c.influx.url != "" {
+		if influx, err = newInfluxWriter(c.influx); err != nil {
+			return err
+		}
+		defer influx.close()
+		slog.Info("Writing results to Influx", "url", redactURL(c.influx.url))
+	}
+	hist := newHistory(c.historySize)
+	if writer != nil {
+		if err := hist.restore(ctx, writer.store, targets); err != nil {
+			slog.Warn("Restoring history failed", "error", err)
+		}
+	}
+	s := newScheduler(work, c.workers, m, newHealth(c.stallTimeout), hist, newAlerter(work, hist, c.alertResults), writer, exp, influx)
+	if c.stateFile != "" {
+		n, err := loadState(c.stateFile, s.alerts, hist)
+		if err != nil {
+			slog.Warn("Restoring state failed", "path", c.stateFile, "error", err)
+		} else if n > 0 {
+			slog.Info("Restored state", "path", c.stateFile, "targets", n)
+		}
+	}
+	var chains []*blockScraper
+	for _, o := range c.chains {
+		if o.bootstrap != "" {
+			if err := bootstrapIndex(ctx, o, c.client); err != nil {
+				return fmt.Errorf("chain %s: bootstrapping the index: %w", o.name, err)
 			}
-
-			if s := resp.Header.Get("server"); s != c.server {
-				log.Printf("Server header mismatch, got: %s\n", s)
+		}
+		bs, err := newBlockScraper(o, c.client, m)
+		if err != nil {
+			return err
+		}
+		// A node that can't serve the stages stops the scraper here rather
+		// than leaving gaps in the index; one that can't be reached is
+		// probed again once scraping starts.
+		if err := bs.adapt(ctx); err != nil {
+			var incapable *incapableError
+			if errors.As(err, &incapable) {
+				return fmt.Errorf("chain %s: %w", o.name, err)
 			}
+			slog.Warn("Probing the RPC provider failed", "chain", o.name, "error", err)
+		}
+		chains = append(chains, bs)
+	}
+	if c.adminAddr != "" {
+		if err := serveAdmin(ctx, c.adminAddr, s, managed, keys, chains, c.pprof); err != nil {
+			return err
+		}
+		slog.Info("Serving admin endpoints", "addr", c.adminAddr)
+	}
+	if c.grpcAddr != "" {
+		if err := serveGRPC(ctx, c.grpcAddr, managed, keys, s.feed); err != nil {
+			return err
+		}
+		slog.Info("Serving the gRPC API", "addr", c.grpcAddr)
+	}
+	ctlReloads := make(chan chan error)
+	if c.controlSocket != "" {
+		if err := serveControl(ctx, c.controlSocket, s, ctlReloads); err != nil {
+			return err
+		}
+		slog.Info("Serving the control socket", "path", c.controlSocket)
+	}
+	if c.uptimeReport > 0 {
+		go reportUptime(ctx, s.history, c.uptimeReport)
+	}
+	s.start(targets)
+	for _, bs := range chains {
+		go bs.run(ctx)
+	}
 
-			if ct := resp.Header.Get("content-type"); ct != c.contentType {
-				log.Printf("Content-Type header mismatch, got: %s\n", ct)
-			}
+	restart := func() error {
+		err := reload(c, args, m)
+		s.health.reloaded(err)
+		if err == nil {
+			keys.configure(c)
+			s.start(managed.with(c))
+		}
+		return err
+	}
 
-			if ua := resp.Header.Get("user-agent"); ua != c.userAgent {
-				log.Printf("User-Agent header mismatch, got: %s\n", ua)
+	for {
+		select {
+		case <-hupChan:
+			slog.Info("Got SIGHUP, reloading")
+			restart()
+		case <-reloadChan:
+			slog.Info("Config file changed, reloading")
+			restart()
+		case <-refreshChan:
+			slog.Info("Remote targets changed, reloading")
+			restart()
+		case <-managed.reload:
+			slog.Info("Targets changed through the admin API, reloading")
+			restart()
+		case done := <-ctlReloads:
+			slog.Info("Asked to reload through the control socket")
+			done <- restart()
+		case <-ctx.Done():
+			slog.Info("Shutting down, waiting for in-flight checks")
+			s.halt()
+			drain(&s.wg, abort, c.shutdownTimeout)
+			drain(&s.alerts.pending, abort, c.shutdownTimeout)
+			for _, bs := range chains {
+				bs.wait()
 			}
+			if c.stateFile != "" {
+				if err := saveState(c.stateFile, s.alerts, s.history); err != nil {
+					slog.Error("Saving state failed", "path", c.stateFile, "error", err)
+				}
+			}
+			slog.Info("Stopped")
+			return nil
 		}
 	}
 }
 
 func main() {
-	ctx := context.Background()
-	ctx, cancel := context.WithCancel(ctx)
-
-	c := &config{}
+	cmd, args := parseCommand(os.Args)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", os.Args[1])
+		usage(os.Stderr)
+		os.Exit(2)
+	}
 
-	defer func() {
-		cancel()
-	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	code, err := cmd.run(ctx, args, os.Stdout)
+	cancel()
 
-	if err := run(ctx, c, os.Stdout); err != nil {
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(2)
+	}
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err)
 		os.Exit(1)
 	}
+	os.Exit(code)
 }
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maintenanceWindow is a period during which a target's failures are
+// recorded but not alerted on. It is either a one-off period from start to
+// end, or recurs at every match of schedule for duration.
+type maintenanceWindow struct {
+	start, end time.Time
+	schedule   *cronSchedule
+	duration   time.Duration
+}
+
+// parseMaintenance parses semicolon-separated windows, each either two
+// RFC 3339 times separated by a slash, e.g.
+// "2024-05-01T02:00:00Z/2024-05-01T04:00:00Z", or a cron expression followed
+// by "for" and a duration, e.g. "0 3 * * sun for 2h".
+func parseMaintenance(value string) ([]maintenanceWindow, error) {
+	var windows []maintenanceWindow
+	for _, part := range strings.Split(value, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if expr, d, ok := strings.Cut(part, " for "); ok {
+			sched, err := parseCron(strings.TrimSpace(expr))
+			if err != nil {
+				return nil, err
+			}
+			duration, err := parseInterval(strings.TrimSpace(d))
+			if err != nil {
+				return nil, err
+			}
+			windows = append(windows, maintenanceWindow{schedule: sched, duration: duration})
+			continue
+		}
+		from, to, ok := strings.Cut(part, "/")
+		if !ok {
+			return nil, fmt.Errorf("%q: want start/end or \"<cron> for <duration>\"", part)
+		}
+		start, err := time.Parse(time.RFC3339, strings.TrimSpace(from))
+		if err != nil {
+			return nil, err
+		}
+		end, err := time.Parse(time.RFC3339, strings.TrimSpace(to))
+		if err != nil {
+			return nil, err
+		}
+		if !end.After(start) {
+			return nil, fmt.Errorf("%q: ends before it starts", part)
+		}
+		windows = append(windows, maintenanceWindow{start: start, end: end})
+	}
+	return windows, nil
+}
+
+// covers reports whether at falls within the window.
+func (w maintenanceWindow) covers(at time.Time) bool {
+	if w.schedule == nil {
+		return !at.Before(w.start) && at.Before(w.end)
+	}
+	// The latest match that could still cover at is the first one after
+	// the window's length before it.
+	m := w.schedule.next(at.Add(-w.duration))
+	return !m.IsZero() && !m.After(at)
+}
+
+// silence mutes alerts about a target, or all of them when Target is empty,
+// until it ends or is lifted. Silences are set at runtime through the admin
+// API and, unlike maintenance windows, don't survive a restart.
+type silence struct {
+	ID      int       `json:"id"`
+	Target  string    `json:"target,omitempty"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Comment string    `json:"comment,omitempty"`
+}
+
+// silences holds the silences in effect.
+type silences struct {
+	mu     sync.Mutex
+	nextID int
+	list   []silence
+}
+
+func (s *silences) covers(url string, at time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, si := range s.list {
+		if (si.Target == "" || si.Target == url) && !at.Before(si.Start) && at.Before(si.End) {
+			return true
+		}
+	}
+	return false
+}
+
+// active drops the silences that have ended and returns the rest.
+func (s *silences) active(now time.Time) []silence {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := s.list[:0]
+	for _, si := range s.list {
+		if now.Before(si.End) {
+			list = append(list, si)
+		}
+	}
+	s.list = list
+	return append([]silence{}, list...)
+}
+
+func (s *silences) add(si silence) silence {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	si.ID = s.nextID
+	s.list = append(s.list, si)
+	return si
+}
+
+func (s *silences) remove(id int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, si := range s.list {
+		if si.ID == id {
+			s.list = append(s.list[:i], s.list[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// silenced reports whether alerts about t are muted at at, by one of its
+// maintenance windows or a silence.
+func (a *alerter) silenced(t *target, at time.Time) bool {
+	for _, w := range t.maintenance {
+		if w.covers(at) {
+			return true
+		}
+	}
+	return a.silences.covers(t.url, at)
+}
+
+// serveSilences lists silences on GET and adds one on POST. A new silence is
+// given as JSON with the target, empty for all, either its duration or its
+// end time, and an optional comment.
+func serveSilences(a *alerter) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(a.silences.active(time.Now()))
+		case http.MethodPost:
+			si, err := a.newSilence(req)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			si = a.silences.add(si)
+			slog.Info("Silenced alerts", "id", si.ID, "target", si.Target, "end", si.End, "comment", si.Comment)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(si)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// liftSilence lifts the silence named by the id path value.
+func liftSilence(a *alerter) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		id, err := strconv.Atoi(req.PathValue("id"))
+		if err != nil || !a.silences.remove(id) {
+			http.Error(w, "no such silence", http.StatusNotFound)
+			return
+		}
+		slog.Info("Lifted silence", "id", id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// silenceRequest is what POST /silences takes: a target, empty for all,
+// and either a duration or an end.
+type silenceRequest struct {
+	Target   string    `json:"target,omitempty"`
+	Duration string    `json:"duration,omitempty"`
+	End      time.Time `json:"end,omitempty"`
+	Comment  string    `json:"comment,omitempty"`
+}
+
+func (a *alerter) newSilence(req *http.Request) (silence, error) {
+	var body silenceRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return silence{}, err
+	}
+	if body.Target != "" && !a.configured(body.Target) {
+		return silence{}, fmt.Errorf("no target %s", body.Target)
+	}
+
+	si := silence{Target: body.Target, Start: time.Now(), End: body.End, Comment: body.Comment}
+	switch {
+	case body.Duration != "" && !body.End.IsZero():
+		return silence{}, errors.New("give either duration or end")
+	case body.Duration != "":
+		d, err := parseInterval(body.Duration)
+		if err != nil {
+			return silence{}, fmt.Errorf("duration: %w", err)
+		}
+		si.End = si.Start.Add(d)
+	case !si.End.After(si.Start):
+		return silence{}, errors.New("give a duration or an end in the future")
+	}
+	return si, nil
+}
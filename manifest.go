@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// indexManifest lists the chunks of an index with their blooms, as
+// manifest.json has it next to them and /chains/{chain}/manifest serves
+// it, so that those who fetch the index can tell what there is and check
+// what they got.
+type indexManifest struct {
+	Version string          `json:"version"`
+	Chain   string          `json:"chain"`
+	Chunks  []manifestChunk `json:"chunks"`
+}
+
+// manifestChunk is a chunk in the manifest. The hashes are the IPFS CIDs
+// of the files once they're pinned.
+type manifestChunk struct {
+	Range       string `json:"range"`
+	BloomHash   string `json:"bloomHash,omitempty"`
+	BloomSize   int64  `json:"bloomSize"`
+	BloomSHA256 string `json:"bloomSha256"`
+	IndexHash   string `json:"indexHash,omitempty"`
+	IndexSize   int64  `json:"indexSize"`
+	IndexSHA256 string `json:"indexSha256"`
+}
+
+func (x *indexStage) manifestPath() string {
+	return filepath.Join(x.dir, "manifest.json")
+}
+
+// loadManifest loads the manifest and brings it in line with the chunks,
+// adding those missing from it and dropping those no longer there.
+func (x *indexStage) loadManifest() error {
+	var err error
+	if x.manifest, err = readManifest(x.manifestPath()); err != nil {
+		return err
+	}
+	listed := make(map[string]manifestChunk)
+	for _, c := range x.manifest.Chunks {
+		listed[c.Range] = c
+	}
+	chunks := make([]manifestChunk, 0, len(x.chunks))
+	changed := len(x.manifest.Chunks) != len(x.chunks) || x.manifest.Version != indexVersion
+	for _, r := range x.chunks {
+		c, ok := listed[r.String()]
+		if !ok {
+			if c, err = x.manifestChunk(r); err != nil {
+				return err
+			}
+			changed = true
+		}
+		chunks = append(chunks, c)
+	}
+	x.manifest.Version, x.manifest.Chain, x.manifest.Chunks = indexVersion, x.chain, chunks
+	if !changed {
+		return nil
+	}
+	return x.saveManifest()
+}
+
+// readManifest reads the manifest at path, an empty one of this version
+// if there is none.
+func readManifest(path string) (indexManifest, error) {
+	m := indexManifest{Version: indexVersion}
+	b, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return m, nil
+	case err != nil:
+		return m, err
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return m, fmt.Errorf("%s: %w", path, err)
+	}
+	return m, nil
+}
+
+// manifestChunk works out the entry of the chunk r.
+func (x *indexStage) manifestChunk(r blockRange) (manifestChunk, error) {
+	c := manifestChunk{Range: r.String()}
+	var err error
+	if c.BloomSize, c.BloomSHA256, err = fileDigest(x.bloomPath(r)); err != nil {
+		return c, err
+	}
+	if c.IndexSize, c.IndexSHA256, err = fileDigest(x.chunkPath(r)); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+func fileDigest(path string) (int64, string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, "", err
+	}
+	sum := sha256.Sum256(b)
+	return int64(len(b)), hex.EncodeToString(sum[:]), nil
+}
+
+// saveManifest writes the manifest. The caller holds x.mu, but for
+// loadManifest.
+func (x *indexStage) saveManifest() error {
+	b, err := json.MarshalIndent(x.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return replaceFileMode(x.manifestPath(), append(b, '\n'), 0o644)
+}
+
+// addToManifest adds the chunk r, just written, to the manifest. The
+// caller holds x.mu.
+func (x *indexStage) addToManifest(r blockRange) error {
+	c, err := x.manifestChunk(r)
+	if err != nil {
+		return err
+	}
+	x.manifest.Chunks = append(x.manifest.Chunks, c)
+	return x.saveManifest()
+}
+
+// dropFromManifest removes the chunk r from the manifest. The caller
+// holds x.mu.
+func (x *indexStage) dropFromManifest(r blockRange) error {
+	x.manifest.Chunks = slices.DeleteFunc(x.manifest.Chunks, func(c manifestChunk) bool { return c.Range == r.String() })
+	return x.saveManifest()
+}
+
+// currentManifest returns a copy of the manifest.
+func (x *indexStage) currentManifest() indexManifest {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	m := x.manifest
+	m.Chunks = slices.Clone(m.Chunks)
+	return m
+}
+
+// serveManifest answers with the manifest of the chain named in the path.
+func serveManifest(scrapers []*blockScraper) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		name := req.PathValue("chain")
+		i := slices.IndexFunc(scrapers, func(s *blockScraper) bool { return s.o.name == name })
+		switch {
+		case i < 0:
+			http.Error(w, fmt.Sprintf("no chain %s", name), http.StatusNotFound)
+		case scrapers[i].index == nil:
+			http.Error(w, fmt.Sprintf("chain %s has no index; set -chain_dir", name), http.StatusNotFound)
+		default:
+			writeJSON(w, http.StatusOK, scrapers[i].index.currentManifest())
+		}
+	}
+}
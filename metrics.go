@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics is what checks and the scheduler are reported to. There is an
+// implementation for each -metrics_backend.
+type metrics interface {
+	// observe records the outcome of a check.
+	observe(r *result)
+	// inFlight adds delta to the number of checks running.
+	inFlight(delta int)
+	// overrun counts a scheduled check of t skipped because the previous
+	// one was still running.
+	overrun(t *target)
+	// reloaded counts a configuration reload.
+	reloaded(ok bool)
+	// retain drops what is kept about targets no longer configured.
+	retain(targets []*target)
+	// chainProgress records the next block the scraper of chain is at and
+	// the head of the chain.
+	chainProgress(chain string, next, head uint64)
+	// chainBlock counts a block processed by the scraper of chain, with
+	// its transactions and the appearances found in it.
+	chainBlock(chain string, transactions, appearances int)
+	// chainReorg counts a reorg the scraper of chain rolled back from, and
+	// the blocks it orphaned.
+	chainReorg(chain string, orphaned int)
+	// chainBlobs counts the blob transactions of a block processed by the
+	// scraper of chain, the blobs they carried and the blob gas the block
+	// used, and records its excess blob gas.
+	chainBlobs(chain string, transactions, blobs int, gasUsed, excessGas uint64)
+	// chainFailover counts the scraper of chain leaving an RPC provider
+	// for another.
+	chainFailover(chain string)
+	// handler serves the metrics for scraping, or is nil for backends that
+	// push them.
+	handler() http.Handler
+}
+
+// metricsOptions selects and configures the metrics backend.
+type metricsOptions struct {
+	backend string
+	statsd  statsdOptions
+}
+
+func newMetrics(o metricsOptions) (metrics, error) {
+	switch o.backend {
+	case "prometheus":
+		return newPromMetrics(), nil
+	case "statsd":
+		return newStatsdMetrics(o.statsd)
+	}
+	return nil, fmt.Errorf("unknown metrics backend %q, want prometheus or statsd", o.backend)
+}
+
+// promMetrics holds Prometheus metrics. They live on a registry of their
+// own, served at /metrics on the admin address.
+type promMetrics struct {
+	registry *prometheus.Registry
+
+	checks      *prometheus.CounterVec
+	failures    *prometheus.CounterVec
+	duration    *prometheus.HistogramVec
+	latency     *prometheus.HistogramVec
+	lastSuccess *prometheus.GaugeVec
+	overruns    *prometheus.CounterVec
+	targets     prometheus.Gauge
+	running     prometheus.Gauge
+	reloads     *prometheus.CounterVec
+	info        targetInfo
+	chainNext   *prometheus.GaugeVec
+	chainHead   *prometheus.GaugeVec
+	blocks      *prometheus.CounterVec
+	txs         *prometheus.CounterVec
+	appearances *prometheus.CounterVec
+	reorgs      *prometheus.CounterVec
+	orphaned    *prometheus.CounterVec
+	failovers   *prometheus.CounterVec
+	blobTxs     *prometheus.CounterVec
+	blobs       *prometheus.CounterVec
+	blobGas     *prometheus.CounterVec
+	excessGas   *prometheus.GaugeVec
+
+	mu   sync.Mutex
+	urls map[string]bool
+}
+
+func newPromMetrics() *promMetrics {
+	m := &promMetrics{
+		registry: prometheus.NewRegistry(),
+		checks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "scraper_checks_total",
+			Help: "Checks performed.",
+		}, []string{"target"}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "scraper_check_failures_total",
+			Help: "Failed checks by reason; a check that fails several expectations counts once for each reason.",
+		}, []string{"target", "reason"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "scraper_check_duration_seconds",
+			Help:    "Time taken by whole checks, including retries.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"target"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "scraper_request_latency_seconds",
+			Help:    "Latency of the final attempt of checks that got a response.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"target"}),
+		lastSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "scraper_last_success_timestamp_seconds",
+			Help: "When the last successful check of a target started.",
+		}, []string{"target"}),
+		overruns: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "scraper_schedule_overruns_total",
+			Help: "Scheduled checks skipped because an earlier one was still running.",
+		}, []string{"target"}),
+		targets: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "scraper_targets",
+			Help: "Targets being checked.",
+		}),
+		running: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "scraper_checks_in_flight",
+			Help: "Checks currently running.",
+		}),
+		reloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "scraper_config_reloads_total",
+			Help: "Configuration reloads by result.",
+		}, []string{"result"}),
+		chainNext: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "scraper_chain_next_block",
+			Help: "First block the block scraper has yet to process.",
+		}, []string{"chain"}),
+		chainHead: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "scraper_chain_head_block",
+			Help: "Latest block of the chain, as the node last reported it.",
+		}, []string{"chain"}),
+		blocks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "scraper_chain_blocks_total",
+			Help: "Blocks processed by the block scraper.",
+		}, []string{"chain"}),
+		txs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "scraper_chain_transactions_total",
+			Help: "Transactions of the blocks processed by the block scraper.",
+		}, []string{"chain"}),
+		appearances: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "scraper_chain_appearances_total",
+			Help: "Appearances of addresses found in the blocks processed by the block scraper.",
+		}, []string{"chain"}),
+		reorgs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "scraper_chain_reorgs_total",
+			Help: "Reorgs the block scraper rolled back from.",
+		}, []string{"chain"}),
+		orphaned: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "scraper_chain_orphaned_blocks_total",
+			Help: "Blocks the block scraper had processed that reorgs orphaned.",
+		}, []string{"chain"}),
+		failovers: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "scraper_chain_rpc_failovers_total",
+			Help: "Times the block scraper left an RPC provider for another.",
+		}, []string{"chain"}),
+		blobTxs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "scraper_chain_blob_transactions_total",
+			Help: "Blob transactions of the blocks processed by the block scraper.",
+		}, []string{"chain"}),
+		blobs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "scraper_chain_blobs_total",
+			Help: "Blobs carried by the blob transactions of the blocks processed by the block scraper.",
+		}, []string{"chain"}),
+		blobGas: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "scraper_chain_blob_gas_used_total",
+			Help: "Blob gas used by the blocks processed by the block scraper.",
+		}, []string{"chain"}),
+		excessGas: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "scraper_chain_excess_blob_gas",
+			Help: "Excess blob gas of the last block processed by the block scraper, which sets the blob base fee.",
+		}, []string{"chain"}),
+		urls: make(map[string]bool),
+	}
+	m.registry.MustRegister(
+		m.checks, m.failures, m.duration, m.latency, m.lastSuccess,
+		m.overruns, m.targets, m.running, m.reloads, &m.info,
+		m.chainNext, m.chainHead, m.blocks, m.txs, m.appearances, m.reorgs, m.orphaned, m.failovers,
+		m.blobTxs, m.blobs, m.blobGas, m.excessGas,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+func (m *promMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+func (m *promMetrics) observe(r *result) {
+	url := redactURL(r.target.url)
+	m.checks.WithLabelValues(url).Inc()
+	m.duration.WithLabelValues(url).Observe(r.duration.Seconds())
+	if r.err != nil {
+		m.failures.WithLabelValues(url, "error").Inc()
+		return
+	}
+	m.latency.WithLabelValues(url).Observe(r.latency.Seconds())
+
+	seen := make(map[string]bool)
+	for _, f := range r.failures {
+		if !seen[f.reason] {
+			seen[f.reason] = true
+			m.failures.WithLabelValues(url, f.reason).Inc()
+		}
+	}
+	if r.ok() {
+		m.lastSuccess.WithLabelValues(url).Set(float64(r.start.UnixNano()) / 1e9)
+	}
+}
+
+func (m *promMetrics) inFlight(delta int) {
+	m.running.Add(float64(delta))
+}
+
+func (m *promMetrics) overrun(t *target) {
+	m.overruns.WithLabelValues(redactURL(t.url)).Inc()
+}
+
+func (m *promMetrics) reloaded(ok bool) {
+	result := "ok"
+	if !ok {
+		result = "error"
+	}
+	m.reloads.WithLabelValues(result).Inc()
+}
+
+func (m *promMetrics) retain(targets []*target) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	next := make(map[string]bool, len(targets))
+	for _, t := range targets {
+		next[redactURL(t.url)] = true
+	}
+	for url := range m.urls {
+		if next[url] {
+			continue
+		}
+		labels := prometheus.Labels{"target": url}
+		m.checks.DeletePartialMatch(labels)
+		m.failures.DeletePartialMatch(labels)
+		m.duration.DeletePartialMatch(labels)
+		m.latency.DeletePartialMatch(labels)
+		m.lastSuccess.DeletePartialMatch(labels)
+		m.overruns.DeletePartialMatch(labels)
+	}
+	m.urls = next
+	m.targets.Set(float64(len(targets)))
+	m.info.set(targets)
+}
+
+func (m *promMetrics) chainProgress(chain string, next, head uint64) {
+	m.chainNext.WithLabelValues(chain).Set(float64(next))
+	m.chainHead.WithLabelValues(chain).Set(float64(head))
+}
+
+func (m *promMetrics) chainBlock(chain string, transactions, appearances int) {
+	m.blocks.WithLabelValues(chain).Inc()
+	m.txs.WithLabelValues(chain).Add(float64(transactions))
+	m.appearances.WithLabelValues(chain).Add(float64(appearances))
+}
+
+func (m *promMetrics) chainReorg(chain string, orphaned int) {
+	m.reorgs.WithLabelValues(chain).Inc()
+	m.orphaned.WithLabelValues(chain).Add(float64(orphaned))
+}
+
+func (m *promMetrics) chainBlobs(chain string, transactions, blobs int, gasUsed, excessGas uint64) {
+	m.blobTxs.WithLabelValues(chain).Add(float64(transactions))
+	m.blobs.WithLabelValues(chain).Add(float64(blobs))
+	m.blobGas.WithLabelValues(chain).Add(float64(gasUsed))
+	m.excessGas.WithLabelValues(chain).Set(float64(excessGas))
+}
+
+func (m *promMetrics) chainFailover(chain string) {
+	m.failovers.WithLabelValues(chain).Inc()
+}
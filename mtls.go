@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// tlsFiles are the PEM files a target authenticates itself with and, when ca
+// is set, verifies servers against instead of the system roots.
+type tlsFiles struct {
+	cert string
+	key  string
+	ca   string
+}
+
+func (f tlsFiles) validate() error {
+	if (f.cert == "") != (f.key == "") {
+		return errors.New("tls_cert and tls_key must be given together")
+	}
+	_, err := newTLSCredentials(f).load()
+	return err
+}
+
+// tlsCredentials holds what was last read from a set of tlsFiles. The files
+// are checked for changes on every new connection, so rotated certificates
+// are picked up without a reload.
+type tlsCredentials struct {
+	files tlsFiles
+
+	mu    sync.Mutex
+	stamp string
+	creds loadedCredentials
+}
+
+type loadedCredentials struct {
+	cert *tls.Certificate
+	pool *x509.CertPool
+}
+
+func newTLSCredentials(files tlsFiles) *tlsCredentials {
+	return &tlsCredentials{files: files}
+}
+
+// load returns the current credentials, re-reading the files if any of them
+// has changed since last time.
+func (c *tlsCredentials) load() (loadedCredentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stamp := ""
+	for _, name := range []string{c.files.cert, c.files.key, c.files.ca} {
+		if name == "" {
+			continue
+		}
+		fi, err := os.Stat(name)
+		if err != nil {
+			return loadedCredentials{}, err
+		}
+		stamp += fmt.Sprintf("%s %d %d\n", name, fi.Size(), fi.ModTime().UnixNano())
+	}
+	if stamp == c.stamp {
+		return c.creds, nil
+	}
+
+	var next loadedCredentials
+	if c.files.cert != "" {
+		cert, err := tls.LoadX509KeyPair(c.files.cert, c.files.key)
+		if err != nil {
+			return loadedCredentials{}, err
+		}
+		next.cert = &cert
+	}
+	if c.files.ca != "" {
+		pem, err := os.ReadFile(c.files.ca)
+		if err != nil {
+			return loadedCredentials{}, err
+		}
+		next.pool = x509.NewCertPool()
+		if !next.pool.AppendCertsFromPEM(pem) {
+			return loadedCredentials{}, fmt.Errorf("%s: no certificates found", c.files.ca)
+		}
+	}
+	c.stamp = stamp
+	c.creds = next
+	return next, nil
+}
+
+// apply makes cfg present the client certificate and verify servers against
+// the CA bundle, both as currently found on disk.
+func (c *tlsCredentials) apply(cfg *tls.Config) {
+	if c.files.cert != "" {
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			creds, err := c.load()
+			if err != nil {
+				return nil, err
+			}
+			return creds.cert, nil
+		}
+	}
+	if c.files.ca == "" || cfg.InsecureSkipVerify {
+		return
+	}
+	// RootCAs can't change once the config is in use, so the standard
+	// verification is replaced by one against the bundle on disk.
+	cfg.InsecureSkipVerify = true
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		creds, err := c.load()
+		if err != nil {
+			return err
+		}
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("no server certificate")
+		}
+		opts := x509.VerifyOptions{
+			DNSName:       cs.ServerName,
+			Roots:         creds.pool,
+			Intermediates: x509.NewCertPool(),
+			CurrentTime:   time.Now(),
+		}
+		for _, cert := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err = cs.PeerCertificates[0].Verify(opts)
+		return err
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// headWatcher follows the head of a chain over a WebSocket subscription to
+// newHeads, waking the scraper as each block arrives so that it needn't
+// poll for them. While the subscription is down, the scraper polls.
+type headWatcher struct {
+	chain string
+	url   string
+	// idle is how long the subscription may go without a block before
+	// it's taken for dropped, and retry how long the watcher waits before
+	// subscribing again, doubled for every failure in a row up to five
+	// minutes.
+	idle, retry time.Duration
+	// wake is signalled for every block, and when the subscription drops.
+	wake       chan struct{}
+	subscribed atomic.Bool
+}
+
+func newHeadWatcher(o chainOptions) *headWatcher {
+	return &headWatcher{
+		chain: o.name,
+		url:   o.wsURL,
+		idle:  10 * o.poll,
+		retry: o.poll,
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+// following reports whether the watcher is subscribed, so the scraper
+// can wait for it instead of polling.
+func (w *headWatcher) following() bool {
+	return w != nil && w.subscribed.Load()
+}
+
+// run keeps the subscription up until ctx is done.
+func (w *headWatcher) run(ctx context.Context) {
+	delay := w.retry
+	for {
+		err := w.subscribe(ctx)
+		if w.subscribed.Swap(false) {
+			delay = w.retry
+			w.notify()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Warn("newHeads subscription failed, polling for blocks", "chain", w.chain, "ws", redactURL(w.url), "retry_in", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, 5*time.Minute)
+	}
+}
+
+func (w *headWatcher) notify() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// subscribe subscribes to newHeads and follows the blocks until the
+// connection fails or ctx is done.
+func (w *headWatcher) subscribe(ctx context.Context) error {
+	dialer := websocket.Dialer{HandshakeTimeout: 10 * time.Second}
+	conn, _, err := dialer.DialContext(ctx, w.url, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	sub := rpcRequest{JSONRPC: "2.0", ID: 1, Method: "eth_subscribe", Params: []any{"newHeads"}}
+	if err := conn.WriteJSON(sub); err != nil {
+		return err
+	}
+	for {
+		conn.SetReadDeadline(time.Now().Add(w.idle))
+		var msg struct {
+			ID     *uint64   `json:"id"`
+			Error  *rpcError `json:"error"`
+			Method string    `json:"method"`
+		}
+		if err := conn.ReadJSON(&msg); err != nil {
+			return err
+		}
+		switch {
+		case msg.Error != nil:
+			return fmt.Errorf("eth_subscribe: %w", msg.Error)
+		case msg.ID != nil:
+			w.subscribed.Store(true)
+			slog.Info("Subscribed to newHeads", "chain", w.chain, "ws", redactURL(w.url))
+		case msg.Method == "eth_subscription":
+			w.notify()
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// apiOperation describes an endpoint of the admin API for the OpenAPI
+// document. body and response are values of the types taken and returned,
+// whose schemas are worked out from their fields, so that the document
+// can't drift from the code.
+type apiOperation struct {
+	method, path string
+	summary      string
+	params       []apiParam
+	body         any
+	status       int
+	response     any
+	// contentType is that of responses that aren't JSON.
+	contentType string
+	// scope is what a key needs to have for the endpoint once there are
+	// keys, none for endpoints that never take one.
+	scope scope
+	// needsKeys is set for endpoints that are off without keys.
+	needsKeys bool
+}
+
+type apiParam struct {
+	name, in, description string
+	// kind is the parameter's JSON type, string if empty.
+	kind     string
+	repeated bool
+}
+
+var (
+	timeParams = []apiParam{
+		{name: "target", in: "query", description: "Only those of the target with this URL"},
+		{name: "since", in: "query", description: "Only those started at or after this RFC 3339 time, or this long ago, e.g. 24h"},
+		{name: "until", in: "query", description: "Only those started before this RFC 3339 time, or this long ago"},
+		{name: "limit", in: "query", kind: "integer", description: "How many to return at most, 100 by default"},
+	}
+	outcomeParam = apiParam{name: "outcome", in: "query", description: "Only those that passed, ok, failed, or failed for a reason, e.g. status"}
+	idParam      = apiParam{name: "id", in: "path", description: "ID of the target, as GET /targets lists it"}
+)
+
+// adminOperations are the endpoints on -admin_addr, but for pprof's.
+var adminOperations = []apiOperation{
+	{method: "GET", path: "/metrics", summary: "Metrics in the Prometheus text format, with -metrics_backend prometheus", status: 200, contentType: "text/plain", scope: scopeRead},
+	{method: "GET", path: "/healthz", summary: "Liveness: fails with 503 once the scheduler has stalled", status: 200, response: healthReport{}},
+	{method: "GET", path: "/readyz", summary: "Readiness: also fails with 503 while the last reload was rejected", status: 200, response: healthReport{}},
+	{
+		method: "GET", path: "/status", summary: "Status of every target",
+		params: []apiParam{{name: "results", in: "query", kind: "integer", description: "Add this many of each target's most recent results"}},
+		status: 200, response: []targetStatus{}, scope: scopeRead,
+	},
+	{
+		method: "GET", path: "/stream", summary: "Every result as it comes in, as server-sent events, or WebSocket messages on upgrade",
+		params: []apiParam{{name: "target", in: "query", repeated: true, description: "Only those of the targets with these URLs"}},
+		status: 200, response: storedResultJSON{}, contentType: "text/event-stream", scope: scopeRead,
+	},
+	{
+		method: "GET", path: "/results", summary: "Stored results, newest first; full pages link to the next in a Link header; needs -store",
+		params: append(slices.Clip(timeParams), outcomeParam, apiParam{name: "cursor", in: "query", description: "Where the page starts, as given in the Link to it"}),
+		status: 200, response: []storedResultJSON{}, scope: scopeRead,
+	},
+	{
+		method: "GET", path: "/results/summary", summary: "Stored results summed up by target; needs -store",
+		params: append(slices.Clip(timeParams[:3]), outcomeParam), status: 200, response: []resultSummary{}, scope: scopeRead,
+	},
+	{
+		method: "GET", path: "/aggregates", summary: "Hourly or daily aggregates of downsampled results, newest first; needs -store",
+		params: append([]apiParam{{name: "resolution", in: "query", description: "hour or day, the default"}}, timeParams...),
+		status: 200, response: []aggregateJSON{}, scope: scopeRead,
+	},
+	{method: "GET", path: "/silences", summary: "Active silences", status: 200, response: []silence{}, scope: scopeRead},
+	{method: "POST", path: "/silences", summary: "Silence the alerts of a target, or all", body: silenceRequest{}, status: 201, response: silence{}, scope: scopeOperate},
+	{
+		method: "DELETE", path: "/silences/{id}", summary: "Lift a silence",
+		params: []apiParam{{name: "id", in: "path", kind: "integer", description: "ID of the silence"}}, status: 204, scope: scopeOperate,
+	},
+	{method: "GET", path: "/pauses", summary: "Targets paused while the scraper runs; one without a target pauses every target", status: 200, response: []pause{}, scope: scopeRead},
+	{method: "POST", path: "/pauses", summary: "Pause a target, or all, for a duration, until an end or until resumed", body: pauseRequest{}, status: 201, response: pause{}, scope: scopeOperate},
+	{
+		method: "DELETE", path: "/pauses", summary: "Resume a target, or without one every target",
+		params: []apiParam{{name: "target", in: "query", description: "URL of the target"}}, status: 204, scope: scopeOperate,
+	},
+	{method: "GET", path: "/chains", summary: "Progress of the block scraper of each chain; needs -chain_rpc_url", status: 200, response: []chainStatus{}, scope: scopeRead},
+	{
+		method: "GET", path: "/chains/{chain}/manifest", summary: "Manifest of the index of a chain; needs -chain_dir",
+		params: []apiParam{{name: "chain", in: "path", description: "Name of the chain, as -chain gives it"}}, status: 200, response: indexManifest{}, scope: scopeRead,
+	},
+	{method: "GET", path: "/targets", summary: "Every target, the configured ones first", status: 200, response: []targetJSON{}, scope: scopeRead, needsKeys: true},
+	{method: "POST", path: "/targets", summary: "Add a target", body: managedTarget{}, status: 201, response: targetJSON{}, scope: scopeAdmin, needsKeys: true},
+	{method: "GET", path: "/targets/{id}", summary: "A target", params: []apiParam{idParam}, status: 200, response: targetJSON{}, scope: scopeRead, needsKeys: true},
+	{
+		method: "PUT", path: "/targets/{id}", summary: "Replace the options of a target added through the API",
+		params: []apiParam{idParam}, body: targetUpdate{}, status: 200, response: targetJSON{}, scope: scopeAdmin, needsKeys: true,
+	},
+	{method: "DELETE", path: "/targets/{id}", summary: "Delete a target added through the API", params: []apiParam{idParam}, status: 204, scope: scopeAdmin, needsKeys: true},
+	{method: "POST", path: "/targets/{id}/pause", summary: "Set the paused option of a target added through the API", params: []apiParam{idParam}, status: 200, response: targetJSON{}, scope: scopeOperate, needsKeys: true},
+	{method: "POST", path: "/targets/{id}/resume", summary: "Clear the paused option of a target added through the API", params: []apiParam{idParam}, status: 200, response: targetJSON{}, scope: scopeOperate, needsKeys: true},
+	{
+		method: "POST", path: "/targets/{id}/run", summary: "Check a target right away and return the result",
+		params: []apiParam{idParam}, status: 200, response: storedResultJSON{}, scope: scopeOperate, needsKeys: true,
+	},
+	{method: "GET", path: "/keys", summary: "Every API key, the configured ones first", status: 200, response: []apiKey{}, scope: scopeAdmin, needsKeys: true},
+	{method: "POST", path: "/keys", summary: "Create an API key; the key is only ever returned here", body: keyRequest{}, status: 201, response: createdKey{}, scope: scopeAdmin, needsKeys: true},
+	{
+		method: "DELETE", path: "/keys/{id}", summary: "Revoke an API key created through the API",
+		params: []apiParam{{name: "id", in: "path", description: "ID of the key"}}, status: 204, scope: scopeAdmin, needsKeys: true,
+	},
+	{method: "GET", path: "/openapi.json", summary: "This document", status: 200, contentType: "application/json"},
+}
+
+// openAPI returns the OpenAPI document describing ops.
+func openAPI(ops []apiOperation) map[string]any {
+	schemas := make(map[string]any)
+	paths := make(map[string]any)
+	for _, op := range ops {
+		o := map[string]any{"summary": op.summary}
+		var params []any
+		for _, p := range op.params {
+			schema := map[string]any{"type": "string"}
+			if p.kind != "" {
+				schema["type"] = p.kind
+			}
+			if p.repeated {
+				schema = map[string]any{"type": "array", "items": schema}
+			}
+			params = append(params, map[string]any{
+				"name":        p.name,
+				"in":          p.in,
+				"description": p.description,
+				"required":    p.in == "path",
+				"schema":      schema,
+			})
+		}
+		if params != nil {
+			o["parameters"] = params
+		}
+		if op.body != nil {
+			o["requestBody"] = map[string]any{
+				"required": true,
+				"content":  map[string]any{"application/json": map[string]any{"schema": schemaOf(reflect.TypeOf(op.body), schemas)}},
+			}
+		}
+		resp := map[string]any{"description": http.StatusText(op.status)}
+		switch {
+		case op.response != nil:
+			contentType := op.contentType
+			if contentType == "" {
+				contentType = "application/json"
+			}
+			resp["content"] = map[string]any{contentType: map[string]any{"schema": schemaOf(reflect.TypeOf(op.response), schemas)}}
+		case op.contentType != "":
+			resp["content"] = map[string]any{op.contentType: map[string]any{}}
+		}
+		responses := map[string]any{strconv.Itoa(op.status): resp}
+		if op.scope != 0 {
+			// Endpoints that are open until there are keys may be called
+			// without one.
+			security := []any{map[string]any{"apiKey": []any{}}}
+			o["description"] = "Needs a key with the " + op.scope.String() + " scope once there are keys."
+			forbidden := "The key lacks the scope"
+			if op.needsKeys {
+				o["description"] = "Needs a key with the " + op.scope.String() + " scope, and is off without keys."
+				forbidden += ", or there are no keys"
+			} else {
+				security = append(security, map[string]any{})
+			}
+			o["security"] = security
+			responses["401"] = map[string]any{"description": "The key is missing or wrong"}
+			responses["403"] = map[string]any{"description": forbidden}
+		}
+		o["responses"] = responses
+
+		item, _ := paths[op.path].(map[string]any)
+		if item == nil {
+			item = make(map[string]any)
+			paths[op.path] = item
+		}
+		item[strings.ToLower(op.method)] = o
+	}
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "trueblocks-scraper-go admin API",
+			"version": version,
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": schemas,
+			"securitySchemes": map[string]any{
+				"apiKey": map[string]any{"type": "http", "scheme": "bearer", "description": "The -admin_token, an -admin_key or a key created through /keys"},
+			},
+		},
+	}
+}
+
+var (
+	timeType         = reflect.TypeOf(time.Time{})
+	optionValuesType = reflect.TypeOf(optionValues{})
+	scopeType        = reflect.TypeOf(scope(0))
+)
+
+// schemaOf returns the schema of values of t as encoding/json has them,
+// adding those of structs to schemas and referring to them there.
+func schemaOf(t reflect.Type, schemas map[string]any) map[string]any {
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t == scopeType:
+		return map[string]any{"type": "string", "enum": scopeNames[1:]}
+	case t == optionValuesType:
+		// optionValues also take a single string.
+		return map[string]any{"oneOf": []any{
+			map[string]any{"type": "string"},
+			map[string]any{"type": "array", "items": map[string]any{"type": "string"}},
+		}}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaOf(t.Elem(), schemas)
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": schemaOf(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaOf(t.Elem(), schemas)}
+	case reflect.Struct:
+		name := schemaName(t)
+		if _, ok := schemas[name]; !ok {
+			// Set first, for types that refer to themselves.
+			schemas[name] = nil
+			props := make(map[string]any)
+			var required []string
+			addProperties(t, schemas, props, &required)
+			s := map[string]any{"type": "object", "properties": props}
+			if required != nil {
+				s["required"] = required
+			}
+			schemas[name] = s
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]any{}
+}
+
+// addProperties adds the JSON fields of struct type t to props, and the
+// names of those that are always there to required.
+func addProperties(t reflect.Type, schemas, props map[string]any, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		if f.Anonymous && tag == "" {
+			addProperties(f.Type, schemas, props, required)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = schemaOf(f.Type, schemas)
+		if !strings.Contains(opts, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// schemaName names the schema of struct type t after it, exported and
+// without a JSON suffix: storedResultJSON is StoredResult.
+func schemaName(t reflect.Type) string {
+	name := []rune(strings.TrimSuffix(t.Name(), "JSON"))
+	name[0] = unicode.ToUpper(name[0])
+	return string(name)
+}
+
+// serveOpenAPI answers with the OpenAPI document of the admin API.
+func serveOpenAPI() http.HandlerFunc {
+	b, err := json.MarshalIndent(openAPI(adminOperations), "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// pagerDutyEventsURL is PagerDuty's Events API v2.
+var pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+// pagerDutyNotifier triggers a PagerDuty incident when a target goes down and
+// resolves it when the target comes back up. Incidents are keyed by target,
+// so repeated alerts for the same outage land in one incident. Targets
+// without a routing key are skipped, which is why every target has one.
+type pagerDutyNotifier struct {
+	client  *http.Client
+	retries int
+}
+
+func newPagerDutyNotifier(retries int) *pagerDutyNotifier {
+	return &pagerDutyNotifier{client: &http.Client{Timeout: 10 * time.Second}, retries: retries}
+}
+
+func (p *pagerDutyNotifier) name() string {
+	return "pagerduty"
+}
+
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+type pagerDutyPayload struct {
+	Summary       string      `json:"summary"`
+	Source        string      `json:"source"`
+	Severity      string      `json:"severity"`
+	Timestamp     time.Time   `json:"timestamp"`
+	Class         string      `json:"class,omitempty"`
+	CustomDetails *alertEvent `json:"custom_details"`
+}
+
+func (p *pagerDutyNotifier) notify(ctx context.Context, e *alertEvent) error {
+	if e.target.pagerDutyKey == "" {
+		return nil
+	}
+
+	ev := pagerDutyEvent{RoutingKey: e.target.pagerDutyKey, EventAction: "resolve", DedupKey: pagerDutyDedupKey(e.Target)}
+	if e.State == "down" {
+		ev.EventAction = "trigger"
+		ev.Payload = &pagerDutyPayload{
+			Summary:       e.Target + " is down: " + e.Error,
+			Source:        e.Target,
+			Severity:      "critical",
+			Timestamp:     e.At,
+			Class:         e.Reason,
+			CustomDetails: e,
+		}
+		// The summary is limited to 1024 characters.
+		if len(ev.Payload.Summary) > 1024 {
+			ev.Payload.Summary = ev.Payload.Summary[:1021] + "..."
+		}
+	}
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	return postWithRetries(ctx, p.client, p.retries, acceptStatus, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, pagerDutyEventsURL, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
+}
+
+// pagerDutyDedupKey is the incident key of the target at url. Dedup keys are
+// limited to 255 characters, so long URLs are hashed.
+func pagerDutyDedupKey(url string) string {
+	if len(url) <= 255 {
+		return url
+	}
+	sum := sha256.Sum256([]byte(url))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
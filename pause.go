@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// pauses are the targets paused while the scraper runs, as opposed to with
+// the paused option, for good or until a time. Their loops keep running but
+// skip the checks. Pauses outlast reloads but not restarts.
+type pauses struct {
+	mu sync.Mutex
+	// until maps targets to when their pauses end, the zero time for when
+	// they're resumed. The empty URL pauses every target.
+	until map[string]time.Time
+}
+
+func newPauses() *pauses {
+	return &pauses{until: make(map[string]time.Time)}
+}
+
+// pause pauses url, or every target if it is empty, until the time given,
+// or for good if that's zero.
+func (p *pauses) pause(url string, until time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.until[url] = until
+}
+
+// resume lifts the pause of url, or the one of every target if it is
+// empty, reporting whether there was one. Targets paused on their own stay
+// paused when every target is resumed.
+func (p *pauses) resume(url string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, paused := p.until[url]
+	delete(p.until, url)
+	return paused
+}
+
+// paused reports whether url is paused, on its own or with every target.
+// Pauses that have run out are lifted.
+func (p *pauses) paused(url string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	paused := false
+	for _, key := range []string{url, ""} {
+		until, ok := p.until[key]
+		switch {
+		case !ok:
+		case until.IsZero() || now.Before(until):
+			paused = true
+		default:
+			delete(p.until, key)
+			if key == "" {
+				slog.Info("Pause of every target ended")
+			} else {
+				slog.Info("Pause ended", "target", key)
+			}
+		}
+	}
+	return paused
+}
+
+// pause is a pause as /pauses lists it. Target is empty for every target,
+// and Until for pauses until resumed.
+type pause struct {
+	Target string     `json:"target,omitempty"`
+	Until  *time.Time `json:"until,omitempty"`
+}
+
+func (p *pauses) list() []pause {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	out := make([]pause, 0, len(p.until))
+	for url, until := range p.until {
+		if until.IsZero() || now.Before(until) {
+			out = append(out, pause{Target: url, Until: timePtr(until)})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Target < out[j].Target })
+	return out
+}
+
+// pauseRequest is what POST /pauses takes: a target, empty for all, and a
+// duration or an end, neither for a pause until resumed.
+type pauseRequest struct {
+	Target   string    `json:"target,omitempty"`
+	Duration string    `json:"duration,omitempty"`
+	End      time.Time `json:"end,omitempty"`
+}
+
+// pauseEnd works out when a pause for d or until end ends, the zero time
+// for neither.
+func pauseEnd(d string, end time.Time) (time.Time, error) {
+	switch {
+	case d != "" && !end.IsZero():
+		return time.Time{}, errors.New("give either duration or end")
+	case d != "":
+		d, err := parseInterval(d)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("duration: %w", err)
+		}
+		return time.Now().Add(d), nil
+	case !end.IsZero() && !end.After(time.Now()):
+		return time.Time{}, errors.New("give an end in the future")
+	}
+	return end, nil
+}
+
+// pauseTargets pauses url, or every target, until end.
+func (s *scheduler) pauseTargets(url string, end time.Time, via string) error {
+	if url != "" && s.target(url) == nil {
+		return fmt.Errorf("no target %s", url)
+	}
+	s.pauses.pause(url, end)
+	attrs := []any{"via", via}
+	if url != "" {
+		attrs = append(attrs, "target", url)
+	}
+	if !end.IsZero() {
+		attrs = append(attrs, "until", end)
+	}
+	slog.Info("Paused checks", attrs...)
+	return nil
+}
+
+// resumeTargets lifts the pause of url, or of every target.
+func (s *scheduler) resumeTargets(url string, via string) {
+	if !s.pauses.resume(url) {
+		return
+	}
+	attrs := []any{"via", via}
+	if url != "" {
+		attrs = append(attrs, "target", url)
+	}
+	slog.Info("Resumed checks", attrs...)
+}
+
+// servePauses lists pauses, and adds them.
+func servePauses(s *scheduler) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, s.pauses.list())
+		case http.MethodPost:
+			var body pauseRequest
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			end, err := pauseEnd(body.Duration, body.End)
+			if err == nil {
+				err = s.pauseTargets(body.Target, end, "admin API")
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeJSON(w, http.StatusCreated, pause{Target: body.Target, Until: timePtr(end)})
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// liftPause lifts the pause of the target query parameter, or of every
+// target without one.
+func liftPause(s *scheduler) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		s.resumeTargets(req.URL.Query().Get("target"), "admin API")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// postgresMigrations bring a PostgreSQL database's schema up to date, like
+// sqliteMigrations, which they mirror.
+var postgresMigrations = []string{
+	`CREATE TABLE results (
+		id       BIGINT  GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+		target   TEXT    NOT NULL,
+		start    BIGINT  NOT NULL,
+		duration BIGINT  NOT NULL,
+		latency  BIGINT  NOT NULL,
+		status   INTEGER NOT NULL,
+		ok       BOOLEAN NOT NULL,
+		reason   TEXT    NOT NULL,
+		error    TEXT    NOT NULL
+	);
+	CREATE INDEX results_target_start ON results (target, start);
+	CREATE INDEX results_start ON results (start)`,
+	`CREATE TABLE aggregates (
+		target      TEXT    NOT NULL,
+		resolution  BIGINT  NOT NULL,
+		start       BIGINT  NOT NULL,
+		checks      INTEGER NOT NULL,
+		failures    INTEGER NOT NULL,
+		latency_p50 BIGINT  NOT NULL,
+		latency_p95 BIGINT  NOT NULL,
+		latency_p99 BIGINT  NOT NULL,
+		PRIMARY KEY (target, resolution, start)
+	)`,
+}
+
+// postgresMigrationLock is the advisory lock held while migrating, so that
+// scrapers sharing a database and starting together migrate it once.
+const postgresMigrationLock = 0x5c4a9e12
+
+// openPostgres opens the PostgreSQL database at rawURL, a postgres:// or
+// postgresql:// connection URL as libpq takes them.
+func openPostgres(rawURL string) (*sqlStore, error) {
+	db, err := sql.Open("pgx", rawURL)
+	if err != nil {
+		return nil, err
+	}
+	s := &sqlStore{db: db, bind: func(n int) string { return "$" + strconv.Itoa(n) }}
+
+	ctx := context.Background()
+	if err := s.migrateLocked(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("-store %s: %w", redactURL(rawURL), err)
+	}
+	return s, nil
+}
+
+func (s *sqlStore) migrateLocked(ctx context.Context) error {
+	// Advisory locks belong to a session, so lock on a connection of its
+	// own for as long as migrating takes.
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, postgresMigrationLock); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, postgresMigrationLock)
+	return s.migrate(ctx, postgresMigrations)
+}
+
+// redactURL returns rawURL with any password replaced, for logging.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Redacted()
+}
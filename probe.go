@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// probeTCP checks that a tcp://host:port target accepts connections.
+func probeTCP(ctx context.Context, t *target, r *result) {
+	host := t.address()
+	if t.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.timeout)
+		defer cancel()
+	}
+	if err := t.limiter.wait(ctx, t.hostname()); err != nil {
+		r.err = err
+		return
+	}
+
+	var d net.Dialer
+	start := time.Now()
+	conn, err := d.DialContext(ctx, "tcp", host)
+	r.latency = time.Since(start)
+	if err != nil {
+		r.err = err
+		slog.Warn("Connect failed", "target", t.url, t.logLabels(), "error", err)
+		return
+	}
+	conn.Close()
+
+	checkLatency(t, r)
+}
+
+// pingOptions configures icmp:// targets.
+type pingOptions struct {
+	count    int
+	interval time.Duration
+	// timeout is how long each echo request waits for its reply.
+	timeout time.Duration
+	// maxLoss is the fraction of echo requests allowed to go unanswered.
+	maxLoss float64
+}
+
+// pingID tells apart the echo requests of concurrent probes. Unprivileged
+// ICMP sockets have the kernel set the identifier, so it only matters when
+// falling back to raw sockets.
+var pingID uint32
+
+// probeICMP sends t.ping.count echo requests to an icmp://host target and
+// fails when more than t.ping.maxLoss of them go unanswered. Latency is the
+// average round trip time of the replies.
+func probeICMP(ctx context.Context, t *target, r *result) {
+	if err := t.limiter.wait(ctx, t.hostname()); err != nil {
+		r.err = err
+		return
+	}
+	ip, err := net.DefaultResolver.LookupIPAddr(ctx, t.hostname())
+	if err != nil {
+		r.err = err
+		slog.Warn("Lookup failed", "target", t.url, t.logLabels(), "error", err)
+		return
+	}
+	if len(ip) == 0 {
+		r.err = errors.New("no addresses")
+		return
+	}
+
+	p, err := newPinger(ip[0].IP)
+	if err != nil {
+		r.err = err
+		slog.Warn("Ping failed", "target", t.url, t.logLabels(), "error", err)
+		return
+	}
+	defer p.conn.Close()
+
+	var received int
+	var total time.Duration
+	for seq := 1; seq <= t.ping.count; seq++ {
+		if seq > 1 {
+			select {
+			case <-ctx.Done():
+				r.err = ctx.Err()
+				return
+			case <-time.After(t.ping.interval):
+			}
+		}
+		rtt, err := p.ping(seq, t.ping.timeout)
+		if err != nil {
+			continue
+		}
+		received++
+		total += rtt
+	}
+
+	if received == 0 {
+		r.err = fmt.Errorf("no replies to %d echo requests", t.ping.count)
+		slog.Warn("Ping failed", "target", t.url, t.logLabels(), "error", r.err)
+		return
+	}
+	r.latency = total / time.Duration(received)
+
+	if loss := 1 - float64(received)/float64(t.ping.count); loss > t.ping.maxLoss {
+		r.fail("packet_loss", "Packet loss %.0f%% exceeds %.0f%%", loss*100, t.ping.maxLoss*100)
+	}
+	checkLatency(t, r)
+}
+
+type pinger struct {
+	conn     *icmp.PacketConn
+	dst      net.Addr
+	id       int
+	echo     icmp.Type
+	reply    icmp.Type
+	protocol int
+}
+
+// newPinger opens an unprivileged ICMP socket if the system allows it and a
+// raw one otherwise.
+func newPinger(ip net.IP) (*pinger, error) {
+	p := &pinger{id: int(atomic.AddUint32(&pingID, 1) & 0xffff)}
+	network, raw, address := "udp4", "ip4:icmp", "0.0.0.0"
+	p.echo, p.reply, p.protocol = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply, 1
+	if ip.To4() == nil {
+		network, raw, address = "udp6", "ip6:ipv6-icmp", "::"
+		p.echo, p.reply, p.protocol = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply, 58
+	}
+
+	conn, err := icmp.ListenPacket(network, address)
+	if err == nil {
+		p.conn = conn
+		p.dst = &net.UDPAddr{IP: ip}
+		return p, nil
+	}
+	if conn, rawErr := icmp.ListenPacket(raw, address); rawErr == nil {
+		p.conn = conn
+		p.dst = &net.IPAddr{IP: ip}
+		return p, nil
+	}
+	return nil, err
+}
+
+// ping sends one echo request and waits up to timeout for its reply.
+func (p *pinger) ping(seq int, timeout time.Duration) (time.Duration, error) {
+	msg := icmp.Message{
+		Type: p.echo,
+		Body: &icmp.Echo{ID: p.id, Seq: seq, Data: []byte("trueblocks-scraper")},
+	}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	if _, err := p.conn.WriteTo(b, p.dst); err != nil {
+		return 0, err
+	}
+	deadline := start.Add(timeout)
+	if err := p.conn.SetReadDeadline(deadline); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := p.conn.ReadFrom(buf)
+		if err != nil {
+			return 0, err
+		}
+		reply, err := icmp.ParseMessage(p.protocol, buf[:n])
+		if err != nil || reply.Type != p.reply {
+			continue
+		}
+		// Unprivileged sockets only see their own replies but with an
+		// identifier the kernel chose, so only the sequence is compared.
+		echo, ok := reply.Body.(*icmp.Echo)
+		if !ok || echo.Seq != seq {
+			continue
+		}
+		if _, isRaw := p.dst.(*net.IPAddr); isRaw && echo.ID != p.id {
+			continue
+		}
+		return time.Since(start), nil
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// proxySettings picks the proxy for a target's requests. With no proxy
+// configured the usual HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment
+// variables apply.
+type proxySettings struct {
+	// proxy is an http://, https:// or socks5:// URL, or "direct" to
+	// bypass any proxy from the environment.
+	proxy string
+	// noProxy lists hosts reached directly, in NO_PROXY syntax.
+	noProxy string
+}
+
+type proxyKey struct{}
+
+func parseProxy(value string) error {
+	if value == "" || value == "direct" {
+		return nil
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+		return nil
+	}
+	return errors.New("want an http://, https:// or socks5:// URL, or direct")
+}
+
+// proxyFor returns the proxy, if any, a request to u should go through.
+func (p proxySettings) proxyFor(u *url.URL) (*url.URL, error) {
+	switch p.proxy {
+	case "":
+		return httpproxy.FromEnvironment().ProxyFunc()(u)
+	case "direct":
+		return nil, nil
+	}
+	cfg := httpproxy.Config{HTTPProxy: p.proxy, HTTPSProxy: p.proxy, NoProxy: p.noProxy}
+	return cfg.ProxyFunc()(u)
+}
+
+// proxyFromContext is the shared transport's Proxy function. It applies the
+// settings of the target a request was made for.
+func proxyFromContext(req *http.Request) (*url.URL, error) {
+	if p, ok := req.Context().Value(proxyKey{}).(proxySettings); ok {
+		return p.proxyFor(req.URL)
+	}
+	return http.ProxyFromEnvironment(req)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// limiter throttles outgoing requests with one token bucket shared by all
+// targets and one per host. A zero rate disables that bucket; a nil limiter
+// never waits.
+type limiter struct {
+	global    *rate.Limiter
+	hostRate  rate.Limit
+	hostBurst int
+
+	mu    sync.Mutex
+	hosts map[string]*rate.Limiter
+}
+
+func newLimiter(globalRate float64, globalBurst int, hostRate float64, hostBurst int) *limiter {
+	if globalRate <= 0 && hostRate <= 0 {
+		return nil
+	}
+
+	l := &limiter{
+		hostRate:  rate.Limit(hostRate),
+		hostBurst: hostBurst,
+		hosts:     make(map[string]*rate.Limiter),
+	}
+	if globalRate > 0 {
+		l.global = rate.NewLimiter(rate.Limit(globalRate), globalBurst)
+	}
+	return l
+}
+
+// reuse returns l if it throttles as newLimiter would with the settings, so
+// that a reload that doesn't change them keeps the buckets and what they
+// have used up, and otherwise a new limiter.
+func (l *limiter) reuse(globalRate float64, globalBurst int, hostRate float64, hostBurst int) *limiter {
+	if l == nil {
+		return newLimiter(globalRate, globalBurst, hostRate, hostBurst)
+	}
+	sameGlobal := l.global == nil && globalRate <= 0 ||
+		l.global != nil && l.global.Limit() == rate.Limit(globalRate) && l.global.Burst() == globalBurst
+	sameHost := l.hostRate <= 0 && hostRate <= 0 ||
+		l.hostRate > 0 && l.hostRate == rate.Limit(hostRate) && l.hostBurst == hostBurst
+	if sameGlobal && sameHost {
+		return l
+	}
+	return newLimiter(globalRate, globalBurst, hostRate, hostBurst)
+}
+
+// wait blocks until a request to host is allowed or ctx is done.
+func (l *limiter) wait(ctx context.Context, host string) error {
+	if l == nil {
+		return nil
+	}
+	if h := l.host(host); h != nil {
+		if err := h.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	if l.global != nil {
+		return l.global.Wait(ctx)
+	}
+	return nil
+}
+
+func (l *limiter) host(host string) *rate.Limiter {
+	if l.hostRate <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	h, ok := l.hosts[host]
+	if !ok {
+		h = rate.NewLimiter(l.hostRate, l.hostBurst)
+		l.hosts[host] = h
+	}
+	return h
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+)
+
+// receiptStage adds the appearances in the receipts of each block: the
+// contracts created, the emitters of logs and the addresses in their
+// indexed topics. It fetches the receipts of a whole block with
+// eth_getBlockReceipts, and those of each transaction with
+// eth_getTransactionReceipt on nodes that lack it.
+type receiptStage struct {
+	chain string
+	rpc   *rpcClient
+	// perTx is set while the provider in use lacks eth_getBlockReceipts.
+	perTx atomic.Bool
+}
+
+func (r *receiptStage) fetch(ctx context.Context, blocks []*scrapedBlock) error {
+	var withTxs []*scrapedBlock
+	for _, b := range blocks {
+		if len(b.block.Transactions) > 0 {
+			withTxs = append(withTxs, b)
+		}
+	}
+	if len(withTxs) == 0 {
+		return nil
+	}
+	receipts, err := r.receipts(ctx, withTxs)
+	if err != nil {
+		return err
+	}
+	for i, b := range withTxs {
+		for _, rc := range receipts[i] {
+			tx := uint32(rc.TransactionIndex)
+			b.appear(rc.ContractAddress, tx)
+			for _, l := range rc.Logs {
+				b.appear(l.Address, tx)
+				for _, topic := range l.Topics {
+					b.appearTopic(topic, tx)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// receipts fetches the receipts of the transactions of each of blocks.
+func (r *receiptStage) receipts(ctx context.Context, blocks []*scrapedBlock) ([][]ethReceipt, error) {
+	receipts := make([][]ethReceipt, len(blocks))
+	if !r.perTx.Load() {
+		calls := make([]*rpcCall, len(blocks))
+		for i, b := range blocks {
+			calls[i] = newRPCCall("eth_getBlockReceipts", &receipts[i], b.block.Number.String())
+		}
+		if err := r.rpc.batch(ctx, calls); err != nil {
+			return nil, err
+		}
+		err := callErr(calls)
+		if err == nil {
+			for i, b := range blocks {
+				if len(receipts[i]) != len(b.block.Transactions) {
+					return nil, fmt.Errorf("eth_getBlockReceipts: %d receipts for the %d transactions of block %d", len(receipts[i]), len(b.block.Transactions), b.block.Number)
+				}
+			}
+			return receipts, nil
+		}
+		if !methodMissing(err) {
+			return nil, err
+		}
+		if !r.perTx.Swap(true) {
+			slog.Info("Node lacks eth_getBlockReceipts, fetching receipts one transaction at a time", "chain", r.chain)
+		}
+	}
+	perTx := make([][]*ethReceipt, len(blocks))
+	var calls []*rpcCall
+	for i, b := range blocks {
+		perTx[i] = make([]*ethReceipt, len(b.block.Transactions))
+		for j, tx := range b.block.Transactions {
+			calls = append(calls, newRPCCall("eth_getTransactionReceipt", &perTx[i][j], tx.Hash))
+		}
+	}
+	if err := r.rpc.batch(ctx, calls); err != nil {
+		return nil, err
+	}
+	if err := callErr(calls); err != nil {
+		return nil, err
+	}
+	for i, b := range blocks {
+		receipts[i] = make([]ethReceipt, len(perTx[i]))
+		for j, rc := range perTx[i] {
+			if rc == nil {
+				return nil, fmt.Errorf("eth_getTransactionReceipt: no receipt for %s", b.block.Transactions[j].Hash)
+			}
+			receipts[i][j] = *rc
+		}
+	}
+	return receipts, nil
+}
+
+func (r *receiptStage) adapt(caps nodeCaps) error {
+	if perTx := !caps.BlockReceipts; !r.perTx.Swap(perTx) && perTx {
+		slog.Info("Node lacks eth_getBlockReceipts, fetching receipts one transaction at a time", "chain", r.chain)
+	}
+	return nil
+}
+
+func (r *receiptStage) process(ctx context.Context, b *scrapedBlock) error {
+	return nil
+}
+
+func (r *receiptStage) flush() error {
+	return nil
+}
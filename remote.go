@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// remoteTimeout bounds fetching a targets document, so that a hung server
+// can't hold up a reload for long.
+const remoteTimeout = 30 * time.Second
+
+// remoteMaxSize is the largest targets document read.
+const remoteMaxSize = 16 << 20
+
+// remoteDocs remembers the targets document last fetched from each
+// -targets_url with its ETag, so that reloads and refreshes only download it
+// again once it has changed.
+var remoteDocs = struct {
+	mu   sync.Mutex
+	docs map[string]remoteDoc
+}{docs: make(map[string]remoteDoc)}
+
+type remoteDoc struct {
+	etag string
+	body []byte
+}
+
+var remoteClient = &http.Client{Timeout: remoteTimeout}
+
+// loadRemoteTargets reads targets from the document at rawURL, written like
+// a targets file but without includes.
+func loadRemoteTargets(rawURL string) ([]targetSpec, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), remoteTimeout)
+	defer cancel()
+
+	body, _, err := fetchTargets(ctx, rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return parseTargets(rawURL, body, "", targetsScope{}, nil)
+}
+
+// fetchTargets returns the targets document at rawURL, an http://, https://
+// or s3:// URL, and whether it differs from the one fetched before.
+func fetchTargets(ctx context.Context, rawURL string) ([]byte, bool, error) {
+	remoteDocs.mu.Lock()
+	defer remoteDocs.mu.Unlock()
+
+	req, err := newTargetsRequest(ctx, rawURL)
+	if err != nil {
+		return nil, false, err
+	}
+	prev, fetched := remoteDocs.docs[rawURL]
+	if fetched && prev.etag != "" {
+		req.Header.Set("If-None-Match", prev.etag)
+	}
+	resp, err := remoteClient.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && fetched:
+		return prev.body, false, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, false, fmt.Errorf("%s: got status %s", rawURL, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, remoteMaxSize+1))
+	if err != nil {
+		return nil, false, fmt.Errorf("%s: %w", rawURL, err)
+	}
+	if len(body) > remoteMaxSize {
+		return nil, false, fmt.Errorf("%s: larger than %d bytes", rawURL, remoteMaxSize)
+	}
+	remoteDocs.docs[rawURL] = remoteDoc{etag: resp.Header.Get("ETag"), body: body}
+	return body, !fetched || !bytes.Equal(body, prev.body), nil
+}
+
+func newTargetsRequest(ctx context.Context, rawURL string) (*http.Request, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	case "s3":
+		return newS3Request(ctx, u.Host, u.Path)
+	}
+	return nil, fmt.Errorf("%s: unsupported scheme %q, want http, https or s3", rawURL, u.Scheme)
+}
+
+// pollTargets fetches the targets document at rawURL every interval and
+// signals reload when it has changed. Failures are logged and the running
+// targets kept.
+func pollTargets(ctx context.Context, rawURL string, every time.Duration, reload chan<- struct{}) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		fetch, cancel := context.WithTimeout(ctx, remoteTimeout)
+		_, changed, err := fetchTargets(fetch, rawURL)
+		cancel()
+		if err != nil {
+			slog.Warn("Fetching targets failed", "url", rawURL, "error", err)
+			continue
+		}
+		if changed {
+			select {
+			case reload <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+)
+
+// recentBlock is a block the scraper processed lately, remembered to tell
+// when the chain reorganises under it.
+type recentBlock struct {
+	Number uint64 `json:"number"`
+	Hash   string `json:"hash"`
+}
+
+// blockUnwinder is a stage that keeps what it makes of the blocks. unwind
+// drops what it has of the blocks from on, orphaned by a reorg, so that it
+// can be handed those of the canonical chain instead.
+type blockUnwinder interface {
+	unwind(from uint64) error
+}
+
+// reorgError is a block that doesn't follow the one the scraper processed
+// before it.
+type reorgError struct {
+	block uint64
+}
+
+func (e *reorgError) Error() string {
+	return fmt.Sprintf("block %d: parent isn't the block processed before it", e.block)
+}
+
+// remember records b as processed, forgetting the blocks more than
+// -chain_reorg_depth behind it.
+func (s *blockScraper) remember(b *ethBlock) {
+	n := uint64(b.Number)
+	s.forget(n)
+	s.recent = append(s.recent, recentBlock{Number: n, Hash: b.Hash})
+	if extra := len(s.recent) - int(s.o.reorgDepth); extra > 0 {
+		s.recent = slices.Delete(s.recent, 0, extra)
+	}
+}
+
+// forget forgets the blocks from on.
+func (s *blockScraper) forget(from uint64) {
+	s.recent = slices.DeleteFunc(s.recent, func(r recentBlock) bool { return r.Number >= from })
+}
+
+// follows returns a *reorgError if the parent of b isn't the block the
+// scraper remembers before it.
+func (s *blockScraper) follows(b *ethBlock) error {
+	n := uint64(b.Number)
+	if len(s.recent) == 0 || n == 0 {
+		return nil
+	}
+	last := s.recent[len(s.recent)-1]
+	if last.Number == n-1 && !strings.EqualFold(last.Hash, b.ParentHash) {
+		return &reorgError{block: n}
+	}
+	return nil
+}
+
+// rollback handles a reorg found at block n: it looks for the last block
+// remembered that the node still has, unwinds the stages past it and saves
+// the progress there, so that the next round scrapes the canonical chain
+// from the fork on.
+func (s *blockScraper) rollback(ctx context.Context, n uint64) error {
+	fork, found := uint64(0), false
+	for i := len(s.recent) - 1; i >= 0 && !found; i-- {
+		hash, err := s.rpc.blockHash(ctx, s.recent[i].Number)
+		if err != nil {
+			return fmt.Errorf("looking for where the chain reorganised: %w", err)
+		}
+		fork, found = s.recent[i].Number, strings.EqualFold(hash, s.recent[i].Hash)
+	}
+	if !found {
+		return fmt.Errorf("block %d: the chain reorganised deeper than the %d blocks -chain_reorg_depth remembers", n, len(s.recent))
+	}
+	from := fork + 1
+	orphaned := n - from
+	slog.Warn("Chain reorganised, rolling back", "chain", s.o.name, "block", n, "fork", fork, "orphaned", orphaned)
+	for _, st := range s.stages {
+		if u, ok := st.(blockUnwinder); ok {
+			if err := u.unwind(from); err != nil {
+				return fmt.Errorf("rolling back to block %d: %w", from, err)
+			}
+		}
+	}
+	s.forget(from)
+	s.mu.Lock()
+	s.next = from
+	s.status.Reorgs++
+	s.status.Orphaned += orphaned
+	s.mu.Unlock()
+	s.metrics.chainReorg(s.o.name, int(orphaned))
+	for _, st := range s.stages {
+		if err := st.flush(); err != nil {
+			return err
+		}
+	}
+	if err := s.saveProgress(from); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.saved = from
+	s.status.NextBlock = from
+	return nil
+}
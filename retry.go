@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+)
+
+// fetch performs t's request, retrying transient failures up to t.attempts
+// times in total. Retries back off exponentially from t.retryBackoff, capped
+// at t.retryMaxBackoff, with full jitter. If every attempt fails the last
+// response or error is returned.
+func fetch(ctx context.Context, t *target) (*response, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := do(ctx, t)
+		if attempt >= t.attempts || !t.retryable(resp, err) {
+			return resp, err
+		}
+
+		reason := ""
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = resp.Status
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		wait := backoff(t.retryBackoff, t.retryMaxBackoff, attempt)
+		slog.Info("Attempt failed, retrying", "target", t.url, t.logLabels(), "attempt", attempt, "attempts", t.attempts, "error", reason, "wait", wait.Round(time.Millisecond))
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// do makes a single attempt at t's request. t.timeout bounds the whole
+// attempt including reading the body, but not time spent rate limited.
+func do(ctx context.Context, t *target) (*response, error) {
+	var body io.Reader
+	if t.requestBody != nil {
+		body = bytes.NewReader(t.requestBody)
+	}
+	ctx = context.WithValue(ctx, redirectPolicyKey{}, t.redirects)
+	ctx = context.WithValue(ctx, proxyKey{}, t.proxy)
+	req, err := http.NewRequestWithContext(ctx, t.method, t.url, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range t.header() {
+		if name == "Host" {
+			req.Host = values[0]
+			continue
+		}
+		req.Header[name] = values
+	}
+	req.Close = !t.conn.keepAlive
+	if err := t.limiter.wait(ctx, req.URL.Hostname()); err != nil {
+		return nil, err
+	}
+
+	cancel := context.CancelFunc(func() {})
+	if t.timeout > 0 {
+		var timeoutCtx context.Context
+		timeoutCtx, cancel = context.WithTimeout(ctx, t.timeout)
+		req = req.WithContext(timeoutCtx)
+	}
+
+	req, span := startRequestSpan(t, req)
+	req, logResponse := traceRequest(t, req)
+	sent := time.Now()
+	resp, err := t.client.Do(req)
+	logResponse(resp, err)
+	if err != nil {
+		cancel()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		return nil, err
+	}
+	resp.Body = cancelBody{resp.Body, func() {
+		cancel()
+		span.End()
+	}}
+	return &response{Response: resp, sent: sent}, nil
+}
+
+// backoff returns a random delay between zero and base*2^(attempt-1),
+// limited to max.
+func backoff(base, max time.Duration, attempt int) time.Duration {
+	d := base
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// retryable reports whether the outcome of an attempt is worth retrying.
+func (t *target) retryable(resp *response, err error) bool {
+	if err != nil {
+		return retryableError(err)
+	}
+	return t.retryStatus[resp.StatusCode]
+}
+
+// retryableError classifies request errors. Network-level failures such as
+// timeouts, refused or reset connections and temporary DNS failures are
+// retried; cancellation, bad URLs and TLS failures are not.
+func retryableError(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTimeout || dnsErr.IsTemporary
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var opErr *net.OpError
+	return errors.As(err, &opErr)
+}
+
+// parseStatusList parses a comma-separated list of HTTP status codes. Each
+// entry is a code, an inclusive range such as 301-302 or a class such as 2xx.
+func parseStatusList(value string) (map[int]bool, error) {
+	codes := make(map[int]bool)
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		lo, hi, err := parseStatusRange(s)
+		if err != nil {
+			return nil, err
+		}
+		for code := lo; code <= hi; code++ {
+			codes[code] = true
+		}
+	}
+	return codes, nil
+}
+
+func parseStatusRange(s string) (int, int, error) {
+	if len(s) == 3 && strings.HasSuffix(strings.ToLower(s), "xx") && s[0] >= '1' && s[0] <= '9' {
+		lo := int(s[0]-'0') * 100
+		return lo, lo + 99, nil
+	}
+	from, to, isRange := strings.Cut(s, "-")
+	lo, err := strconv.Atoi(strings.TrimSpace(from))
+	if err != nil || lo < 100 || lo > 999 {
+		return 0, 0, fmt.Errorf("bad status code %q", s)
+	}
+	if !isRange {
+		return lo, lo, nil
+	}
+	hi, err := strconv.Atoi(strings.TrimSpace(to))
+	if err != nil || hi < lo || hi > 999 {
+		return 0, 0, fmt.Errorf("bad status range %q", s)
+	}
+	return lo, hi, nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// rpcCall is a call of a batch. Its result is decoded into result, a null
+// one leaving it alone, and err is set if it failed.
+type rpcCall struct {
+	method string
+	params []any
+	result any
+	err    error
+}
+
+func newRPCCall(method string, result any, params ...any) *rpcCall {
+	if params == nil {
+		params = []any{}
+	}
+	return &rpcCall{method: method, params: params, result: result}
+}
+
+// batchRejectedError is a batch the provider turned away for its size, or
+// for being a batch at all.
+type batchRejectedError struct {
+	size   int
+	reason string
+}
+
+func (e *batchRejectedError) Error() string {
+	return fmt.Sprintf("batch of %d calls rejected: %s", e.size, e.reason)
+}
+
+// batch makes calls, as many in each HTTP request as the provider in use
+// takes, up to -chain_rpc_batch. When the provider rejects a batch, it is
+// split in half, and the provider sent no bigger batches from then on,
+// down to single calls. It returns an error if calls couldn't be made at
+// all; otherwise each call has its own.
+func (c *rpcClient) batch(ctx context.Context, calls []*rpcCall) error {
+	for len(calls) > 0 {
+		n := min(len(calls), c.batchSize())
+		if n == 1 {
+			call := calls[0]
+			err := c.call(ctx, call.method, call.result, call.params...)
+			if providerFault(err) || ctx.Err() != nil {
+				return err
+			}
+			call.err = err
+			calls = calls[1:]
+			continue
+		}
+		err := c.doBatch(ctx, calls[:n])
+		var rejected *batchRejectedError
+		if errors.As(err, &rejected) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		calls = calls[n:]
+	}
+	return nil
+}
+
+// batchSize is the most calls the provider in use takes in a batch.
+func (c *rpcClient) batchSize() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.endpoints[c.current].batch
+}
+
+// doBatch makes calls in one request, failing over like do.
+func (c *rpcClient) doBatch(ctx context.Context, calls []*rpcCall) error {
+	reqs := make([]rpcRequest, len(calls))
+	for i, call := range calls {
+		reqs[i] = rpcRequest{JSONRPC: "2.0", ID: c.ids.Add(1), Method: call.method, Params: call.params}
+	}
+	body, err := json.Marshal(reqs)
+	if err != nil {
+		return err
+	}
+	e := c.pick()
+	for tried := 1; ; tried++ {
+		err = c.postBatch(ctx, e, body, reqs, calls)
+		var rejected *batchRejectedError
+		if errors.As(err, &rejected) {
+			c.shrinkBatch(e, rejected)
+			return err
+		}
+		if ctx.Err() != nil || !providerFault(err) {
+			c.served(e)
+			return err
+		}
+		next := c.failed(e, err)
+		if next == e || tried >= len(c.endpoints) {
+			return err
+		}
+		e = next
+	}
+}
+
+// shrinkBatch halves the batches e is sent after it rejected one.
+func (c *rpcClient) shrinkBatch(e *rpcEndpoint, rejected *batchRejectedError) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if size := max(rejected.size/2, 1); size < e.batch {
+		e.batch = size
+		slog.Warn("RPC provider rejected a batch, sending smaller ones", "chain", c.chain, "rpc", redactURL(e.url), "rejected", rejected.size, "batch", size, "reason", rejected.reason)
+	}
+}
+
+// postBatch posts the batch body of reqs to e and hands each of calls its
+// response.
+func (c *rpcClient) postBatch(ctx context.Context, e *rpcEndpoint, body []byte, reqs []rpcRequest, calls []*rpcCall) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return &endpointError{fmt.Errorf("batch: %w", err)}
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return &endpointError{fmt.Errorf("batch: %w", err)}
+	}
+	switch {
+	case resp.StatusCode == http.StatusRequestEntityTooLarge || resp.StatusCode == http.StatusBadRequest:
+		return &batchRejectedError{size: len(calls), reason: resp.Status}
+	case resp.StatusCode != http.StatusOK:
+		return &endpointError{fmt.Errorf("batch: %s: %s", resp.Status, strings.TrimSpace(string(b[:min(len(b), 512)])))}
+	}
+	b = bytes.TrimSpace(b)
+	if len(b) > 0 && b[0] == '{' {
+		// A single response to a batch is the provider refusing it.
+		var r rpcResponse
+		if err := json.Unmarshal(b, &r); err != nil || r.Error == nil {
+			return &endpointError{errors.New("batch: answered with a single response")}
+		}
+		if rateLimited(r.Error) {
+			return fmt.Errorf("batch: %w", r.Error)
+		}
+		return &batchRejectedError{size: len(calls), reason: r.Error.Error()}
+	}
+	var rs []rpcResponse
+	if err := json.Unmarshal(b, &rs); err != nil {
+		return &endpointError{fmt.Errorf("batch: %w", err)}
+	}
+	byID := make(map[uint64]*rpcResponse, len(rs))
+	for i := range rs {
+		byID[rs[i].ID] = &rs[i]
+	}
+	if len(byID) < len(calls) {
+		if len(rs) > 0 && rs[0].Error != nil && batchRefusal(rs[0].Error) {
+			return &batchRejectedError{size: len(calls), reason: rs[0].Error.Error()}
+		}
+		return &endpointError{fmt.Errorf("batch: %d responses to %d calls", len(byID), len(calls))}
+	}
+	for i, call := range calls {
+		r, ok := byID[reqs[i].ID]
+		if !ok {
+			return &endpointError{fmt.Errorf("batch: no response to %s", call.method)}
+		}
+		call.err = nil
+		switch {
+		case r.Error != nil:
+			if rateLimited(r.Error) {
+				return fmt.Errorf("%s: %w", call.method, r.Error)
+			}
+			if batchRefusal(r.Error) {
+				return &batchRejectedError{size: len(calls), reason: r.Error.Error()}
+			}
+			call.err = fmt.Errorf("%s: %w", call.method, r.Error)
+		case len(r.Result) == 0 || string(r.Result) == "null":
+		default:
+			if err := json.Unmarshal(r.Result, call.result); err != nil {
+				call.err = fmt.Errorf("%s: %w", call.method, err)
+			}
+		}
+	}
+	return nil
+}
+
+// batchRefusal reports whether err is a provider refusing a batch for its
+// size.
+func batchRefusal(err *rpcError) bool {
+	msg := strings.ToLower(err.Message)
+	return strings.Contains(msg, "batch") &&
+		(strings.Contains(msg, "too large") || strings.Contains(msg, "too big") || strings.Contains(msg, "exceed") || strings.Contains(msg, "limit") || strings.Contains(msg, "not supported"))
+}
+
+// callErr returns the first error of calls.
+func callErr(calls []*rpcCall) error {
+	for _, call := range calls {
+		if call.err != nil {
+			return call.err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// rpcCooldown is how long a provider that failed a call is passed
+	// over, doubled for every further call it fails in a row up to
+	// rpcMaxCooldown.
+	rpcCooldown    = 5 * time.Second
+	rpcMaxCooldown = 5 * time.Minute
+	// rpcScoreWeight is the weight of the latest call in a provider's
+	// score.
+	rpcScoreWeight = 0.1
+)
+
+// rpcEndpoint is a provider of a chain, with how well it has served. The
+// client's mu guards all but url.
+type rpcEndpoint struct {
+	url string
+	// score is a moving average of the calls it answered, from 0 for none
+	// to 1 for all.
+	score float64
+	// head is the latest block it reported, 0 until it has.
+	head uint64
+	// failures counts the calls it failed in a row, and down is when it
+	// may be called again after them.
+	failures  int
+	down      time.Time
+	lastError string
+	// batch is the most calls it's sent in a batch, lowered when it
+	// rejects one.
+	batch int
+	// caps is what it had when last probed, nil until it has been.
+	caps *nodeCaps
+}
+
+// rpcStatus is a provider as /chains shows it.
+type rpcStatus struct {
+	URL     string  `json:"url"`
+	Current bool    `json:"current,omitempty"`
+	Score   float64 `json:"score"`
+	Head    uint64  `json:"head,omitempty"`
+	Batch   int     `json:"batch"`
+	// Behind is set while it's more than -chain_rpc_max_lag blocks
+	// behind the furthest provider, and DownUntil while it's passed over
+	// after failing.
+	Behind    bool       `json:"behind,omitempty"`
+	DownUntil *time.Time `json:"down_until,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	// Capabilities is what it had when last probed.
+	Capabilities *nodeCaps `json:"capabilities,omitempty"`
+}
+
+// providerFault reports whether err is the provider's fault rather than
+// the call's, so that another provider may answer it.
+func providerFault(err error) bool {
+	var ee *endpointError
+	return errors.As(err, &ee) || rateLimited(err)
+}
+
+// rateLimited reports whether err is the provider turning a call away for
+// going over its limits.
+func rateLimited(err error) bool {
+	var re *rpcError
+	if !errors.As(err, &re) {
+		return false
+	}
+	if re.Code == -32005 || re.Code == 429 {
+		return true
+	}
+	msg := strings.ToLower(re.Message)
+	return strings.Contains(msg, "rate limit") || strings.Contains(msg, "too many requests") || strings.Contains(msg, "limit exceeded")
+}
+
+// pick returns the provider in use.
+func (c *rpcClient) pick() *rpcEndpoint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.endpoints[c.current]
+}
+
+// served records a call e answered.
+func (c *rpcClient) served(e *rpcEndpoint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e.score += rpcScoreWeight * (1 - e.score)
+	e.failures, e.down, e.lastError = 0, time.Time{}, ""
+}
+
+// failed records a call e failed with err, failing over from it if it's
+// in use, and returns the provider to call next.
+func (c *rpcClient) failed(e *rpcEndpoint, err error) *rpcEndpoint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	e.score -= rpcScoreWeight * e.score
+	e.failures++
+	e.down = now.Add(min(rpcCooldown<<min(e.failures-1, 16), rpcMaxCooldown))
+	e.lastError = err.Error()
+	c.failOver(e, now, err.Error())
+	return c.endpoints[c.current]
+}
+
+// sawHead records the head e reported, failing over from it if it's in
+// use and behind.
+func (c *rpcClient) sawHead(e *rpcEndpoint, head uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e.head = head
+	if lag := c.lag(e, time.Now()); lag > c.maxLag {
+		c.failOver(e, time.Now(), fmt.Sprintf("%d blocks behind", lag))
+	}
+}
+
+// lag is how many blocks e is behind the furthest provider that isn't
+// down. The caller holds c.mu.
+func (c *rpcClient) lag(e *rpcEndpoint, now time.Time) uint64 {
+	if e.head == 0 {
+		return 0
+	}
+	var best uint64
+	for _, o := range c.endpoints {
+		if !now.Before(o.down) {
+			best = max(best, o.head)
+		}
+	}
+	return best - min(best, e.head)
+}
+
+// failOver moves to the provider with the best score of those neither
+// down nor behind, if e is in use and there is one; otherwise e stays in
+// use, so that the client sticks to a provider until it has to leave it.
+// The caller holds c.mu.
+func (c *rpcClient) failOver(e *rpcEndpoint, now time.Time, reason string) {
+	if c.endpoints[c.current] != e {
+		return
+	}
+	best := -1
+	for i, o := range c.endpoints {
+		if o == e || now.Before(o.down) || c.lag(o, now) > c.maxLag {
+			continue
+		}
+		if best < 0 || o.score > c.endpoints[best].score {
+			best = i
+		}
+	}
+	if best < 0 {
+		return
+	}
+	slog.Warn("Failing over to another RPC provider", "chain", c.chain, "from", redactURL(e.url), "to", redactURL(c.endpoints[best].url), "reason", reason)
+	c.current = best
+	c.metrics.chainFailover(c.chain)
+}
+
+// probe asks every provider for its head every interval until ctx is done,
+// so that their scores and heads stay current and the one in use is left
+// once it falls behind. A single provider isn't probed.
+func (c *rpcClient) probe(ctx context.Context, interval time.Duration) {
+	if len(c.endpoints) < 2 {
+		return
+	}
+	body := []byte(`{"jsonrpc":"2.0","id":0,"method":"eth_blockNumber","params":[]}`)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		var wg sync.WaitGroup
+		for _, e := range c.endpoints {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				var head quantity
+				err := c.post(ctx, e, "eth_blockNumber", body, &head)
+				switch {
+				case ctx.Err() != nil:
+				case err != nil:
+					c.failed(e, err)
+				default:
+					c.served(e)
+					c.sawHead(e, uint64(head))
+				}
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+// status returns the URL of the provider in use and the state of each.
+func (c *rpcClient) status() (string, []rpcStatus) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	out := make([]rpcStatus, len(c.endpoints))
+	for i, e := range c.endpoints {
+		out[i] = rpcStatus{
+			URL:     redactURL(e.url),
+			Current: i == c.current,
+			Score:   math.Round(e.score*1000) / 1000,
+			Head:    e.head,
+			Batch:   e.batch,
+			Behind:  c.lag(e, now) > c.maxLag,
+			Error:   e.lastError,
+		}
+		if e.caps != nil {
+			caps := *e.caps
+			out[i].Capabilities = &caps
+		}
+		if now.Before(e.down) {
+			out[i].DownUntil = timePtr(e.down.UTC().Truncate(time.Second))
+		}
+	}
+	return out[c.current].URL, out
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// emptySHA256 is the hex SHA-256 of an empty payload, which GET requests
+// have.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// newS3Request returns a request for the object key in bucket, signed with
+// AWS Signature Version 4.
+//
+// Like the AWS CLI, the region and credentials are taken from the
+// environment: AWS_REGION or AWS_DEFAULT_REGION, us-east-1 if neither is set,
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN. Without
+// credentials the request is sent unsigned, which works for public objects.
+// AWS_ENDPOINT_URL_S3 or AWS_ENDPOINT_URL point it at an S3-compatible
+// service instead, addressing the bucket in the path.
+func newS3Request(ctx context.Context, bucket, key string) (*http.Request, error) {
+	key = strings.TrimPrefix(key, "/")
+	if bucket == "" || key == "" {
+		return nil, errors.New("s3: want s3://bucket/key")
+	}
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	path := "/" + awsEscape(key)
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_S3")
+	if endpoint == "" {
+		endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	if endpoint != "" {
+		endpoint = strings.TrimRight(endpoint, "/")
+		path = "/" + awsEscape(bucket) + path
+	} else {
+		endpoint = "https://" + bucket + ".s3." + region + ".amazonaws.com"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Keep the path as escaped for signing rather than re-escaped by
+	// net/url.
+	req.URL.RawPath = path
+
+	id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if id == "" || secret == "" {
+		return req, nil
+	}
+	signS3(req, id, secret, os.Getenv("AWS_SESSION_TOKEN"), region, time.Now())
+	return req, nil
+}
+
+// signS3 adds a Signature Version 4 Authorization header to req, an S3
+// request without a body, covering its host and x-amz- headers.
+func signS3(req *http.Request, id, secret, token, region string, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", emptySHA256)
+	if token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+
+	names := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if token != "" {
+		names = append(names, "x-amz-security-token")
+	}
+	var headers strings.Builder
+	for _, name := range names {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		headers.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	signed := strings.Join(names, ";")
+	canonical := strings.Join([]string{
+		req.Method, req.URL.EscapedPath(), req.URL.RawQuery, headers.String(), signed, emptySHA256,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + req.Header.Get("X-Amz-Date") + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := []byte("AWS4" + secret)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		id, scope, signed, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// awsEscape escapes an object key as AWS signatures expect: everything but
+// unreserved characters and slashes is percent-encoded.
+func awsEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// scheduler runs one timing loop per target. Loops don't run checks
+// themselves but hand them to a fixed pool of workers, which bounds how many
+// checks are in flight at once. The set of loops is replaced wholesale
+// whenever the configuration is reloaded; the pool lives as long as the
+// scheduler.
+type scheduler struct {
+	// work is handed to every check. It is independent of the loops so
+	// that stopping a loop lets its in-flight check finish.
+	work      context.Context
+	jobs      chan job
+	metrics   metrics
+	health    *health
+	history   *history
+	alerts    *alerter
+	checksums *checksumTracker
+	slo       *sloTracker
+	// store, if not nil, saves every result.
+	store *storeWriter
+	// export, if not nil, appends every result to a file.
+	export *exporter
+	// influx, if not nil, writes every result to InfluxDB.
+	influx *influxWriter
+	// feed streams results to API clients.
+	feed   *feed
+	pauses *pauses
+	stop   context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu sync.Mutex
+	// targets are those the loops were last started for.
+	targets []*target
+}
+
+// job is a single check handed from a loop to a worker. done receives the
+// result once the check has finished; it must have room for it.
+type job struct {
+	t    *target
+	done chan *result
+}
+
+func newScheduler(work context.Context, workers int, m metrics, h *health, hist *history, alerts *alerter, st *storeWriter, exp *exporter, influx *influxWriter) *scheduler {
+	s := &scheduler{
+		work:      work,
+		jobs:      make(chan job),
+		metrics:   m,
+		health:    h,
+		history:   hist,
+		alerts:    alerts,
+		checksums: newChecksumTracker(),
+		slo:       newSLOTracker(),
+		store:     st,
+		export:    exp,
+		influx:    influx,
+		feed:      newFeed(),
+		pauses:    newPauses(),
+	}
+	for i := 0; i < workers; i++ {
+		go s.worker()
+	}
+	return s
+}
+
+// start stops any running loops and starts one for each of targets.
+func (s *scheduler) start(targets []*target) {
+	s.halt()
+	s.metrics.retain(targets)
+	s.health.started(targets)
+	s.history.retain(targets)
+	s.alerts.retain(targets)
+	s.mu.Lock()
+	s.targets = targets
+	s.mu.Unlock()
+
+	ctx, stop := context.WithCancel(context.Background())
+	s.stop = stop
+	for _, t := range targets {
+		if t.paused {
+			continue
+		}
+		s.wg.Add(1)
+		go s.loop(ctx, *t)
+	}
+}
+
+// target returns the target with url, or nil.
+func (s *scheduler) target(url string) *target {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.targets {
+		if t.url == url {
+			return t
+		}
+	}
+	return nil
+}
+
+// targetWithID returns the target the admin API identifies by id, or nil.
+func (s *scheduler) targetWithID(id string) *target {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.targets {
+		if targetID(t.url) == id {
+			return t
+		}
+	}
+	return nil
+}
+
+// runNow checks t right away, besides its schedule, and returns the result
+// once it is in, unless ctx is done first.
+func (s *scheduler) runNow(ctx context.Context, t *target) (*result, error) {
+	done := make(chan *result, 1)
+	select {
+	case s.jobs <- job{t: t, done: done}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	select {
+	case r := <-done:
+		return r, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// halt stops all loops. Checks already under way run to completion; use
+// drain to wait for them.
+func (s *scheduler) halt() {
+	if s.stop != nil {
+		s.stop()
+	}
+	s.health.stopped()
+}
+
+func (s *scheduler) worker() {
+	for {
+		select {
+		case <-s.work.Done():
+			return
+		case j := <-s.jobs:
+			s.metrics.inFlight(1)
+			r := check(s.work, j.t)
+			s.metrics.inFlight(-1)
+			s.checksums.observe(r)
+			s.metrics.observe(r)
+			s.history.observe(r)
+			s.alerts.observe(r)
+			s.slo.observe(r)
+			s.store.observe(r)
+			s.export.observe(r)
+			s.influx.observe(r)
+			s.feed.observe(r)
+			j.done <- r
+		}
+	}
+}
+
+func (s *scheduler) loop(ctx context.Context, t target) {
+	defer s.wg.Done()
+
+	// Intervals are measured between scheduled start times rather than
+	// from the end of the previous check, so slow checks don't push the
+	// schedule back. A check that overruns a whole interval skips ahead.
+	next := t.next(time.Now())
+	timer := time.NewTimer(time.Until(next))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			// Wait for a free worker, then for the check to finish, so a
+			// target never has more than one check in flight. The loop
+			// only returns once its check is done, which is what drain
+			// relies on.
+			if !s.pauses.paused(t.url) {
+				done := make(chan *result, 1)
+				s.health.due(&t)
+				select {
+				case s.jobs <- job{t: &t, done: done}:
+					s.health.picked(&t)
+					<-done
+				case <-ctx.Done():
+					s.health.abandoned(&t)
+					return
+				}
+			}
+
+			next = t.next(next)
+			if now := time.Now(); next.Before(now) {
+				s.metrics.overrun(&t)
+				next = t.next(now)
+			}
+			timer.Reset(time.Until(next))
+		}
+	}
+}
@@ -0,0 +1,5 @@
+// Package scraperpb is the gRPC client and server code of the scraper's
+// management API, generated from scraper.proto.
+package scraperpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative scraper.proto
@@ -0,0 +1,416 @@
+// The scraper's management API. It serves the same targets as the /targets
+// REST API on -admin_addr and streams check results as they come in. Every
+// call needs the -admin_token in the authorization metadata, as
+// "Bearer <token>".
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             v5.28.3
+// source: scraper.proto
+
+package scraperpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Scraper_ListTargets_FullMethodName   = "/trueblocks.scraper.v1.Scraper/ListTargets"
+	Scraper_GetTarget_FullMethodName     = "/trueblocks.scraper.v1.Scraper/GetTarget"
+	Scraper_AddTarget_FullMethodName     = "/trueblocks.scraper.v1.Scraper/AddTarget"
+	Scraper_UpdateTarget_FullMethodName  = "/trueblocks.scraper.v1.Scraper/UpdateTarget"
+	Scraper_DeleteTarget_FullMethodName  = "/trueblocks.scraper.v1.Scraper/DeleteTarget"
+	Scraper_PauseTarget_FullMethodName   = "/trueblocks.scraper.v1.Scraper/PauseTarget"
+	Scraper_ResumeTarget_FullMethodName  = "/trueblocks.scraper.v1.Scraper/ResumeTarget"
+	Scraper_StreamResults_FullMethodName = "/trueblocks.scraper.v1.Scraper/StreamResults"
+)
+
+// ScraperClient is the client API for Scraper service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ScraperClient interface {
+	// ListTargets returns every target, the configured ones first.
+	ListTargets(ctx context.Context, in *ListTargetsRequest, opts ...grpc.CallOption) (*ListTargetsResponse, error)
+	GetTarget(ctx context.Context, in *GetTargetRequest, opts ...grpc.CallOption) (*Target, error)
+	// AddTarget adds a target, which is checked from then on. Fails with
+	// ALREADY_EXISTS if a target has its URL and INVALID_ARGUMENT if it
+	// doesn't validate.
+	AddTarget(ctx context.Context, in *AddTargetRequest, opts ...grpc.CallOption) (*Target, error)
+	// UpdateTarget replaces the options of a target added through the API.
+	// Configured targets can't be changed, which fails with
+	// FAILED_PRECONDITION, as do the calls below.
+	UpdateTarget(ctx context.Context, in *UpdateTargetRequest, opts ...grpc.CallOption) (*Target, error)
+	DeleteTarget(ctx context.Context, in *DeleteTargetRequest, opts ...grpc.CallOption) (*DeleteTargetResponse, error)
+	// PauseTarget and ResumeTarget set and clear the target's paused option.
+	PauseTarget(ctx context.Context, in *PauseTargetRequest, opts ...grpc.CallOption) (*Target, error)
+	ResumeTarget(ctx context.Context, in *ResumeTargetRequest, opts ...grpc.CallOption) (*Target, error)
+	// StreamResults sends the result of every check from when it is called
+	// until it is canceled. Results are dropped for clients that fall behind.
+	StreamResults(ctx context.Context, in *StreamResultsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Result], error)
+}
+
+type scraperClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewScraperClient(cc grpc.ClientConnInterface) ScraperClient {
+	return &scraperClient{cc}
+}
+
+func (c *scraperClient) ListTargets(ctx context.Context, in *ListTargetsRequest, opts ...grpc.CallOption) (*ListTargetsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListTargetsResponse)
+	err := c.cc.Invoke(ctx, Scraper_ListTargets_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *scraperClient) GetTarget(ctx context.Context, in *GetTargetRequest, opts ...grpc.CallOption) (*Target, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Target)
+	err := c.cc.Invoke(ctx, Scraper_GetTarget_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *scraperClient) AddTarget(ctx context.Context, in *AddTargetRequest, opts ...grpc.CallOption) (*Target, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Target)
+	err := c.cc.Invoke(ctx, Scraper_AddTarget_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *scraperClient) UpdateTarget(ctx context.Context, in *UpdateTargetRequest, opts ...grpc.CallOption) (*Target, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Target)
+	err := c.cc.Invoke(ctx, Scraper_UpdateTarget_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *scraperClient) DeleteTarget(ctx context.Context, in *DeleteTargetRequest, opts ...grpc.CallOption) (*DeleteTargetResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DeleteTargetResponse)
+	err := c.cc.Invoke(ctx, Scraper_DeleteTarget_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *scraperClient) PauseTarget(ctx context.Context, in *PauseTargetRequest, opts ...grpc.CallOption) (*Target, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Target)
+	err := c.cc.Invoke(ctx, Scraper_PauseTarget_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *scraperClient) ResumeTarget(ctx context.Context, in *ResumeTargetRequest, opts ...grpc.CallOption) (*Target, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Target)
+	err := c.cc.Invoke(ctx, Scraper_ResumeTarget_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *scraperClient) StreamResults(ctx context.Context, in *StreamResultsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Result], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Scraper_ServiceDesc.Streams[0], Scraper_StreamResults_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[StreamResultsRequest, Result]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Scraper_StreamResultsClient = grpc.ServerStreamingClient[Result]
+
+// ScraperServer is the server API for Scraper service.
+// All implementations must embed UnimplementedScraperServer
+// for forward compatibility.
+type ScraperServer interface {
+	// ListTargets returns every target, the configured ones first.
+	ListTargets(context.Context, *ListTargetsRequest) (*ListTargetsResponse, error)
+	GetTarget(context.Context, *GetTargetRequest) (*Target, error)
+	// AddTarget adds a target, which is checked from then on. Fails with
+	// ALREADY_EXISTS if a target has its URL and INVALID_ARGUMENT if it
+	// doesn't validate.
+	AddTarget(context.Context, *AddTargetRequest) (*Target, error)
+	// UpdateTarget replaces the options of a target added through the API.
+	// Configured targets can't be changed, which fails with
+	// FAILED_PRECONDITION, as do the calls below.
+	UpdateTarget(context.Context, *UpdateTargetRequest) (*Target, error)
+	DeleteTarget(context.Context, *DeleteTargetRequest) (*DeleteTargetResponse, error)
+	// PauseTarget and ResumeTarget set and clear the target's paused option.
+	PauseTarget(context.Context, *PauseTargetRequest) (*Target, error)
+	ResumeTarget(context.Context, *ResumeTargetRequest) (*Target, error)
+	// StreamResults sends the result of every check from when it is called
+	// until it is canceled. Results are dropped for clients that fall behind.
+	StreamResults(*StreamResultsRequest, grpc.ServerStreamingServer[Result]) error
+	mustEmbedUnimplementedScraperServer()
+}
+
+// UnimplementedScraperServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedScraperServer struct{}
+
+func (UnimplementedScraperServer) ListTargets(context.Context, *ListTargetsRequest) (*ListTargetsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListTargets not implemented")
+}
+func (UnimplementedScraperServer) GetTarget(context.Context, *GetTargetRequest) (*Target, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetTarget not implemented")
+}
+func (UnimplementedScraperServer) AddTarget(context.Context, *AddTargetRequest) (*Target, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddTarget not implemented")
+}
+func (UnimplementedScraperServer) UpdateTarget(context.Context, *UpdateTargetRequest) (*Target, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateTarget not implemented")
+}
+func (UnimplementedScraperServer) DeleteTarget(context.Context, *DeleteTargetRequest) (*DeleteTargetResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteTarget not implemented")
+}
+func (UnimplementedScraperServer) PauseTarget(context.Context, *PauseTargetRequest) (*Target, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PauseTarget not implemented")
+}
+func (UnimplementedScraperServer) ResumeTarget(context.Context, *ResumeTargetRequest) (*Target, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ResumeTarget not implemented")
+}
+func (UnimplementedScraperServer) StreamResults(*StreamResultsRequest, grpc.ServerStreamingServer[Result]) error {
+	return status.Errorf(codes.Unimplemented, "method StreamResults not implemented")
+}
+func (UnimplementedScraperServer) mustEmbedUnimplementedScraperServer() {}
+func (UnimplementedScraperServer) testEmbeddedByValue()                 {}
+
+// UnsafeScraperServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ScraperServer will
+// result in compilation errors.
+type UnsafeScraperServer interface {
+	mustEmbedUnimplementedScraperServer()
+}
+
+func RegisterScraperServer(s grpc.ServiceRegistrar, srv ScraperServer) {
+	// If the following call pancis, it indicates UnimplementedScraperServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Scraper_ServiceDesc, srv)
+}
+
+func _Scraper_ListTargets_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListTargetsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ScraperServer).ListTargets(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Scraper_ListTargets_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ScraperServer).ListTargets(ctx, req.(*ListTargetsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Scraper_GetTarget_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetTargetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ScraperServer).GetTarget(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Scraper_GetTarget_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ScraperServer).GetTarget(ctx, req.(*GetTargetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Scraper_AddTarget_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddTargetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ScraperServer).AddTarget(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Scraper_AddTarget_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ScraperServer).AddTarget(ctx, req.(*AddTargetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Scraper_UpdateTarget_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateTargetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ScraperServer).UpdateTarget(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Scraper_UpdateTarget_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ScraperServer).UpdateTarget(ctx, req.(*UpdateTargetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Scraper_DeleteTarget_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteTargetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ScraperServer).DeleteTarget(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Scraper_DeleteTarget_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ScraperServer).DeleteTarget(ctx, req.(*DeleteTargetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Scraper_PauseTarget_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PauseTargetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ScraperServer).PauseTarget(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Scraper_PauseTarget_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ScraperServer).PauseTarget(ctx, req.(*PauseTargetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Scraper_ResumeTarget_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ResumeTargetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ScraperServer).ResumeTarget(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Scraper_ResumeTarget_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ScraperServer).ResumeTarget(ctx, req.(*ResumeTargetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Scraper_StreamResults_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamResultsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ScraperServer).StreamResults(m, &grpc.GenericServerStream[StreamResultsRequest, Result]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Scraper_StreamResultsServer = grpc.ServerStreamingServer[Result]
+
+// Scraper_ServiceDesc is the grpc.ServiceDesc for Scraper service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Scraper_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "trueblocks.scraper.v1.Scraper",
+	HandlerType: (*ScraperServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListTargets",
+			Handler:    _Scraper_ListTargets_Handler,
+		},
+		{
+			MethodName: "GetTarget",
+			Handler:    _Scraper_GetTarget_Handler,
+		},
+		{
+			MethodName: "AddTarget",
+			Handler:    _Scraper_AddTarget_Handler,
+		},
+		{
+			MethodName: "UpdateTarget",
+			Handler:    _Scraper_UpdateTarget_Handler,
+		},
+		{
+			MethodName: "DeleteTarget",
+			Handler:    _Scraper_DeleteTarget_Handler,
+		},
+		{
+			MethodName: "PauseTarget",
+			Handler:    _Scraper_PauseTarget_Handler,
+		},
+		{
+			MethodName: "ResumeTarget",
+			Handler:    _Scraper_ResumeTarget_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamResults",
+			Handler:       _Scraper_StreamResults_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "scraper.proto",
+}
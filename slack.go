@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// slackPostMessageURL is Slack's chat.postMessage method.
+var slackPostMessageURL = "https://slack.com/api/chat.postMessage"
+
+// slackOptions configure posting alerts to Slack, through an incoming
+// webhook or with a bot token. Both are resolved with secretValue.
+type slackOptions struct {
+	webhook string
+	token   string
+}
+
+// slackNotifier posts alerts to Slack. A webhook posts to its own channel
+// unless the target names another; a bot token always needs the target's
+// channel.
+type slackNotifier struct {
+	client  *http.Client
+	webhook string
+	token   string
+	retries int
+}
+
+// newSlackNotifier returns nil when Slack isn't configured.
+func newSlackNotifier(o slackOptions, retries int) (*slackNotifier, error) {
+	if o.webhook != "" && o.token != "" {
+		return nil, errors.New("-slack_webhook_url and -slack_token don't go together")
+	}
+	webhook, err := secretValue(o.webhook)
+	if err != nil {
+		return nil, fmt.Errorf("-slack_webhook_url: %w", err)
+	}
+	token, err := secretValue(o.token)
+	if err != nil {
+		return nil, fmt.Errorf("-slack_token: %w", err)
+	}
+	if webhook == "" && token == "" {
+		return nil, nil
+	}
+	if webhook != "" {
+		if _, err := url.ParseRequestURI(webhook); err != nil {
+			return nil, fmt.Errorf("-slack_webhook_url: %w", err)
+		}
+	}
+	return &slackNotifier{
+		client:  &http.Client{Timeout: 10 * time.Second},
+		webhook: webhook,
+		token:   token,
+		retries: retries,
+	}, nil
+}
+
+func (s *slackNotifier) name() string {
+	return "slack"
+}
+
+func (s *slackNotifier) checkTarget(t *target) error {
+	if s.token != "" && t.slackChannel == "" {
+		return errors.New("-slack_token needs a slack_channel")
+	}
+	return nil
+}
+
+func (s *slackNotifier) notify(ctx context.Context, e *alertEvent) error {
+	body, err := json.Marshal(struct {
+		Channel string `json:"channel,omitempty"`
+		Text    string `json:"text"`
+	}{e.target.slackChannel, slackStyle.message(e)})
+	if err != nil {
+		return err
+	}
+
+	endpoint, accept := s.webhook, acceptStatus
+	if s.token != "" {
+		endpoint, accept = slackPostMessageURL, acceptSlackAPI
+	}
+	return postWithRetries(ctx, s.client, s.retries, accept, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+		if s.token != "" {
+			req.Header.Set("Authorization", "Bearer "+s.token)
+		}
+		return req, nil
+	})
+}
+
+// acceptSlackAPI accepts Web API responses that report success. The API
+// answers errors with a 200 and says what went wrong in the body.
+func acceptSlackAPI(resp *http.Response) error {
+	if err := acceptStatus(resp); err != nil {
+		return err
+	}
+	var reply struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return err
+	}
+	if !reply.OK {
+		return fmt.Errorf("slack: %s", reply.Error)
+	}
+	return nil
+}
+
+// slackStyle formats alerts in Slack's mrkdwn, which only needs &, < and >
+// escaped.
+var slackStyle = chatStyle{
+	down:   ":red_circle:",
+	up:     ":large_green_circle:",
+	bold:   "*",
+	escape: strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace,
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// slo is a latency objective: objective of all checks within the trailing
+// window must succeed in under latency.
+type slo struct {
+	latency   time.Duration
+	objective float64
+	window    time.Duration
+}
+
+// sloTracker keeps the samples each target's SLO is evaluated over. It is
+// keyed by URL so that history survives a reload.
+type sloTracker struct {
+	mu      sync.Mutex
+	windows map[string]*sloWindow
+}
+
+type sloWindow struct {
+	samples  []sloSample
+	good     int
+	breached bool
+}
+
+type sloSample struct {
+	at   time.Time
+	good bool
+}
+
+func newSLOTracker() *sloTracker {
+	return &sloTracker{windows: make(map[string]*sloWindow)}
+}
+
+// observe adds r to its target's window and logs when the SLO starts or
+// stops being met.
+func (s *sloTracker) observe(r *result) {
+	o := r.target.slo
+	if o.latency <= 0 || o.window <= 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w, ok := s.windows[r.target.url]
+	if !ok {
+		w = &sloWindow{}
+		s.windows[r.target.url] = w
+	}
+
+	good := r.ok() && r.latency <= o.latency
+	w.samples = append(w.samples, sloSample{at: r.start, good: good})
+	if good {
+		w.good++
+	}
+
+	cutoff := r.start.Add(-o.window)
+	drop := 0
+	for drop < len(w.samples) && w.samples[drop].at.Before(cutoff) {
+		if w.samples[drop].good {
+			w.good--
+		}
+		drop++
+	}
+	w.samples = w.samples[drop:]
+
+	ratio := float64(w.good) / float64(len(w.samples))
+	breached := ratio < o.objective
+	if breached != w.breached {
+		level, msg := slog.LevelInfo, "SLO met again"
+		if breached {
+			level, msg = slog.LevelWarn, "SLO breached"
+		}
+		slog.Log(context.Background(), level, msg, "target", r.target.url,
+			"ratio", ratio, "checks", len(w.samples), "latency", o.latency, "window", o.window, "objective", o.objective)
+		w.breached = breached
+	}
+}
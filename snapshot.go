@@ -0,0 +1,249 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// snapshotVersion is the version of the archive format. Archives of a newer
+// version are refused.
+const snapshotVersion = 1
+
+// Files in an archive. Results and aggregates are in NDJSON, as
+// storedResult and aggregate have them in JSON; the state is a copy of the
+// state file.
+const (
+	snapshotManifest   = "manifest.json"
+	snapshotResults    = "results.ndjson"
+	snapshotAggregates = "aggregates.ndjson"
+	snapshotState      = "state.json"
+)
+
+// manifest describes an archive.
+type manifest struct {
+	Version    int       `json:"version"`
+	Created    time.Time `json:"created"`
+	Scraper    string    `json:"scraper"`
+	Results    int       `json:"results"`
+	Aggregates int       `json:"aggregates"`
+	State      bool      `json:"state"`
+}
+
+func exportCommand(ctx context.Context, args []string, out io.Writer) (int, error) {
+	c := &config{}
+	if err := c.init(args); err != nil {
+		return 1, err
+	}
+	st, err := openStore(c.store.url)
+	if err != nil {
+		return 1, err
+	}
+	defer st.close()
+
+	m, err := exportSnapshot(ctx, st, c.stateFile, c.archive)
+	if err != nil {
+		os.Remove(c.archive)
+		return 1, err
+	}
+	fmt.Fprintf(out, "Exported %d results and %d aggregates", m.Results, m.Aggregates)
+	if m.State {
+		fmt.Fprintf(out, " and the state")
+	}
+	fmt.Fprintf(out, " to %s\n", c.archive)
+	return 0, nil
+}
+
+// exportSnapshot writes everything in st, and the state file at statePath
+// if there is one, to a zip archive at path.
+func exportSnapshot(ctx context.Context, st store, statePath, path string) (manifest, error) {
+	m := manifest{Version: snapshotVersion, Created: time.Now().UTC(), Scraper: version}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return m, err
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+
+	enc, err := snapshotFile(zw, snapshotResults)
+	if err != nil {
+		return m, err
+	}
+	err = st.scan(ctx, func(r storedResult) error {
+		m.Results++
+		return enc.Encode(r)
+	})
+	if err != nil {
+		return m, fmt.Errorf("exporting results: %w", err)
+	}
+	if enc, err = snapshotFile(zw, snapshotAggregates); err != nil {
+		return m, err
+	}
+	err = st.scanAggregates(ctx, func(a aggregate) error {
+		m.Aggregates++
+		return enc.Encode(a)
+	})
+	if err != nil {
+		return m, fmt.Errorf("exporting aggregates: %w", err)
+	}
+
+	// The state file only exists while the scraper is stopped.
+	if statePath != "" {
+		b, err := os.ReadFile(statePath)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+		case err != nil:
+			return m, err
+		default:
+			w, err := zw.Create(snapshotState)
+			if err != nil {
+				return m, err
+			}
+			if _, err := w.Write(b); err != nil {
+				return m, err
+			}
+			m.State = true
+		}
+	}
+
+	if enc, err = snapshotFile(zw, snapshotManifest); err != nil {
+		return m, err
+	}
+	if err := enc.Encode(m); err != nil {
+		return m, err
+	}
+	if err := zw.Close(); err != nil {
+		return m, err
+	}
+	return m, f.Close()
+}
+
+func snapshotFile(zw *zip.Writer, name string) (*json.Encoder, error) {
+	w, err := zw.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return json.NewEncoder(w), nil
+}
+
+func importCommand(ctx context.Context, args []string, out io.Writer) (int, error) {
+	c := &config{}
+	if err := c.init(args); err != nil {
+		return 1, err
+	}
+	st, err := openStore(c.store.url)
+	if err != nil {
+		return 1, err
+	}
+	defer st.close()
+
+	m, err := importSnapshot(ctx, st, c.stateFile, c.archive)
+	if err != nil {
+		return 1, err
+	}
+	fmt.Fprintf(out, "Imported %d results and %d aggregates", m.Results, m.Aggregates)
+	if m.State && c.stateFile != "" {
+		fmt.Fprintf(out, " and the state")
+	}
+	fmt.Fprintf(out, " from %s\n", c.archive)
+	return 0, nil
+}
+
+// importSnapshot adds what the archive at path holds to st and, if
+// statePath is set, overwrites the state file with its state.
+func importSnapshot(ctx context.Context, st store, statePath, path string) (manifest, error) {
+	var m manifest
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return m, err
+	}
+	defer zr.Close()
+	if err := readSnapshotFile(&zr.Reader, snapshotManifest, func(b []byte) error { return json.Unmarshal(b, &m) }); err != nil {
+		return m, err
+	}
+	if m.Version > snapshotVersion {
+		return m, fmt.Errorf("%s: archive version %d is newer than this binary's %d", path, m.Version, snapshotVersion)
+	}
+
+	var results []storedResult
+	err = readSnapshotFile(&zr.Reader, snapshotResults, func(b []byte) error {
+		var r storedResult
+		if err := json.Unmarshal(b, &r); err != nil {
+			return err
+		}
+		if results = append(results, r); len(results) >= storeBatch {
+			err := st.save(ctx, results)
+			results = results[:0]
+			return err
+		}
+		return nil
+	})
+	if err == nil && len(results) > 0 {
+		err = st.save(ctx, results)
+	}
+	if err != nil {
+		return m, fmt.Errorf("importing results: %w", err)
+	}
+
+	var aggregates []aggregate
+	err = readSnapshotFile(&zr.Reader, snapshotAggregates, func(b []byte) error {
+		var a aggregate
+		if err := json.Unmarshal(b, &a); err != nil {
+			return err
+		}
+		if aggregates = append(aggregates, a); len(aggregates) >= storeBatch {
+			err := st.saveAggregates(ctx, aggregates)
+			aggregates = aggregates[:0]
+			return err
+		}
+		return nil
+	})
+	if err == nil && len(aggregates) > 0 {
+		err = st.saveAggregates(ctx, aggregates)
+	}
+	if err != nil {
+		return m, fmt.Errorf("importing aggregates: %w", err)
+	}
+
+	if m.State && statePath != "" {
+		f, err := zr.Open(snapshotState)
+		if err != nil {
+			return m, err
+		}
+		defer f.Close()
+		b, err := io.ReadAll(f)
+		if err != nil {
+			return m, err
+		}
+		if err := os.WriteFile(statePath, b, 0o644); err != nil {
+			return m, err
+		}
+	}
+	return m, nil
+}
+
+// readSnapshotFile calls fn with every line of the archive's file name.
+func readSnapshotFile(zr *zip.Reader, name string, fn func([]byte) error) error {
+	f, err := zr.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 16<<20)
+	line := 0
+	for sc.Scan() {
+		line++
+		if err := fn(sc.Bytes()); err != nil {
+			return fmt.Errorf("%s:%d: %w", name, line, err)
+		}
+	}
+	return sc.Err()
+}
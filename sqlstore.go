@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqlStore is a store in an SQL database, SQLite or PostgreSQL. Its schema
+// is kept up to date by the binary: migrations are applied in order, once
+// each, and the version reached recorded in schema_migrations.
+type sqlStore struct {
+	db *sql.DB
+	// bind returns the placeholder of the nth query parameter, from 1.
+	bind func(n int) string
+}
+
+// sqliteMigrations bring an SQLite database's schema up to date. Times and
+// durations are stored in nanoseconds. Never change a migration that has
+// been released; add another.
+var sqliteMigrations = []string{
+	`CREATE TABLE results (
+		id       INTEGER PRIMARY KEY,
+		target   TEXT    NOT NULL,
+		start    INTEGER NOT NULL,
+		duration INTEGER NOT NULL,
+		latency  INTEGER NOT NULL,
+		status   INTEGER NOT NULL,
+		ok       INTEGER NOT NULL,
+		reason   TEXT    NOT NULL,
+		error    TEXT    NOT NULL
+	);
+	CREATE INDEX results_target_start ON results (target, start);
+	CREATE INDEX results_start ON results (start)`,
+	`CREATE TABLE aggregates (
+		target      TEXT    NOT NULL,
+		resolution  INTEGER NOT NULL,
+		start       INTEGER NOT NULL,
+		checks      INTEGER NOT NULL,
+		failures    INTEGER NOT NULL,
+		latency_p50 INTEGER NOT NULL,
+		latency_p95 INTEGER NOT NULL,
+		latency_p99 INTEGER NOT NULL,
+		PRIMARY KEY (target, resolution, start)
+	)`,
+}
+
+// openSQLite opens the SQLite database at path, an embedded file.
+func openSQLite(path string) (*sqlStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("-store: sqlite needs a path")
+	}
+	// WAL lets /results read while results are written, and the busy
+	// timeout has them wait for each other rather than fail.
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=synchronous(NORMAL)")
+	if err != nil {
+		return nil, err
+	}
+	s := &sqlStore{db: db, bind: func(int) string { return "?" }}
+	if err := s.migrate(context.Background(), sqliteMigrations); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("-store %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// migrate applies the migrations the database hasn't had yet.
+func (s *sqlStore) migrate(ctx context.Context, migrations []string) error {
+	if _, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return err
+	}
+	var version int
+	if err := s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("schema version %d is newer than this binary's %d", version, len(migrations))
+	}
+	for i := version; i < len(migrations); i++ {
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES (`+s.bind(1)+`)`, i+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) save(ctx context.Context, results []storedResult) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO results (target, start, duration, latency, status, ok, reason, error) VALUES (`+s.binds(1, 8)+`)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, r := range results {
+		if _, err := stmt.ExecContext(ctx, r.Target, r.Start.UnixNano(), int64(r.Duration), int64(r.Latency), r.Status, r.OK, r.Reason, r.Error); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// where returns the WHERE clause selecting the results q does, if any, and
+// its parameters.
+func (s *sqlStore) where(q resultQuery) (string, []any) {
+	var where []string
+	var args []any
+	bind := func(arg any) string {
+		args = append(args, arg)
+		return s.bind(len(args))
+	}
+	if q.target != "" {
+		where = append(where, "target = "+bind(q.target))
+	}
+	if !q.since.IsZero() {
+		where = append(where, "start >= "+bind(q.since.UnixNano()))
+	}
+	if !q.until.IsZero() {
+		where = append(where, "start < "+bind(q.until.UnixNano()))
+	}
+	if q.ok != nil {
+		where = append(where, "ok = "+bind(*q.ok))
+	}
+	if q.reason != "" {
+		// reason holds the reasons comma-separated.
+		where = append(where, "',' || reason || ',' LIKE "+bind("%,"+q.reason+",%"))
+	}
+	if !q.after.start.IsZero() {
+		start := q.after.start.UnixNano()
+		where = append(where, "(start < "+bind(start)+" OR start = "+bind(start)+" AND target < "+bind(q.after.target)+")")
+	}
+	if len(where) == 0 {
+		return "", nil
+	}
+	return ` WHERE ` + strings.Join(where, " AND "), args
+}
+
+func (s *sqlStore) query(ctx context.Context, q resultQuery) ([]storedResult, error) {
+	where, args := s.where(q)
+	args = append(args, q.limit)
+	query := `SELECT target, start, duration, latency, status, ok, reason, error FROM results` + where +
+		` ORDER BY start DESC, target DESC LIMIT ` + s.bind(len(args))
+	var out []storedResult
+	err := s.scanResults(ctx, query, args, func(r storedResult) error {
+		out = append(out, r)
+		return nil
+	})
+	return out, err
+}
+
+func (s *sqlStore) each(ctx context.Context, q resultQuery, fn func(storedResult) error) error {
+	where, args := s.where(q)
+	return s.scanResults(ctx, `SELECT target, start, duration, latency, status, ok, reason, error FROM results`+where, args, fn)
+}
+
+// scanResults calls fn with every result query returns, stopping at the
+// first error.
+func (s *sqlStore) scanResults(ctx context.Context, query string, args []any, fn func(storedResult) error) error {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r storedResult
+		var start, duration, latency int64
+		if err := rows.Scan(&r.Target, &start, &duration, &latency, &r.Status, &r.OK, &r.Reason, &r.Error); err != nil {
+			return err
+		}
+		r.Start = time.Unix(0, start)
+		r.Duration = time.Duration(duration)
+		r.Latency = time.Duration(latency)
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// pruneBatch is the most results prune deletes at once, so that it doesn't
+// hold up saving new ones for long.
+const pruneBatch = 10000
+
+func (s *sqlStore) prune(ctx context.Context, before time.Time, keep int) (int64, error) {
+	var total int64
+	del := func(ids string, args ...any) error {
+		for {
+			res, err := s.db.ExecContext(ctx, `DELETE FROM results WHERE id IN (`+ids+`)`, args...)
+			if err != nil {
+				return err
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			total += n
+			if n < pruneBatch {
+				return nil
+			}
+		}
+	}
+	if !before.IsZero() {
+		if err := del(`SELECT id FROM results WHERE start < `+s.bind(1)+` LIMIT `+s.bind(2), before.UnixNano(), pruneBatch); err != nil {
+			return total, err
+		}
+	}
+	if keep > 0 {
+		ranked := `SELECT id, ROW_NUMBER() OVER (PARTITION BY target ORDER BY start DESC) AS n FROM results`
+		if err := del(`SELECT id FROM (`+ranked+`) AS ranked WHERE n > `+s.bind(1)+` LIMIT `+s.bind(2), keep, pruneBatch); err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (s *sqlStore) downsample(ctx context.Context, before, hourlyBefore time.Time) (int64, error) {
+	var total int64
+	cutoff := before.UTC().Truncate(daily)
+	for {
+		var oldest sql.NullInt64
+		if err := s.db.QueryRowContext(ctx, `SELECT MIN(start) FROM results`).Scan(&oldest); err != nil {
+			return total, err
+		}
+		if !oldest.Valid || oldest.Int64 >= cutoff.UnixNano() {
+			break
+		}
+		day := time.Unix(0, oldest.Int64).UTC().Truncate(daily)
+		n, err := s.downsampleDay(ctx, day)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	if !hourlyBefore.IsZero() {
+		if _, err := s.db.ExecContext(ctx, `DELETE FROM aggregates WHERE resolution = `+s.bind(1)+` AND start < `+s.bind(2), int64(hourly), hourlyBefore.UnixNano()); err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// downsampleDay rolls the results of the day that starts at day up into
+// aggregates. Deleting them first means that of several scrapers sharing a
+// database, only one gets to roll up each result.
+func (s *sqlStore) downsampleDay(ctx context.Context, day time.Time) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `DELETE FROM results WHERE start >= `+s.bind(1)+` AND start < `+s.bind(2)+` RETURNING target, start, latency, ok`,
+		day.UnixNano(), day.Add(daily).UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	var results []storedResult
+	for rows.Next() {
+		var r storedResult
+		var start, latency int64
+		if err := rows.Scan(&r.Target, &start, &latency, &r.OK); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		r.Start = time.Unix(0, start)
+		r.Latency = time.Duration(latency)
+		results = append(results, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	slices.SortStableFunc(results, func(a, b storedResult) int { return strings.Compare(a.Target, b.Target) })
+
+	if err := s.addAggregates(ctx, tx, append(aggregateResults(results, hourly), aggregateResults(results, daily)...)); err != nil {
+		return 0, err
+	}
+	return int64(len(results)), tx.Commit()
+}
+
+// addAggregates inserts aggregates in tx. A period already rolled up, from
+// results that came in late, gets the new checks added to it but keeps its
+// percentiles.
+func (s *sqlStore) addAggregates(ctx context.Context, tx *sql.Tx, aggregates []aggregate) error {
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO aggregates (target, resolution, start, checks, failures, latency_p50, latency_p95, latency_p99) VALUES (`+s.binds(1, 8)+`)
+		ON CONFLICT (target, resolution, start) DO UPDATE SET checks = aggregates.checks + excluded.checks, failures = aggregates.failures + excluded.failures`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, a := range aggregates {
+		if _, err := stmt.ExecContext(ctx, a.Target, int64(a.Resolution), a.Start.UnixNano(), a.Checks, a.Failures, int64(a.LatencyP50), int64(a.LatencyP95), int64(a.LatencyP99)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) saveAggregates(ctx context.Context, aggregates []aggregate) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := s.addAggregates(ctx, tx, aggregates); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) scan(ctx context.Context, fn func(storedResult) error) error {
+	return s.scanResults(ctx, `SELECT target, start, duration, latency, status, ok, reason, error FROM results ORDER BY id`, nil, fn)
+}
+
+func (s *sqlStore) scanAggregates(ctx context.Context, fn func(aggregate) error) error {
+	rows, err := s.db.QueryContext(ctx, `SELECT target, resolution, start, checks, failures, latency_p50, latency_p95, latency_p99 FROM aggregates ORDER BY resolution, start, target`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a aggregate
+		var resolution, start, p50, p95, p99 int64
+		if err := rows.Scan(&a.Target, &resolution, &start, &a.Checks, &a.Failures, &p50, &p95, &p99); err != nil {
+			return err
+		}
+		a.Resolution = time.Duration(resolution)
+		a.Start = time.Unix(0, start).UTC()
+		a.LatencyP50, a.LatencyP95, a.LatencyP99 = time.Duration(p50), time.Duration(p95), time.Duration(p99)
+		if err := fn(a); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *sqlStore) aggregates(ctx context.Context, q aggregateQuery) ([]aggregate, error) {
+	args := []any{int64(q.resolution)}
+	where := []string{"resolution = " + s.bind(1)}
+	add := func(cond string, arg any) {
+		args = append(args, arg)
+		where = append(where, cond+s.bind(len(args)))
+	}
+	if q.target != "" {
+		add("target = ", q.target)
+	}
+	if !q.since.IsZero() {
+		add("start >= ", q.since.UnixNano())
+	}
+	if !q.until.IsZero() {
+		add("start < ", q.until.UnixNano())
+	}
+	args = append(args, q.limit)
+	query := `SELECT target, start, checks, failures, latency_p50, latency_p95, latency_p99 FROM aggregates WHERE ` + strings.Join(where, " AND ") +
+		` ORDER BY start DESC, target LIMIT ` + s.bind(len(args))
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []aggregate
+	for rows.Next() {
+		a := aggregate{Resolution: q.resolution}
+		var start, p50, p95, p99 int64
+		if err := rows.Scan(&a.Target, &start, &a.Checks, &a.Failures, &p50, &p95, &p99); err != nil {
+			return nil, err
+		}
+		a.Start = time.Unix(0, start).UTC()
+		a.LatencyP50, a.LatencyP95, a.LatencyP99 = time.Duration(p50), time.Duration(p95), time.Duration(p99)
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+// binds returns the placeholders of parameters from to to, comma-separated.
+func (s *sqlStore) binds(from, to int) string {
+	marks := make([]string, 0, to-from+1)
+	for n := from; n <= to; n++ {
+		marks = append(marks, s.bind(n))
+	}
+	return strings.Join(marks, ", ")
+}
+
+func (s *sqlStore) close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// stateVersion is the version of the state file's format. Files of another
+// version are ignored.
+const stateVersion = 1
+
+// savedState is what -state_file holds: what the scraper knows about its
+// targets that a restart would otherwise lose.
+type savedState struct {
+	Version  int                    `json:"version"`
+	SavedAt  time.Time              `json:"saved_at"`
+	Targets  map[string]savedTarget `json:"targets"`
+	Silences []silence              `json:"silences,omitempty"`
+	// NextSilenceID keeps silence IDs from being reused.
+	NextSilenceID int `json:"next_silence_id"`
+}
+
+// savedTarget is a target's alerting state and failure counters, see
+// alertState and targetHistory.
+type savedTarget struct {
+	Down                bool       `json:"down"`
+	Since               *time.Time `json:"since,omitempty"`
+	Streak              int        `json:"streak"`
+	Alerted             *time.Time `json:"alerted,omitempty"`
+	Repeats             int        `json:"repeats,omitempty"`
+	Escalated           bool       `json:"escalated,omitempty"`
+	Outage              *outage    `json:"outage,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LastSuccess         *time.Time `json:"last_success,omitempty"`
+	LastFailure         *record    `json:"last_failure,omitempty"`
+}
+
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func timeOf(t *time.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return *t
+}
+
+// saveState writes the state of a and h to path. The file is replaced in
+// one go, so a crash while saving leaves the previous one in place.
+func saveState(path string, a *alerter, h *history) error {
+	st := savedState{Version: stateVersion, SavedAt: time.Now(), Targets: make(map[string]savedTarget)}
+
+	a.mu.Lock()
+	for url, s := range a.states {
+		st.Targets[url] = savedTarget{
+			Down:      s.down,
+			Since:     timePtr(s.since),
+			Streak:    s.streak,
+			Alerted:   timePtr(s.alerted),
+			Repeats:   s.repeats,
+			Escalated: s.escalated,
+			Outage:    s.outage,
+		}
+	}
+	a.mu.Unlock()
+	st.Silences = a.silences.active(time.Now())
+	a.silences.mu.Lock()
+	st.NextSilenceID = a.silences.nextID
+	a.silences.mu.Unlock()
+
+	h.mu.Lock()
+	for url, th := range h.targets {
+		saved := st.Targets[url]
+		saved.ConsecutiveFailures = th.consecutiveFailures
+		saved.LastSuccess = timePtr(th.lastSuccess)
+		saved.LastFailure = th.lastFailure
+		st.Targets[url] = saved
+	}
+	h.mu.Unlock()
+
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	return replaceFile(path, b)
+}
+
+// replaceFile writes b to a file next to path and renames it over path, so
+// that a crash leaves either the old or the new contents. Only the owner
+// may read the file.
+func replaceFile(path string, b []byte) error {
+	return replaceFileMode(path, b, 0o600)
+}
+
+// replaceFileMode is replaceFile for a file with the permissions perm.
+func replaceFileMode(path string, b []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// loadState restores the state saved at path into a and h, for the targets
+// that are still configured once the scheduler starts. A missing file is
+// not an error. The file is removed once loaded, so that after a crash a
+// stale state isn't restored a second time; the counters of targets h has
+// results for already are left alone.
+func loadState(path string, a *alerter, h *history) (int, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var st savedState
+	if err := json.Unmarshal(b, &st); err != nil {
+		return 0, fmt.Errorf("%s: %w", path, err)
+	}
+	if st.Version != stateVersion {
+		return 0, fmt.Errorf("%s: unknown version %d", path, st.Version)
+	}
+
+	a.mu.Lock()
+	for url, saved := range st.Targets {
+		a.states[url] = &alertState{
+			down:      saved.Down,
+			since:     timeOf(saved.Since),
+			streak:    saved.Streak,
+			alerted:   timeOf(saved.Alerted),
+			repeats:   saved.Repeats,
+			escalated: saved.Escalated,
+			outage:    saved.Outage,
+		}
+	}
+	a.mu.Unlock()
+	a.silences.mu.Lock()
+	a.silences.list = append(a.silences.list, st.Silences...)
+	a.silences.nextID = max(a.silences.nextID, st.NextSilenceID)
+	a.silences.mu.Unlock()
+
+	h.mu.Lock()
+	for url, saved := range st.Targets {
+		th, ok := h.targets[url]
+		if !ok {
+			th = &targetHistory{}
+			h.targets[url] = th
+		}
+		if len(th.ring) > 0 {
+			continue
+		}
+		th.consecutiveFailures = saved.ConsecutiveFailures
+		th.lastSuccess = timeOf(saved.LastSuccess)
+		th.lastFailure = saved.LastFailure
+	}
+	h.mu.Unlock()
+
+	return len(st.Targets), os.Remove(path)
+}
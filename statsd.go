@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// statsdOptions configures the StatsD backend.
+type statsdOptions struct {
+	addr   string
+	prefix string
+	// dogstatsd sends the target and reason as DogStatsD tags. Plain StatsD
+	// has no tags, so they become part of the metric name instead.
+	dogstatsd bool
+}
+
+// statsdMetrics pushes metrics to a StatsD server over UDP as they happen.
+// Sending is best effort: a packet that can't be sent is dropped.
+type statsdMetrics struct {
+	o       statsdOptions
+	conn    net.Conn
+	running atomic.Int64
+}
+
+func newStatsdMetrics(o statsdOptions) (*statsdMetrics, error) {
+	conn, err := net.Dial("udp", o.addr)
+	if err != nil {
+		return nil, err
+	}
+	return &statsdMetrics{o: o, conn: conn}, nil
+}
+
+// statsdUnsafe matches what plain StatsD can't have in a metric name.
+var statsdUnsafe = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// metric formats one metric. tags alternate names and values.
+func (m *statsdMetrics) metric(name, value, kind string, tags ...string) string {
+	var b strings.Builder
+	b.WriteString(m.o.prefix)
+	b.WriteString(name)
+	if !m.o.dogstatsd {
+		for i := 1; i < len(tags); i += 2 {
+			b.WriteByte('.')
+			b.WriteString(strings.Trim(statsdUnsafe.ReplaceAllString(tags[i], "_"), "_"))
+		}
+	}
+	fmt.Fprintf(&b, ":%s|%s", value, kind)
+	if m.o.dogstatsd && len(tags) > 0 {
+		b.WriteString("|#")
+		for i := 0; i+1 < len(tags); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(tags[i] + ":" + strings.ReplaceAll(tags[i+1], ",", "_"))
+		}
+	}
+	return b.String()
+}
+
+// tags returns the tags of a metric about t, followed by more. Labels are
+// only sent as DogStatsD tags; plain StatsD would have them lengthen the
+// metric name.
+func (m *statsdMetrics) tags(t *target, more ...string) []string {
+	tags := append([]string{"target", t.url}, more...)
+	if m.o.dogstatsd {
+		for _, name := range labelNames(t.labels) {
+			tags = append(tags, name, t.labels[name])
+		}
+	}
+	return tags
+}
+
+func (m *statsdMetrics) send(lines ...string) {
+	m.conn.Write([]byte(strings.Join(lines, "\n")))
+}
+
+func millis(d time.Duration) string {
+	return fmt.Sprintf("%.3f", float64(d)/float64(time.Millisecond))
+}
+
+func (m *statsdMetrics) observe(r *result) {
+	tags := m.tags(r.target)
+	lines := []string{
+		m.metric("checks", "1", "c", tags...),
+		m.metric("check.duration", millis(r.duration), "ms", tags...),
+	}
+	up := "0"
+	if r.ok() {
+		up = "1"
+	}
+	lines = append(lines, m.metric("check.up", up, "g", tags...))
+	if r.err != nil {
+		lines = append(lines, m.metric("check.failures", "1", "c", m.tags(r.target, "reason", "error")...))
+	} else {
+		lines = append(lines, m.metric("request.latency", millis(r.latency), "ms", tags...))
+		seen := make(map[string]bool)
+		for _, f := range r.failures {
+			if !seen[f.reason] {
+				seen[f.reason] = true
+				lines = append(lines, m.metric("check.failures", "1", "c", m.tags(r.target, "reason", f.reason)...))
+			}
+		}
+	}
+	m.send(lines...)
+}
+
+func (m *statsdMetrics) inFlight(delta int) {
+	n := m.running.Add(int64(delta))
+	m.send(m.metric("checks_in_flight", fmt.Sprint(n), "g"))
+}
+
+func (m *statsdMetrics) overrun(t *target) {
+	m.send(m.metric("schedule.overruns", "1", "c", m.tags(t)...))
+}
+
+func (m *statsdMetrics) reloaded(ok bool) {
+	result := "ok"
+	if !ok {
+		result = "error"
+	}
+	m.send(m.metric("config.reloads", "1", "c", "result", result))
+}
+
+func (m *statsdMetrics) retain(targets []*target) {
+	m.send(m.metric("targets", fmt.Sprint(len(targets)), "g"))
+}
+
+func (m *statsdMetrics) chainProgress(chain string, next, head uint64) {
+	m.send(
+		m.metric("chain.next_block", fmt.Sprint(next), "g", "chain", chain),
+		m.metric("chain.head_block", fmt.Sprint(head), "g", "chain", chain),
+	)
+}
+
+func (m *statsdMetrics) chainBlock(chain string, transactions, appearances int) {
+	m.send(
+		m.metric("chain.blocks", "1", "c", "chain", chain),
+		m.metric("chain.transactions", fmt.Sprint(transactions), "c", "chain", chain),
+		m.metric("chain.appearances", fmt.Sprint(appearances), "c", "chain", chain),
+	)
+}
+
+func (m *statsdMetrics) chainReorg(chain string, orphaned int) {
+	m.send(
+		m.metric("chain.reorgs", "1", "c", "chain", chain),
+		m.metric("chain.orphaned_blocks", fmt.Sprint(orphaned), "c", "chain", chain),
+	)
+}
+
+func (m *statsdMetrics) chainBlobs(chain string, transactions, blobs int, gasUsed, excessGas uint64) {
+	m.send(
+		m.metric("chain.blob_transactions", fmt.Sprint(transactions), "c", "chain", chain),
+		m.metric("chain.blobs", fmt.Sprint(blobs), "c", "chain", chain),
+		m.metric("chain.blob_gas_used", fmt.Sprint(gasUsed), "c", "chain", chain),
+		m.metric("chain.excess_blob_gas", fmt.Sprint(excessGas), "g", "chain", chain),
+	)
+}
+
+func (m *statsdMetrics) chainFailover(chain string) {
+	m.send(m.metric("chain.rpc_failovers", "1", "c", "chain", chain))
+}
+
+func (m *statsdMetrics) handler() http.Handler {
+	return nil
+}
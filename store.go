@@ -0,0 +1,480 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// store keeps check results durably, so that history survives restarts and
+// can be queried later. There is an implementation for each kind of -store
+// URL.
+type store interface {
+	// save records results, all or none of them.
+	save(ctx context.Context, results []storedResult) error
+	// query returns the results q selects, newest first.
+	query(ctx context.Context, q resultQuery) ([]storedResult, error)
+	// each calls fn with every result q selects, but for its limit, in no
+	// particular order, stopping at the first error.
+	each(ctx context.Context, q resultQuery, fn func(storedResult) error) error
+	// prune deletes results that started before before, unless it is zero,
+	// and all but the keep newest of each target, unless keep is 0. It
+	// returns how many it deleted.
+	prune(ctx context.Context, before time.Time, keep int) (int64, error)
+	// downsample rolls the results that started before the UTC day before
+	// is in up into hourly and daily aggregates, and deletes them and the
+	// hourly aggregates of periods that started before hourlyBefore,
+	// unless it is zero. It returns how many results it rolled up.
+	downsample(ctx context.Context, before, hourlyBefore time.Time) (int64, error)
+	// aggregates returns the aggregates q selects, newest first.
+	aggregates(ctx context.Context, q aggregateQuery) ([]aggregate, error)
+	// scan and scanAggregates call fn with every result or aggregate,
+	// stopping at the first error.
+	scan(ctx context.Context, fn func(storedResult) error) error
+	scanAggregates(ctx context.Context, fn func(aggregate) error) error
+	// saveAggregates records aggregates, adding the checks of those for
+	// periods that are already there.
+	saveAggregates(ctx context.Context, aggregates []aggregate) error
+	close() error
+}
+
+// storedResult is the outcome of a check as stored. Journals and archives
+// have it as JSON, with the durations in nanoseconds.
+type storedResult struct {
+	Target   string        `json:"target"`
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+	// Latency is 0 for checks that got no response.
+	Latency time.Duration `json:"latency"`
+	Status  int           `json:"status"`
+	OK      bool          `json:"ok"`
+	// Reason and Error are those of record.
+	Reason string `json:"reason,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func newStoredResult(r *result) storedResult {
+	rec := newRecord(r)
+	return storedResult{
+		Target:   r.target.url,
+		Start:    r.start,
+		Duration: r.duration,
+		Latency:  r.latency,
+		Status:   r.status,
+		OK:       rec.OK,
+		Reason:   rec.Reason,
+		Error:    rec.Error,
+	}
+}
+
+// record returns s as /status shows results.
+func (s storedResult) record() record {
+	rec := record{Start: s.Start, Duration: s.Duration.String(), Status: s.Status, OK: s.OK, Reason: s.Reason, Error: s.Error}
+	if s.Latency > 0 {
+		rec.Latency = s.Latency.String()
+	}
+	return rec
+}
+
+// resultQuery selects stored results: those of target, or of every target
+// if it is empty, that started in [since, until), zero times leaving that
+// end open, up to limit of them.
+type resultQuery struct {
+	target       string
+	since, until time.Time
+	// ok, unless nil, selects only results that passed or failed, and
+	// reason only failures with that among their reasons. Aggregates aren't
+	// selected by either.
+	ok     *bool
+	reason string
+	// after, unless its start is zero, selects only results that come after
+	// it newest first, for the next page.
+	after resultCursor
+	limit int
+}
+
+// resultCursor is where a page of results ended. Results are paged newest
+// first, and by target for those that started at the same time.
+type resultCursor struct {
+	start  time.Time
+	target string
+}
+
+// selects reports whether q selects r, but for its limit.
+func (q resultQuery) selects(r storedResult) bool {
+	switch {
+	case q.target != "" && r.Target != q.target,
+		!q.since.IsZero() && r.Start.Before(q.since),
+		!q.until.IsZero() && !r.Start.Before(q.until),
+		q.ok != nil && r.OK != *q.ok,
+		q.reason != "" && !slices.Contains(strings.Split(r.Reason, ","), q.reason):
+		return false
+	}
+	return q.after.start.IsZero() || q.after.comesBefore(r)
+}
+
+// comesBefore reports whether c comes before r newest first.
+func (c resultCursor) comesBefore(r storedResult) bool {
+	return r.Start.Before(c.start) || r.Start.Equal(c.start) && r.Target < c.target
+}
+
+// upper returns the time results q selects start before, or at if
+// inclusive, the zero time for no bound.
+func (q resultQuery) upper() (t time.Time, inclusive bool) {
+	switch {
+	case q.after.start.IsZero():
+		return q.until, false
+	case q.until.IsZero() || !q.until.Before(q.after.start):
+		return q.after.start, true
+	}
+	return q.until, false
+}
+
+// encode returns c as the cursor parameter of /results.
+func (c resultCursor) encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(c.start.UnixNano(), 10) + " " + c.target))
+}
+
+func parseResultCursor(v string) (resultCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return resultCursor{}, errors.New("bad cursor")
+	}
+	start, target, _ := strings.Cut(string(b), " ")
+	ns, err := strconv.ParseInt(start, 10, 64)
+	if err != nil || ns == 0 {
+		return resultCursor{}, errors.New("bad cursor")
+	}
+	return resultCursor{time.Unix(0, ns), target}, nil
+}
+
+// storeOptions says where results are kept and how often they're written.
+type storeOptions struct {
+	url   string
+	flush time.Duration
+	// journal is the file results are journaled to, empty for none.
+	journal   string
+	retention retention
+}
+
+// retention says which stored results are pruned, and how often.
+type retention struct {
+	// maxAge and maxResults, per target, bound the results kept, 0 for no
+	// bound.
+	maxAge     time.Duration
+	maxResults int
+	every      time.Duration
+	// downsample rolls results past maxAge up into aggregates instead of
+	// just deleting them. Hourly aggregates are kept for hourlyMaxAge, 0
+	// for ever, and daily ones for ever.
+	downsample   bool
+	hourlyMaxAge time.Duration
+}
+
+// pruneResults deletes the results r no longer keeps from st right away and
+// then every r.every, until ctx is done.
+func pruneResults(ctx context.Context, st store, r retention) {
+	if r.maxAge == 0 && r.maxResults == 0 {
+		return
+	}
+	ticker := time.NewTicker(r.every)
+	defer ticker.Stop()
+	for {
+		var before time.Time
+		if r.maxAge > 0 {
+			before = time.Now().Add(-r.maxAge)
+		}
+		started := time.Now()
+		if r.downsample && !before.IsZero() {
+			var hourlyBefore time.Time
+			if r.hourlyMaxAge > 0 {
+				hourlyBefore = time.Now().Add(-r.hourlyMaxAge)
+			}
+			n, err := st.downsample(ctx, before, hourlyBefore)
+			if err != nil && ctx.Err() == nil {
+				slog.Error("Downsampling results failed", "error", err)
+			} else if n > 0 {
+				slog.Info("Downsampled results", "results", n, "took", time.Since(started))
+			}
+			// What's left of the day before is in is kept until
+			// the day can be downsampled whole.
+			before = time.Time{}
+			started = time.Now()
+		}
+		n, err := st.prune(ctx, before, r.maxResults)
+		if err != nil && ctx.Err() == nil {
+			slog.Error("Pruning results failed", "error", err)
+		} else if n > 0 {
+			slog.Info("Pruned results", "results", n, "took", time.Since(started))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// openStore opens the store rawURL names, creating it if need be.
+func openStore(rawURL string) (store, error) {
+	scheme, rest, ok := strings.Cut(rawURL, ":")
+	if !ok {
+		return nil, fmt.Errorf("-store %q: want sqlite:path, bolt:path or a postgres:// URL", redactURL(rawURL))
+	}
+	switch scheme {
+	case "sqlite":
+		return openSQLite(strings.TrimPrefix(rest, "//"))
+	case "bolt":
+		return openBolt(strings.TrimPrefix(rest, "//"))
+	case "postgres", "postgresql":
+		return openPostgres(rawURL)
+	}
+	return nil, fmt.Errorf("-store %q: unsupported store %q, want sqlite, bolt or postgres", redactURL(rawURL), scheme)
+}
+
+const (
+	// storeBuffer is how many results wait to be saved before new ones are
+	// dropped.
+	storeBuffer = 4096
+	// storeBatch is the most results saved at once.
+	storeBatch = 500
+)
+
+// storeWriter saves results to a store in batches, off the workers, so that
+// a slow store doesn't hold up checks. A nil storeWriter saves nothing.
+type storeWriter struct {
+	store store
+	// journal, if not nil, has results journaled before they are queued.
+	journal *journal
+	results chan storedResult
+	done    chan struct{}
+}
+
+// newStoreWriter saves results to st every interval, or sooner once a batch
+// has filled up.
+func newStoreWriter(st store, every time.Duration, j *journal) *storeWriter {
+	w := &storeWriter{store: st, journal: j, results: make(chan storedResult, storeBuffer), done: make(chan struct{})}
+	go w.loop(every)
+	return w
+}
+
+func (w *storeWriter) observe(r *result) {
+	if w == nil {
+		return
+	}
+	s := newStoredResult(r)
+	queue := func() {
+		select {
+		case w.results <- s:
+		default:
+			slog.Warn("Store falling behind, dropping result", "target", r.target.url, r.target.logLabels())
+		}
+	}
+	if w.journal == nil {
+		queue()
+		return
+	}
+	w.journal.add(s, queue)
+}
+
+func (w *storeWriter) loop(every time.Duration) {
+	defer close(w.done)
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	var batch []storedResult
+	flush := func() {
+		// With a journal, the batch is made up of everything its
+		// segment holds.
+		var segment string
+		if w.journal != nil {
+			var err error
+			segment, err = w.journal.rotate(func() {
+				for {
+					select {
+					case r, ok := <-w.results:
+						if !ok {
+							return
+						}
+						batch = append(batch, r)
+					default:
+						return
+					}
+				}
+			})
+			if err != nil {
+				slog.Error("Rotating journal failed", "error", err)
+			}
+		}
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := w.store.save(ctx, batch); err != nil {
+			slog.Error("Saving results failed", "results", len(batch), "error", err)
+			if segment != "" {
+				slog.Warn("Results kept in journal to be saved on the next start", "path", segment)
+			}
+		} else if segment != "" {
+			os.Remove(segment)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case r, ok := <-w.results:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, r)
+			if len(batch) >= storeBatch {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// close saves the results still waiting and closes the store. No results
+// may be observed after.
+func (w *storeWriter) close() {
+	if w == nil {
+		return
+	}
+	close(w.results)
+	<-w.done
+	if w.journal != nil {
+		w.journal.close()
+	}
+	if err := w.store.close(); err != nil {
+		slog.Error("Closing store failed", "error", err)
+	}
+}
+
+// storedResultJSON is how /results shows a result.
+type storedResultJSON struct {
+	Target string `json:"target"`
+	record
+}
+
+// newStoredResultJSON returns s as /results shows it, with any password in
+// the target's URL masked, since any read key sees it.
+func newStoredResultJSON(s storedResult) storedResultJSON {
+	return storedResultJSON{redactURL(s.Target), s.record()}
+}
+
+// serveResults answers with stored results as JSON, newest first. The target
+// query parameter selects a target's, since and until bound when they
+// started, as RFC 3339 times or durations before now, outcome picks those
+// that passed, ok, failed, or failed for a reason, and limit caps how many
+// are returned, 100 by default. Full pages link to the next in a Link
+// header, which passes the cursor parameter.
+func serveResults(st store) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		params := req.URL.Query()
+		q, err := parseResultQuery(params)
+		if err == nil {
+			err = parseOutcome(&q, params)
+		}
+		if err == nil && params.Has("cursor") {
+			q.after, err = parseResultCursor(params.Get("cursor"))
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		results, err := st.query(req.Context(), q)
+		if err != nil {
+			slog.Error("Querying results failed", "error", err)
+			http.Error(w, "querying results failed", http.StatusInternalServerError)
+			return
+		}
+		out := make([]storedResultJSON, len(results))
+		for i, s := range results {
+			out[i] = newStoredResultJSON(s)
+		}
+		if len(results) == q.limit {
+			last := results[len(results)-1]
+			params.Set("cursor", resultCursor{last.Start, last.Target}.encode())
+			next := url.URL{Path: req.URL.Path, RawQuery: params.Encode()}
+			w.Header().Set("Link", "<"+next.String()+`>; rel="next"`)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	}
+}
+
+// parseOutcome sets what q selects by the outcome query parameter: ok for
+// results that passed, failed for those that didn't, and anything else for
+// those that failed for that reason, such as status.
+func parseOutcome(q *resultQuery, params url.Values) error {
+	ok := true
+	switch v := params.Get("outcome"); v {
+	case "":
+		return nil
+	case "ok":
+	case "failed":
+		ok = false
+	default:
+		if !validReason(v) {
+			return fmt.Errorf("outcome must be ok, failed or a reason, not %q", v)
+		}
+		ok, q.reason = false, v
+	}
+	q.ok = &ok
+	return nil
+}
+
+// validReason reports whether reason could be one a result failed for.
+func validReason(reason string) bool {
+	return reason != "" && !strings.ContainsFunc(reason, func(r rune) bool {
+		return (r < 'a' || r > 'z') && r != '_'
+	})
+}
+
+// parseResultQuery works out the results the target, since, until and limit
+// query parameters select, as serveResults describes.
+func parseResultQuery(params url.Values) (resultQuery, error) {
+	q := resultQuery{target: params.Get("target"), limit: 100}
+	var err error
+	if q.since, err = parseQueryTime(params.Get("since")); err != nil {
+		return q, fmt.Errorf("since: %w", err)
+	}
+	if q.until, err = parseQueryTime(params.Get("until")); err != nil {
+		return q, fmt.Errorf("until: %w", err)
+	}
+	if v := params.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 10000 {
+			return q, errors.New("limit must be between 1 and 10000")
+		}
+		q.limit = n
+	}
+	return q, nil
+}
+
+// parseQueryTime parses an RFC 3339 time or a duration before now. Empty is
+// the zero time.
+func parseQueryTime(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(v); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// streamKeepAlive is how often an idle stream is sent a comment or ping, so
+// that proxies in between don't time it out.
+const streamKeepAlive = 30 * time.Second
+
+// serveStream pushes every result from f as it comes in, in the form of
+// /results: as server-sent events or, to clients asking for an upgrade, as
+// WebSocket text messages. Repeated target parameters limit the stream to
+// those targets.
+func serveStream(f *feed) http.HandlerFunc {
+	// The default origin check refuses pages of other sites, which could
+	// otherwise read the stream from a browser on the admin network.
+	var upgrader websocket.Upgrader
+	return func(w http.ResponseWriter, req *http.Request) {
+		targets := req.URL.Query()["target"]
+		wanted := func(r storedResult) bool {
+			return len(targets) == 0 || slices.Contains(targets, r.Target)
+		}
+		if websocket.IsWebSocketUpgrade(req) {
+			conn, err := upgrader.Upgrade(w, req, nil)
+			if err != nil {
+				return
+			}
+			streamWebSocket(conn, f, wanted)
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+		results, unsubscribe := f.subscribe()
+		defer unsubscribe()
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		// Keeps nginx from buffering the stream.
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		keepAlive := time.NewTicker(streamKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case <-req.Context().Done():
+				return
+			case <-keepAlive.C:
+				fmt.Fprint(w, ": keep-alive\n\n")
+			case r := <-results:
+				if !wanted(r) {
+					continue
+				}
+				b, _ := json.Marshal(newStoredResultJSON(r))
+				fmt.Fprintf(w, "data: %s\n\n", b)
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// streamWebSocket sends results to conn until the client goes away.
+func streamWebSocket(conn *websocket.Conn, f *feed, wanted func(storedResult) bool) {
+	defer conn.Close()
+	results, unsubscribe := f.subscribe()
+	defer unsubscribe()
+
+	// Nothing is expected from the client, but reading is what notices it
+	// closing the connection.
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		var err error
+		select {
+		case <-gone:
+			return
+		case <-keepAlive.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second))
+		case r := <-results:
+			if !wanted(r) {
+				continue
+			}
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			err = conn.WriteJSON(newStoredResultJSON(r))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// resultSummary sums up the stored results of a target, as
+// /results/summary shows it.
+type resultSummary struct {
+	Target   string `json:"target"`
+	Checks   int    `json:"checks"`
+	Failures int    `json:"failures"`
+	// Availability is the share of checks that passed.
+	Availability float64   `json:"availability"`
+	First        time.Time `json:"first"`
+	Last         time.Time `json:"last"`
+	// The latency percentiles are those of the checks that got a response.
+	LatencyP50 string `json:"latency_p50,omitempty"`
+	LatencyP95 string `json:"latency_p95,omitempty"`
+	LatencyP99 string `json:"latency_p99,omitempty"`
+	// Reasons counts failures by reason; those that failed for several
+	// count for each.
+	Reasons map[string]int `json:"reasons,omitempty"`
+}
+
+// summarize sums up the results of st that q selects by target, in target
+// order.
+func summarize(ctx context.Context, st store, q resultQuery) ([]resultSummary, error) {
+	summaries := make(map[string]*resultSummary)
+	latencies := make(map[string][]time.Duration)
+	err := st.each(ctx, q, func(r storedResult) error {
+		s := summaries[r.Target]
+		if s == nil {
+			s = &resultSummary{Target: r.Target, First: r.Start, Last: r.Start}
+			summaries[r.Target] = s
+		}
+		s.Checks++
+		if r.Start.Before(s.First) {
+			s.First = r.Start
+		}
+		if r.Start.After(s.Last) {
+			s.Last = r.Start
+		}
+		if !r.OK {
+			s.Failures++
+			for _, reason := range strings.Split(r.Reason, ",") {
+				if reason == "" {
+					continue
+				}
+				if s.Reasons == nil {
+					s.Reasons = make(map[string]int)
+				}
+				s.Reasons[reason]++
+			}
+		}
+		if r.Latency > 0 {
+			latencies[r.Target] = append(latencies[r.Target], r.Latency)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]resultSummary, 0, len(summaries))
+	for target, s := range summaries {
+		s.Availability = float64(s.Checks-s.Failures) / float64(s.Checks)
+		if l := latencies[target]; len(l) > 0 {
+			slices.Sort(l)
+			s.LatencyP50 = percentile(l, 0.50).String()
+			s.LatencyP95 = percentile(l, 0.95).String()
+			s.LatencyP99 = percentile(l, 0.99).String()
+		}
+		out = append(out, *s)
+	}
+	slices.SortFunc(out, func(a, b resultSummary) int { return strings.Compare(a.Target, b.Target) })
+	return out, nil
+}
+
+// serveSummary answers with a summary of the stored results of each target
+// as JSON. The target, since, until and outcome query parameters select the
+// results summed up as they do for /results.
+func serveSummary(st store) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		params := req.URL.Query()
+		q, err := parseResultQuery(params)
+		if err == nil {
+			err = parseOutcome(&q, params)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		out, err := summarize(req.Context(), st, q)
+		if err != nil {
+			slog.Error("Summing up results failed", "error", err)
+			http.Error(w, "summing up results failed", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, out)
+	}
+}
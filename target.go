@@ -0,0 +1,737 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// target is a single monitored endpoint together with what its responses
+// are expected to look like.
+type target struct {
+	// alertAfter and resolveAfter are how many checks in a row must fail
+	// or pass for the target to go down or come back up.
+	alertAfter   int
+	resolveAfter int
+	// alertRepeat is how often alerts are repeated while the target stays
+	// down, 0 for never.
+	alertRepeat time.Duration
+	// alertExec is a shell command run when the target goes down or comes
+	// back up.
+	alertExec string
+	// escalateAfter is how long the target must be down before the
+	// notifiers named in escalateTo are told too.
+	escalateAfter time.Duration
+	escalateTo    []string
+	// apiKey is sent in the apiKeyHeader request header.
+	apiKey       string
+	apiKeyHeader string
+	// assertions are checked against every response in addition to the
+	// status code.
+	assertions []assertion
+	// attempts is the maximum number of tries per check, the first
+	// included.
+	attempts  int
+	bodyLimit int64
+	// checksum is the SHA-256 the body must have, or checksumStable.
+	checksum string
+	// discordWebhook is where the target's Discord alerts are posted.
+	discordWebhook string
+	dns            dnsOptions
+	// emailTo are the recipients of the target's email alerts.
+	emailTo []string
+	grpc    grpcOptions
+	ping    pingOptions
+	ws      wsOptions
+	// jitter is the fraction of tick by which each interval is randomly
+	// lengthened or shortened.
+	jitter float64
+	// labels are attached to the target's log entries, metrics and alerts.
+	// Like requestHeader they may be shared with the defaults.
+	labels map[string]string
+	// paused targets are not checked.
+	paused bool
+	// client and limiter are shared by all targets of a config.
+	client     *http.Client
+	conn       connPolicy
+	limiter    *limiter
+	maxLatency time.Duration
+	// maintenance are the windows during which the target isn't alerted
+	// on. Like assertions it may be shared with the defaults.
+	maintenance []maintenanceWindow
+	// minSize and maxSize bound the body size, 0 meaning no bound.
+	minSize int64
+	maxSize int64
+	method  string
+	// pagerDutyKey is the routing key of the PagerDuty service the
+	// target's incidents are raised in, empty for none.
+	pagerDutyKey string
+	// notifiers are told when the target goes down or comes back up.
+	notifiers   []notifier
+	requestBody []byte
+	// requestHeader is sent with every request. Like assertions it may be
+	// shared with the defaults, so it is cloned before being changed.
+	requestHeader http.Header
+	// readBody is set when an assertion needs the response body.
+	proxy           proxySettings
+	readBody        bool
+	redirects       redirectPolicy
+	retryBackoff    time.Duration
+	retryMaxBackoff time.Duration
+	retryStatus     map[int]bool
+	// scheme selects the probe, see probes.
+	scheme string
+	// slackChannel is where Slack alerts go, instead of the webhook's own
+	// channel.
+	slackChannel string
+	// telegramChat is the chat the target's Telegram alerts are sent to.
+	telegramChat string
+	// schedule, when set, replaces tick and jitter.
+	schedule *cronSchedule
+	// slo, when its latency is set, is evaluated over a rolling window.
+	slo     slo
+	status  map[int]bool
+	tick    time.Duration
+	tls     tlsFiles
+	timeout time.Duration
+	url     string
+}
+
+// newTarget parses rawURL into a target that starts out as a copy of
+// defaults. Per-target settings are given as a query string in the URL
+// fragment, e.g. https://rpc.example.com/#tick=10s. Fragments are never sent
+// to the server, so it is removed from the URL that gets requested.
+func newTarget(rawURL string, defaults target) (*target, error) {
+	return newTargetWith(rawURL, defaults, nil)
+}
+
+// newTargetWith is newTarget with more options applied by set once those in
+// the fragment have been, before the target is validated.
+func newTargetWith(rawURL string, defaults target, set func(t *target) error) (*target, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := url.ParseQuery(u.Fragment)
+	if err != nil {
+		return nil, fmt.Errorf("%s: bad options: %w", rawURL, err)
+	}
+	if _, ok := probes[u.Scheme]; !ok {
+		return nil, fmt.Errorf("%s: unsupported scheme %q", rawURL, u.Scheme)
+	}
+	if (u.Scheme == "tcp" || u.Scheme == "grpc" || u.Scheme == "grpcs") && u.Port() == "" {
+		return nil, fmt.Errorf("%s: %s targets need a port", rawURL, u.Scheme)
+	}
+	u.Fragment = ""
+	u.RawFragment = ""
+
+	t := defaults
+	t.url = u.String()
+	t.scheme = u.Scheme
+
+	keys := make([]string, 0, len(opts))
+	for key := range opts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range opts[key] {
+			if err := t.set(key, value); err != nil {
+				return nil, fmt.Errorf("%s: option %s: %w", t.url, key, err)
+			}
+		}
+	}
+	if set != nil {
+		if err := set(&t); err != nil {
+			return nil, err
+		}
+	}
+	if err := t.tls.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", t.url, err)
+	}
+	for _, n := range t.notifiers {
+		if c, ok := n.(targetChecker); ok {
+			if err := c.checkTarget(&t); err != nil {
+				return nil, fmt.Errorf("%s: %w", t.url, err)
+			}
+		}
+	}
+
+	return &t, nil
+}
+
+// setRequestHeader replaces a header sent with every request, or removes it
+// when value is empty.
+func (t *target) setRequestHeader(name, value string) {
+	h := t.requestHeader.Clone()
+	if h == nil {
+		h = make(http.Header)
+	}
+	if value == "" {
+		h.Del(name)
+	} else {
+		h.Set(name, value)
+	}
+	t.requestHeader = h
+}
+
+// set applies a single per-target option.
+func (t *target) set(key, value string) error {
+	switch key {
+	case "status":
+		codes, err := parseStatusList(value)
+		if err != nil {
+			return err
+		}
+		if len(codes) == 0 {
+			return errors.New("no status codes")
+		}
+		t.status = codes
+	case "header", "server", "content_type":
+		if value == "" {
+			break
+		}
+		spec := value
+		if name, ok := headerShorthands[key]; ok {
+			spec = name + ": " + value
+		}
+		a, err := newHeaderAssertion(spec)
+		if err != nil {
+			return err
+		}
+		t.addAssertion(a)
+	case "method":
+		if value == "" || strings.ContainsAny(value, " \t") {
+			return fmt.Errorf("bad method %q", value)
+		}
+		t.method = strings.ToUpper(value)
+	case "request_body":
+		if value == "" {
+			t.requestBody = nil
+			break
+		}
+		body, err := readValue(value)
+		if err != nil {
+			return err
+		}
+		t.requestBody = body
+	case "request_content_type":
+		t.setRequestHeader("Content-Type", value)
+	case "user_agent":
+		// Empty keeps whatever request_header set, or else Go's default.
+		if value != "" {
+			t.setRequestHeader("User-Agent", value)
+		}
+	case "echo_header":
+		if value == "" {
+			break
+		}
+		if strings.ContainsAny(value, " \t:") {
+			return fmt.Errorf("bad header name %q", value)
+		}
+		t.addAssertion(echoHeaderAssertion(http.CanonicalHeaderKey(value)))
+	case "follow_redirects":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		t.redirects.follow = b
+	case "max_redirects":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return errors.New("must not be negative")
+		}
+		t.redirects.max = n
+	case "final_url":
+		if value == "" {
+			break
+		}
+		t.addAssertion(finalURLAssertion(value))
+	case "cert_min_validity":
+		d, err := parseDays(value)
+		if err != nil {
+			return err
+		}
+		if d > 0 {
+			t.addAssertion(certExpiryAssertion(d))
+		}
+	case "cert_verify":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		if b {
+			t.addAssertion(certChainAssertion{})
+		}
+	case "cert_hostname":
+		if value != "" {
+			t.addAssertion(certHostnameAssertion(value))
+		}
+	case "location":
+		if value == "" {
+			break
+		}
+		a, err := newHeaderAssertion("Location: " + value)
+		if err != nil {
+			return err
+		}
+		t.addAssertion(a)
+	case "dns_type":
+		typ := strings.ToUpper(value)
+		if _, ok := dnsLookups[typ]; !ok {
+			return fmt.Errorf("unsupported record type %q", value)
+		}
+		t.dns.recordType = typ
+	case "dns_answer":
+		if value == "" {
+			t.dns.answers = nil
+			break
+		}
+		t.dns.answers = append(t.dns.answers[:len(t.dns.answers):len(t.dns.answers)], normalizeAnswer(value))
+	case "dns_server":
+		t.dns.server = value
+	case "grpc_service":
+		t.grpc.service = value
+	case "grpc_status":
+		s, ok := healthpb.HealthCheckResponse_ServingStatus_value[strings.ToUpper(value)]
+		if !ok {
+			return fmt.Errorf("unknown serving status %q", value)
+		}
+		t.grpc.status = healthpb.HealthCheckResponse_ServingStatus(s)
+	case "ws_message":
+		if value == "" {
+			t.ws.message = nil
+			break
+		}
+		msg, err := readValue(value)
+		if err != nil {
+			return err
+		}
+		t.ws.message = msg
+	case "ws_expect":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return errors.New("must not be negative")
+		}
+		t.ws.expect = n
+	case "ws_deadline":
+		d, err := parseInterval(value)
+		if err != nil {
+			return err
+		}
+		t.ws.deadline = d
+	case "ping_count":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		if n < 1 {
+			return errors.New("must be at least 1")
+		}
+		t.ping.count = n
+	case "ping_interval", "ping_timeout":
+		d, err := parseInterval(value)
+		if err != nil {
+			return err
+		}
+		if key == "ping_interval" {
+			t.ping.interval = d
+		} else {
+			t.ping.timeout = d
+		}
+	case "max_packet_loss":
+		f, err := parseFraction(value)
+		if err != nil {
+			return err
+		}
+		if f < 0 || f > 1 {
+			return errors.New("must be between 0 and 100%")
+		}
+		t.ping.maxLoss = f
+	case "basic_auth", "bearer_token", "api_key":
+		if value == "" {
+			break
+		}
+		if err := t.setAuth(key, value); err != nil {
+			return err
+		}
+	case "api_key_header":
+		if value == "" || strings.ContainsAny(value, " \t:") {
+			return fmt.Errorf("bad header name %q", value)
+		}
+		t.apiKeyHeader = value
+	case "proxy":
+		if err := parseProxy(value); err != nil {
+			return err
+		}
+		t.proxy.proxy = value
+	case "no_proxy":
+		t.proxy.noProxy = value
+	case "request_header":
+		if value == "" {
+			break
+		}
+		name, v, ok := strings.Cut(value, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return fmt.Errorf("%q: want \"Name: value\"", value)
+		}
+		h := t.requestHeader.Clone()
+		if h == nil {
+			h = make(http.Header)
+		}
+		h.Add(name, strings.TrimSpace(v))
+		t.requestHeader = h
+	case "tick":
+		d, err := parseInterval(value)
+		if err != nil {
+			return err
+		}
+		t.tick = d
+	case "jitter":
+		f, err := parseJitter(value)
+		if err != nil {
+			return err
+		}
+		t.jitter = f
+	case "schedule":
+		if value == "" {
+			t.schedule = nil
+			break
+		}
+		sched, err := parseCron(value)
+		if err != nil {
+			return err
+		}
+		t.schedule = sched
+	case "attempts":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		if n < 1 {
+			return errors.New("must be at least 1")
+		}
+		t.attempts = n
+	case "retry_backoff", "retry_max_backoff":
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		if d < 0 {
+			return errors.New("must not be negative")
+		}
+		if key == "retry_backoff" {
+			t.retryBackoff = d
+		} else {
+			t.retryMaxBackoff = d
+		}
+	case "timeout":
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		if d < 0 {
+			return errors.New("must not be negative")
+		}
+		t.timeout = d
+	case "body_contains", "body_not_contains", "body_matches", "body_not_matches":
+		if value == "" {
+			break
+		}
+		a, err := newBodyAssertion(key, value)
+		if err != nil {
+			return err
+		}
+		t.addAssertion(a)
+		t.readBody = true
+	case "json":
+		if value == "" {
+			break
+		}
+		a, err := newJSONAssertion(value)
+		if err != nil {
+			return err
+		}
+		t.addAssertion(a)
+		t.readBody = true
+	case "body_limit":
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		if n < 1 {
+			return errors.New("must be at least 1")
+		}
+		t.bodyLimit = n
+	case "email_to":
+		to, err := parseRecipients(value)
+		if err != nil {
+			return err
+		}
+		t.emailTo = to
+	case "pagerduty_routing_key":
+		key, err := secretValue(value)
+		if err != nil {
+			return err
+		}
+		t.pagerDutyKey = key
+	case "telegram_chat":
+		t.telegramChat = value
+	case "discord_webhook_url":
+		webhook, err := secretValue(value)
+		if err != nil {
+			return err
+		}
+		if webhook != "" {
+			if _, err := url.ParseRequestURI(webhook); err != nil {
+				return err
+			}
+		}
+		t.discordWebhook = webhook
+	case "alert_after", "resolve_after":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		if n < 1 {
+			return errors.New("must be at least 1")
+		}
+		if key == "alert_after" {
+			t.alertAfter = n
+		} else {
+			t.resolveAfter = n
+		}
+	case "alert_repeat", "escalate_after":
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		if d < 0 {
+			return errors.New("must not be negative")
+		}
+		if key == "alert_repeat" {
+			t.alertRepeat = d
+		} else {
+			t.escalateAfter = d
+		}
+	case "maintenance":
+		windows, err := parseMaintenance(value)
+		if err != nil {
+			return err
+		}
+		t.maintenance = append(t.maintenance[:len(t.maintenance):len(t.maintenance)], windows...)
+	case "alert_exec":
+		t.alertExec = value
+	case "label":
+		if err := t.setLabels(value); err != nil {
+			return err
+		}
+	case "paused":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		t.paused = b
+	case "escalate_to":
+		var names []string
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if !slices.Contains(notifierNames, name) {
+				return fmt.Errorf("unknown notifier %q, want one of %s", name, strings.Join(notifierNames, ", "))
+			}
+			names = append(names, name)
+		}
+		t.escalateTo = names
+	case "slack_channel":
+		t.slackChannel = value
+	case "sha256":
+		sum, err := parseChecksum(value)
+		if err != nil {
+			return err
+		}
+		t.checksum = sum
+	case "tls_cert":
+		t.tls.cert = value
+	case "tls_key":
+		t.tls.key = value
+	case "tls_ca":
+		t.tls.ca = value
+	case "http_version":
+		switch value {
+		case "auto", "1.1", "2":
+		default:
+			return errors.New("want auto, 1.1 or 2")
+		}
+		t.conn.http1 = value == "1.1"
+		t.conn.http2 = value == "2"
+	case "http_keep_alive", "fresh_connection":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		if key == "http_keep_alive" {
+			t.conn.keepAlive = b
+		} else {
+			t.conn.fresh = b
+		}
+	case "min_size", "max_size":
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return errors.New("must not be negative")
+		}
+		if key == "min_size" {
+			t.minSize = n
+		} else {
+			t.maxSize = n
+		}
+		if n > 0 {
+			t.readBody = true
+		}
+	case "max_latency", "slo_latency", "slo_window":
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		if d < 0 {
+			return errors.New("must not be negative")
+		}
+		switch key {
+		case "max_latency":
+			t.maxLatency = d
+		case "slo_latency":
+			t.slo.latency = d
+		default:
+			t.slo.window = d
+		}
+	case "slo_objective":
+		f, err := parseFraction(value)
+		if err != nil {
+			return err
+		}
+		if f <= 0 || f > 1 {
+			return errors.New("must be above 0 and at most 100%")
+		}
+		t.slo.objective = f
+	case "retry_status":
+		codes, err := parseStatusList(value)
+		if err != nil {
+			return err
+		}
+		t.retryStatus = codes
+	default:
+		return errors.New("unknown option")
+	}
+	return nil
+}
+
+// readValue returns value, or the contents of the file it names if it
+// starts with "@".
+func readValue(value string) ([]byte, error) {
+	if strings.HasPrefix(value, "@") {
+		return os.ReadFile(value[1:])
+	}
+	return []byte(value), nil
+}
+
+// addAssertion appends a to t's assertions without touching the slice t
+// may share with the defaults it was copied from.
+func (t *target) addAssertion(a assertion) {
+	t.assertions = append(t.assertions[:len(t.assertions):len(t.assertions)], a)
+}
+
+// parseInterval parses a strictly positive duration.
+func parseInterval(value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, errors.New("must be positive")
+	}
+	return d, nil
+}
+
+// parseFraction parses a ratio ("0.1") or a percentage ("10%").
+func parseFraction(value string) (float64, error) {
+	scale := 1.0
+	if strings.HasSuffix(value, "%") {
+		value = strings.TrimSuffix(value, "%")
+		scale = 100
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	return f / scale, nil
+}
+
+// parseJitter parses a jitter fraction, which must be in [0, 1).
+func parseJitter(value string) (float64, error) {
+	f, err := parseFraction(value)
+	if err != nil {
+		return 0, err
+	}
+	if f < 0 || f >= 1 {
+		return 0, errors.New("must be at least 0 and less than 100%")
+	}
+	return f, nil
+}
+
+// interval returns the time to wait between two checks of t: tick, moved
+// randomly by up to jitter in either direction.
+func (t *target) interval() time.Duration {
+	if t.jitter == 0 {
+		return t.tick
+	}
+	spread := float64(t.tick) * t.jitter
+	return t.tick + time.Duration((rand.Float64()*2-1)*spread)
+}
+
+// hostname returns the host part of t's URL, without any port.
+func (t *target) hostname() string {
+	u, err := url.Parse(t.url)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// address returns the host:port part of t's URL.
+func (t *target) address() string {
+	u, err := url.Parse(t.url)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// next returns when the check following the one due at prev should run.
+func (t *target) next(prev time.Time) time.Time {
+	if t.schedule != nil {
+		return t.schedule.next(prev)
+	}
+	return prev.Add(t.interval())
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// managedHeader heads the file the managed targets are saved to.
+const managedHeader = "Targets added through the admin API. The scraper rewrites this file\nwhenever they change, so edits are lost unless made while it is stopped."
+
+// targetID identifies a target in the admin API: the start of the SHA-256 of
+// its URL, so that it is stable across restarts and fits in a path.
+func targetID(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return hex.EncodeToString(sum[:6])
+}
+
+// optionValues are the values of a target option, given in JSON as a
+// string or a list of them.
+type optionValues []string
+
+func (v *optionValues) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*v = optionValues{s}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return errors.New("option values must be strings or lists of strings")
+	}
+	*v = list
+	return nil
+}
+
+// managedTarget is a target added through the admin API, with the options
+// it was given.
+type managedTarget struct {
+	URL     string                  `json:"url"`
+	Options map[string]optionValues `json:"options,omitempty"`
+}
+
+// managedTargets are the targets added through the admin API. If path is
+// set they are saved to it, as a targets file, and loaded from it on
+// startup. Every change signals reload.
+type managedTargets struct {
+	path   string
+	reload chan struct{}
+
+	mu      sync.Mutex
+	targets []managedTarget
+	// defaults and configured are from the config last loaded: new targets
+	// get the defaults and may not have the URL of a configured target.
+	defaults   target
+	configured []*target
+}
+
+// newManagedTargets loads the managed targets saved at path, if any.
+func newManagedTargets(path string) (*managedTargets, error) {
+	m := &managedTargets{path: path, reload: make(chan struct{}, 1)}
+	if path == "" {
+		return m, nil
+	}
+	specs, err := loadTargetsFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, spec := range specs {
+		mt := managedTarget{URL: spec.url, Options: make(map[string]optionValues)}
+		for _, o := range spec.options {
+			mt.Options[o.key] = append(mt.Options[o.key], o.value)
+		}
+		m.targets = append(m.targets, mt)
+	}
+	return m, nil
+}
+
+// with returns the targets of c followed by the managed targets, and
+// remembers c for the API. Managed targets that are now invalid, or also
+// configured, are left out.
+func (m *managedTargets) with(c *config) []*target {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.defaults = c.defaults
+	m.configured = c.targets
+
+	targets := slices.Clip(c.targets)
+	for _, mt := range m.targets {
+		t, err := m.newTarget(mt)
+		if err == nil && m.isConfigured(t.url) {
+			err = errors.New("also configured")
+		}
+		if err != nil {
+			slog.Warn("Skipping target added through the admin API", "target", mt.URL, "error", err)
+			continue
+		}
+		targets = append(targets, t)
+	}
+	return targets
+}
+
+// newTarget validates mt against the defaults.
+func (m *managedTargets) newTarget(mt managedTarget) (*target, error) {
+	if strings.Contains(mt.URL, "#") {
+		return nil, errors.New("give options in options rather than the URL fragment")
+	}
+	return newTargetWith(mt.URL, m.defaults, func(t *target) error {
+		for _, key := range sortedKeys(mt.Options) {
+			for _, value := range mt.Options[key] {
+				if err := checkManagedOption(key, value); err != nil {
+					return fmt.Errorf("option %s: %w", key, err)
+				}
+				if err := t.set(key, value); err != nil {
+					return fmt.Errorf("option %s: %w", key, err)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// checkManagedOption refuses what only the config may give a target, as
+// whoever adds targets through the API would otherwise run commands on
+// the scraper's host, with alert_exec, or have its files, with tls_cert,
+// tls_key and tls_ca and the @path of request_body and ws_message, and
+// its environment and Vault secrets, with the references of the
+// credentials and alert destinations, sent to a target of their choosing.
+func checkManagedOption(key, value string) error {
+	switch key {
+	case "alert_exec":
+		return errors.New("runs a command, which targets added through the API may not")
+	case "tls_cert", "tls_key", "tls_ca":
+		return errors.New("names a local file, which targets added through the API may not")
+	case "request_body", "ws_message":
+		if strings.HasPrefix(value, "@") {
+			return errors.New("@path reads a local file, which targets added through the API may not")
+		}
+	case "basic_auth", "bearer_token", "api_key", "pagerduty_routing_key", "discord_webhook_url":
+		for _, prefix := range []string{"@", "file://", "env:", "vault://"} {
+			if strings.HasPrefix(value, prefix) {
+				return errors.New("reads a file, the environment or Vault, which targets added through the API may not")
+			}
+		}
+	}
+	return nil
+}
+
+func (m *managedTargets) isConfigured(url string) bool {
+	return slices.ContainsFunc(m.configured, func(t *target) bool { return t.url == url })
+}
+
+// find returns the index of the managed target with id, or -1.
+func (m *managedTargets) find(id string) int {
+	return slices.IndexFunc(m.targets, func(mt managedTarget) bool { return targetID(mt.URL) == id })
+}
+
+// update saves targets as the managed targets and signals a reload.
+func (m *managedTargets) update(targets []managedTarget) error {
+	if err := m.save(targets); err != nil {
+		return err
+	}
+	m.targets = targets
+	select {
+	case m.reload <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// save writes targets to the targets file at m.path.
+func (m *managedTargets) save(targets []managedTarget) error {
+	if m.path == "" {
+		return nil
+	}
+	list := &yaml.Node{Kind: yaml.SequenceNode}
+	for _, mt := range targets {
+		entry := &yaml.Node{Kind: yaml.MappingNode, Content: []*yaml.Node{scalarNode("url"), scalarNode(mt.URL)}}
+		for _, key := range sortedKeys(mt.Options) {
+			values := mt.Options[key]
+			value := &yaml.Node{Kind: yaml.SequenceNode, Style: yaml.FlowStyle}
+			for _, v := range values {
+				value.Content = append(value.Content, scalarNode(v))
+			}
+			if len(values) == 1 {
+				value = value.Content[0]
+			}
+			entry.Content = append(entry.Content, scalarNode(key), value)
+		}
+		list.Content = append(list.Content, entry)
+	}
+	doc := &yaml.Node{
+		Kind:        yaml.MappingNode,
+		HeadComment: managedHeader,
+		Content:     []*yaml.Node{scalarNode("targets"), list},
+	}
+	var b bytes.Buffer
+	enc := yaml.NewEncoder(&b)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	return replaceFile(m.path, b.Bytes())
+}
+
+func scalarNode(value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// targetJSON is a target as the admin API lists it. Source is "config" for
+// targets from the command line, config and targets files, which the API
+// can't change, and "api" for those added through it.
+type targetJSON struct {
+	ID      string                  `json:"id"`
+	URL     string                  `json:"url"`
+	Source  string                  `json:"source"`
+	Paused  bool                    `json:"paused"`
+	Labels  map[string]string       `json:"labels,omitempty"`
+	Options map[string]optionValues `json:"options,omitempty"`
+}
+
+// secretOptions are the options whose values are credentials, which the
+// API shows only to admin keys.
+var secretOptions = []string{"basic_auth", "bearer_token", "api_key", "pagerduty_routing_key", "discord_webhook_url"}
+
+// redacted returns tj with the credentials in its URL and options
+// replaced, for keys short of the admin scope: the values of
+// secretOptions, those of the sensitiveHeaders in request_header and any
+// password in the URL and proxy.
+func (tj targetJSON) redacted() targetJSON {
+	tj.URL = redactURL(tj.URL)
+	if tj.Options == nil {
+		return tj
+	}
+	options := make(map[string]optionValues, len(tj.Options))
+	for key, values := range tj.Options {
+		values = slices.Clone(values)
+		for i, v := range values {
+			switch {
+			case slices.Contains(secretOptions, key):
+				values[i] = "redacted"
+			case key == "proxy":
+				values[i] = redactURL(v)
+			case key == "request_header":
+				name, _, _ := strings.Cut(v, ":")
+				if slices.ContainsFunc(sensitiveHeaders, func(h string) bool { return strings.EqualFold(h, strings.TrimSpace(name)) }) {
+					values[i] = name + ": redacted"
+				}
+			}
+		}
+		options[key] = values
+	}
+	tj.Options = options
+	return tj
+}
+
+// targetUpdate is what PUT /targets/{id} takes.
+type targetUpdate struct {
+	Options map[string]optionValues `json:"options"`
+}
+
+// Errors of the targets API.
+var (
+	errNoTarget     = errors.New("no such target")
+	errConfigured   = errors.New("target is configured, not added through the API")
+	errTargetExists = errors.New("target exists")
+)
+
+// invalidTargetError is returned for targets that don't validate.
+type invalidTargetError struct{ err error }
+
+func (e invalidTargetError) Error() string { return e.err.Error() }
+func (e invalidTargetError) Unwrap() error { return e.err }
+
+// list returns every target, the configured ones first.
+func (m *managedTargets) list() []targetJSON {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]targetJSON, 0, len(m.configured)+len(m.targets))
+	for _, t := range m.configured {
+		out = append(out, targetJSON{ID: targetID(t.url), URL: t.url, Source: "config", Paused: t.paused, Labels: t.labels})
+	}
+	for _, mt := range m.targets {
+		out = append(out, m.managedJSON(mt))
+	}
+	return out
+}
+
+func (m *managedTargets) managedJSON(mt managedTarget) targetJSON {
+	tj := targetJSON{ID: targetID(mt.URL), URL: mt.URL, Source: "api", Options: mt.Options}
+	if t, err := m.newTarget(mt); err == nil {
+		tj.Paused, tj.Labels = t.paused, t.labels
+	}
+	return tj
+}
+
+// get returns the target with id.
+func (m *managedTargets) get(id string) (targetJSON, error) {
+	for _, tj := range m.list() {
+		if tj.ID == id {
+			return tj, nil
+		}
+	}
+	return targetJSON{}, errNoTarget
+}
+
+// add adds mt to the managed targets.
+func (m *managedTargets) add(mt managedTarget) (targetJSON, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, err := m.newTarget(mt)
+	if err != nil {
+		return targetJSON{}, invalidTargetError{err}
+	}
+	mt.URL = t.url
+	if m.isConfigured(mt.URL) || m.find(targetID(mt.URL)) >= 0 {
+		return targetJSON{}, errTargetExists
+	}
+	if err := m.update(append(slices.Clip(m.targets), mt)); err != nil {
+		return targetJSON{}, err
+	}
+	slog.Info("Added target through the admin API", "target", mt.URL)
+	return m.managedJSON(mt), nil
+}
+
+// modify changes the options of the managed target with id with fn.
+func (m *managedTargets) modify(id string, fn func(options map[string]optionValues) map[string]optionValues) (targetJSON, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i, err := m.locate(id)
+	if err != nil {
+		return targetJSON{}, err
+	}
+	mt := m.targets[i]
+	options := make(map[string]optionValues, len(mt.Options))
+	for k, v := range mt.Options {
+		options[k] = v
+	}
+	mt.Options = fn(options)
+	if _, err := m.newTarget(mt); err != nil {
+		return targetJSON{}, invalidTargetError{err}
+	}
+	targets := slices.Clone(m.targets)
+	targets[i] = mt
+	if err := m.update(targets); err != nil {
+		return targetJSON{}, err
+	}
+	slog.Info("Changed target through the admin API", "target", mt.URL)
+	return m.managedJSON(mt), nil
+}
+
+// setPaused pauses or resumes the managed target with id.
+func (m *managedTargets) setPaused(id string, paused bool) (targetJSON, error) {
+	return m.modify(id, func(options map[string]optionValues) map[string]optionValues {
+		if paused {
+			options["paused"] = optionValues{"true"}
+		} else {
+			delete(options, "paused")
+		}
+		return options
+	})
+}
+
+// remove deletes the managed target with id.
+func (m *managedTargets) remove(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i, err := m.locate(id)
+	if err != nil {
+		return err
+	}
+	url := m.targets[i].URL
+	if err := m.update(slices.Delete(slices.Clone(m.targets), i, i+1)); err != nil {
+		return err
+	}
+	slog.Info("Deleted target through the admin API", "target", url)
+	return nil
+}
+
+// locate returns the index of the managed target with id.
+func (m *managedTargets) locate(id string) (int, error) {
+	if i := m.find(id); i >= 0 {
+		return i, nil
+	}
+	if slices.ContainsFunc(m.configured, func(t *target) bool { return targetID(t.url) == id }) {
+		return -1, errConfigured
+	}
+	return -1, errNoTarget
+}
+
+// serveTargets serves the targets API on mux. Every endpoint needs a key of
+// keys with the scope given, and is off without any. Keys short of the
+// admin scope get the targets redacted.
+func serveTargets(mux *http.ServeMux, m *managedTargets, keys *apiKeys) {
+	handle := func(pattern string, need scope, h func(req *http.Request) (int, any, error)) {
+		mux.Handle(pattern, keys.require(need, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			status, v, err := h(req)
+			if err != nil {
+				http.Error(w, err.Error(), targetsStatus(err))
+				return
+			}
+			if v == nil {
+				w.WriteHeader(status)
+				return
+			}
+			if keys.authorize(bearerToken(req), scopeAdmin) != nil {
+				switch tv := v.(type) {
+				case targetJSON:
+					v = tv.redacted()
+				case []targetJSON:
+					for i := range tv {
+						tv[i] = tv[i].redacted()
+					}
+				}
+			}
+			writeJSON(w, status, v)
+		})))
+	}
+	handle("GET /targets", scopeRead, func(req *http.Request) (int, any, error) {
+		return http.StatusOK, m.list(), nil
+	})
+	handle("POST /targets", scopeAdmin, func(req *http.Request) (int, any, error) {
+		var mt managedTarget
+		if err := json.NewDecoder(req.Body).Decode(&mt); err != nil {
+			return 0, nil, invalidTargetError{err}
+		}
+		tj, err := m.add(mt)
+		return http.StatusCreated, tj, err
+	})
+	handle("GET /targets/{id}", scopeRead, func(req *http.Request) (int, any, error) {
+		tj, err := m.get(req.PathValue("id"))
+		return http.StatusOK, tj, err
+	})
+	handle("PUT /targets/{id}", scopeAdmin, func(req *http.Request) (int, any, error) {
+		var body targetUpdate
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			return 0, nil, invalidTargetError{err}
+		}
+		tj, err := m.modify(req.PathValue("id"), func(map[string]optionValues) map[string]optionValues {
+			return body.Options
+		})
+		return http.StatusOK, tj, err
+	})
+	handle("DELETE /targets/{id}", scopeAdmin, func(req *http.Request) (int, any, error) {
+		return http.StatusNoContent, nil, m.remove(req.PathValue("id"))
+	})
+	handle("POST /targets/{id}/pause", scopeOperate, func(req *http.Request) (int, any, error) {
+		tj, err := m.setPaused(req.PathValue("id"), true)
+		return http.StatusOK, tj, err
+	})
+	handle("POST /targets/{id}/resume", scopeOperate, func(req *http.Request) (int, any, error) {
+		tj, err := m.setPaused(req.PathValue("id"), false)
+		return http.StatusOK, tj, err
+	})
+}
+
+// runTarget checks a target right away, besides its schedule, and answers
+// with the result, which counts like any other. Paused targets are checked
+// too.
+func runTarget(s *scheduler) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		t := s.targetWithID(req.PathValue("id"))
+		if t == nil {
+			http.Error(w, errNoTarget.Error(), http.StatusNotFound)
+			return
+		}
+		r, err := s.runNow(req.Context(), t)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, http.StatusOK, newStoredResultJSON(newStoredResult(r)))
+	}
+}
+
+// targetsStatus is the HTTP status for an error of the targets API.
+func targetsStatus(err error) int {
+	var invalid invalidTargetError
+	switch {
+	case errors.Is(err, errNoTarget):
+		return http.StatusNotFound
+	case errors.Is(err, errConfigured), errors.Is(err, errTargetExists):
+		return http.StatusConflict
+	case errors.As(err, &invalid):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
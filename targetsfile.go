@@ -0,0 +1,427 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// targetSpec is a target as declared in a targets file: its URL and the
+// per-target options that go with it, in the order they were given.
+type targetSpec struct {
+	path    string
+	url     string
+	line    int
+	options []targetOption
+	// forEach, until expanded, makes the spec a template for one target
+	// per combination of the variables' values.
+	forEach []templateVar
+}
+
+// targetOption is an option given in a targets file, at line of path.
+type targetOption struct {
+	key, value string
+	path       string
+	line       int
+}
+
+// targetsScope is what a targets file passes on to the files it includes.
+type targetsScope struct {
+	vars map[string]string
+	// defaults are the options every target starts out with.
+	defaults []targetOption
+}
+
+type templateVar struct {
+	name   string
+	values []string
+}
+
+// loadTargetsFile reads a YAML file listing targets, e.g.
+//
+//	vars:
+//	  domain: example.com
+//	defaults:
+//	  timeout: 5s
+//	  headers:
+//	    User-Agent: scraper
+//	include:
+//	  - targets.d/*.yaml
+//	targets:
+//	  - url: https://{{host}}.{{domain}}/
+//	    for_each:
+//	      host: [rpc1, rpc2, rpc3]
+//	    method: POST
+//	    headers:
+//	      Content-Type: application/json
+//	    request_body: '{"jsonrpc":"2.0","method":"eth_syncing","params":[],"id":1}'
+//	    tick: 10s
+//	    json:
+//	      - result == false
+//	    slack_channel: "#rpc"
+//
+// Every target key other than url, headers, labels and for_each is a
+// per-target option, as in the URL fragment; a list gives an option several
+// times. headers and labels map names to values and stand for
+// request_header and label. defaults are options given to every target
+// before its own. for_each repeats the target for every value of each
+// variable, and {{name}} in the URL and options is replaced by the
+// variable's value, or one from vars. include reads more files, relative to
+// the one including them, which see its vars and defaults.
+func loadTargetsFile(path string) ([]targetSpec, error) {
+	return loadTargets(filepath.Clean(path), targetsScope{}, nil)
+}
+
+// loadTargets loads path in the scope of the files including it, which are
+// listed in including to catch include cycles.
+func loadTargets(path string, scope targetsScope, including []string) ([]targetSpec, error) {
+	if slices.Contains(including, path) {
+		return nil, fmt.Errorf("%s: include cycle", path)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseTargets(path, b, filepath.Dir(path), scope, append(including, path))
+}
+
+// parseTargets parses the targets document b, named name in errors. Includes
+// are relative to dir, and not allowed if it is empty.
+func parseTargets(name string, b []byte, dir string, scope targetsScope, including []string) ([]targetSpec, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s:%d: want a mapping with a targets list", name, root.Line)
+	}
+	// vars and defaults apply to the whole file, wherever they are.
+	for i := 0; i < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		var err error
+		switch key.Value {
+		case "vars":
+			scope.vars, err = parseVars(value, scope.vars)
+		case "defaults":
+			var defaults targetSpec
+			if defaults, err = parseDefaults(value); err == nil {
+				defaults.setPath(name)
+				scope.defaults = withDefaults(scope.defaults, defaults.options)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%w", name, err)
+		}
+	}
+
+	var specs []targetSpec
+	for i := 0; i < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		switch key.Value {
+		case "vars", "defaults":
+		case "include":
+			patterns, err := scalars(value, "include")
+			if err != nil {
+				return nil, fmt.Errorf("%s:%w", name, err)
+			}
+			for _, p := range patterns {
+				if dir == "" {
+					return nil, fmt.Errorf("%s:%d: include is only allowed in files", name, p.line)
+				}
+				more, err := include(dir, p.value, scope, including)
+				if err != nil {
+					return nil, fmt.Errorf("%s:%d: %w", name, p.line, err)
+				}
+				specs = append(specs, more...)
+			}
+		case "targets":
+			if value.Kind != yaml.SequenceNode {
+				return nil, fmt.Errorf("%s:%d: targets must be a list", name, value.Line)
+			}
+			for _, item := range value.Content {
+				spec, err := parseTargetSpec(item)
+				if err != nil {
+					return nil, fmt.Errorf("%s:%w", name, err)
+				}
+				spec.setPath(name)
+				spec.options = withDefaults(scope.defaults, spec.options)
+				expanded, err := spec.expand(scope.vars)
+				if err != nil {
+					return nil, fmt.Errorf("%s:%w", name, err)
+				}
+				specs = append(specs, expanded...)
+			}
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown key %q", name, key.Line, key.Value)
+		}
+	}
+	return specs, nil
+}
+
+// include loads the files matching pattern, relative to dir, in name order.
+// A pattern without wildcards must match a file.
+func include(dir, pattern string, scope targetsScope, including []string) ([]targetSpec, error) {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(dir, pattern)
+	}
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 && !strings.ContainsAny(pattern, "*?[") {
+		return nil, fmt.Errorf("include %s: no such file", pattern)
+	}
+	sort.Strings(paths)
+
+	var specs []targetSpec
+	for _, p := range paths {
+		more, err := loadTargets(p, scope, including)
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, more...)
+	}
+	return specs, nil
+}
+
+// parseVars returns inherited with the variables n defines added.
+func parseVars(n *yaml.Node, inherited map[string]string) (map[string]string, error) {
+	if n.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%d: vars must map names to values", n.Line)
+	}
+	vars := make(map[string]string, len(inherited)+len(n.Content)/2)
+	for name, v := range inherited {
+		vars[name] = v
+	}
+	for i := 0; i < len(n.Content); i += 2 {
+		name, v := n.Content[i], n.Content[i+1]
+		if v.Kind != yaml.ScalarNode {
+			return nil, fmt.Errorf("%d: var %s must be a string", v.Line, name.Value)
+		}
+		vars[name.Value] = v.Value
+	}
+	return vars, nil
+}
+
+// scalars returns a string, or each of a list of strings, with its line.
+func scalars(n *yaml.Node, what string) ([]targetOption, error) {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		return []targetOption{{key: what, value: n.Value, line: n.Line}}, nil
+	case yaml.SequenceNode:
+		out := make([]targetOption, 0, len(n.Content))
+		for _, v := range n.Content {
+			if v.Kind != yaml.ScalarNode {
+				return nil, fmt.Errorf("%d: %s must be a list of strings", v.Line, what)
+			}
+			out = append(out, targetOption{key: what, value: v.Value, line: v.Line})
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("%d: %s must be a string or a list of them", n.Line, what)
+}
+
+// parseTargetSpec parses one entry of the targets list. Errors start with
+// the line they refer to.
+func parseTargetSpec(n *yaml.Node) (targetSpec, error) {
+	if n.Kind != yaml.MappingNode {
+		return targetSpec{}, fmt.Errorf("%d: want a mapping with a url", n.Line)
+	}
+	spec, err := parseEntry(n)
+	if err == nil && spec.url == "" {
+		err = fmt.Errorf("%d: target without a url", n.Line)
+	}
+	return spec, err
+}
+
+// parseDefaults parses the defaults block, which takes the keys of a target
+// other than url and for_each.
+func parseDefaults(n *yaml.Node) (targetSpec, error) {
+	if n.Kind != yaml.MappingNode {
+		return targetSpec{}, fmt.Errorf("%d: defaults must map options to values", n.Line)
+	}
+	for i := 0; i < len(n.Content); i += 2 {
+		if key := n.Content[i]; key.Value == "url" || key.Value == "for_each" {
+			return targetSpec{}, fmt.Errorf("%d: %s can't have a default", key.Line, key.Value)
+		}
+	}
+	return parseEntry(n)
+}
+
+// parseEntry parses the keys of a target, a mapping.
+func parseEntry(n *yaml.Node) (targetSpec, error) {
+	spec := targetSpec{line: n.Line}
+	for i := 0; i < len(n.Content); i += 2 {
+		key, value := n.Content[i], n.Content[i+1]
+		switch key.Value {
+		case "url":
+			if value.Kind != yaml.ScalarNode || value.Value == "" {
+				return spec, fmt.Errorf("%d: url must be a string", value.Line)
+			}
+			spec.url = value.Value
+		case "headers":
+			if value.Kind != yaml.MappingNode {
+				return spec, fmt.Errorf("%d: headers must map names to values", value.Line)
+			}
+			for j := 0; j < len(value.Content); j += 2 {
+				name, v := value.Content[j], value.Content[j+1]
+				if v.Kind != yaml.ScalarNode {
+					return spec, fmt.Errorf("%d: header %s must be a string", v.Line, name.Value)
+				}
+				spec.options = append(spec.options, targetOption{key: "request_header", value: name.Value + ": " + v.Value, line: name.Line})
+			}
+		case "labels":
+			if value.Kind != yaml.MappingNode {
+				return spec, fmt.Errorf("%d: labels must map names to values", value.Line)
+			}
+			for j := 0; j < len(value.Content); j += 2 {
+				name, v := value.Content[j], value.Content[j+1]
+				if v.Kind != yaml.ScalarNode {
+					return spec, fmt.Errorf("%d: label %s must be a string", v.Line, name.Value)
+				}
+				spec.options = append(spec.options, targetOption{key: "label", value: name.Value + "=" + v.Value, line: name.Line})
+			}
+		case "for_each":
+			if value.Kind != yaml.MappingNode {
+				return spec, fmt.Errorf("%d: for_each must map names to lists of values", value.Line)
+			}
+			for j := 0; j < len(value.Content); j += 2 {
+				name := value.Content[j]
+				values, err := scalars(value.Content[j+1], name.Value)
+				if err != nil {
+					return spec, err
+				}
+				tv := templateVar{name: name.Value}
+				for _, v := range values {
+					tv.values = append(tv.values, v.value)
+				}
+				spec.forEach = append(spec.forEach, tv)
+			}
+		default:
+			values, err := scalars(value, key.Value)
+			if err != nil {
+				return spec, err
+			}
+			spec.options = append(spec.options, values...)
+		}
+	}
+	return spec, nil
+}
+
+// setPath records path as where spec and its options were given.
+func (spec *targetSpec) setPath(path string) {
+	spec.path = path
+	for i := range spec.options {
+		spec.options[i].path = path
+	}
+}
+
+// withDefaults returns options preceded by defaults, so that they are
+// overridden by options given again. Headers are added to rather than
+// replaced by request_header, so defaults for the headers options sets are
+// left out.
+func withDefaults(defaults, options []targetOption) []targetOption {
+	set := make(map[string]bool)
+	for _, o := range options {
+		if o.key == "request_header" {
+			name, _, _ := strings.Cut(o.value, ":")
+			set[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+		}
+	}
+	out := make([]targetOption, 0, len(defaults)+len(options))
+	for _, o := range defaults {
+		if o.key == "request_header" {
+			name, _, _ := strings.Cut(o.value, ":")
+			if set[http.CanonicalHeaderKey(strings.TrimSpace(name))] {
+				continue
+			}
+		}
+		out = append(out, o)
+	}
+	return append(out, options...)
+}
+
+// templateRef matches a {{name}} reference to a variable.
+var templateRef = regexp.MustCompile(`\{\{\s*(\w+)\s*\}\}`)
+
+// expand returns a spec for every combination of spec's for_each values,
+// with variables replaced. Errors start with the line they refer to.
+func (spec targetSpec) expand(vars map[string]string) ([]targetSpec, error) {
+	combos := []map[string]string{vars}
+	for _, tv := range spec.forEach {
+		var next []map[string]string
+		for _, c := range combos {
+			for _, v := range tv.values {
+				m := make(map[string]string, len(c)+1)
+				for name, value := range c {
+					m[name] = value
+				}
+				m[tv.name] = v
+				next = append(next, m)
+			}
+		}
+		combos = next
+	}
+
+	out := make([]targetSpec, 0, len(combos))
+	for _, c := range combos {
+		s := targetSpec{path: spec.path, line: spec.line}
+		var err error
+		if s.url, err = substitute(spec.url, c); err != nil {
+			return nil, fmt.Errorf("%d: url: %w", spec.line, err)
+		}
+		for _, o := range spec.options {
+			if o.value, err = substitute(o.value, c); err != nil {
+				return nil, fmt.Errorf("%d: %s: %w", o.line, o.key, err)
+			}
+			s.options = append(s.options, o)
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+// substitute replaces the {{name}} references in s with their values.
+func substitute(s string, vars map[string]string) (string, error) {
+	var err error
+	out := templateRef.ReplaceAllStringFunc(s, func(ref string) string {
+		name := templateRef.FindStringSubmatch(ref)[1]
+		v, ok := vars[name]
+		if !ok && err == nil {
+			err = fmt.Errorf("undefined variable %s", name)
+		}
+		return v
+	})
+	return out, err
+}
+
+// newTarget creates the target spec declares, reporting errors in its
+// options with the file and line they are on.
+func (spec targetSpec) newTarget(defaults target) (*target, error) {
+	var optionErr error
+	t, err := newTargetWith(spec.url, defaults, func(t *target) error {
+		for _, o := range spec.options {
+			if err := t.set(o.key, o.value); err != nil {
+				optionErr = fmt.Errorf("%s:%d: %s: option %s: %w", o.path, o.line, t.url, o.key, err)
+				return optionErr
+			}
+		}
+		return nil
+	})
+	if err != nil && err != optionErr {
+		err = fmt.Errorf("%s:%d: %w", spec.path, spec.line, err)
+	}
+	return t, err
+}
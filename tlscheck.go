@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// leafCert returns the certificate the server identified itself with.
+func leafCert(r *response) (*x509.Certificate, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil, errors.New("No TLS certificate presented")
+	}
+	return r.TLS.PeerCertificates[0], nil
+}
+
+// certExpiryAssertion fails when the server certificate expires within the
+// given duration.
+type certExpiryAssertion time.Duration
+
+func (a certExpiryAssertion) check(r *response) error {
+	leaf, err := leafCert(r)
+	if err != nil {
+		return err
+	}
+	if left := time.Until(leaf.NotAfter); left < time.Duration(a) {
+		return fmt.Errorf("Certificate for %s expires %s, in %s", leaf.Subject.CommonName, leaf.NotAfter.Format(time.RFC3339), formatDays(left))
+	}
+	return nil
+}
+
+// certChainAssertion verifies the presented chain against the system roots.
+// Normally a bad chain fails the request outright; this reports it as an
+// ordinary failure for clients that skip verification.
+type certChainAssertion struct{}
+
+func (certChainAssertion) check(r *response) error {
+	leaf, err := leafCert(r)
+	if err != nil {
+		return err
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range r.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(c)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{Intermediates: intermediates}); err != nil {
+		return fmt.Errorf("Certificate chain does not verify: %s", err)
+	}
+	return nil
+}
+
+// certHostnameAssertion expects the server certificate to cover a host name.
+type certHostnameAssertion string
+
+func (a certHostnameAssertion) check(r *response) error {
+	leaf, err := leafCert(r)
+	if err != nil {
+		return err
+	}
+	if err := leaf.VerifyHostname(string(a)); err != nil {
+		return fmt.Errorf("Certificate does not cover %s: %s", string(a), err)
+	}
+	return nil
+}
+
+// parseDays parses a duration that may also be given in whole days, e.g.
+// "14d".
+func parseDays(value string) (time.Duration, error) {
+	if strings.HasSuffix(value, "d") {
+		n, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("bad number of days %q", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
+
+func formatDays(d time.Duration) string {
+	if d < 0 {
+		return "the past"
+	}
+	if d < 24*time.Hour {
+		return d.Round(time.Minute).String()
+	}
+	return fmt.Sprintf("%.1f days", d.Hours()/24)
+}
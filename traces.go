@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// traceStage adds the appearances in the traces of each block: the callers
+// and targets of every call, the contracts created and the beneficiaries
+// of those destroyed, the addresses in the topics of the logs the traces
+// carry and the miners rewarded. It traces blocks with the first of
+// traceProviders the node in use has.
+type traceStage struct {
+	chain string
+	rpc   *rpcClient
+	// provider is the index in traceProviders of the one in use.
+	provider atomic.Int32
+}
+
+// blockTrace is a step of the execution of a block as the traces have it,
+// whichever trace provider made them: a call, the creation or
+// self-destruct of a contract, or a reward.
+type blockTrace struct {
+	// Type is call, create, selfdestruct or reward.
+	Type string
+	// Tx is the transaction it's part of, txBlockReward or txUncleReward
+	// for a reward.
+	Tx uint32
+	// From is the caller, the creator or the contract destroyed, and To
+	// the target, the contract created, the beneficiary or the miner
+	// rewarded.
+	From, To string
+	// Logs are those it emitted, for trace providers that have them.
+	Logs []traceLog
+}
+
+type traceLog struct {
+	Address string
+	Topics  []string
+}
+
+// traceProvider is a method a node may have of tracing blocks. trace
+// traces a batch of blocks with it and normalises the traces of each to
+// blockTraces.
+type traceProvider interface {
+	method() string
+	has(caps nodeCaps) bool
+	trace(ctx context.Context, rpc *rpcClient, blocks []*scrapedBlock) ([][]blockTrace, error)
+}
+
+// traceProviders are the trace providers the stage knows, the preferred
+// first: trace_block has the rewards, and debug_traceBlockByNumber with the
+// callTracer the logs.
+var traceProviders = []traceProvider{parityTracer{}, gethTracer{}}
+
+func (t *traceStage) fetch(ctx context.Context, blocks []*scrapedBlock) error {
+	for {
+		i := t.provider.Load()
+		traces, err := traceProviders[i].trace(ctx, t.rpc, blocks)
+		if err == nil {
+			for j, b := range blocks {
+				for _, tr := range traces[j] {
+					b.appear(tr.From, tr.Tx)
+					b.appear(tr.To, tr.Tx)
+					for _, l := range tr.Logs {
+						b.appear(l.Address, tr.Tx)
+						for _, topic := range l.Topics {
+							b.appearTopic(topic, tr.Tx)
+						}
+					}
+				}
+			}
+			return nil
+		}
+		if !methodMissing(err) || int(i)+1 >= len(traceProviders) {
+			return err
+		}
+		if t.provider.CompareAndSwap(i, i+1) {
+			slog.Info("Switched trace provider", "chain", t.chain, "from", traceProviders[i].method(), "to", traceProviders[i+1].method())
+		}
+	}
+}
+
+func (t *traceStage) adapt(caps nodeCaps) error {
+	i := slices.IndexFunc(traceProviders, func(p traceProvider) bool { return p.has(caps) })
+	switch {
+	case i < 0:
+		return errors.New("node lacks trace_block and debug_traceBlockByNumber, which -chain_traces takes; -chain_traces=false indexes without traces")
+	case !caps.Archive:
+		return fmt.Errorf("node lacks the state of block %d, which tracing it takes; use an archive node, or -chain_traces=false to index without traces", caps.Block)
+	}
+	if prev := t.provider.Swap(int32(i)); int(prev) != i {
+		slog.Info("Switched trace provider", "chain", t.chain, "from", traceProviders[prev].method(), "to", traceProviders[i].method())
+	}
+	return nil
+}
+
+func (t *traceStage) process(ctx context.Context, b *scrapedBlock) error {
+	return nil
+}
+
+func (t *traceStage) flush() error {
+	return nil
+}
+
+// parityTracer traces blocks with trace_block, as Erigon, Nethermind and
+// OpenEthereum have it.
+type parityTracer struct{}
+
+// parityTrace is a trace as trace_block returns it, as far as addresses
+// go. TransactionPosition is missing for rewards.
+type parityTrace struct {
+	Type   string `json:"type"`
+	Action struct {
+		From          string `json:"from"`
+		To            string `json:"to"`
+		Address       string `json:"address"`
+		RefundAddress string `json:"refundAddress"`
+		Author        string `json:"author"`
+		RewardType    string `json:"rewardType"`
+	} `json:"action"`
+	Result *struct {
+		Address string `json:"address"`
+	} `json:"result"`
+	TransactionPosition *uint32 `json:"transactionPosition"`
+}
+
+func (parityTracer) method() string         { return "trace_block" }
+func (parityTracer) has(caps nodeCaps) bool { return caps.TraceBlock }
+
+func (parityTracer) trace(ctx context.Context, rpc *rpcClient, blocks []*scrapedBlock) ([][]blockTrace, error) {
+	traces := make([][]parityTrace, len(blocks))
+	calls := make([]*rpcCall, len(blocks))
+	for i, b := range blocks {
+		calls[i] = newRPCCall("trace_block", &traces[i], b.block.Number.String())
+	}
+	if err := rpc.batch(ctx, calls); err != nil {
+		return nil, err
+	}
+	if err := callErr(calls); err != nil {
+		return nil, err
+	}
+	out := make([][]blockTrace, len(blocks))
+	for i := range blocks {
+		for _, tr := range traces[i] {
+			if tr.TransactionPosition == nil {
+				if tr.Type == "reward" {
+					tx := uint32(txBlockReward)
+					if tr.Action.RewardType == "uncle" {
+						tx = txUncleReward
+					}
+					out[i] = append(out[i], blockTrace{Type: "reward", Tx: tx, To: tr.Action.Author})
+				}
+				continue
+			}
+			bt := blockTrace{Type: tr.Type, Tx: *tr.TransactionPosition, From: tr.Action.From, To: tr.Action.To}
+			switch tr.Type {
+			case "create":
+				if tr.Result != nil {
+					bt.To = tr.Result.Address
+				}
+			case "suicide":
+				bt.Type, bt.From, bt.To = "selfdestruct", tr.Action.Address, tr.Action.RefundAddress
+			}
+			out[i] = append(out[i], bt)
+		}
+	}
+	return out, nil
+}
+
+// gethTracer traces blocks with debug_traceBlockByNumber and the
+// callTracer, as Geth and Reth have it.
+type gethTracer struct{}
+
+// callFrame is a call as the callTracer has it, with the calls it made.
+// The to of a creation is the contract created, and that of a
+// self-destruct the beneficiary.
+type callFrame struct {
+	Type  string      `json:"type"`
+	From  string      `json:"from"`
+	To    string      `json:"to"`
+	Calls []callFrame `json:"calls"`
+	Logs  []struct {
+		Address string   `json:"address"`
+		Topics  []string `json:"topics"`
+	} `json:"logs"`
+}
+
+// txTrace is the trace of a transaction as debug_traceBlockByNumber
+// returns it, in the order of the transactions.
+type txTrace struct {
+	Result *callFrame `json:"result"`
+	Error  string     `json:"error"`
+}
+
+// callTracer has the node's callTracer include the logs of each call.
+var callTracer = map[string]any{"tracer": "callTracer", "tracerConfig": map[string]any{"withLog": true}}
+
+func (gethTracer) method() string         { return "debug_traceBlockByNumber" }
+func (gethTracer) has(caps nodeCaps) bool { return caps.DebugTrace }
+
+func (gethTracer) trace(ctx context.Context, rpc *rpcClient, blocks []*scrapedBlock) ([][]blockTrace, error) {
+	traces := make([][]txTrace, len(blocks))
+	calls := make([]*rpcCall, len(blocks))
+	for i, b := range blocks {
+		calls[i] = newRPCCall("debug_traceBlockByNumber", &traces[i], b.block.Number.String(), callTracer)
+	}
+	if err := rpc.batch(ctx, calls); err != nil {
+		return nil, err
+	}
+	if err := callErr(calls); err != nil {
+		return nil, err
+	}
+	out := make([][]blockTrace, len(blocks))
+	for i := range blocks {
+		for tx, tr := range traces[i] {
+			if tr.Result != nil {
+				out[i] = flattenFrame(out[i], tr.Result, uint32(tx))
+			}
+		}
+	}
+	return out, nil
+}
+
+// flattenFrame appends f and the calls it made to traces.
+func flattenFrame(traces []blockTrace, f *callFrame, tx uint32) []blockTrace {
+	bt := blockTrace{Type: "call", Tx: tx, From: f.From, To: f.To}
+	switch t := strings.ToLower(f.Type); {
+	case strings.HasPrefix(t, "create"):
+		bt.Type = "create"
+	case t == "selfdestruct" || t == "suicide":
+		bt.Type = "selfdestruct"
+	}
+	for _, l := range f.Logs {
+		bt.Logs = append(bt.Logs, traceLog{Address: l.Address, Topics: l.Topics})
+	}
+	traces = append(traces, bt)
+	for i := range f.Calls {
+		traces = flattenFrame(traces, &f.Calls[i], tx)
+	}
+	return traces
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptrace"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/httptrace/otelhttptrace"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer makes the spans of checks. It does nothing unless tracing has been
+// set up with -otlp_endpoint.
+var tracer = otel.Tracer("github.com/TrueBlocks/trueblocks-scraper-go")
+
+// tracingOptions configures the OTLP exporter.
+type tracingOptions struct {
+	endpoint    string
+	insecure    bool
+	sampleRatio float64
+}
+
+// setupTracing exports spans over OTLP/gRPC and propagates trace context to
+// the services checked, so their traces join the scraper's. The returned
+// function flushes buffered spans and stops the exporter.
+func setupTracing(ctx context.Context, o tracingOptions) (func(context.Context) error, error) {
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(o.endpoint)}
+	if o.insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	exporter, err := otlptracegrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName("trueblocks-scraper")))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(o.sampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown, nil
+}
+
+// startCheckSpan starts the span covering a whole check of t.
+func startCheckSpan(ctx context.Context, t *target) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "check "+t.scheme, trace.WithAttributes(
+		attribute.String("scraper.target", t.url),
+		attribute.String("scraper.check", t.scheme),
+	))
+}
+
+// endCheckSpan records the outcome of r on its span and ends it.
+func endCheckSpan(span trace.Span, r *result) {
+	if r.status != 0 {
+		span.SetAttributes(semconv.HTTPResponseStatusCode(r.status))
+	}
+	for _, f := range r.failures {
+		span.AddEvent("failure", trace.WithAttributes(
+			attribute.String("scraper.reason", f.reason),
+			attribute.String("scraper.message", f.message),
+		))
+	}
+	switch {
+	case r.err != nil:
+		span.RecordError(r.err)
+		span.SetStatus(codes.Error, r.err.Error())
+	case !r.ok():
+		span.SetStatus(codes.Error, r.failures[0].message)
+	}
+	span.End()
+}
+
+// startRequestSpan starts a client span for req, with child spans for DNS,
+// connecting and the TLS handshake, and passes the trace context on in its
+// headers. The span is ended by endRequestSpan, or failing that when the
+// response body is closed.
+func startRequestSpan(t *target, req *http.Request) (*http.Request, trace.Span) {
+	ctx, span := tracer.Start(req.Context(), "HTTP "+req.Method, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(req.Method),
+			semconv.URLFull(req.URL.String()),
+		))
+	if !span.IsRecording() {
+		return req, span
+	}
+	ctx = httptrace.WithClientTrace(ctx, otelhttptrace.NewClientTrace(ctx,
+		otelhttptrace.WithRedactedHeaders(t.apiKeyHeader)))
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	return req.WithContext(ctx), span
+}
+
+// endRequestSpan ends the span of the request resp answers, once its body
+// has been read.
+func endRequestSpan(resp *response) {
+	span := trace.SpanFromContext(resp.Request.Context())
+	span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+	span.End()
+}
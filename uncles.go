@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// uncleStage adds the miners of the uncles of each block, paid for them
+// by the block that included them, at txUncleReward. trace_block has those
+// rewards too, but debug_traceBlockByNumber doesn't. Blocks since the
+// merge have no uncles, so the stage makes no calls for them.
+type uncleStage struct {
+	rpc *rpcClient
+}
+
+// ethUncle is the header of an uncle, as far as the scraper cares.
+type ethUncle struct {
+	Hash  string `json:"hash"`
+	Miner string `json:"miner"`
+}
+
+func (u *uncleStage) fetch(ctx context.Context, blocks []*scrapedBlock) error {
+	var calls []*rpcCall
+	var of []*scrapedBlock
+	var uncles []*ethUncle
+	for _, b := range blocks {
+		for i := range b.block.Uncles {
+			uncle := &ethUncle{}
+			calls = append(calls, newRPCCall("eth_getUncleByBlockNumberAndIndex", uncle, b.block.Number.String(), quantity(i).String()))
+			of = append(of, b)
+			uncles = append(uncles, uncle)
+		}
+	}
+	if len(calls) == 0 {
+		return nil
+	}
+	if err := u.rpc.batch(ctx, calls); err != nil {
+		return err
+	}
+	if err := callErr(calls); err != nil {
+		return err
+	}
+	next := map[*scrapedBlock]int{}
+	for i, uncle := range uncles {
+		b := of[i]
+		want := b.block.Uncles[next[b]]
+		next[b]++
+		if !strings.EqualFold(uncle.Hash, want) {
+			return fmt.Errorf("block %d: node has uncle %q where the block has %s", b.block.Number, uncle.Hash, want)
+		}
+		b.appear(uncle.Miner, txUncleReward)
+	}
+	return nil
+}
+
+func (u *uncleStage) process(ctx context.Context, b *scrapedBlock) error {
+	return nil
+}
+
+func (u *uncleStage) flush() error {
+	return nil
+}
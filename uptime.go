@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// uptimeWindows are the trailing windows availability is reported over.
+var uptimeWindows = []struct {
+	name  string
+	hours int64
+}{
+	{"24h", 24},
+	{"7d", 7 * 24},
+	{"30d", 30 * 24},
+}
+
+// uptimeHours is how far back availability is kept, enough for the longest
+// window.
+const uptimeHours = 30 * 24
+
+// uptimeBucket counts the checks started during one hour since the epoch.
+type uptimeBucket struct {
+	hour      int64
+	checks    int
+	successes int
+}
+
+// uptime counts checks and successes per hour so that availability over
+// weeks doesn't take a sample per check.
+type uptime struct {
+	buckets [uptimeHours]uptimeBucket
+}
+
+func (u *uptime) observe(at time.Time, ok bool) {
+	hour := at.Unix() / 3600
+	b := &u.buckets[hour%uptimeHours]
+	if b.hour != hour {
+		*b = uptimeBucket{hour: hour}
+	}
+	b.checks++
+	if ok {
+		b.successes++
+	}
+}
+
+// availability returns the percentage of checks that succeeded within each
+// window ending at now, leaving out windows without any checks. Windows are
+// counted in whole hours, including the current one.
+func (u *uptime) availability(now time.Time) map[string]float64 {
+	out := make(map[string]float64, len(uptimeWindows))
+	hour := now.Unix() / 3600
+	for _, w := range uptimeWindows {
+		checks, successes := 0, 0
+		for _, b := range u.buckets {
+			if b.checks > 0 && b.hour <= hour && b.hour > hour-w.hours {
+				checks += b.checks
+				successes += b.successes
+			}
+		}
+		if checks > 0 {
+			out[w.name] = 100 * float64(successes) / float64(checks)
+		}
+	}
+	return out
+}
+
+// reportUptime logs the availability of every target each interval until ctx
+// is done.
+func reportUptime(ctx context.Context, h *history, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, s := range h.status(0) {
+			attrs := []any{"target", s.Target, labelGroup(s.Labels)}
+			for _, w := range uptimeWindows {
+				if a, ok := s.Availability[w.name]; ok {
+					attrs = append(attrs, w.name, fmt.Sprintf("%.3f%%", a))
+				}
+			}
+			slog.Info("Availability", attrs...)
+		}
+	}
+}
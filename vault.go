@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// vaultSecret reads a secret from HashiCorp Vault. ref is the API path the
+// secret is read from, optionally followed by "#" and the key within it,
+// which can only be left out of secrets with a single key. Both KV version 1
+// and 2 work; for version 2 the path includes "data", as in
+// "secret/data/scraper#token".
+//
+// The server and credentials are taken from the environment like Vault's
+// own CLI does: VAULT_ADDR, VAULT_TOKEN or else ~/.vault-token,
+// VAULT_NAMESPACE and VAULT_CACERT.
+func vaultSecret(ref string) (string, error) {
+	path, key, _ := strings.Cut(ref, "#")
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return "", errors.New("vault: VAULT_ADDR is not set")
+	}
+	token, err := vaultToken()
+	if err != nil {
+		return "", err
+	}
+	client, err := vaultClient()
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(addr, "/")+"/v1/"+strings.TrimLeft(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("vault: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault: reading %s: got status %s", path, resp.Status)
+	}
+
+	var secret struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return "", fmt.Errorf("vault: reading %s: %w", path, err)
+	}
+	data := secret.Data
+	// KV version 2 nests the secret's data next to its metadata.
+	if inner, ok := data["data"].(map[string]any); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+	if key == "" {
+		if len(data) != 1 {
+			return "", fmt.Errorf("vault: %s has %d keys, name one after #", path, len(data))
+		}
+		for k := range data {
+			key = k
+		}
+	}
+	v, ok := data[key].(string)
+	if !ok {
+		return "", fmt.Errorf("vault: %s has no string %s", path, key)
+	}
+	return v, nil
+}
+
+func vaultToken() (string, error) {
+	if token := os.Getenv("VAULT_TOKEN"); token != "" {
+		return token, nil
+	}
+	home, err := os.UserHomeDir()
+	if err == nil {
+		b, err := os.ReadFile(filepath.Join(home, ".vault-token"))
+		if err == nil {
+			return strings.TrimSpace(string(b)), nil
+		}
+	}
+	return "", errors.New("vault: VAULT_TOKEN is not set and there is no ~/.vault-token")
+}
+
+func vaultClient() (*http.Client, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	if path := os.Getenv("VAULT_CACERT"); path != "" {
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("vault: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("vault: no certificates in %s", path)
+		}
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	}
+	return client, nil
+}
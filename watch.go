@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// configDebounce coalesces the burst of events most editors produce when
+// saving a file into a single reload.
+const configDebounce = 250 * time.Millisecond
+
+// watchConfig signals reload whenever the config file at path is written or
+// recreated. The containing directory is watched rather than the file itself
+// so that editors that save by renaming over the original are noticed too.
+func watchConfig(ctx context.Context, path string, reload chan<- struct{}) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := w.Add(filepath.Dir(path)); err != nil {
+		w.Close()
+		return err
+	}
+
+	go func() {
+		defer w.Close()
+
+		var debounce <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(ev.Name) != path || !ev.Has(fsnotify.Write) && !ev.Has(fsnotify.Create) {
+					continue
+				}
+				debounce = time.After(configDebounce)
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				slog.Error("Config watcher failed", "error", err)
+			case <-debounce:
+				debounce = nil
+				select {
+				case reload <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// webhookSignatureHeader carries the hex HMAC-SHA256 of the body, keyed with
+// the webhook secret and prefixed with "sha256=".
+const webhookSignatureHeader = "X-Scraper-Signature"
+
+// webhookNotifier POSTs events as JSON to a URL, retrying with exponential
+// backoff until it answers with a 2xx.
+type webhookNotifier struct {
+	client  *http.Client
+	url     string
+	secret  string
+	retries int
+}
+
+func newWebhookNotifier(url, secret string, retries int) *webhookNotifier {
+	return &webhookNotifier{
+		client:  &http.Client{Timeout: 10 * time.Second},
+		url:     url,
+		secret:  secret,
+		retries: retries,
+	}
+}
+
+func (w *webhookNotifier) name() string {
+	return "webhook"
+}
+
+func (w *webhookNotifier) notify(ctx context.Context, e *alertEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	err = postWithRetries(ctx, w.client, w.retries, acceptStatus, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if w.secret != "" {
+			mac := hmac.New(sha256.New, []byte(w.secret))
+			mac.Write(body)
+			req.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		}
+		return req, nil
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", w.url, err)
+	}
+	return nil
+}
+
+// acceptStatus accepts any 2xx response.
+func acceptStatus(resp *http.Response) error {
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("got status %s", resp.Status)
+	}
+	return nil
+}
+
+// postWithRetries sends the request newRequest builds until accept is happy
+// with the response, at most retries more times, doubling the delay from
+// one second between attempts.
+func postWithRetries(ctx context.Context, client *http.Client, retries int, accept func(*http.Response) error, newRequest func() (*http.Request, error)) error {
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err == nil {
+			err = accept(resp)
+			resp.Body.Close()
+			if err == nil {
+				return nil
+			}
+		}
+		if attempt >= retries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsOptions configures ws:// and wss:// targets.
+type wsOptions struct {
+	// message is sent right after connecting, e.g. an eth_subscribe call.
+	message []byte
+	// expect is how many messages must arrive within deadline of the
+	// connection being established. For subscriptions this usually counts
+	// the confirmation as well as the first notification.
+	expect   int
+	deadline time.Duration
+}
+
+// probeWebSocket connects to a WebSocket target, optionally sends a message
+// and waits for messages to arrive. Servers that accept connections but
+// then go silent fail the check. Assertions see the handshake response with
+// the last message received as its body.
+func probeWebSocket(ctx context.Context, t *target, r *result) {
+	if t.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.timeout)
+		defer cancel()
+	}
+	if err := t.limiter.wait(ctx, t.hostname()); err != nil {
+		r.err = err
+		return
+	}
+
+	dialer := websocket.Dialer{
+		Proxy:           func(req *http.Request) (*url.URL, error) { return t.proxy.proxyFor(req.URL) },
+		TLSClientConfig: t.tlsConfig(),
+	}
+	start := time.Now()
+	conn, resp, err := dialer.DialContext(ctx, t.url, t.header())
+	if err != nil {
+		if resp != nil {
+			err = fmt.Errorf("%w (%s)", err, resp.Status)
+		}
+		r.err = err
+		slog.Warn("Connect failed", "target", t.url, t.logLabels(), "error", err)
+		return
+	}
+	defer conn.Close()
+	r.status = resp.StatusCode
+
+	if t.ws.message != nil {
+		if err := conn.WriteMessage(websocket.TextMessage, t.ws.message); err != nil {
+			r.err = err
+			slog.Warn("Sending message failed", "target", t.url, t.logLabels(), "error", err)
+			return
+		}
+	}
+
+	deadline := time.Now().Add(t.ws.deadline)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetReadDeadline(deadline)
+
+	var last []byte
+	for i := 0; i < t.ws.expect; i++ {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			r.latency = time.Since(start)
+			r.fail("messages", "Got %d of %d expected messages within %s: %s", i, t.ws.expect, t.ws.deadline, err)
+			return
+		}
+		last = msg
+	}
+	r.latency = time.Since(start)
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+
+	checkLatency(t, r)
+
+	rr := &response{Response: resp, body: last, sent: start}
+	for _, a := range t.assertions {
+		if err := a.check(rr); err != nil {
+			r.fail("assertion", "%s", err)
+		}
+	}
+}